@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+)
+
+// catalogForUser returns the parts of the catalog that the user may access.
+func catalogForUser(catalogService catalog.CatalogService, authService auth.AuthService, user auth.User) catalog.CatalogService {
+	allowed, restricted := authService.AllowedStorages(user)
+	if !restricted {
+		return catalogService
+	}
+
+	allowedByID := make(map[string]bool, 0)
+	for _, ss := range catalogService.GetStorages() {
+		for _, entry := range allowed {
+			if entry == ss.GetID() || entry == ss.GetName() {
+				allowedByID[ss.GetID()] = true
+			}
+		}
+	}
+	return catalog.NewFilteredCatalog(catalogService, func(storageServiceID string) bool {
+		return allowedByID[storageServiceID]
+	})
+}
+
+// catalogFor returns the parts of the catalog that the requesting user may access,
+// with the play counts and their ratings. When authentication is disabled, that is everything.
+func catalogFor(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, ratingsService ratings.RatingsService) catalog.CatalogService {
+	catalogService = plays.catalog(catalogService)
+	user, ok := currentUser(c)
+	if ok {
+		catalogService = catalogForUser(catalogService, authService, user)
+	}
+	return ratedCatalog(catalogService, ratingsService, user.Name)
+}
+
+// emptyCatalog is used when a share's creator no longer exists.
+func emptyCatalog(catalogService catalog.CatalogService) catalog.CatalogService {
+	return catalog.NewFilteredCatalog(catalogService, func(storageServiceID string) bool {
+		return false
+	})
+}
+
+// catalogForShare returns the parts of the catalog that the creator of a share may access,
+// so that shares can't be used to get around access restrictions.
+func catalogForShare(catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, claims auth.TokenClaims) catalog.CatalogService {
+	catalogService = plays.catalog(catalogService)
+	if !authService.Enabled() {
+		return catalogService
+	}
+	user, err := authService.GetUser(claims.Subject)
+	if err != nil {
+		return emptyCatalog(catalogService)
+	}
+	return catalogForUser(catalogService, authService, user)
+}
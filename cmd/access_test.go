@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestAccessControl(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(nullStorage))
+	diskStorage, err := storage.NewDiskStorage("../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+
+	config := Config{
+		Users: []auth.User{
+			{Name: "parent", PasswordHash: hash},
+			{Name: "kid", PasswordHash: hash, Groups: []string{"kids"}},
+		},
+		Groups: []auth.Group{
+			{Name: "kids", Storages: []string{nullStorage.GetName()}},
+		},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	}
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	_, allPlaylists := catalogService.GetTracks()
+	var diskTrack catalog.Track
+	for _, playlist := range allPlaylists {
+		if playlist.StorageServiceID == diskStorage.GetID() {
+			diskTrack = playlist.Tracks[0]
+		}
+	}
+
+	getWithCookie := func(target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(cookie)
+		return doRequest(e, req)
+	}
+	getPlaylists := func(cookie *http.Cookie) []catalog.Playlist {
+		rec := getWithCookie("/api/playlists", cookie)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var playlists []catalog.Playlist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &playlists))
+		return playlists
+	}
+
+	t.Run("Unrestricted", func(t *testing.T) {
+		cookie := login(t, e, "parent", "secret")
+		assert.Len(t, getPlaylists(cookie), len(allPlaylists))
+
+		rec := getWithCookie("/tracks/"+diskTrack.ID+"/data", cookie)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Restricted", func(t *testing.T) {
+		cookie := login(t, e, "kid", "secret")
+		playlists := getPlaylists(cookie)
+		require.Len(t, playlists, 1)
+		assert.Equal(t, nullStorage.GetID(), playlists[0].StorageServiceID)
+
+		rec := getWithCookie("/tracks/"+diskTrack.ID+"/data", cookie)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		rec = getWithCookie("/tracks/"+diskTrack.ID, cookie)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		rec = getWithCookie("/api/tracks/"+diskTrack.ID, cookie)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		// Shares can't be used to get around the restrictions.
+		req := newJSONRequest(http.MethodPost, "/api/shares", `{"scope": "track", "id": "`+diskTrack.ID+`"}`)
+		req.AddCookie(cookie)
+		rec = doRequest(e, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("SmartPlaylists", func(t *testing.T) {
+		// The disk storage's tracks come first, but the limit applies
+		// to the tracks that the user can see.
+		require.NoError(t, catalogService.ConfigureSmartPlaylists([]catalog.SmartPlaylist{
+			{Name: "First", Sort: "library", Limit: 1},
+		}))
+		smartPlaylists := catalogService.GetSmartPlaylists()
+		require.Len(t, smartPlaylists, 1)
+		first, err := catalogService.GetPlaylist(smartPlaylists[0].ID)
+		require.NoError(t, err)
+		require.Len(t, first.Tracks, 1)
+		assert.Equal(t, diskStorage.GetID(), first.Tracks[0].StorageServiceID)
+
+		cookie := login(t, e, "kid", "secret")
+		for _, playlist := range getPlaylists(cookie) {
+			if playlist.Smart {
+				require.Len(t, playlist.Tracks, 1)
+				assert.Equal(t, nullStorage.GetID(), playlist.Tracks[0].StorageServiceID)
+			}
+		}
+		rec := getWithCookie("/api/playlists/"+first.ID, cookie)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var playlist catalog.Playlist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &playlist))
+		require.Len(t, playlist.Tracks, 1)
+		assert.Equal(t, nullStorage.GetID(), playlist.Tracks[0].StorageServiceID)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+)
+
+const (
+	trackContextKey = "track" // The catalog.Track being streamed, for the access log
+	rangeContextKey = "range" // The requested byte range, for the access log
+)
+
+// accessLog logs every request, including the track and byte range
+// requested when streaming track data.
+func accessLog(logger *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			if err := next(c); err != nil {
+				// Turn the error into a response now, so that the status can be logged.
+				c.Error(err)
+			}
+
+			req := c.Request()
+			res := c.Response()
+			attrs := []slog.Attr{
+				slog.String("requestID", res.Header().Get(echo.HeaderXRequestID)),
+				slog.String("remoteIP", c.RealIP()),
+				slog.String("method", req.Method),
+				slog.String("uri", req.RequestURI),
+				slog.Int("status", res.Status),
+				slog.Int64("bytes", res.Size),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if user, ok := currentUser(c); ok {
+				attrs = append(attrs, slog.String("user", user.Name))
+			}
+			if track, ok := c.Get(trackContextKey).(catalog.Track); ok {
+				attrs = append(attrs, slog.String("trackID", track.ID), slog.String("storage", track.StorageName))
+			}
+			if byteRange, ok := c.Get(rangeContextKey).(string); ok {
+				attrs = append(attrs, slog.String("range", byteRange))
+			}
+
+			level := slog.LevelInfo
+			if res.Status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(context.Background(), level, "Request", attrs...)
+			return nil
+		}
+	}
+}
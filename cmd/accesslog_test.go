@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/internal/logging"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(logging.Options{Format: logging.FormatJSON}, &buf)
+	require.NoError(t, err)
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger.Logger)
+	defer slog.SetDefault(defaultLogger)
+
+	e, catalogService := setupTestServer(t, Config{})
+	tracks, _ := catalogService.GetTracks()
+	track := tracks[0]
+	buf.Reset() // Ignore any logs from setting up
+
+	readEntry := func() map[string]any {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		buf.Reset()
+		return entry
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/tracks/"+track.ID+"/data", nil)
+	req.Header.Set("Range", "bytes=10-19")
+	rec := doRequest(e, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+
+	entry := readEntry()
+	assert.Equal(t, "Request", entry["msg"])
+	assert.Equal(t, rec.Header().Get("X-Request-Id"), entry["requestID"])
+	assert.NotEmpty(t, entry["requestID"])
+	assert.Equal(t, float64(http.StatusPartialContent), entry["status"])
+	assert.Equal(t, float64(10), entry["bytes"])
+	assert.Equal(t, track.ID, entry["trackID"])
+	assert.Equal(t, "null", entry["storage"])
+	assert.Equal(t, "bytes=10-19", entry["range"])
+	assert.Contains(t, entry, "duration")
+
+	// Errors are logged with the status they turn into.
+	rec = doRequest(e, httptest.NewRequest(http.MethodGet, "/tracks/nope", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	entry = readEntry()
+	assert.Equal(t, float64(http.StatusNotFound), entry["status"])
+	assert.NotContains(t, entry, "trackID")
+}
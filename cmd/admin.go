@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// A problem found while scanning a storage, for the scan report.
+type scanReportEntry struct {
+	Library string `json:"library"`
+	storage.ScanProblem
+}
+
+// wantsJSON returns true if the client prefers a JSON response, e.g.: for scripts.
+func wantsJSON(c echo.Context) bool {
+	return c.QueryParam("format") == "json" ||
+		strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON)
+}
+
+func getAdminScanReport(c echo.Context, catalogService catalog.CatalogService) error {
+	entries := make([]scanReportEntry, 0)
+	for _, ss := range catalogService.GetStorages() {
+		for _, problem := range ss.GetScanReport() {
+			entries = append(entries, scanReportEntry{
+				Library:     ss.GetName(),
+				ScanProblem: problem,
+			})
+		}
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, entries)
+	}
+	return c.Render(http.StatusOK, "scanreport.tmpl.html", entries)
+}
+
+// getAdminIDCollisions reports tracks and playlists with the same ID in more than one storage,
+// and which copy is being used.
+func getAdminIDCollisions(c echo.Context, catalogService catalog.CatalogService) error {
+	collisions := catalogService.GetCollisions()
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, collisions)
+	}
+	return c.Render(http.StatusOK, "idcollisions.tmpl.html", collisions)
+}
+
+// Data for the duplicates report.
+type duplicatesPage struct {
+	Match      catalog.DuplicateMatch    `json:"match"`
+	Groups     []catalog.DuplicateGroup  `json:"groups"`
+	Unreadable []catalog.UnreadableTrack `json:"unreadable"` // Tracks left out when matching by content
+}
+
+// getAdminDuplicates reports tracks that look like copies of each other, e.g.: the same
+// album ripped in two formats, so that the admin can decide which copies to remove.
+// Tracks are matched by their tags, or by their data with ?match=content.
+// Tracks whose data can't be read are listed in the report, rather than
+// failing it.
+func getAdminDuplicates(c echo.Context, catalogService catalog.CatalogService, contentHashes *catalog.ContentHashes) error {
+	catalogService = catalogForLibrary(c, catalogService)
+	tracks, _ := catalogService.GetTracks()
+	tracks = catalog.ExpandSources(tracks) // Any duplicates that have been merged
+
+	page := duplicatesPage{
+		Match:      catalog.DuplicateMatch(c.QueryParam("match")),
+		Unreadable: make([]catalog.UnreadableTrack, 0),
+	}
+	switch page.Match {
+	case "", catalog.DuplicateMatchTags:
+		page.Match = catalog.DuplicateMatchTags
+		page.Groups = catalog.FindDuplicates(tracks)
+	case catalog.DuplicateMatchContent:
+		var err error
+		page.Groups, page.Unreadable, err = contentHashes.FindDuplicates(c.Request().Context(), catalogService, tracks)
+		if err != nil {
+			return err
+		}
+		for _, u := range page.Unreadable {
+			slog.Warn("Unable to read track to find duplicates", "trackID", u.Track.ID, "storage", u.Track.StorageName, "error", u.Error)
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "match must be tags or content")
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, page)
+	}
+	return c.Render(http.StatusOK, "duplicates.tmpl.html", page)
+}
+
+func setupAdminEndpoints(g *echo.Group, catalogService catalog.CatalogService, authService auth.AuthService) {
+	contentHashes := catalog.NewContentHashes()
+	admin := g.Group("/admin", requireAdmin(authService))
+	admin.GET("/scan-report", func(c echo.Context) error {
+		return getAdminScanReport(c, catalogService)
+	})
+	admin.GET("/id-collisions", func(c echo.Context) error {
+		return getAdminIDCollisions(c, catalogService)
+	})
+	admin.GET("/duplicates", func(c echo.Context) error {
+		return getAdminDuplicates(c, catalogService, contentHashes)
+	})
+}
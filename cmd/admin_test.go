@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestAdminScanReport(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	// Not a FLAC file, so tags can't be read.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "corrupt.flac"), []byte("not a flac file"), 0o644))
+
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{})
+	require.NoError(t, err)
+	diskStorage, err := storage.NewDiskStorage(dir, []string{}, storage.Options{Name: "problems"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+
+	config := Config{
+		Users: []auth.User{
+			{Name: "admin", PasswordHash: hash, Admin: true},
+			{Name: "fred", PasswordHash: hash},
+		},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	}
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	getScanReport := func(cookie *http.Cookie, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/scan-report", nil)
+		req.Header.Set("Accept", accept)
+		req.AddCookie(cookie)
+		return doRequest(e, req)
+	}
+
+	t.Run("Admin", func(t *testing.T) {
+		cookie := login(t, e, "admin", "secret")
+
+		rec := getScanReport(cookie, "application/json")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var entries []scanReportEntry
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+		require.Len(t, entries, 1)
+		assert.Equal(t, "problems", entries[0].Library)
+		assert.Equal(t, filepath.Join(dir, "corrupt.flac"), entries[0].Location)
+		assert.Equal(t, storage.ScanStageTags, entries[0].Stage)
+		assert.Equal(t, storage.ScanActionUntagged, entries[0].Action)
+
+		rec = getScanReport(cookie, "text/html")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "corrupt.flac")
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		cookie := login(t, e, "fred", "secret")
+		rec := getScanReport(cookie, "application/json")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+}
+
+func TestAdminIDCollisions(t *testing.T) {
+	cdsPath := "../testdata/services/storage/diskstorage/Music/cds"
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: cdsPath},
+			{Type: "diskStorage", Name: "mirror", Path: cdsPath, Priority: 1},
+		},
+		IDCollisions: "priority",
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/id-collisions?format=json", nil)
+	rec := doRequest(e, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var collisions []catalog.Collision
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &collisions))
+	require.Len(t, collisions, 7)
+	assert.Equal(t, "cds", collisions[0].Copies[0].StorageName)
+	assert.Empty(t, collisions[0].Copies[0].ID)
+	assert.Equal(t, collisions[0].ID, collisions[0].Copies[1].ID)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/id-collisions", nil)
+	rec = doRequest(e, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "mirror")
+	assert.Contains(t, rec.Body.String(), "(not used)")
+}
+
+// A copy of an album in another storage, so that its tracks are duplicates.
+func duplicatesCatalog(t *testing.T) catalog.CatalogService {
+	cdsPath := "../testdata/services/storage/diskstorage/Music/cds"
+	dir := filepath.Join(t.TempDir(), "Artist", "Album1")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	for _, filename := range []string{"track1-example.ogg", "track2-example.flac"} {
+		data, err := os.ReadFile(filepath.Join(cdsPath, "Artist/Album1", filename))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filename), data, 0o644))
+	}
+
+	catalogService, err := buildCatalog(Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: cdsPath},
+			{Type: "diskStorage", Name: "copies", Path: filepath.Dir(filepath.Dir(dir))},
+		},
+	})
+	require.NoError(t, err)
+	return catalogService
+}
+
+func TestAdminDuplicates(t *testing.T) {
+	catalogService := duplicatesCatalog(t)
+	authService, err := buildAuth(Config{})
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(Config{}), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	getPage := func(target string) duplicatesPage {
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var page duplicatesPage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		return page
+	}
+	getGroups := func(target string) []catalog.DuplicateGroup {
+		return getPage(target).Groups
+	}
+
+	t.Run("Tags", func(t *testing.T) {
+		groups := getGroups("/admin/duplicates?format=json")
+		require.Len(t, groups, 2)
+		assert.Equal(t, "artist / album1 / 0 / 1 / album1 track1 example", groups[0].Key)
+		require.Len(t, groups[0].Tracks, 2)
+		assert.Equal(t, "cds", groups[0].Tracks[0].StorageName)
+		assert.Equal(t, "copies", groups[0].Tracks[1].StorageName)
+		assert.Equal(t, "audio/ogg", groups[0].Tracks[0].MIMEType)
+		assert.Equal(t, 160003, groups[0].Tracks[0].Bitrate)
+	})
+
+	t.Run("Content", func(t *testing.T) {
+		page := getPage("/admin/duplicates?format=json&match=content")
+		assert.Equal(t, catalog.DuplicateMatchContent, page.Match)
+		require.Len(t, page.Groups, 2)
+		assert.Regexp(t, "^sha256:", page.Groups[0].Key)
+		assert.Empty(t, page.Unreadable)
+	})
+
+	t.Run("Library", func(t *testing.T) {
+		assert.Empty(t, getGroups("/admin/duplicates?format=json&library=cds"))
+	})
+
+	t.Run("BadMatch", func(t *testing.T) {
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/admin/duplicates?format=json&match=nope", nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("HTML", func(t *testing.T) {
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/admin/duplicates", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "copies")
+		assert.Contains(t, rec.Body.String(), "160 kbit/s")
+		assert.Contains(t, rec.Body.String(), "(preferred)")
+	})
+
+	t.Run("Unreadable", func(t *testing.T) {
+		// Two copies of a track, one of which is removed after the catalog is built.
+		data, err := os.ReadFile("../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track1-example.ogg")
+		require.NoError(t, err)
+		dirs := []string{t.TempDir(), t.TempDir()}
+		for _, dir := range dirs {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "track.ogg"), data, 0o644))
+		}
+		catalogService, err := buildCatalog(Config{
+			StorageServices: []StorageServiceConfig{
+				{Type: "diskStorage", Name: "kept", Path: dirs[0]},
+				{Type: "diskStorage", Name: "removed", Path: dirs[1]},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(filepath.Join(dirs[1], "track.ogg")))
+		e, err := setupEndpoints(newLiveConfig(Config{}), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+		require.NoError(t, err)
+
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/admin/duplicates?format=json&match=content", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var page duplicatesPage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Empty(t, page.Groups)
+		require.Len(t, page.Unreadable, 1)
+		assert.Equal(t, "removed", page.Unreadable[0].Track.StorageName)
+
+		rec = doRequest(e, httptest.NewRequest(http.MethodGet, "/admin/duplicates?match=content", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Unreadable")
+		assert.Contains(t, rec.Body.String(), "removed")
+	})
+}
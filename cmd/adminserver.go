@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+)
+
+// Summary of a storage in the catalog, for debugging.
+type storageSummary struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	Tracks       int     `json:"tracks"`
+	Playlists    int     `json:"playlists"`
+	Ignored      int     `json:"ignored"`
+	Problems     int     `json:"problems"`
+	ScanDuration float64 `json:"scanDurationSeconds"`
+}
+
+type catalogSummary struct {
+	Tracks     int              `json:"tracks"`
+	Playlists  int              `json:"playlists"`
+	Collisions int              `json:"collisions"` // Tracks and playlists in more than one storage
+	Storages   []storageSummary `json:"storages"`
+}
+
+func summarizeCatalog(catalogService catalog.CatalogService) catalogSummary {
+	tracks, playlists := catalogService.GetTracks()
+	summary := catalogSummary{
+		Tracks:     len(tracks),
+		Playlists:  len(playlists),
+		Collisions: len(catalogService.GetCollisions()),
+		Storages:   make([]storageSummary, 0),
+	}
+
+	for _, ss := range catalogService.GetStorages() {
+		stats := ss.GetScanStats()
+		storageSummary := storageSummary{
+			ID:           ss.GetID(),
+			Name:         ss.GetName(),
+			Ignored:      stats.Ignored,
+			Problems:     len(ss.GetScanReport()),
+			ScanDuration: stats.Duration.Seconds(),
+		}
+		for _, track := range tracks {
+			if track.StorageServiceID == ss.GetID() {
+				storageSummary.Tracks++
+			}
+		}
+		for _, playlist := range playlists {
+			if playlist.StorageServiceID == ss.GetID() {
+				storageSummary.Playlists++
+			}
+		}
+		summary.Storages = append(summary.Storages, storageSummary)
+	}
+	return summary
+}
+
+// allStacks returns the stacks of all goroutines, like a SIGQUIT would print.
+func allStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func getDebugGoroutines(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+	return runtimepprof.Lookup("goroutine").WriteTo(c.Response(), 2)
+}
+
+func getDebugMemStats(c echo.Context) error {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return c.JSON(http.StatusOK, memStats)
+}
+
+func postDebugDumpStacks(c echo.Context) error {
+	slog.Warn("Dumping goroutine stacks", "stacks", string(allStacks()))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// isLoopbackAddr returns true if the address only accepts connections from this machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminServerAuth requires an admin user for every request to the admin server,
+// using HTTP basic authentication or an API token. The admin server doesn't
+// have a login page, so that it can be used from curl or Prometheus.
+func adminServerAuth(authService auth.AuthService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !authService.Enabled() {
+				return next(c)
+			}
+
+			var user auth.User
+			err := auth.ErrInvalidCredentials
+			if token, ok := bearerToken(c); ok {
+				user, err = userFromAPIToken(authService, token)
+			} else if username, password, ok := c.Request().BasicAuth(); ok {
+				user, err = authService.Authenticate(username, password)
+			}
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="minimediaserver admin"`)
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+			if !user.Admin {
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+			return next(c)
+		}
+	}
+}
+
+// setupAdminServer sets up the optional admin server, which listens
+// on its own address so that it can be kept off the public network.
+// It serves the metrics, some debugging endpoints including pprof,
+// and an endpoint for reloading the configuration.
+func setupAdminServer(config Config, catalogService catalog.CatalogService, authService auth.AuthService, metrics *serverMetrics, r *reloader) (*echo.Echo, error) {
+	if !authService.Enabled() && !isLoopbackAddr(config.AdminAddr) {
+		return nil, errors.New("the admin server can only listen on a loopback address when there are no users")
+	}
+
+	e := echo.New()
+	e.HideBanner = true
+	e.Use(adminServerAuth(authService))
+
+	e.GET("/metrics", metrics.handler())
+
+	e.GET("/debug/catalog", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, summarizeCatalog(catalogService))
+	})
+	e.GET("/debug/goroutines", getDebugGoroutines)
+	e.GET("/debug/memstats", getDebugMemStats)
+	e.POST("/debug/dump-stacks", postDebugDumpStacks)
+	if r != nil {
+		e.POST("/reload", func(c echo.Context) error {
+			return postReload(c, r)
+		})
+	}
+
+	e.GET("/debug/pprof/", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	e.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	e.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	e.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	e.POST("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	e.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// Named profiles, e.g.: heap, goroutine, block.
+	e.GET("/debug/pprof/:profile", func(c echo.Context) error {
+		pprof.Handler(c.Param("profile")).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+
+	return e, nil
+}
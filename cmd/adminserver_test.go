@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+)
+
+func TestAdminServer(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	config := Config{
+		AdminAddr: "0.0.0.0:9090",
+		Users: []auth.User{
+			{Name: "admin", PasswordHash: hash, Admin: true},
+			{Name: "fred", PasswordHash: hash},
+		},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	}
+	_, catalogService := setupTestServer(t, config)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	adminServer, err := setupAdminServer(config, catalogService, authService, newServerMetrics(catalogService), nil)
+	require.NoError(t, err)
+
+	get := func(target string, username string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if username != "" {
+			req.SetBasicAuth(username, "secret")
+		}
+		return doRequest(adminServer, req)
+	}
+
+	t.Run("Auth", func(t *testing.T) {
+		rec := get("/debug/catalog", "")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get(echo.HeaderWWWAuthenticate))
+
+		rec = get("/debug/catalog", "fred")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/debug/catalog", nil)
+		req.SetBasicAuth("admin", "wrong")
+		rec = doRequest(adminServer, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("Catalog", func(t *testing.T) {
+		rec := get("/debug/catalog", "admin")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var summary catalogSummary
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &summary))
+		assert.Equal(t, 1, summary.Tracks)
+		assert.Equal(t, 1, summary.Playlists)
+		assert.Zero(t, summary.Collisions)
+		require.Len(t, summary.Storages, 1)
+		assert.Equal(t, "null", summary.Storages[0].Name)
+		assert.Equal(t, 1, summary.Storages[0].Tracks)
+	})
+
+	t.Run("MemStats", func(t *testing.T) {
+		rec := get("/debug/memstats", "admin")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var memStats map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &memStats))
+		assert.Contains(t, memStats, "HeapAlloc")
+	})
+
+	t.Run("Goroutines", func(t *testing.T) {
+		rec := get("/debug/goroutines", "admin")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "goroutine")
+	})
+
+	t.Run("DumpStacks", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/debug/dump-stacks", nil)
+		req.SetBasicAuth("admin", "secret")
+		rec := doRequest(adminServer, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+
+	t.Run("Pprof", func(t *testing.T) {
+		rec := get("/debug/pprof/", "admin")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "heap")
+
+		rec = get("/debug/pprof/heap?debug=1", "admin")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "heap profile")
+	})
+}
+
+func TestAdminServerWithoutUsers(t *testing.T) {
+	var config Config
+	_, catalogService := setupTestServer(t, config)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+
+	// Without users, anyone who can connect can use the admin server,
+	// so it must only be reachable from this machine.
+	config.AdminAddr = ":9090"
+	_, err = setupAdminServer(config, catalogService, authService, newServerMetrics(catalogService), nil)
+	assert.Error(t, err)
+
+	config.AdminAddr = "127.0.0.1:9090"
+	adminServer, err := setupAdminServer(config, catalogService, authService, newServerMetrics(catalogService), nil)
+	require.NoError(t, err)
+	rec := doRequest(adminServer, httptest.NewRequest(http.MethodGet, "/debug/catalog", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	assert.True(t, isLoopbackAddr("127.0.0.1:9090"))
+	assert.True(t, isLoopbackAddr("[::1]:9090"))
+	assert.True(t, isLoopbackAddr("localhost:9090"))
+	assert.False(t, isLoopbackAddr(":9090"))
+	assert.False(t, isLoopbackAddr("0.0.0.0:9090"))
+	assert.False(t, isLoopbackAddr("192.168.1.2:9090"))
+	assert.False(t, isLoopbackAddr("nonsense"))
+}
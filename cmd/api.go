@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+)
+
+// JSON API, e.g.: for scripts using API tokens.
+
+type apiLibrary struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func getAPILibraries(c echo.Context, catalogService catalog.CatalogService) error {
+	libraries := make([]apiLibrary, 0)
+	for _, ss := range catalogService.GetStorages() {
+		libraries = append(libraries, apiLibrary{
+			ID:   ss.GetID(),
+			Name: ss.GetName(),
+		})
+	}
+	return c.JSON(http.StatusOK, libraries)
+}
+
+func getAPITracks(c echo.Context, catalogService catalog.CatalogService) error {
+	tracks, _, err := tracksForList(c, catalogService)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tracks)
+}
+
+func getAPITracksByID(c echo.Context, catalogService catalog.CatalogService) error {
+	track, err := catalogService.GetTrack(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, track)
+}
+
+func getAPIPlaylists(c echo.Context, catalogService catalog.CatalogService) error {
+	_, playlists, err := tracksForList(c, catalogService)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, playlists)
+}
+
+func getAPIPlaylistsByID(c echo.Context, catalogService catalog.CatalogService) error {
+	playlist, err := catalogService.GetPlaylist(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, playlist)
+}
+
+type apiTokenResponse struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// postAPITokens creates a long-lived API token for the logged in user.
+func postAPITokens(c echo.Context, authService auth.AuthService) error {
+	user, ok := currentUser(c)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "API tokens need a logged in user")
+	}
+
+	token, claims, err := authService.NewToken(auth.TokenClaims{
+		Kind:    auth.TokenKindAPI,
+		Subject: user.Name,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, apiTokenResponse{ID: claims.ID, Token: token})
+}
+
+type revokeRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// postAPITokensRevoke revokes an API token or share link.
+// Only the user that created the token may revoke it.
+func postAPITokensRevoke(c echo.Context, authService auth.AuthService) error {
+	var req revokeRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	claims, err := authService.VerifyToken(req.Token)
+	if err != nil {
+		if errors.Is(err, auth.ErrRevokedToken) || errors.Is(err, auth.ErrExpiredToken) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if user, ok := currentUser(c); ok && user.Name != claims.Subject {
+		return echo.NewHTTPError(http.StatusForbidden, "token belongs to another user")
+	}
+
+	if err := authService.RevokeToken(claims); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func postAPIShares(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService) error {
+	var req shareRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	share, err := createShare(c, catalogService, authService, req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, share)
+}
+
+func setupAPIEndpoints(g *echo.Group, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, ratingsService ratings.RatingsService) {
+	withETag := catalogETag(catalogService, plays, ratingsService)
+	g.GET("/api/libraries", func(c echo.Context) error {
+		return getAPILibraries(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/api/tracks", func(c echo.Context) error {
+		return getAPITracks(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/api/tracks/:id", func(c echo.Context) error {
+		return getAPITracksByID(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/api/playlists", func(c echo.Context) error {
+		return getAPIPlaylists(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/api/playlists/:id", func(c echo.Context) error {
+		return getAPIPlaylistsByID(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.POST("/api/tokens", func(c echo.Context) error {
+		return postAPITokens(c, authService)
+	})
+	g.POST("/api/tokens/revoke", func(c echo.Context) error {
+		return postAPITokensRevoke(c, authService)
+	})
+	g.POST("/api/shares", func(c echo.Context) error {
+		return postAPIShares(c, catalogFor(c, catalogService, authService, plays, ratingsService), authService)
+	})
+}
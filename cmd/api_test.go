@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+)
+
+func TestAPIEndpoints(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	e, catalogService := setupTestServer(t, Config{
+		Users:         []auth.User{{Name: "fred", PasswordHash: hash}},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	})
+	tracks, playlists := catalogService.GetTracks()
+
+	apiRequest := func(method string, target string, body string, token string) *httptest.ResponseRecorder {
+		req := newJSONRequest(method, target, body)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return doRequest(e, req)
+	}
+
+	t.Run("NoToken", func(t *testing.T) {
+		rec := apiRequest(http.MethodGet, "/api/tracks", "", "")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("BadToken", func(t *testing.T) {
+		rec := apiRequest(http.MethodGet, "/api/tracks", "", "garbage")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+	})
+
+	// Create an API token, using a session.
+	cookie := login(t, e, "fred", "secret")
+	req := httptest.NewRequest(http.MethodPost, "/api/tokens", nil)
+	req.AddCookie(cookie)
+	rec := doRequest(e, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var tokenResponse apiTokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokenResponse))
+	token := tokenResponse.Token
+
+	t.Run("Tracks", func(t *testing.T) {
+		rec := apiRequest(http.MethodGet, "/api/tracks", "", token)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var apiTracks []catalog.Track
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &apiTracks))
+		assert.Equal(t, tracks, apiTracks)
+
+		rec = apiRequest(http.MethodGet, "/api/tracks/"+tracks[0].ID, "", token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = apiRequest(http.MethodGet, "/api/tracks/nope", "", token)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Libraries", func(t *testing.T) {
+		rec := apiRequest(http.MethodGet, "/api/libraries", "", token)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var libraries []apiLibrary
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &libraries))
+		require.Len(t, libraries, 1)
+		assert.Equal(t, "null", libraries[0].Name)
+
+		rec = apiRequest(http.MethodGet, "/api/tracks?library=null", "", token)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var apiTracks []catalog.Track
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &apiTracks))
+		assert.Len(t, apiTracks, 1)
+
+		rec = apiRequest(http.MethodGet, "/api/tracks?library=nope", "", token)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &apiTracks))
+		assert.Len(t, apiTracks, 0)
+	})
+
+	t.Run("Playlists", func(t *testing.T) {
+		rec := apiRequest(http.MethodGet, "/api/playlists", "", token)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var apiPlaylists []catalog.Playlist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &apiPlaylists))
+		assert.Equal(t, playlists, apiPlaylists)
+
+		rec = apiRequest(http.MethodGet, "/api/playlists/"+playlists[0].ID, "", token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("TrackData", func(t *testing.T) {
+		rec := apiRequest(http.MethodGet, "/tracks/"+tracks[0].ID+"/data", "", token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("ShareTokenIsNotAnAPIToken", func(t *testing.T) {
+		rec := apiRequest(http.MethodPost, "/api/shares", `{"scope": "track", "id": "`+tracks[0].ID+`"}`, token)
+		require.Equal(t, http.StatusCreated, rec.Code)
+		var share shareResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &share))
+
+		rec = apiRequest(http.MethodGet, "/api/tracks", "", share.Token)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		rec := apiRequest(http.MethodPost, "/api/tokens/revoke", `{"token": "`+token+`"}`, token)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		rec = apiRequest(http.MethodGet, "/api/tracks", "", token)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
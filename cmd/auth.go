@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+)
+
+const (
+	sessionCookieName = "minimediaserver_session"
+	userContextKey    = "user" // Key for the authenticated auth.User in echo.Context
+)
+
+// Paths that can be accessed without logging in.
+// Share links are checked by their own handlers.
+var publicPathPrefixes = []string{
+	"/static/",
+	"/login",
+	"/share/",
+}
+
+type loginPage struct {
+	Next  string
+	Error string
+}
+
+// Only allow redirects to paths on this server after logging in.
+func safeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/"
+	}
+	return next
+}
+
+// redirectAfterLogin returns where to go after logging in: the next path
+// if it is safe, otherwise the root page.
+func redirectAfterLogin(c echo.Context, next string) string {
+	if safeRedirectPath(next) != next {
+		return externalURLFor(c).path("/")
+	}
+	return next
+}
+
+func getLogin(c echo.Context) error {
+	return c.Render(http.StatusOK, "login.tmpl.html", loginPage{
+		Next: redirectAfterLogin(c, c.QueryParam("next")),
+	})
+}
+
+func postLogin(c echo.Context, authService auth.AuthService) error {
+	username := c.FormValue("username")
+	password := c.FormValue("password")
+	next := redirectAfterLogin(c, c.FormValue("next"))
+
+	user, err := authService.Authenticate(username, password)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			return c.Render(http.StatusUnauthorized, "login.tmpl.html", loginPage{
+				Next:  next,
+				Error: "Invalid username or password",
+			})
+		}
+		return err
+	}
+
+	session, err := authService.NewSession(user)
+	if err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     externalURLFor(c).cookiePath(),
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   externalURLFor(c).Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusSeeOther, next)
+}
+
+func postLogout(c echo.Context, authService auth.AuthService) error {
+	if cookie, err := c.Cookie(sessionCookieName); err == nil {
+		authService.DeleteSession(cookie.Value)
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     externalURLFor(c).cookiePath(),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   externalURLFor(c).Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusSeeOther, externalURLFor(c).path("/login"))
+}
+
+func isPublicPath(path string) bool {
+	for _, prefix := range publicPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Browsers get redirected to the login page; everything else
+// (e.g.: the audio player fetching track data) gets a 401.
+func wantsHTML(c echo.Context) bool {
+	return c.Request().Method == http.MethodGet &&
+		strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, if any.
+func bearerToken(c echo.Context) (string, bool) {
+	const prefix = "Bearer "
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// Find the user for an API token.
+func userFromAPIToken(authService auth.AuthService, token string) (auth.User, error) {
+	claims, err := authService.VerifyToken(token)
+	if err != nil {
+		return auth.User{}, err
+	}
+	if claims.Kind != auth.TokenKindAPI {
+		return auth.User{}, auth.ErrInvalidToken
+	}
+	return authService.GetUser(claims.Subject)
+}
+
+// authMiddleware requires a valid session or API token for every route
+// except the public ones (static assets, login page, share links).
+func authMiddleware(authService auth.AuthService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u := externalURLFor(c)
+			if !authService.Enabled() || isPublicPath(u.routePath(c.Request())) {
+				return next(c)
+			}
+
+			// Scripts use API tokens rather than logging in.
+			if token, ok := bearerToken(c); ok {
+				user, err := userFromAPIToken(authService, token)
+				if err != nil {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+					return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+				}
+				c.Set(userContextKey, user)
+				return next(c)
+			}
+
+			if cookie, err := c.Cookie(sessionCookieName); err == nil {
+				session, err := authService.GetSession(cookie.Value)
+				if err == nil {
+					user, err := authService.GetUser(session.Username)
+					if err == nil {
+						c.Set(userContextKey, user)
+						return next(c)
+					}
+				}
+			}
+
+			if wantsHTML(c) {
+				loginURL := u.path("/login") + "?next=" + url.QueryEscape(u.requestURI(c.Request()))
+				return c.Redirect(http.StatusSeeOther, loginURL)
+			}
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+	}
+}
+
+// requireAdmin only allows admin users through. When authentication
+// is disabled, everyone is an admin.
+func requireAdmin(authService auth.AuthService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !authService.Enabled() {
+				return next(c)
+			}
+			if user, ok := currentUser(c); ok && user.Admin {
+				return next(c)
+			}
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+	}
+}
+
+// currentUser returns the logged in user, if any.
+func currentUser(c echo.Context) (auth.User, bool) {
+	user, ok := c.Get(userContextKey).(auth.User)
+	return user, ok
+}
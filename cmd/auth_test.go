@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+)
+
+// Log in, and return the session cookie.
+func login(t *testing.T, e *echo.Echo, username string, password string) *http.Cookie {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := doRequest(e, req)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	return cookies[0]
+}
+
+func TestAuthEndpoints(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	e, _ := setupTestServer(t, Config{
+		Users:         []auth.User{{Name: "fred", PasswordHash: hash}},
+		SessionMaxAge: 3600,
+	})
+
+	postLogin := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"fred"}, "password": {password}, "next": {"/playlists"}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		return doRequest(e, req)
+	}
+
+	t.Run("BrowserRedirectedToLogin", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/playlists", nil)
+		req.Header.Set("Accept", "text/html")
+		rec := doRequest(e, req)
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "/login?next=%2Fplaylists", rec.Header().Get("Location"))
+	})
+
+	t.Run("UnauthorizedWithoutSession", func(t *testing.T) {
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/tracks", nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("StaticIsPublic", func(t *testing.T) {
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/static/playlistsbyid.css", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("BadPassword", func(t *testing.T) {
+		rec := postLogin("wrong")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Empty(t, rec.Result().Cookies())
+	})
+
+	t.Run("LoginAndLogout", func(t *testing.T) {
+		rec := postLogin("secret")
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "/playlists", rec.Header().Get("Location"))
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		cookie := cookies[0]
+		assert.Equal(t, sessionCookieName, cookie.Name)
+		assert.True(t, cookie.HttpOnly)
+
+		req := httptest.NewRequest(http.MethodGet, "/tracks", nil)
+		req.AddCookie(cookie)
+		rec = doRequest(e, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req = httptest.NewRequest(http.MethodPost, "/logout", nil)
+		req.AddCookie(cookie)
+		rec = doRequest(e, req)
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+
+		req = httptest.NewRequest(http.MethodGet, "/tracks", nil)
+		req.AddCookie(cookie)
+		rec = doRequest(e, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+func TestSafeRedirectPath(t *testing.T) {
+	assert.Equal(t, "/playlists", safeRedirectPath("/playlists"))
+	assert.Equal(t, "/", safeRedirectPath(""))
+	assert.Equal(t, "/", safeRedirectPath("https://example.com/"))
+	assert.Equal(t, "/", safeRedirectPath("//example.com/"))
+	assert.Equal(t, "/", safeRedirectPath("/\\example.com/"))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/richdawe/minimediaserver/internal/logging"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+	"github.com/spf13/viper"
+)
+
+// Exit codes
+const (
+	exitOK            = 0
+	exitError         = 1 // Something went wrong, e.g.: a storage couldn't be scanned
+	exitUsage         = 2 // Bad command-line arguments
+	exitInvalidConfig = 3 // The configuration couldn't be loaded or is invalid
+)
+
+const usage = `Usage: minimediaserver [command] [options]
+
+Commands:
+  serve             Run the server (the default)
+  scan              Scan the storages, and print the playlists and their tracks
+  tags <file>       Print the tags read from a file, and how it would be grouped
+  validate-config   Check the configuration
+  export            Print the catalog as JSON
+  hash-password     Read a password from stdin, and print its hash for the configuration
+  help              Print this help
+
+Run "minimediaserver <command> -help" for a command's options.
+`
+
+// Returned for bad command-line arguments.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+// Returned when the configuration can't be loaded or is invalid.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	message := e.err.Error()
+	if strings.Contains(message, "\n") {
+		// One problem per line
+		return "invalid configuration:\n  " + strings.ReplaceAll(message, "\n", "\n  ")
+	}
+	return "invalid configuration: " + message
+}
+func (e *configError) Unwrap() error { return e.err }
+
+// Options shared by the commands that read the configuration.
+type configFlags struct {
+	configFile string
+}
+
+func (cf *configFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&cf.configFile, "config", "", "configuration file in JSON, YAML or TOML (default: .minimediaserver.json, .yaml or .toml in $HOME or the current directory)")
+}
+
+// load reads the configuration.
+func (cf *configFlags) load() (Config, error) {
+	setLoadConfigOptions(cf.configFile)
+	config, err := loadConfig()
+	if err != nil {
+		return Config{}, &configError{err}
+	}
+	return config, nil
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parseFlags parses the command's arguments, and checks the number of positional arguments.
+// Any problems are printed along with the command's usage, like the flag package does.
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		return &usageError{err}
+	}
+	if fs.NArg() != nargs {
+		return flagProblem(fs, fmt.Errorf("expected %d arguments, got %d", nargs, fs.NArg()))
+	}
+	return nil
+}
+
+// flagProblem prints a problem with the arguments, along with the command's usage.
+func flagProblem(fs *flag.FlagSet, err error) error {
+	fmt.Fprintln(fs.Output(), err)
+	fs.Usage()
+	return &usageError{err}
+}
+
+// useLogger logs to stderr at the configured level, for the commands that don't serve.
+// The log file settings are only used by the server.
+func useLogger(config Config, stderr io.Writer) error {
+	options := config.Log
+	options.File = ""
+	logger, err := logging.New(options, stderr)
+	if err != nil {
+		return &configError{err}
+	}
+	slog.SetDefault(logger.Logger)
+	return nil
+}
+
+func runServe(args []string, stderr io.Writer) error {
+	var cf configFlags
+	var addr, logLevel string
+	fs := newFlagSet("serve", stderr)
+	cf.register(fs)
+	fs.StringVar(&addr, "addr", "", "address to listen on, overriding host and port, e.g.: 127.0.0.1:1323")
+	fs.StringVar(&logLevel, "log-level", "", "log level, overriding logLevel: debug, info, warn or error")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	setLoadConfigOptions(cf.configFile)
+	// The options take precedence over the environment and the configuration file,
+	// including when the configuration is reloaded.
+	if addr != "" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return flagProblem(fs, err)
+		}
+		viper.Set("host", host)
+		viper.Set("port", port)
+	}
+	if logLevel != "" {
+		viper.Set("loglevel", logLevel)
+	}
+	return serve()
+}
+
+func runScan(args []string, stdout io.Writer, stderr io.Writer) error {
+	var cf configFlags
+	fs := newFlagSet("scan", stderr)
+	cf.register(fs)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	config, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if err := useLogger(config, stderr); err != nil {
+		return err
+	}
+	catalogService, err := buildCatalog(config)
+	if err != nil {
+		return err
+	}
+
+	_, playlists := catalogService.GetTracks()
+	for _, s := range summarizeCatalog(catalogService).Storages {
+		fmt.Fprintf(stdout, "Library %s: %d tracks, %d playlists, %d ignored, %d problems\n",
+			s.Name, s.Tracks, s.Playlists, s.Ignored, s.Problems)
+		for _, playlist := range playlists {
+			if playlist.StorageServiceID != s.ID {
+				continue
+			}
+			fmt.Fprintf(stdout, "\n  %s\n", playlist.Name)
+			for i, track := range playlist.Tracks {
+				fmt.Fprintf(stdout, "    %2d. %s\n", i+1, track.Name)
+			}
+		}
+		fmt.Fprintln(stdout)
+	}
+	return nil
+}
+
+// storageForFile finds the disk storage containing a file, so that the file
+// is annotated using the storage's regular expressions. If no storage
+// contains the file, a storage for the file's directory is used.
+func storageForFile(config Config, location string) (*storage.DiskStorage, error) {
+	for _, css := range config.StorageServices {
+		if css.Type != "diskStorage" {
+			continue
+		}
+		basePath, err := filepath.Abs(css.diskPath())
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(basePath, location); err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return storage.NewDiskStorage(basePath, css.Regexps, storage.Options{Name: css.storageName()})
+	}
+	return storage.NewDiskStorage(filepath.Dir(location), []string{}, storage.Options{})
+}
+
+func runTags(args []string, stdout io.Writer, stderr io.Writer) error {
+	var cf configFlags
+	fs := newFlagSet("tags", stderr)
+	cf.register(fs)
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	config, err := cf.load()
+	if err != nil {
+		return err
+	}
+	location, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ds, err := storageForFile(config, location)
+	if err != nil {
+		return err
+	}
+	track, strategy, err := ds.InspectFile(location)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "File:\t%s\n", track.Location)
+	fmt.Fprintf(w, "Library:\t%s\n", ds.GetName())
+	fmt.Fprintf(w, "MIME type:\t%s\n", track.MIMEType)
+	fmt.Fprintf(w, "Size:\t%d\n", track.DataLen)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Tags:")
+	fmt.Fprintf(w, "  Title:\t%s\n", track.Tags.Title)
+	fmt.Fprintf(w, "  Artist:\t%s\n", track.Tags.Artist)
+	fmt.Fprintf(w, "  Album:\t%s\n", track.Tags.Album)
+	fmt.Fprintf(w, "  Album artist:\t%s\n", track.Tags.AlbumArtist)
+	fmt.Fprintf(w, "  Album ID:\t%s\n", track.Tags.AlbumId)
+	fmt.Fprintf(w, "  Genre:\t%s\n", track.Tags.Genre)
+	fmt.Fprintf(w, "  Track number:\t%d\n", track.Tags.TrackNumber)
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Annotated using:\t%s\n", strategy)
+	fmt.Fprintf(w, "  Name:\t%s\n", track.Name)
+	fmt.Fprintf(w, "  Title:\t%s\n", track.Title)
+	fmt.Fprintf(w, "  Artist:\t%s\n", track.Artist)
+	fmt.Fprintf(w, "  Album:\t%s\n", track.Album)
+	fmt.Fprintf(w, "  Album artist:\t%s\n", track.AlbumArtist)
+	fmt.Fprintf(w, "  Playlist location:\t%s\n", track.PlaylistLocation)
+	return w.Flush()
+}
+
+func runValidateConfig(args []string, stdout io.Writer, stderr io.Writer) error {
+	var cf configFlags
+	fs := newFlagSet("validate-config", stderr)
+	cf.register(fs)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	config, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(config); err != nil {
+		return &configError{err}
+	}
+	fmt.Fprintln(stdout, "Configuration is valid")
+	return nil
+}
+
+// The whole catalog, as exported by the export command.
+type catalogExport struct {
+	Libraries []apiLibrary       `json:"libraries"`
+	Tracks    []catalog.Track    `json:"tracks"`
+	Playlists []catalog.Playlist `json:"playlists"`
+}
+
+func runExport(args []string, stdout io.Writer, stderr io.Writer) error {
+	var cf configFlags
+	fs := newFlagSet("export", stderr)
+	cf.register(fs)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	config, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if err := useLogger(config, stderr); err != nil {
+		return err
+	}
+	catalogService, err := buildCatalog(config)
+	if err != nil {
+		return err
+	}
+
+	export := catalogExport{Libraries: make([]apiLibrary, 0)}
+	export.Tracks, export.Playlists = catalogService.GetTracks()
+	for _, ss := range catalogService.GetStorages() {
+		export.Libraries = append(export.Libraries, apiLibrary{
+			ID:   ss.GetID(),
+			Name: ss.GetName(),
+		})
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(export)
+}
+
+func runHashPassword(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("hash-password", stderr)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	return hashPassword(stdin, stdout, stderr)
+}
+
+// run runs the command given by the arguments, and returns the exit code.
+// With no command, the server is started.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args, stderr)
+	case "scan":
+		err = runScan(args, stdout, stderr)
+	case "tags":
+		err = runTags(args, stdout, stderr)
+	case "validate-config":
+		err = runValidateConfig(args, stdout, stderr)
+	case "export":
+		err = runExport(args, stdout, stderr)
+	case "hash-password":
+		err = runHashPassword(args, stdin, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "unknown command %s\n\n%s", command, usage)
+		return exitUsage
+	}
+
+	var uErr *usageError
+	var cErr *configError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &uErr):
+		// The problem has already been printed with the usage.
+		return exitUsage
+	case errors.As(err, &cErr):
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return exitInvalidConfig
+	}
+	fmt.Fprintf(stderr, "error: %v\n", err)
+	return exitError
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// runCommand runs a command, returning its exit code and output.
+func runCommand(t *testing.T, stdin string, args ...string) (int, string, string) {
+	// The commands set where the configuration is read from.
+	t.Cleanup(viper.Reset)
+
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func writeConfigFile(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "minimediaserver.json")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+	return path
+}
+
+func TestCLI(t *testing.T) {
+	cdsPath, err := filepath.Abs("../testdata/services/storage/diskstorage/Music/cds")
+	require.NoError(t, err)
+	configFile := writeConfigFile(t, `{
+		"storageServices": [
+			{"type": "diskStorage", "name": "cds", "path": "`+cdsPath+`"}
+		],
+		"logLevel": "error"
+	}`)
+
+	t.Run("Help", func(t *testing.T) {
+		code, stdout, _ := runCommand(t, "", "help")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "validate-config")
+
+		code, _, stderr := runCommand(t, "", "scan", "-help")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stderr, "-config")
+	})
+
+	t.Run("BadUsage", func(t *testing.T) {
+		code, _, stderr := runCommand(t, "", "frobnicate")
+		assert.Equal(t, exitUsage, code)
+		assert.Contains(t, stderr, "unknown command frobnicate")
+
+		code, _, _ = runCommand(t, "", "scan", "--no-such-flag")
+		assert.Equal(t, exitUsage, code)
+
+		code, _, stderr = runCommand(t, "", "serve", "--addr", "nonsense")
+		assert.Equal(t, exitUsage, code)
+		assert.Contains(t, stderr, "missing port in address")
+
+		code, _, stderr = runCommand(t, "", "tags")
+		assert.Equal(t, exitUsage, code)
+		assert.Contains(t, stderr, "expected 1 arguments, got 0")
+	})
+
+	t.Run("ValidateConfig", func(t *testing.T) {
+		code, stdout, _ := runCommand(t, "", "validate-config", "--config", configFile)
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "Configuration is valid")
+
+		badConfigFile := writeConfigFile(t, `{
+			"storageServices": [
+				{"type": "MEGASTORAGE"},
+				{"type": "diskStorage", "path": "/dev/__DOES_NOT_EXIST__"},
+				{"type": "diskStorage", "path": "/dev/__ALSO_MISSING__", "ignoreErrors": true}
+			],
+			"logLevel": "loud"
+		}`)
+		code, _, stderr := runCommand(t, "", "validate-config", "--config", badConfigFile)
+		assert.Equal(t, exitInvalidConfig, code)
+		assert.Equal(t, "error: invalid configuration:\n"+
+			"  storageServices[0].type: unknown value \"MEGASTORAGE\", expected one of nullStorage, diskStorage\n"+
+			"  storageServices[1].path: stat /dev/__DOES_NOT_EXIST__: no such file or directory\n"+
+			"  logLevel: unknown log level loud\n", stderr)
+
+		code, _, _ = runCommand(t, "", "validate-config", "--config", filepath.Join(t.TempDir(), "missing.json"))
+		assert.Equal(t, exitInvalidConfig, code)
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		code, stdout, _ := runCommand(t, "", "scan", "--config", configFile)
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "Library cds: 4 tracks, 3 playlists, 2 ignored, 0 problems")
+		assert.Contains(t, stdout, "Artist :: album1\n     1. the-artist :: ALBUM1_TRACK1_EXAMPLE\n     2. the-artist :: ALBUM1_TRACK2_EXAMPLE\n")
+	})
+
+	t.Run("ScanInvalidConfig", func(t *testing.T) {
+		missingConfigFile := writeConfigFile(t, `{"storageServices": [{"type": "diskStorage", "path": "/dev/__DOES_NOT_EXIST__"}]}`)
+		code, _, stderr := runCommand(t, "", "scan", "--config", missingConfigFile)
+		assert.Equal(t, exitInvalidConfig, code)
+		assert.Contains(t, stderr, "__DOES_NOT_EXIST__")
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		code, stdout, _ := runCommand(t, "", "export", "--config", configFile)
+		require.Equal(t, exitOK, code)
+
+		var export catalogExport
+		require.NoError(t, json.Unmarshal([]byte(stdout), &export))
+		require.Len(t, export.Libraries, 1)
+		assert.Equal(t, "cds", export.Libraries[0].Name)
+		assert.Len(t, export.Tracks, 4)
+		assert.Len(t, export.Playlists, 3)
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		location := filepath.Join(cdsPath, "Artist/Album1/track1-example.ogg")
+		code, stdout, _ := runCommand(t, "", "tags", "--config", configFile, location)
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "Library:    cds\n")
+		assert.Contains(t, stdout, "Annotated using:      tags\n")
+		assert.Contains(t, stdout, "ALBUM1_TRACK1_EXAMPLE")
+
+		code, _, _ = runCommand(t, "", "tags", "--config", configFile, filepath.Join(cdsPath, "Artist/Album1/example.txt"))
+		assert.Equal(t, exitError, code)
+	})
+
+	t.Run("HashPassword", func(t *testing.T) {
+		code, stdout, _ := runCommand(t, "secret\n", "hash-password")
+		require.Equal(t, exitOK, code)
+		hash := strings.TrimSpace(stdout)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")))
+
+		code, _, _ = runCommand(t, "\n", "hash-password")
+		assert.Equal(t, exitError, code)
+	})
+}
+
+func TestStorageForFile(t *testing.T) {
+	dir := t.TempDir()
+	cdsPath := filepath.Join(dir, "cds")
+	otherPath := filepath.Join(dir, "cds-other")
+	require.NoError(t, os.Mkdir(cdsPath, 0o755))
+	require.NoError(t, os.Mkdir(otherPath, 0o755))
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "nullStorage"},
+			{Type: "diskStorage", Name: "cds", Path: cdsPath, Regexps: []string{"(?P<title>.+)"}},
+		},
+	}
+
+	ds, err := storageForFile(config, filepath.Join(cdsPath, "Artist/Album1/track1.ogg"))
+	require.NoError(t, err)
+	assert.Equal(t, "cds", ds.GetName())
+	assert.Equal(t, []string{"(?P<title>.+)"}, ds.Regexps)
+
+	// Not in any storage, even though the path starts with the storage's path.
+	ds, err = storageForFile(config, filepath.Join(otherPath, "track.ogg"))
+	require.NoError(t, err)
+	assert.Equal(t, otherPath, ds.BasePath)
+	assert.Empty(t, ds.Regexps)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+)
+
+// Conditional requests (RFC 9110 section 13), so that clients can check
+// whether their cached copy is still current instead of downloading it again.
+// Track data has a strong ETag from the track's version, and a Last-Modified
+// date. Pages and API responses listing the catalog have a weak ETag, which
+// changes whenever the catalog, the play counts or the user's ratings do,
+// and every catalog.ChoosingInterval for tracks which change over time.
+
+// serverInstance distinguishes this run of the server from others,
+// since the catalog generation starts again when the server is restarted.
+var serverInstance = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// trackETag returns the ETag for a track's data, or an empty string if it has no version.
+func trackETag(track catalog.Track) string {
+	if track.Version == "" {
+		return ""
+	}
+	return `"` + track.Version + `"`
+}
+
+// listingETag returns the ETag for a page or API response listing the catalog.
+// The response also depends on the play counts, who is logged in, their ratings,
+// the path prefix used for links, and when the tracks which change over time
+// were chosen, e.g.: for smart playlists with "added in last 30 days".
+func listingETag(c echo.Context, generation uint64, playsGeneration uint64, ratingsGeneration uint64, chosenAt time.Time) string {
+	h := fnv.New64a()
+	h.Write([]byte(serverInstance + "\x00" + externalURLFor(c).Prefix + "\x00"))
+	if user, ok := currentUser(c); ok {
+		h.Write([]byte(user.Name))
+	}
+	return fmt.Sprintf(`W/"%d.%d.%d.%d-%x"`, generation, playsGeneration, ratingsGeneration, chosenAt.Unix(), h.Sum64())
+}
+
+// etagMatches returns true if the ETag is in the list from an If-None-Match
+// or If-Range header. Weak comparison ignores whether the ETags are weak,
+// otherwise neither can be weak.
+func etagMatches(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// setValidators adds the ETag and Last-Modified headers, if known.
+func setValidators(header http.Header, etag string, modTime time.Time) {
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		header.Set(echo.HeaderLastModified, modTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified returns true if the client's cached copy is current, so that
+// a 304 response can be sent. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag, true)
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get(echo.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	// HTTP dates only have a resolution of seconds.
+	return !modTime.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// rangeStillValid returns true if a Range request should be honoured: either there is
+// no If-Range header, or the client's partial copy is of the current data.
+func rangeStillValid(r *http.Request, etag string, modTime time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagMatches(ifRange, etag, false)
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(date)
+}
+
+// catalogETag adds a weak ETag to successful responses listing the catalog,
+// and answers conditional requests for them.
+func catalogETag(catalogService catalog.CatalogService, plays *playRecorder, ratingsService ratings.RatingsService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			etag := listingETag(c, catalogService.Generation(), plays.generation(), ratingsService.Generation(), catalog.ChoosingTime(time.Now()))
+			res := c.Response()
+			// The response depends on who is logged in, so it shouldn't be stored by shared caches.
+			res.Header().Set(echo.HeaderCacheControl, "private, no-cache")
+			if notModified(c.Request(), etag, time.Time{}) {
+				res.Header().Set("ETag", etag)
+				return c.NoContent(http.StatusNotModified)
+			}
+			res.Before(func() {
+				if res.Status == http.StatusOK {
+					res.Header().Set("ETag", etag)
+				}
+			})
+			return next(c)
+		}
+	}
+}
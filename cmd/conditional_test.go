@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestETagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"abc"`, `"abc"`, false))
+	assert.True(t, etagMatches(`"xyz", "abc"`, `"abc"`, false))
+	assert.True(t, etagMatches(`*`, `"abc"`, false))
+	assert.False(t, etagMatches(`"xyz"`, `"abc"`, false))
+	assert.False(t, etagMatches(`"abc"`, "", false))
+
+	// Weak ETags only match using weak comparison.
+	assert.False(t, etagMatches(`W/"abc"`, `"abc"`, false))
+	assert.False(t, etagMatches(`W/"abc"`, `W/"abc"`, false))
+	assert.True(t, etagMatches(`W/"abc"`, `"abc"`, true))
+	assert.True(t, etagMatches(`"abc"`, `W/"abc"`, true))
+}
+
+func TestNotModified(t *testing.T) {
+	modTime := time.Date(2024, time.March, 1, 12, 0, 0, 500, time.UTC)
+	newRequest := func(method string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, "/", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+
+	assert.False(t, notModified(newRequest(http.MethodGet, nil), `"v1"`, modTime))
+	assert.True(t, notModified(newRequest(http.MethodGet, map[string]string{"If-None-Match": `"v1"`}), `"v1"`, modTime))
+	assert.True(t, notModified(newRequest(http.MethodHead, map[string]string{"If-None-Match": `"v0", "v1"`}), `"v1"`, modTime))
+	assert.False(t, notModified(newRequest(http.MethodGet, map[string]string{"If-None-Match": `"v0"`}), `"v1"`, modTime))
+	assert.False(t, notModified(newRequest(http.MethodPost, map[string]string{"If-None-Match": `"v1"`}), `"v1"`, modTime))
+
+	lastModified := modTime.Format(http.TimeFormat)
+	assert.True(t, notModified(newRequest(http.MethodGet, map[string]string{"If-Modified-Since": lastModified}), `"v1"`, modTime))
+	assert.False(t, notModified(newRequest(http.MethodGet, map[string]string{"If-Modified-Since": modTime.Add(-time.Second).Format(http.TimeFormat)}), `"v1"`, modTime))
+	assert.False(t, notModified(newRequest(http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}), `"v1"`, modTime))
+	assert.False(t, notModified(newRequest(http.MethodGet, map[string]string{"If-Modified-Since": lastModified}), `"v1"`, time.Time{}))
+
+	// If-None-Match takes precedence.
+	assert.False(t, notModified(newRequest(http.MethodGet, map[string]string{"If-None-Match": `"v0"`, "If-Modified-Since": lastModified}), `"v1"`, modTime))
+}
+
+func TestRangeStillValid(t *testing.T) {
+	modTime := time.Date(2024, time.March, 1, 12, 0, 0, 500, time.UTC)
+	ifRange := func(value string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if value != "" {
+			req.Header.Set("If-Range", value)
+		}
+		return req
+	}
+
+	assert.True(t, rangeStillValid(ifRange(""), `"v1"`, modTime))
+	assert.True(t, rangeStillValid(ifRange(`"v1"`), `"v1"`, modTime))
+	assert.False(t, rangeStillValid(ifRange(`"v0"`), `"v1"`, modTime))
+	assert.False(t, rangeStillValid(ifRange(`W/"v1"`), `"v1"`, modTime))
+	assert.True(t, rangeStillValid(ifRange(modTime.Format(http.TimeFormat)), `"v1"`, modTime))
+	assert.False(t, rangeStillValid(ifRange(modTime.Add(-time.Hour).Format(http.TimeFormat)), `"v1"`, modTime))
+	assert.False(t, rangeStillValid(ifRange("garbage"), `"v1"`, modTime))
+}
+
+// Find a track from a disk storage, which has a modification time.
+func diskTrack(t *testing.T, catalogService catalog.CatalogService) catalog.Track {
+	tracks, _ := catalogService.GetTracks()
+	for _, track := range tracks {
+		if !track.ModTime.IsZero() {
+			return track
+		}
+	}
+	require.Fail(t, "no track with a modification time")
+	return catalog.Track{}
+}
+
+func TestListingETag(t *testing.T) {
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/tracks", nil), httptest.NewRecorder())
+	at := catalog.ChoosingTime(time.Now())
+	etag := listingETag(c, 1, 2, 3, at)
+	assert.Equal(t, etag, listingETag(c, 1, 2, 3, at))
+	assert.NotEqual(t, etag, listingETag(c, 2, 2, 3, at))
+
+	// Tracks which change over time are chosen again in the next interval.
+	assert.NotEqual(t, etag, listingETag(c, 1, 2, 3, at.Add(catalog.ChoosingInterval)))
+}
+
+func TestConditionalTrackData(t *testing.T) {
+	e, catalogService := setupTestServer(t, Config{})
+	diskStorage, err := storage.NewDiskStorage("../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+	track := diskTrack(t, catalogService)
+	target := "/tracks/" + track.ID + "/data"
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return doRequest(e, req)
+	}
+
+	rec := get(nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	lastModified := rec.Header().Get(echo.HeaderLastModified)
+	assert.Equal(t, `"`+track.Version+`"`, etag)
+	assert.Equal(t, track.ModTime.UTC().Format(http.TimeFormat), lastModified)
+	assert.Equal(t, "max-age=0", rec.Header().Get("Cache-Control"))
+
+	t.Run("IfNoneMatch", func(t *testing.T) {
+		rec := get(map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Empty(t, rec.Body.String())
+		assert.Equal(t, etag, rec.Header().Get("ETag"))
+		assert.Equal(t, "max-age=0", rec.Header().Get("Cache-Control"))
+
+		rec = get(map[string]string{"If-None-Match": `"something-else"`})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, int(track.DataLen), rec.Body.Len())
+	})
+
+	t.Run("IfModifiedSince", func(t *testing.T) {
+		rec := get(map[string]string{"If-Modified-Since": lastModified})
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+
+		rec = get(map[string]string{"If-Modified-Since": track.ModTime.Add(-time.Hour).UTC().Format(http.TimeFormat)})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("IfRange", func(t *testing.T) {
+		rec := get(map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, 10, rec.Body.Len())
+
+		// The client's partial copy is out of date, so it gets everything.
+		rec = get(map[string]string{"Range": "bytes=0-9", "If-Range": `"old-version"`})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, int(track.DataLen), rec.Body.Len())
+	})
+}
+
+func TestConditionalListings(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+	e, catalogService := setupTestServer(t, Config{
+		Users: []auth.User{
+			{Name: "fred", PasswordHash: hash},
+			{Name: "wilma", PasswordHash: hash},
+		},
+		SessionMaxAge: 3600,
+	})
+	fred := login(t, e, "fred", "secret")
+	wilma := login(t, e, "wilma", "secret")
+
+	get := func(target string, cookie *http.Cookie, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(cookie)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		return doRequest(e, req)
+	}
+
+	for _, target := range []string{"/tracks", "/playlists", "/api/tracks", "/api/playlists", "/api/libraries"} {
+		t.Run(strings.ReplaceAll(target, "/", "_"), func(t *testing.T) {
+			rec := get(target, fred, "")
+			require.Equal(t, http.StatusOK, rec.Code)
+			etag := rec.Header().Get("ETag")
+			assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+			assert.Equal(t, "private, no-cache", rec.Header().Get("Cache-Control"))
+
+			rec = get(target, fred, etag)
+			assert.Equal(t, http.StatusNotModified, rec.Code)
+			assert.Empty(t, rec.Body.String())
+
+			// Other users may see different things.
+			rec = get(target, wilma, etag)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+		})
+	}
+
+	t.Run("NotFound", func(t *testing.T) {
+		rec := get("/api/tracks/nope", fred, "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Empty(t, rec.Header().Get("ETag"))
+	})
+
+	t.Run("CatalogChanges", func(t *testing.T) {
+		rec := get("/api/tracks", fred, "")
+		etag := rec.Header().Get("ETag")
+
+		otherStorage, err := storage.NewNullStorage(storage.Options{Name: "other"})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(otherStorage))
+
+		rec = get("/api/tracks", fred, etag)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	})
+}
@@ -1,116 +1,602 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
-	"strings"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/richdawe/minimediaserver/internal/logging"
+	"github.com/richdawe/minimediaserver/services/auth"
 	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/history"
+	"github.com/richdawe/minimediaserver/services/ratings"
+	"github.com/richdawe/minimediaserver/services/scrobble"
 	"github.com/richdawe/minimediaserver/services/storage"
 	"github.com/spf13/viper"
 )
 
 type StorageServiceConfig struct {
 	Type    string   `mapstructure:"type"`
+	Name    string   `mapstructure:"name"` // Optional; defaults to the path for diskStorage
 	Path    string   `mapstructure:"path"`
 	Regexps []string `mapstructure:"regexps"`
+
+	// Per-storage settings
+	CacheMaxAge    *int     `mapstructure:"cacheMaxAge"`    // Overrides the server-wide setting
+	IgnorePatterns []string `mapstructure:"ignorePatterns"` // Glob patterns for files/directories to skip
+	Priority       int      `mapstructure:"priority"`       // Whose copy of a track is used, for the priority ID collision policy
+	IgnoreErrors   bool     `mapstructure:"ignoreErrors"`   // Start without this storage if it can't be loaded
+	ErrorPolicy    string   `mapstructure:"errorPolicy"`    // What to do about unreadable files: fail, skip or retry
+	Retries        int      `mapstructure:"retries"`        // How many times to retry, for the retry error policy
+	Concurrency    int      `mapstructure:"concurrency"`    // How many files to scan at once
+}
+
+// SmartPlaylistConfig is a playlist whose tracks are chosen by a rule; see catalog.SmartPlaylist.
+type SmartPlaylistConfig struct {
+	Name  string `mapstructure:"name"`
+	Rule  string `mapstructure:"rule"` // e.g.: genre = Jazz AND year < 1970
+	Sort  string `mapstructure:"sort"` // e.g.: added desc
+	Limit int    `mapstructure:"limit"`
+}
+
+// ScrobblerConfig is a user's account on a scrobbling service, which their plays are submitted to.
+type ScrobblerConfig struct {
+	User    string `mapstructure:"user"`    // Whose plays; empty if authentication is disabled
+	Type    string `mapstructure:"type"`    // listenbrainz, lastfm or librefm
+	BaseURL string `mapstructure:"baseUrl"` // Defaults to the service's own
+
+	Token string `mapstructure:"token"` // For listenbrainz
+
+	// For lastfm and librefm. A session key is fetched using the username
+	// and password, if there isn't one.
+	APIKey     string `mapstructure:"apiKey"`
+	Secret     string `mapstructure:"secret"`
+	SessionKey string `mapstructure:"sessionKey"`
+	Username   string `mapstructure:"username"`
+	Password   string `mapstructure:"password"`
+}
+
+// diskPath returns the path for a diskStorage, with ~ and environment variables expanded.
+func (css StorageServiceConfig) diskPath() string {
+	return expandPath(css.Path)
+}
+
+// storageName returns the name of the storage, which determines its ID.
+func (css StorageServiceConfig) storageName() string {
+	if css.Name != "" {
+		return css.Name
+	}
+	switch css.Type {
+	case "nullStorage":
+		return "null"
+	case "diskStorage":
+		if css.Path != "" {
+			return css.diskPath()
+		}
+	}
+	return css.Type
 }
 
 type Config struct {
-	Addr            string // Server IP + port
+	Addr            string   // Server IP + port
+	AdminAddr       string   // Admin server IP + port; the admin server is disabled if empty
+	BasePath        string   // Path prefix for all of the server's URLs, e.g.: /music; empty if none
+	TrustedProxies  []string // IP addresses and CIDR ranges of reverse proxies whose X-Forwarded-* headers are used
 	StorageServices []StorageServiceConfig
+	IDCollisions    string // What to do about tracks with the same ID in more than one storage: first, priority or namespace
+	MergeDuplicates bool   // Whether copies of the same track, e.g.: in different formats, are shown as one track
 	CacheMaxAge     int
+
+	SmartPlaylists     []SmartPlaylistConfig
+	SmartPlaylistsFile string // Where smart playlists added using the API are persisted; in-memory if empty
+
+	PlaysFile   string // Where the history of plays is persisted; in-memory if empty
+	RatingsFile string // Where the users' ratings and stars are persisted; in-memory if empty
+
+	Scrobblers            []ScrobblerConfig
+	ScrobbleQueueFile     string // Where listens waiting to be submitted are persisted; in-memory if empty
+	ScrobbleRetryInterval int    // How often to try submitting listens again, in seconds
+
+	Users         []auth.User  // If empty, authentication is disabled
+	Groups        []auth.Group // Groups of users, e.g.: for sharing storage allow-lists
+	UsersFile     string       // Optional file containing more users
+	SessionMaxAge int          // Session lifetime in seconds
+
+	Secret       string // For signing share links and API tokens; random if empty
+	DenylistFile string // Where revoked tokens are persisted; in-memory if empty
+
+	Log logging.Options
+
+	TLS TLSConfig // HTTPS settings
 }
 
-func setLoadConfigOptions() {
+// cacheMaxAgeFor returns how long track data from a storage may be cached by clients.
+func (config Config) cacheMaxAgeFor(storageServiceID string) int {
+	for _, css := range config.StorageServices {
+		if css.CacheMaxAge != nil && storage.NameToID(css.storageName()) == storageServiceID {
+			return *css.CacheMaxAge
+		}
+	}
+	return config.CacheMaxAge
+}
+
+// smartPlaylists returns the configured smart playlists.
+func (config Config) smartPlaylists() []catalog.SmartPlaylist {
+	playlists := make([]catalog.SmartPlaylist, 0, len(config.SmartPlaylists))
+	for _, spc := range config.SmartPlaylists {
+		playlists = append(playlists, catalog.SmartPlaylist{
+			Name:  spc.Name,
+			Rule:  spc.Rule,
+			Sort:  spc.Sort,
+			Limit: spc.Limit,
+		})
+	}
+	return playlists
+}
+
+// setLoadConfigOptions sets where the configuration is read from.
+// If configFile is empty, .minimediaserver.json, .minimediaserver.yaml
+// or .minimediaserver.toml is looked for in $HOME and then the current
+// directory. The type of the file is determined by its extension.
+func setLoadConfigOptions(configFile string) {
+	if configFile != "" {
+		viper.SetConfigFile(expandPath(configFile))
+		return
+	}
 	viper.SetConfigName(".minimediaserver")
-	viper.SetConfigType("json")
 	viper.AddConfigPath("$HOME")
 	viper.AddConfigPath(".")
 }
 
+// loadConfig reads the configuration. Settings are taken from, in order of precedence:
+//
+//  1. Command-line options, e.g.: --log-level, which are set in viper using viper.Set
+//  2. Environment variables, e.g.: MINIMEDIASERVER_LOG_LEVEL
+//  3. The configuration file
+//  4. Defaults
+//
+// The settings are checked against the schema before they are used.
 func loadConfig() (Config, error) {
 	// Set some defaults
 	viper.SetDefault("host", "127.0.0.1")
 	viper.SetDefault("port", "1323")
+	viper.SetDefault("adminhost", "127.0.0.1")
 	viper.SetDefault("cachemaxage", "3600")
+	viper.SetDefault("sessionmaxage", "604800") // 1 week
+	viper.SetDefault("scrobbleretryinterval", "300")
+	bindEnv()
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			// TODO: info log
-			fmt.Println("no configuration file found - using defaults")
+			slog.Info("No configuration file found - using defaults")
 		} else {
 			return Config{}, err
 		}
+	} else {
+		slog.Debug("Read configuration file", "file", viper.ConfigFileUsed())
+	}
+
+	settings := viper.AllSettings()
+	if err := applyEnvOverrides(settings, os.Environ()); err != nil {
+		return Config{}, err
+	}
+	if err := checkSettings(configSchema, settings); err != nil {
+		return Config{}, err
+	}
+
+	// Use the checked settings, including the overrides for lists.
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return Config{}, err
 	}
 
 	var config Config
 
 	// config.Addr
-	host := viper.GetString("host")
+	host := v.GetString("host")
 	if host == "*" {
 		host = ""
 	}
-	port := viper.GetString("port")
+	port := v.GetString("port")
 	config.Addr = host + ":" + port
 
+	// config.AdminAddr
+	if adminPort := v.GetString("adminport"); adminPort != "" {
+		adminHost := v.GetString("adminhost")
+		if adminHost == "*" {
+			adminHost = ""
+		}
+		config.AdminAddr = adminHost + ":" + adminPort
+	}
+
+	// config.BasePath, config.TrustedProxies
+	config.BasePath = cleanBasePath(v.GetString("basepath"))
+	config.TrustedProxies = v.GetStringSlice("trustedproxies")
+
 	// config.StorageServices
-	err := viper.UnmarshalKey("storageServices", &config.StorageServices)
+	err := v.UnmarshalKey("storageServices", &config.StorageServices)
 	if err != nil {
 		return Config{}, err
 	}
 
 	for _, css := range config.StorageServices {
-		fmt.Printf("%+v\n", css)
+		slog.Debug("Storage configuration", "config", fmt.Sprintf("%+v", css))
 	}
+	config.IDCollisions = v.GetString("idcollisions")
+	config.MergeDuplicates = v.GetBool("mergeduplicates")
 
 	// config.CacheMaxAge
-	config.CacheMaxAge = viper.GetInt("cachemaxage")
+	config.CacheMaxAge = v.GetInt("cachemaxage")
+
+	// config.SmartPlaylists, config.SmartPlaylistsFile
+	err = v.UnmarshalKey("smartPlaylists", &config.SmartPlaylists)
+	if err != nil {
+		return Config{}, err
+	}
+	config.SmartPlaylistsFile = expandPath(v.GetString("smartplaylistsfile"))
+
+	// config.PlaysFile, config.RatingsFile
+	config.PlaysFile = expandPath(v.GetString("playsfile"))
+	config.RatingsFile = expandPath(v.GetString("ratingsfile"))
+
+	// config.Scrobblers, config.ScrobbleQueueFile, config.ScrobbleRetryInterval
+	err = v.UnmarshalKey("scrobblers", &config.Scrobblers)
+	if err != nil {
+		return Config{}, err
+	}
+	config.ScrobbleQueueFile = expandPath(v.GetString("scrobblequeuefile"))
+	config.ScrobbleRetryInterval = v.GetInt("scrobbleretryinterval")
+
+	// config.Users
+	err = v.UnmarshalKey("users", &config.Users)
+	if err != nil {
+		return Config{}, err
+	}
+	config.UsersFile = expandPath(v.GetString("usersfile"))
+	if config.UsersFile != "" {
+		users, err := loadUsersFile(config.UsersFile)
+		if err != nil {
+			return Config{}, err
+		}
+		config.Users = append(config.Users, users...)
+	}
+	config.SessionMaxAge = v.GetInt("sessionmaxage")
+
+	// config.Groups
+	err = v.UnmarshalKey("groups", &config.Groups)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// config.Secret, config.DenylistFile
+	config.Secret = v.GetString("secret")
+	config.DenylistFile = expandPath(v.GetString("denylistfile"))
+
+	// config.TLS
+	err = v.UnmarshalKey("tls", &config.TLS)
+	if err != nil {
+		return Config{}, err
+	}
+	config.TLS.Cert = expandPath(config.TLS.Cert)
+	config.TLS.Key = expandPath(config.TLS.Key)
+	config.TLS.CacheDir = expandPath(config.TLS.CacheDir)
+	if redirectPort := v.GetString("tls.redirectport"); redirectPort != "" {
+		config.TLS.RedirectAddr = host + ":" + redirectPort
+	}
+
+	// config.Log
+	config.Log = logging.Options{
+		Level:      v.GetString("loglevel"),
+		Format:     v.GetString("logformat"),
+		File:       expandPath(v.GetString("logfile")),
+		MaxSize:    v.GetInt("logmaxsize"),
+		MaxBackups: v.GetInt("logmaxbackups"),
+	}
 
 	return config, nil
 }
 
-func buildCatalog(config Config) (catalog.CatalogService, error) {
-	catalogService, err := catalog.NewBasicCatalog()
+// loadUsersFile reads users from a separate file, so that password hashes
+// can be kept apart from the main configuration. The file has the same
+// format as the "users" section of the main configuration.
+func loadUsersFile(path string) ([]auth.User, error) {
+	path = expandPath(path)
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if err := checkSettings(usersFileSchema, v.AllSettings()); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var users []auth.User
+	if err := v.UnmarshalKey("users", &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func buildAuth(config Config) (auth.AuthService, error) {
+	secret := []byte(config.Secret)
+	if len(secret) == 0 {
+		slog.Warn("No secret configured - share links and API tokens will not work after a restart")
+		var err error
+		secret, err = auth.NewRandomSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	denylist, err := auth.NewDenylist(config.DenylistFile)
+	if err != nil {
+		return nil, err
+	}
+	tokenSigner, err := auth.NewTokenSigner(secret, denylist)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionMaxAge := time.Duration(config.SessionMaxAge) * time.Second
+	return auth.NewBasicAuth(config.Users, config.Groups, sessionMaxAge, tokenSigner)
+}
+
+// Build the history of plays, and the recorder which keeps the play counts from it.
+// If scrobbles isn't nil, the plays are also submitted to the users' scrobbling services.
+func buildPlays(config Config, scrobbles scrobble.ScrobbleService) (*playRecorder, *history.BasicHistory, error) {
+	historyService, err := history.NewBasicHistory(config.PlaysFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newPlayRecorder(historyService, scrobbles), historyService, nil
+}
+
+// Build the store of the users' ratings and stars.
+func buildRatings(config Config) (*ratings.BasicRatings, error) {
+	return ratings.NewBasicRatings(config.RatingsFile)
+}
+
+// Build the scrobbler for the users' scrobbling services; nil if there aren't any.
+func buildScrobbler(config Config) (scrobble.ScrobbleService, error) {
+	if len(config.Scrobblers) == 0 {
+		return nil, nil
+	}
+	clients := make(map[string][]scrobble.Client)
+	for _, sc := range config.Scrobblers {
+		clients[sc.User] = append(clients[sc.User], newScrobbleClient(sc))
+	}
+	queue, err := scrobble.NewQueue(config.ScrobbleQueueFile)
 	if err != nil {
 		return nil, err
 	}
+	return scrobble.NewBasicScrobbler(queue, clients)
+}
 
-	// Always provide at least one storage service.
+// A storage being loaded by loadStorages.
+type loadingStorage struct {
+	config StorageServiceConfig
+	ss     storage.StorageService
+	err    error
+}
+
+// Scan a storage, logging how long it took.
+func scanStorage(ss storage.StorageService) error {
+	start := time.Now()
+	tracks, playlists, err := ss.FindTracks()
+	if err != nil {
+		return err
+	}
+	slog.Info("Loaded storage", "storage", ss.GetName(), "duration", time.Since(start).Round(time.Millisecond),
+		"tracks", len(tracks), "playlists", len(playlists),
+		"ignored", ss.GetScanStats().Ignored, "problems", len(ss.GetScanReport()))
+	return nil
+}
+
+// storageConfigs returns the configured storages. There is always at least one.
+func (config Config) storageConfigs() []StorageServiceConfig {
 	if len(config.StorageServices) == 0 {
-		config.StorageServices = []StorageServiceConfig{
+		return []StorageServiceConfig{
 			{
 				Type: "nullStorage",
 			},
 		}
 	}
+	return config.StorageServices
+}
 
-	for _, css := range config.StorageServices {
-		var ss storage.StorageService
-		var err error
+// Check that each storage has a different name, since the names determine the storage IDs.
+func checkStorageNames(configs []StorageServiceConfig) error {
+	names := make(map[string]bool, 0)
+	for _, css := range configs {
+		name := css.storageName()
+		if names[name] {
+			return fmt.Errorf("storage name %s is used more than once", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
 
-		switch css.Type {
-		case "nullStorage":
-			ss, err = storage.NewNullStorage()
-		case "diskStorage":
-			path := css.Path
-			if path == "" {
-				path = "."
+// Create a storage from its configuration. The storage isn't scanned yet.
+func newStorage(css StorageServiceConfig) (storage.StorageService, error) {
+	var ss storage.StorageService
+	var err error
+
+	name := css.storageName()
+	options := storage.Options{
+		Name:           name,
+		IgnorePatterns: css.IgnorePatterns,
+		Priority:       css.Priority,
+		ErrorPolicy:    storage.ErrorPolicy(css.ErrorPolicy),
+		Retries:        css.Retries,
+		Concurrency:    css.Concurrency,
+	}
+
+	switch css.Type {
+	case "nullStorage":
+		ss, err = storage.NewNullStorage(options)
+	case "diskStorage":
+		if css.Path == "" {
+			err = errors.New("path is required for diskStorage")
+			break
+		}
+		ss, err = storage.NewDiskStorage(css.diskPath(), css.Regexps, options)
+	default:
+		err = fmt.Errorf("unknown storage service %s", css.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storage %s: %w", name, err)
+	}
+	return ss, nil
+}
+
+// validateConfig checks the parts of the configuration that the schema can't,
+// by creating the storages without scanning them. All the problems found are returned.
+func validateConfig(config Config) error {
+	errs := make([]error, 0)
+	if _, err := logging.ParseLevel(config.Log.Level); err != nil {
+		errs = append(errs, err)
+	}
+
+	configs := config.storageConfigs()
+	if err := checkStorageNames(configs); err != nil {
+		errs = append(errs, err)
+	}
+	for _, css := range configs {
+		// Storages that may be missing at start-up are only checked when scanned.
+		if _, err := newStorage(css); err != nil && !css.IgnoreErrors {
+			errs = append(errs, err)
+		}
+	}
+
+	names := make(map[string]bool, 0)
+	for _, sp := range config.smartPlaylists() {
+		if err := sp.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if names[sp.Name] {
+			errs = append(errs, fmt.Errorf("smart playlist name %s is used more than once", sp.Name))
+		}
+		names[sp.Name] = true
+	}
+
+	scrobblers := make(map[string]bool, 0)
+	for _, sc := range config.Scrobblers {
+		if len(config.Users) > 0 && !slices.ContainsFunc(config.Users, func(user auth.User) bool { return user.Name == sc.User }) {
+			errs = append(errs, fmt.Errorf("scrobbler for unknown user %q", sc.User))
+		}
+		key := sc.User + " " + newScrobbleClient(sc).Name()
+		if scrobblers[key] {
+			errs = append(errs, fmt.Errorf("scrobbler %s for user %q is configured more than once", newScrobbleClient(sc).Name(), sc.User))
+		}
+		scrobblers[key] = true
+	}
+	return errors.Join(errs...)
+}
+
+// Create and scan the configured storages. The storages are scanned concurrently.
+// Any errors are recorded against each storage.
+func loadStorages(configs []StorageServiceConfig) []*loadingStorage {
+	loading := make([]*loadingStorage, 0, len(configs))
+	for _, css := range configs {
+		ss, err := newStorage(css)
+		loading = append(loading, &loadingStorage{config: css, ss: ss, err: err})
+	}
+
+	var wg sync.WaitGroup
+	for _, ls := range loading {
+		if ls.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(ls *loadingStorage) {
+			defer wg.Done()
+			if err := scanStorage(ls.ss); err != nil {
+				ls.err = fmt.Errorf("storage %s: %w", ls.ss.GetName(), err)
 			}
-			path = strings.Replace(path, "$HOME", os.Getenv("HOME"), -1)
-			ss, err = storage.NewDiskStorage(path, css.Regexps)
-		default:
-			err = fmt.Errorf("unknown storage service %s", css.Type)
+		}(ls)
+	}
+	wg.Wait()
+
+	return loading
+}
+
+// warnCollisions logs a warning if storages have tracks or playlists with the same IDs,
+// e.g.: because their paths overlap. The details are in the admin ID collisions report.
+func warnCollisions(catalogService catalog.CatalogService) {
+	collisions := catalogService.GetCollisions()
+	if len(collisions) == 0 {
+		return
+	}
+	storages := make(map[string]bool, 0)
+	for _, collision := range collisions {
+		for _, c := range collision.Copies {
+			storages[c.StorageName] = true
 		}
-		if err != nil {
-			return nil, err
+	}
+	names := make([]string, 0, len(storages))
+	for name := range storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	slog.Warn("Some tracks or playlists are in more than one storage", "collisions", len(collisions), "storages", names)
+}
+
+// Build the catalog from the configured storages. The storages
+// are scanned concurrently, but added to the catalog in the order
+// they are configured.
+func buildCatalog(config Config) (catalog.CatalogService, error) {
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{
+		CollisionPolicy: catalog.CollisionPolicy(config.IDCollisions),
+		MergeDuplicates: config.MergeDuplicates,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The smart playlists are added first, so that they are chosen
+	// from the storages' tracks as soon as they are loaded.
+	if err := catalogService.ConfigureSmartPlaylists(config.smartPlaylists()); err != nil {
+		return nil, err
+	}
+	added, err := loadSmartPlaylists(config.SmartPlaylistsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range added {
+		if _, err := catalogService.AddSmartPlaylist(sp); err != nil {
+			return nil, fmt.Errorf("%s: %w", config.SmartPlaylistsFile, err)
 		}
+	}
 
-		err = catalogService.AddStorage(ss)
+	configs := config.storageConfigs()
+	if err := checkStorageNames(configs); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	for _, ls := range loadStorages(configs) {
+		err := ls.err
+		if err == nil {
+			// The storage's tracks have already been found, so this is quick.
+			err = catalogService.AddStorage(ls.ss)
+		}
 		if err != nil {
+			if ls.config.IgnoreErrors {
+				slog.Warn("Ignoring storage that could not be loaded", "error", err)
+				continue
+			}
 			return nil, err
 		}
 	}
+	slog.Info("Loaded storages", "storages", len(catalogService.GetStorages()), "duration", time.Since(start).Round(time.Millisecond))
+	warnCollisions(catalogService)
 
 	return catalogService, nil
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
 )
 
 func TestConfig(t *testing.T) {
@@ -27,7 +31,7 @@ func TestConfig(t *testing.T) {
 			Type: "nullStorage", Path: "/dev/null",
 		})
 		config.StorageServices = append(config.StorageServices, StorageServiceConfig{
-			Type: "diskStorage", Path: "",
+			Type: "diskStorage", Path: ".",
 		})
 
 		catalogService, err := buildCatalog(config)
@@ -35,6 +39,13 @@ func TestConfig(t *testing.T) {
 		require.NotNil(t, catalogService)
 	})
 
+	t.Run("Disk storage without a path", func(t *testing.T) {
+		noPath := config
+		noPath.StorageServices = []StorageServiceConfig{{Type: "diskStorage"}}
+		_, err := buildCatalog(noPath)
+		assert.EqualError(t, err, "storage diskStorage: path is required for diskStorage")
+	})
+
 	t.Run("Invalid storage service name", func(t *testing.T) {
 		config.StorageServices = append(config.StorageServices, StorageServiceConfig{
 			Type: "MEGASTORAGE!!!!1", Path: "/dev/urandom",
@@ -52,4 +63,81 @@ func TestConfig(t *testing.T) {
 		_, err := buildCatalog(config)
 		require.Error(t, err)
 	})
+
+	t.Run("Duplicate storage names", func(t *testing.T) {
+		config := Config{
+			StorageServices: []StorageServiceConfig{
+				{Type: "nullStorage", Name: "music"},
+				{Type: "diskStorage", Name: "music", Path: "../testdata/services/storage/diskstorage/Music/cds"},
+			},
+		}
+		_, err := buildCatalog(config)
+		require.Error(t, err)
+	})
+
+	t.Run("Ignore storage errors", func(t *testing.T) {
+		config := Config{
+			StorageServices: []StorageServiceConfig{
+				{Type: "nullStorage"},
+				{Type: "diskStorage", Path: "/dev/__DOES_NOT_EXIST__", IgnoreErrors: true},
+			},
+		}
+		catalogService, err := buildCatalog(config)
+		require.NoError(t, err)
+		require.Len(t, catalogService.GetStorages(), 1)
+		assert.Equal(t, "null", catalogService.GetStorages()[0].GetName())
+	})
+}
+
+func TestStorageSettings(t *testing.T) {
+	oneDay := 86400
+	config := Config{
+		CacheMaxAge: 3600,
+		StorageServices: []StorageServiceConfig{
+			{Type: "nullStorage", CacheMaxAge: &oneDay},
+			{Type: "diskStorage", Name: "cds", Path: "../testdata/services/storage/diskstorage/Music/cds", Concurrency: 2, Priority: 1},
+		},
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+
+	storages := catalogService.GetStorages()
+	require.Len(t, storages, 2)
+	assert.Equal(t, "null", storages[0].GetName())
+	assert.Equal(t, "cds", storages[1].GetName())
+	assert.Equal(t, storage.NameToID("cds"), storages[1].GetID())
+	assert.Equal(t, 2, storages[1].GetOptions().Concurrency)
+	assert.Equal(t, 1, storages[1].GetOptions().Priority)
+
+	assert.Equal(t, 86400, config.cacheMaxAgeFor(storages[0].GetID()))
+	assert.Equal(t, 3600, config.cacheMaxAgeFor(storages[1].GetID()))
+}
+
+func TestBuildCatalogConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile("../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track1-example.ogg")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "track.ogg"), data, 0o644))
+
+	// The storages are scanned at the same time, but should still
+	// end up in the catalog in the configured order.
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "music", Path: dir},
+			{Type: "diskStorage", Name: "missing", Path: "../testdata/__DOES_NOT_EXIST__", IgnoreErrors: true},
+			{Type: "nullStorage"},
+			{Type: "diskStorage", Name: "cds", Path: "../testdata/services/storage/diskstorage/Music/cds"},
+		},
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+
+	storages := catalogService.GetStorages()
+	require.Len(t, storages, 3)
+	assert.Equal(t, "music", storages[0].GetName())
+	assert.Equal(t, "null", storages[1].GetName())
+	assert.Equal(t, "cds", storages[2].GetName())
+
+	tracks, _ := catalogService.GetTracks()
+	assert.NotEmpty(t, tracks)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+// Settings can be overridden using environment variables, which is
+// handy when running in a container. The variable for a setting is its
+// name in upper case, with words separated by underscores, prefixed by
+// MINIMEDIASERVER_. E.g.: logLevel is MINIMEDIASERVER_LOG_LEVEL,
+// and tls.cert is MINIMEDIASERVER_TLS_CERT.
+//
+// Settings in lists of objects include the index of the object.
+// E.g.: MINIMEDIASERVER_STORAGE_SERVICES_0_PATH is the path
+// for the first storage. A storage can be added by using the next index.
+
+const envPrefix = "MINIMEDIASERVER_"
+
+// envName returns the environment variable name for a setting.
+func envName(names ...string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, name := range names {
+		if i > 0 {
+			b.WriteRune('_')
+		}
+		for j, r := range name {
+			if unicode.IsUpper(r) && j > 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+func isScalar(s setting) bool {
+	return s.kind == kindString || s.kind == kindInt || s.kind == kindBool
+}
+
+// bindEnv makes viper look up the settings in the environment,
+// except for the settings in lists of objects.
+func bindEnv() {
+	for _, s := range configSchema {
+		// BindEnv only fails if no key is given.
+		switch {
+		case isScalar(s):
+			_ = viper.BindEnv(strings.ToLower(s.name), envName(s.name))
+		case s.kind == kindObject:
+			for _, field := range s.fields {
+				if isScalar(field) {
+					_ = viper.BindEnv(strings.ToLower(s.name+"."+field.name), envName(s.name, field.name))
+				}
+			}
+		}
+	}
+}
+
+// applyEnvOverrides sets the settings in lists of objects from the environment,
+// e.g.: MINIMEDIASERVER_STORAGE_SERVICES_0_PATH. Environment variables that
+// don't match a setting are reported as problems, to catch typos.
+func applyEnvOverrides(settings map[string]any, environ []string) error {
+	problems := make(configProblems, 0)
+
+	for _, env := range environ {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		if !applyEnvOverride(settings, name, value) {
+			problems.add(name, "environment variable doesn't match any setting")
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// applyEnvOverride applies one environment variable, returning false if it isn't for a known setting.
+func applyEnvOverride(settings map[string]any, name string, value string) bool {
+	for _, s := range configSchema {
+		if isScalar(s) && name == envName(s.name) {
+			// Already looked up by viper.
+			return true
+		}
+		if s.kind == kindObject {
+			for _, field := range s.fields {
+				if isScalar(field) && name == envName(s.name, field.name) {
+					return true
+				}
+			}
+		}
+		if s.kind != kindObjects || !strings.HasPrefix(name, envName(s.name)+"_") {
+			continue
+		}
+
+		indexAndField := strings.TrimPrefix(name, envName(s.name)+"_")
+		indexString, fieldName, ok := strings.Cut(indexAndField, "_")
+		if !ok {
+			return false
+		}
+		index, err := strconv.Atoi(indexString)
+		if err != nil || index < 0 {
+			return false
+		}
+		i := slices.IndexFunc(s.fields, func(field setting) bool {
+			return isScalar(field) && envName(field.name) == envPrefix+fieldName
+		})
+		if i == -1 {
+			return false
+		}
+
+		key := strings.ToLower(s.name)
+		objects, _ := settings[key].([]any)
+		for len(objects) <= index {
+			objects = append(objects, map[string]any{})
+		}
+		object, ok := objects[index].(map[string]any)
+		if !ok {
+			// Leave it for the schema check to complain about.
+			return true
+		}
+		object = lowerKeys(object)
+		object[strings.ToLower(s.fields[i].name)] = value
+		objects[index] = object
+		settings[key] = objects
+		return true
+	}
+	return false
+}
+
+// expandPath expands ~ at the start of a path to the home directory,
+// and environment variables like $HOME or ${MUSIC_DIR} anywhere in it.
+// References to variables that aren't set are left alone, so that
+// they show up in error messages.
+func expandPath(path string) string {
+	path = os.Expand(path, func(name string) string {
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		return fmt.Sprintf("${%s}", name)
+	})
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + path[1:]
+		}
+	}
+	return path
+}
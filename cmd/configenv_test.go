@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "MINIMEDIASERVER_PORT", envName("port"))
+	assert.Equal(t, "MINIMEDIASERVER_LOG_LEVEL", envName("logLevel"))
+	assert.Equal(t, "MINIMEDIASERVER_STORAGE_SERVICES_0_CACHE_MAX_AGE", envName("storageServices", "0", "cacheMaxAge"))
+	assert.Equal(t, "MINIMEDIASERVER_TLS_HSTS_MAX_AGE", envName("tls", "hstsMaxAge"))
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	settings := map[string]any{
+		"storageservices": []any{
+			map[string]any{"type": "diskStorage", "path": "/music"},
+		},
+	}
+
+	err := applyEnvOverrides(settings, []string{
+		"HOME=/home/fred",
+		"MINIMEDIASERVER_LOG_LEVEL=debug",
+		"MINIMEDIASERVER_STORAGE_SERVICES_0_PATH=/mnt/music",
+		"MINIMEDIASERVER_STORAGE_SERVICES_1_TYPE=nullStorage",
+		"MINIMEDIASERVER_USERS_0_NAME=fred",
+		"MINIMEDIASERVER_TLS_SELF_SIGNED=true",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"storageservices": []any{
+			map[string]any{"type": "diskStorage", "path": "/mnt/music"},
+			map[string]any{"type": "nullStorage"},
+		},
+		"users": []any{
+			map[string]any{"name": "fred"},
+		},
+	}, settings)
+
+	err = applyEnvOverrides(settings, []string{
+		"MINIMEDIASERVER_LOGLEVEL=debug",
+		"MINIMEDIASERVER_STORAGE_SERVICES_PATH=/mnt/music",
+		"MINIMEDIASERVER_STORAGE_SERVICES_0_REGEXPS=(?P<title>.+)",
+	})
+	var problems configProblems
+	require.ErrorAs(t, err, &problems)
+	assert.Len(t, problems, 3)
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Setenv("HOME", "/home/fred")
+	t.Setenv("MUSIC_DIR", "/mnt/music")
+
+	assert.Equal(t, "/home/fred/Music", expandPath("$HOME/Music"))
+	assert.Equal(t, "/home/fred/Music", expandPath("~/Music"))
+	assert.Equal(t, "/home/fred", expandPath("~"))
+	assert.Equal(t, "/mnt/music/cds", expandPath("${MUSIC_DIR}/cds"))
+	assert.Equal(t, "${__NOT_SET__}/cds", expandPath("${__NOT_SET__}/cds"))
+	assert.Equal(t, "/music/~fred", expandPath("/music/~fred"))
+	assert.Equal(t, "", expandPath(""))
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	cdsPath, err := filepath.Abs("../testdata/services/storage/diskstorage/Music/cds")
+	require.NoError(t, err)
+
+	configs := map[string]string{
+		"minimediaserver.json": `{
+			"port": "1337",
+			"storageServices": [{"type": "diskStorage", "name": "cds", "path": "${CDS_PATH}", "ignoreErrors": true}],
+			"logLevel": "warn"
+		}`,
+		"minimediaserver.yaml": `
+port: 1337
+storageServices:
+  - type: diskStorage
+    name: cds
+    path: ${CDS_PATH}
+    ignoreErrors: true
+logLevel: warn
+`,
+		"minimediaserver.toml": `
+port = 1337
+logLevel = "warn"
+
+[[storageServices]]
+type = "diskStorage"
+name = "cds"
+path = "${CDS_PATH}"
+ignoreErrors = true
+`,
+	}
+
+	for name, contents := range configs {
+		t.Run(name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			t.Setenv("CDS_PATH", cdsPath)
+			configFile := filepath.Join(t.TempDir(), name)
+			require.NoError(t, os.WriteFile(configFile, []byte(contents), 0o644))
+			setLoadConfigOptions(configFile)
+
+			config, err := loadConfig()
+			require.NoError(t, err)
+			assert.Equal(t, "127.0.0.1:1337", config.Addr)
+			assert.Equal(t, "warn", config.Log.Level)
+			require.Len(t, config.StorageServices, 1)
+			assert.Equal(t, cdsPath, config.StorageServices[0].diskPath())
+			assert.True(t, config.StorageServices[0].IgnoreErrors)
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	cdsPath := "../testdata/services/storage/diskstorage/Music/cds"
+	configFile := filepath.Join(t.TempDir(), "minimediaserver.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+host: "*"
+port: 1337
+cacheMaxAge: 60
+logLevel: warn
+storageServices:
+  - type: nullStorage
+`), 0o644))
+	setLoadConfigOptions(configFile)
+
+	// Environment variables override the file, which overrides the defaults.
+	t.Setenv("MINIMEDIASERVER_PORT", "8080")
+	t.Setenv("MINIMEDIASERVER_LOG_LEVEL", "info")
+	t.Setenv("MINIMEDIASERVER_STORAGE_SERVICES_1_TYPE", "diskStorage")
+	t.Setenv("MINIMEDIASERVER_STORAGE_SERVICES_1_PATH", cdsPath)
+	t.Setenv("MINIMEDIASERVER_STORAGE_SERVICES_1_IGNORE_ERRORS", "true")
+	config, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", config.Addr)
+	assert.Equal(t, 60, config.CacheMaxAge)
+	assert.Equal(t, 604800, config.SessionMaxAge)
+	assert.Equal(t, "info", config.Log.Level)
+	assert.Equal(t, []StorageServiceConfig{
+		{Type: "nullStorage"},
+		{Type: "diskStorage", Path: cdsPath, IgnoreErrors: true},
+	}, config.StorageServices)
+
+	// Settings in objects can be overridden too.
+	t.Setenv("MINIMEDIASERVER_TLS_SELF_SIGNED", "true")
+	t.Setenv("MINIMEDIASERVER_TLS_CACHE_DIR", "~/.cache/mms")
+	t.Setenv("MINIMEDIASERVER_TLS_REDIRECT_PORT", "8000")
+	config, err = loadConfig()
+	require.NoError(t, err)
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	assert.Equal(t, TLSConfig{SelfSigned: true, CacheDir: home + "/.cache/mms", RedirectAddr: ":8000"}, config.TLS)
+
+	// Command-line options override everything.
+	viper.Set("loglevel", "debug")
+	config, err = loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "debug", config.Log.Level)
+
+	// Overrides are checked like everything else.
+	t.Setenv("MINIMEDIASERVER_PORT", "http")
+	_, err = loadConfig()
+	assert.ErrorContains(t, err, "port: must be an integer")
+	t.Setenv("MINIMEDIASERVER_PORT", "8080")
+
+	t.Setenv("MINIMEDIASERVER_LOGLEVEL", "debug")
+	_, err = loadConfig()
+	assert.ErrorContains(t, err, "MINIMEDIASERVER_LOGLEVEL: environment variable doesn't match any setting")
+}
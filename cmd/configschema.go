@@ -0,0 +1,612 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/richdawe/minimediaserver/internal/logging"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// The configuration file is checked against a schema before it is used,
+// so that typos and bad values are reported with the key they are for,
+// rather than being ignored or causing a confusing error later on.
+
+// The types of value a setting can have.
+type settingKind int
+
+const (
+	kindString  settingKind = iota
+	kindInt                 // Also accepts a string containing an integer, e.g.: "port": "1337"
+	kindBool                // Also accepts "true" or "false"
+	kindStrings             // A list of strings
+	kindObjects             // A list of objects, each described by the setting's fields
+	kindObject              // An object, described by the setting's fields
+)
+
+func (k settingKind) String() string {
+	switch k {
+	case kindString:
+		return "a string"
+	case kindInt:
+		return "an integer"
+	case kindBool:
+		return "true or false"
+	case kindStrings:
+		return "a list of strings"
+	case kindObjects:
+		return "a list of objects"
+	case kindObject:
+		return "an object"
+	}
+	return "unknown"
+}
+
+// A setting in the configuration file.
+type setting struct {
+	name   string // As written in the documentation; keys are matched case-insensitively
+	kind   settingKind
+	fields []setting // For kindObjects
+
+	// Optional extra checks, for a value of the right kind,
+	// and for an object or each object in a list of objects.
+	check       func(value any) error
+	checkObject func(path string, object map[string]any, problems *configProblems)
+}
+
+// A problem with a setting, e.g.: storageServices[1].type
+type configProblem struct {
+	path    string
+	message string
+}
+
+// configProblems is all the problems found in the configuration.
+type configProblems []configProblem
+
+func (p *configProblems) add(path string, format string, args ...any) {
+	*p = append(*p, configProblem{path: path, message: fmt.Sprintf(format, args...)})
+}
+
+func (p configProblems) Error() string {
+	lines := make([]string, 0, len(p))
+	for _, problem := range p {
+		lines = append(lines, problem.path+": "+problem.message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func oneOf(values ...string) func(value any) error {
+	return func(value any) error {
+		s := value.(string)
+		if slices.Contains(values, s) {
+			return nil
+		}
+		for _, v := range values {
+			if strings.EqualFold(s, v) {
+				return fmt.Errorf("unknown value %q (did you mean %q?)", s, v)
+			}
+		}
+		return fmt.Errorf("unknown value %q, expected one of %s", s, strings.Join(values, ", "))
+	}
+}
+
+func atLeast(min int) func(value any) error {
+	return func(value any) error {
+		if n, _ := toInt(value); n < min {
+			return fmt.Errorf("must be at least %d", min)
+		}
+		return nil
+	}
+}
+
+func isPort(value any) error {
+	if n, _ := toInt(value); n < 1 || n > 65535 {
+		return fmt.Errorf("%v is not a valid port number", value)
+	}
+	return nil
+}
+
+func isLogLevel(value any) error {
+	_, err := logging.ParseLevel(value.(string))
+	return err
+}
+
+func isLogFormat(value any) error {
+	switch strings.ToLower(value.(string)) {
+	case "", logging.FormatText, logging.FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown value %q, expected one of %s, %s", value, logging.FormatText, logging.FormatJSON)
+}
+
+func isGlob(value any) error {
+	_, err := filepath.Match(value.(string), "")
+	return err
+}
+
+func isBasePath(value any) error {
+	basePath := value.(string)
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		return fmt.Errorf("must start with /")
+	}
+	if strings.ContainsAny(basePath, "?#") || strings.Contains(basePath, "//") || strings.Contains(basePath, ":") {
+		return fmt.Errorf("must be a path, e.g.: /music")
+	}
+	return nil
+}
+
+func isTrustedProxy(value any) error {
+	_, err := parseTrustedProxies([]string{value.(string)})
+	return err
+}
+
+func isRegexp(value any) error {
+	_, err := storage.CompileRegexp(value.(string))
+	return err
+}
+
+// The settings for each type of storage, in addition to the common ones.
+var storageTypeSettings = map[string][]string{
+	"nullStorage": {},
+	"diskStorage": {"path", "regexps"},
+}
+
+// Checks which depend on the type of storage.
+func checkStorageService(path string, object map[string]any, problems *configProblems) {
+	storageType, ok := object["type"].(string)
+	if !ok {
+		if _, found := object["type"]; !found {
+			problems.add(path, "type is required")
+		}
+		return
+	}
+	typeSettings, ok := storageTypeSettings[storageType]
+	if !ok {
+		// Already reported by the check on the type setting.
+		return
+	}
+	for _, name := range []string{"path", "regexps"} {
+		if _, found := object[strings.ToLower(name)]; found && !slices.Contains(typeSettings, name) {
+			problems.add(path+"."+name, "not used by %s", storageType)
+		}
+	}
+
+	if storageType == "diskStorage" {
+		diskPath, ok := object["path"].(string)
+		if !ok {
+			if _, found := object["path"]; !found {
+				problems.add(path, "path is required for diskStorage")
+			}
+			return
+		}
+		// Storages that may be missing when the server starts are only checked when they are scanned.
+		if ignoreErrors, _ := toBool(object["ignoreerrors"]); ignoreErrors {
+			return
+		}
+		css := StorageServiceConfig{Path: diskPath}
+		fileinfo, err := os.Stat(css.diskPath())
+		if err != nil {
+			problems.add(path+".path", "%v", err)
+		} else if !fileinfo.IsDir() {
+			problems.add(path+".path", "%s is not a directory", css.diskPath())
+		}
+	}
+}
+
+var storageServiceSettings = []setting{
+	{name: "type", kind: kindString, check: oneOf("nullStorage", "diskStorage")},
+	{name: "name", kind: kindString},
+	{name: "path", kind: kindString},
+	{name: "regexps", kind: kindStrings, check: isRegexp},
+	{name: "cacheMaxAge", kind: kindInt, check: atLeast(0)},
+	{name: "ignorePatterns", kind: kindStrings, check: isGlob},
+	{name: "priority", kind: kindInt},
+	{name: "ignoreErrors", kind: kindBool},
+	{name: "errorPolicy", kind: kindString, check: oneOf(string(storage.ErrorPolicySkip), string(storage.ErrorPolicyRetry), string(storage.ErrorPolicyFail))},
+	{name: "retries", kind: kindInt, check: atLeast(0)},
+	{name: "concurrency", kind: kindInt, check: atLeast(0)},
+}
+
+func requireFields(names ...string) func(path string, object map[string]any, problems *configProblems) {
+	return func(path string, object map[string]any, problems *configProblems) {
+		for _, name := range names {
+			if _, found := object[strings.ToLower(name)]; !found {
+				problems.add(path, "%s is required", name)
+			}
+		}
+	}
+}
+
+func isRule(value any) error {
+	_, err := catalog.ParseRule(value.(string))
+	return err
+}
+
+func isSortOrder(value any) error {
+	_, err := catalog.ParseSortOrder(value.(string))
+	return err
+}
+
+var smartPlaylistSettings = []setting{
+	{name: "name", kind: kindString},
+	{name: "rule", kind: kindString, check: isRule},
+	{name: "sort", kind: kindString, check: isSortOrder},
+	{name: "limit", kind: kindInt, check: atLeast(0)},
+}
+
+func isURL(value any) error {
+	u, err := url.Parse(value.(string))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL, e.g.: https://example.com/api")
+	}
+	return nil
+}
+
+// The settings for each type of scrobbler, in addition to the common ones.
+var scrobblerTypeSettings = map[string][]string{
+	"listenbrainz": {"token"},
+	"lastfm":       {"apiKey", "secret", "sessionKey", "username", "password"},
+	"librefm":      {"apiKey", "secret", "sessionKey", "username", "password"},
+}
+
+// Checks which depend on the type of scrobbler.
+func checkScrobbler(path string, object map[string]any, problems *configProblems) {
+	requireFields("type")(path, object, problems)
+	scrobblerType, _ := object["type"].(string)
+	typeSettings, ok := scrobblerTypeSettings[scrobblerType]
+	if !ok {
+		// Already reported by the check on the type setting.
+		return
+	}
+	isSet := func(name string) bool {
+		value, found := object[strings.ToLower(name)]
+		return found && value != ""
+	}
+	for _, name := range []string{"token", "apiKey", "secret", "sessionKey", "username", "password"} {
+		if isSet(name) && !slices.Contains(typeSettings, name) {
+			problems.add(path+"."+name, "not used by %s", scrobblerType)
+		}
+	}
+
+	if scrobblerType == "listenbrainz" {
+		requireFields("token")(path, object, problems)
+		return
+	}
+	requireFields("apiKey", "secret")(path, object, problems)
+	if !isSet("sessionKey") && (!isSet("username") || !isSet("password")) {
+		problems.add(path, "sessionKey, or username and password, are required")
+	}
+}
+
+var scrobblerSettings = []setting{
+	{name: "user", kind: kindString},
+	{name: "type", kind: kindString, check: oneOf("listenbrainz", "lastfm", "librefm")},
+	{name: "baseUrl", kind: kindString, check: isURL},
+	{name: "token", kind: kindString},
+	{name: "apiKey", kind: kindString},
+	{name: "secret", kind: kindString},
+	{name: "sessionKey", kind: kindString},
+	{name: "username", kind: kindString},
+	{name: "password", kind: kindString},
+}
+
+var userSettings = []setting{
+	{name: "name", kind: kindString},
+	{name: "passwordHash", kind: kindString},
+	{name: "admin", kind: kindBool},
+	{name: "storages", kind: kindStrings},
+	{name: "groups", kind: kindStrings},
+}
+
+var groupSettings = []setting{
+	{name: "name", kind: kindString},
+	{name: "storages", kind: kindStrings},
+}
+
+// Checks for combinations of the HTTPS settings.
+func checkTLS(path string, object map[string]any, problems *configProblems) {
+	isSet := func(name string) bool {
+		value, found := object[strings.ToLower(name)]
+		if !found || value == nil || value == "" {
+			return false
+		}
+		if b, ok := toBool(value); ok && !b {
+			return false
+		}
+		if list, ok := value.([]any); ok && len(list) == 0 {
+			return false
+		}
+		return true
+	}
+
+	if isSet("cert") != isSet("key") {
+		problems.add(path, "cert and key must be set together")
+	}
+	if isSet("autocertDomains") && (isSet("cert") || isSet("selfSigned")) {
+		problems.add(path+".autocertDomains", "can't be used with cert or selfSigned")
+	}
+	enabled := isSet("cert") || isSet("selfSigned") || isSet("autocertDomains")
+	for _, name := range []string{"redirectPort", "hstsMaxAge", "autocertEmail", "autocertDirectoryUrl"} {
+		if isSet(name) && !enabled {
+			problems.add(path+"."+name, "only used with HTTPS; set cert and key, selfSigned or autocertDomains")
+		}
+	}
+
+	// A self-signed certificate is generated if the files don't exist.
+	if isSet("selfSigned") {
+		return
+	}
+	for _, name := range []string{"cert", "key"} {
+		if file, ok := object[name].(string); ok && file != "" {
+			if _, err := os.Stat(expandPath(file)); err != nil {
+				problems.add(path+"."+name, "%v", err)
+			}
+		}
+	}
+}
+
+var tlsSettings = []setting{
+	{name: "cert", kind: kindString},
+	{name: "key", kind: kindString},
+	{name: "selfSigned", kind: kindBool},
+	{name: "cacheDir", kind: kindString},
+	{name: "autocertDomains", kind: kindStrings},
+	{name: "autocertEmail", kind: kindString},
+	{name: "autocertDirectoryUrl", kind: kindString},
+	{name: "redirectPort", kind: kindInt, check: isPort},
+	{name: "hstsMaxAge", kind: kindInt, check: atLeast(0)},
+}
+
+// The schema for the whole configuration file.
+var configSchema = []setting{
+	{name: "host", kind: kindString},
+	{name: "port", kind: kindInt, check: isPort},
+	{name: "adminHost", kind: kindString},
+	{name: "adminPort", kind: kindInt, check: isPort},
+	{name: "basePath", kind: kindString, check: isBasePath},
+	{name: "trustedProxies", kind: kindStrings, check: isTrustedProxy},
+	{name: "storageServices", kind: kindObjects, fields: storageServiceSettings, checkObject: checkStorageService},
+	{name: "idCollisions", kind: kindString, check: oneOf(string(catalog.CollisionPolicyFirst), string(catalog.CollisionPolicyPriority), string(catalog.CollisionPolicyNamespace))},
+	{name: "mergeDuplicates", kind: kindBool},
+	{name: "cacheMaxAge", kind: kindInt, check: atLeast(0)},
+	{name: "smartPlaylists", kind: kindObjects, fields: smartPlaylistSettings, checkObject: requireFields("name")},
+	{name: "smartPlaylistsFile", kind: kindString},
+	{name: "playsFile", kind: kindString},
+	{name: "ratingsFile", kind: kindString},
+	{name: "scrobblers", kind: kindObjects, fields: scrobblerSettings, checkObject: checkScrobbler},
+	{name: "scrobbleQueueFile", kind: kindString},
+	{name: "scrobbleRetryInterval", kind: kindInt, check: atLeast(1)},
+	{name: "users", kind: kindObjects, fields: userSettings, checkObject: requireFields("name", "passwordHash")},
+	{name: "groups", kind: kindObjects, fields: groupSettings, checkObject: requireFields("name")},
+	{name: "usersFile", kind: kindString},
+	{name: "sessionMaxAge", kind: kindInt, check: atLeast(1)},
+	{name: "secret", kind: kindString},
+	{name: "denylistFile", kind: kindString},
+	{name: "logLevel", kind: kindString, check: isLogLevel},
+	{name: "logFormat", kind: kindString, check: isLogFormat},
+	{name: "logFile", kind: kindString},
+	{name: "logMaxSize", kind: kindInt, check: atLeast(0)},
+	{name: "logMaxBackups", kind: kindInt, check: atLeast(0)},
+	{name: "tls", kind: kindObject, fields: tlsSettings, checkObject: checkTLS},
+}
+
+// The schema for a separate users file.
+var usersFileSchema = []setting{
+	{name: "users", kind: kindObjects, fields: userSettings, checkObject: requireFields("name", "passwordHash")},
+}
+
+func toInt(value any) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func toBool(value any) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, true
+		}
+	}
+	return false, false
+}
+
+// The distance between two strings, counting swapped letters as one edit,
+// for suggesting the right name for a misspelt setting.
+func editDistance(a string, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// unknownSetting describes an unknown setting, suggesting the closest known one.
+func unknownSetting(settings []setting, key string) string {
+	key = strings.ToLower(key)
+	suggestion := ""
+	best := 3 // Only suggest names that are close
+	for _, s := range settings {
+		name := strings.ToLower(s.name)
+		distance := editDistance(name, key)
+		if len(key) >= 4 && (strings.HasPrefix(name, key) || strings.HasPrefix(key, name)) {
+			distance = min(distance, 1)
+		}
+		if distance < best {
+			suggestion, best = s.name, distance
+		}
+	}
+	if suggestion != "" {
+		return fmt.Sprintf("unknown setting (did you mean %s?)", suggestion)
+	}
+	return "unknown setting"
+}
+
+// Check a value against its setting.
+func checkValue(s setting, path string, value any, problems *configProblems) {
+	checkOne := func(path string, value any) {
+		if s.check == nil {
+			return
+		}
+		if err := s.check(value); err != nil {
+			problems.add(path, "%v", err)
+		}
+	}
+
+	switch s.kind {
+	case kindString:
+		if _, ok := value.(string); !ok {
+			problems.add(path, "must be %s", s.kind)
+			return
+		}
+		checkOne(path, value)
+	case kindInt:
+		if _, ok := toInt(value); !ok {
+			problems.add(path, "must be %s", s.kind)
+			return
+		}
+		checkOne(path, value)
+	case kindBool:
+		if _, ok := toBool(value); !ok {
+			problems.add(path, "must be %s", s.kind)
+			return
+		}
+		checkOne(path, value)
+	case kindStrings:
+		values, ok := value.([]any)
+		if !ok {
+			problems.add(path, "must be %s", s.kind)
+			return
+		}
+		for i, v := range values {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if _, ok := v.(string); !ok {
+				problems.add(itemPath, "must be a string")
+				continue
+			}
+			checkOne(itemPath, v)
+		}
+	case kindObject:
+		object, ok := value.(map[string]any)
+		if !ok {
+			problems.add(path, "must be %s", s.kind)
+			return
+		}
+		object = lowerKeys(object)
+		checkObject(s.fields, path, object, problems)
+		if s.checkObject != nil {
+			s.checkObject(path, object, problems)
+		}
+	case kindObjects:
+		values, ok := value.([]any)
+		if !ok {
+			problems.add(path, "must be %s", s.kind)
+			return
+		}
+		for i, v := range values {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			object, ok := v.(map[string]any)
+			if !ok {
+				problems.add(itemPath, "must be an object")
+				continue
+			}
+			object = lowerKeys(object)
+			checkObject(s.fields, itemPath, object, problems)
+			if s.checkObject != nil {
+				s.checkObject(itemPath, object, problems)
+			}
+		}
+	}
+}
+
+// Check the settings in an object against the schema for it.
+func checkObject(settings []setting, path string, object map[string]any, problems *configProblems) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	// Report problems in the order of the schema, then any unknown settings,
+	// so that the output is the same every time.
+	for _, s := range settings {
+		value, found := object[strings.ToLower(s.name)]
+		if !found || value == nil {
+			continue
+		}
+		checkValue(s, joinPath(path, s.name), value, problems)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		known := false
+		for _, s := range settings {
+			if strings.EqualFold(s.name, key) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			problems.add(joinPath(path, key), "%s", unknownSetting(settings, key))
+		}
+	}
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func lowerKeys(object map[string]any) map[string]any {
+	lowered := make(map[string]any, len(object))
+	for key, value := range object {
+		lowered[strings.ToLower(key)] = value
+	}
+	return lowered
+}
+
+// checkSettings checks the settings read from a configuration file
+// against its schema. All the problems found are returned, or nil.
+func checkSettings(schema []setting, settings map[string]any) error {
+	problems := make(configProblems, 0)
+	checkObject(schema, "", lowerKeys(settings), &problems)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSettings(t *testing.T) {
+	cdsPath := "../testdata/services/storage/diskstorage/Music/cds"
+
+	check := func(t *testing.T, config string) error {
+		var settings map[string]any
+		require.NoError(t, json.Unmarshal([]byte(config), &settings))
+		return checkSettings(configSchema, settings)
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		err := check(t, `{
+			"host": "*",
+			"port": "1337",
+			"adminPort": 9090,
+			"basePath": "/music/",
+			"trustedProxies": ["127.0.0.1", "10.0.0.0/8", "::1"],
+			"storageServices": [
+				{"type": "nullStorage"},
+				{
+					"type": "diskStorage",
+					"name": "cds",
+					"path": "`+cdsPath+`",
+					"regexps": ["(?P<artist>.+) - (?P<album>.+) \\((?P<trackno>\\d+)\\) - (?P<title>.+)"],
+					"ignorePatterns": ["*.m3u"],
+					"ignoreErrors": true,
+					"errorPolicy": "retry",
+					"retries": 2,
+					"cacheMaxAge": 86400
+				},
+				{"type": "diskStorage", "path": "/dev/__DOES_NOT_EXIST__", "ignoreErrors": true}
+			],
+			"users": [{"name": "fred", "passwordHash": "$2a$10$...", "admin": true, "storages": ["cds"]}],
+			"groups": [{"name": "family", "storages": ["cds"]}],
+			"LogLevel": "DEBUG",
+			"logFormat": "json",
+			"tls": {"selfSigned": true, "cacheDir": "/var/cache/minimediaserver", "redirectPort": 8080, "hstsMaxAge": 31536000}
+		}`)
+		assert.NoError(t, err)
+	})
+
+	tests := []struct {
+		name     string
+		config   string
+		problems []string
+	}{
+		{
+			name:     "UnknownSettings",
+			config:   `{"prot": 1337, "storageServices": [{"type": "nullStorage", "frobnicate": true}]}`,
+			problems: []string{"storageServices[0].frobnicate: unknown setting", "prot: unknown setting (did you mean port?)"},
+		},
+		{
+			name:     "WrongTypes",
+			config:   `{"port": "http", "cacheMaxAge": 1.5, "storageServices": {"type": "nullStorage"}, "secret": 42}`,
+			problems: []string{"port: must be an integer", "storageServices: must be a list of objects", "cacheMaxAge: must be an integer", "secret: must be a string"},
+		},
+		{
+			name:     "BadValues",
+			config:   `{"port": 70000, "sessionMaxAge": 0, "logFormat": "xml"}`,
+			problems: []string{"port: 70000 is not a valid port number", "sessionMaxAge: must be at least 1", `logFormat: unknown value "xml", expected one of text, json`},
+		},
+		{
+			name:     "StorageType",
+			config:   `{"storageServices": [{"type": "diskstorage", "path": "/"}, {"name": "music"}]}`,
+			problems: []string{`storageServices[0].type: unknown value "diskstorage" (did you mean "diskStorage"?)`, "storageServices[1]: type is required"},
+		},
+		{
+			name: "StorageFields",
+			config: `{"storageServices": [
+				{"type": "nullStorage", "path": "/"},
+				{"type": "diskStorage"},
+				{"type": "diskStorage", "path": "/dev/__DOES_NOT_EXIST__"},
+				{"type": "diskStorage", "path": "` + cdsPath + `/Artist/Album1/example.txt"},
+				{"type": "diskStorage", "path": "/", "ignoreErrors": "yes", "errorPolicy": "ignore", "concurrency": -1}
+			]}`,
+			problems: []string{
+				"storageServices[0].path: not used by nullStorage",
+				"storageServices[1]: path is required for diskStorage",
+				"storageServices[2].path: stat /dev/__DOES_NOT_EXIST__: no such file or directory",
+				"storageServices[3].path: " + cdsPath + "/Artist/Album1/example.txt is not a directory",
+				"storageServices[4].ignoreErrors: must be true or false",
+				`storageServices[4].errorPolicy: unknown value "ignore", expected one of skip, retry, fail`,
+				"storageServices[4].concurrency: must be at least 0",
+			},
+		},
+		{
+			name: "Regexps",
+			config: `{"storageServices": [{"type": "diskStorage", "path": "/", "regexps": [
+				"(?P<artist>.+) - (?P<title>.+)",
+				"(?P<incomplete",
+				"(?P<year>.+) - (?P<tilte>.+)",
+				"(.+) - (.+)",
+				42
+			], "ignorePatterns": ["[unterminated"]}]}`,
+			problems: []string{
+				"storageServices[0].regexps[1]: error parsing regexp: invalid named capture: `(?P<incomplete`",
+				"storageServices[0].regexps[2]: regexp (?P<year>.+) - (?P<tilte>.+): no recognised named groups, expected one or more of albumartist, album, trackno, artist, title",
+				"storageServices[0].regexps[3]: regexp (.+) - (.+): no named groups, expected one or more of albumartist, album, trackno, artist, title",
+				"storageServices[0].regexps[4]: must be a string",
+				"storageServices[0].ignorePatterns[0]: syntax error in pattern",
+			},
+		},
+		{
+			name:     "IDCollisions",
+			config:   `{"idCollisions": "last", "storageServices": [{"type": "nullStorage", "priority": "high"}]}`,
+			problems: []string{`storageServices[0].priority: must be an integer`, `idCollisions: unknown value "last", expected one of first, priority, namespace`},
+		},
+		{
+			name:     "Proxy",
+			config:   `{"basePath": "music", "trustedProxies": ["localhost", "10.0.0.0/33"]}`,
+			problems: []string{"basePath: must start with /", `trustedProxies[0]: ParseAddr("localhost"): unable to parse IP`, `trustedProxies[1]: netip.ParsePrefix("10.0.0.0/33"): prefix length out of range`},
+		},
+		{
+			name: "TLS",
+			config: `{"tls": {
+				"cert": "/etc/__DOES_NOT_EXIST__/cert.pem",
+				"autocertDomains": ["music.example.com"],
+				"redirectPort": "http",
+				"hstsMaxAge": -1
+			}}`,
+			problems: []string{
+				"tls.redirectPort: must be an integer",
+				"tls.hstsMaxAge: must be at least 0",
+				"tls: cert and key must be set together",
+				"tls.autocertDomains: can't be used with cert or selfSigned",
+				"tls.cert: stat /etc/__DOES_NOT_EXIST__/cert.pem: no such file or directory",
+			},
+		},
+		{
+			name:     "TLSDisabled",
+			config:   `{"tls": {"redirectPort": 80, "hstsMaxAge": 3600}, "logLevel": "info"}`,
+			problems: []string{"tls.redirectPort: only used with HTTPS; set cert and key, selfSigned or autocertDomains", "tls.hstsMaxAge: only used with HTTPS; set cert and key, selfSigned or autocertDomains"},
+		},
+		{
+			name:     "TLSNotAnObject",
+			config:   `{"tls": true}`,
+			problems: []string{"tls: must be an object"},
+		},
+		{
+			name: "SmartPlaylists",
+			config: `{"smartPlaylists": [
+				{"name": "Jazz", "rule": "genre = Jazz AND year < 1970", "sort": "year desc", "limit": 50},
+				{"rule": "added in last 30 days"},
+				{"name": "Bad", "rule": "colour = red", "sort": "year upwards", "limit": -1}
+			]}`,
+			problems: []string{
+				"smartPlaylists[1]: name is required",
+				`smartPlaylists[2].rule: unknown field "colour"`,
+				`smartPlaylists[2].sort: expected asc or desc after year, got "upwards"`,
+				"smartPlaylists[2].limit: must be at least 0",
+			},
+		},
+		{
+			name: "Scrobblers",
+			config: `{"scrobblers": [
+				{"user": "fred", "type": "listenbrainz", "token": "abc"},
+				{"user": "fred", "type": "lastfm", "apiKey": "key", "secret": "secret", "username": "fred", "password": "pw"},
+				{"user": "fred", "type": "librefm", "baseUrl": "https://music.example.com/2.0/", "apiKey": "key", "secret": "secret", "sessionKey": "sk"},
+				{"user": "wilma", "type": "listenbrainz", "apiKey": "key"},
+				{"user": "wilma", "type": "lastfm", "apiKey": "key", "username": "wilma", "baseUrl": "ws.audioscrobbler.com"},
+				{"user": "wilma", "type": "myspace"},
+				{"user": "wilma"}
+			], "scrobbleRetryInterval": 0}`,
+			problems: []string{
+				"scrobblers[3].apiKey: not used by listenbrainz",
+				"scrobblers[3]: token is required",
+				"scrobblers[4].baseUrl: must be an http or https URL, e.g.: https://example.com/api",
+				"scrobblers[4]: secret is required",
+				"scrobblers[4]: sessionKey, or username and password, are required",
+				`scrobblers[5].type: unknown value "myspace", expected one of listenbrainz, lastfm, librefm`,
+				"scrobblers[6]: type is required",
+				"scrobbleRetryInterval: must be at least 1",
+			},
+		},
+		{
+			name:     "Users",
+			config:   `{"users": [{"name": "fred"}, "wilma"], "groups": [{"storages": ["cds"]}]}`,
+			problems: []string{"users[0]: passwordHash is required", "users[1]: must be an object", "groups[0]: name is required"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := check(t, test.config)
+			require.Error(t, err)
+			var problems configProblems
+			require.ErrorAs(t, err, &problems)
+			messages := make([]string, 0)
+			for _, problem := range problems {
+				messages = append(messages, problem.path+": "+problem.message)
+			}
+			assert.Equal(t, test.problems, messages)
+		})
+	}
+}
+
+func TestLoadConfigChecksSettings(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "minimediaserver.json")
+	require.NoError(t, os.WriteFile(configFile, []byte(`{"storageServices": [{"type": "diskstorage"}]}`), 0o644))
+	setLoadConfigOptions(configFile)
+	t.Cleanup(viper.Reset)
+
+	_, err := loadConfig()
+	assert.ErrorContains(t, err, `storageServices[0].type: unknown value "diskstorage" (did you mean "diskStorage"?)`)
+
+	usersFile := filepath.Join(dir, "users.json")
+	require.NoError(t, os.WriteFile(usersFile, []byte(`{"users": [{"name": "fred", "password": "secret"}]}`), 0o644))
+	_, err = loadUsersFile(usersFile)
+	assert.ErrorContains(t, err, "users[0].password: unknown setting (did you mean passwordHash?)")
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("path", "path"))
+	assert.Equal(t, 1, editDistance("pth", "path"))
+	assert.Equal(t, 1, editDistance("prot", "port"))
+	assert.Equal(t, 3, editDistance("prot", "host"))
+	assert.Equal(t, 4, editDistance("", "port"))
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
 	"html/template"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -16,7 +20,10 @@ import (
 
 	"github.com/richdawe/minimediaserver/internal/httprange"
 	"github.com/richdawe/minimediaserver/internal/offsetlimitreader"
+	"github.com/richdawe/minimediaserver/services/auth"
 	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+	"github.com/richdawe/minimediaserver/services/storage"
 )
 
 //go:embed templates/*
@@ -29,57 +36,318 @@ type TemplateRenderer struct {
 	templates *template.Template
 }
 
+// Data for executing a template: the page, and the prefix for the request (see
+// externalURL). Links in the templates use the Path method, e.g.:
+// {{ $.Path "/static/favicon.png" }}, and the page is in .Page.
+type templateData struct {
+	Page   any
+	Prefix string
+}
+
+// Path returns the path that the client should use for a path on the server.
+func (td templateData) Path(p string) string {
+	return td.Prefix + p
+}
+
+func newTemplateRenderer() (*TemplateRenderer, error) {
+	t := template.New("endpoints").Funcs(template.FuncMap{
+		"addInt": templateAddInt,
+		"kbps":   templateKbps,
+		"format": templateFormat,
+		"size":   templateSize,
+		"stars":  templateStars,
+	})
+	t, err := t.ParseFS(templatesContent, "templates/*.tmpl.html")
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateRenderer{
+		templates: t,
+	}, nil
+}
+
 func (tr *TemplateRenderer) Render(w io.Writer, name string, data any, c echo.Context) error {
-	return tr.templates.ExecuteTemplate(w, name, data)
+	// Render into a buffer, so that nothing is sent if there's an error.
+	var buf bytes.Buffer
+	err := tr.templates.ExecuteTemplate(&buf, name, templateData{
+		Page:   data,
+		Prefix: externalURLFor(c).Prefix,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
 }
 
 func getRoot(c echo.Context, catalogService catalog.CatalogService) error {
-	// TODO: how to catch errors in template rendering?
-	return c.Render(http.StatusOK, "root.tmpl.html", make(map[string]string, 0))
+	data := make(map[string]string, 0)
+	if user, ok := currentUser(c); ok {
+		data["User"] = user.Name
+	}
+	return c.Render(http.StatusOK, "root.tmpl.html", data)
+}
+
+// libraryNames returns the names of the storages ("libraries") in the catalog.
+func libraryNames(catalogService catalog.CatalogService) []string {
+	names := make([]string, 0)
+	for _, ss := range catalogService.GetStorages() {
+		names = append(names, ss.GetName())
+	}
+	return names
+}
+
+// catalogForLibrary narrows the catalog down to the library
+// in the "library" query parameter, if present.
+func catalogForLibrary(c echo.Context, catalogService catalog.CatalogService) catalog.CatalogService {
+	library := c.QueryParam("library")
+	if library == "" {
+		return catalogService
+	}
+
+	libraryIDs := make(map[string]bool, 0)
+	for _, ss := range catalogService.GetStorages() {
+		if ss.GetName() == library {
+			libraryIDs[ss.GetID()] = true
+		}
+	}
+	return catalog.NewFilteredCatalog(catalogService, func(storageServiceID string) bool {
+		return libraryIDs[storageServiceID]
+	})
+}
+
+// collapseDuplicates returns true if the "duplicates" query parameter asks for
+// copies of the same track in different formats or libraries to be shown once.
+func collapseDuplicates(c echo.Context) bool {
+	return c.QueryParam("duplicates") == "collapse"
+}
+
+// tracksForList returns the tracks and playlists to list, with only the preferred
+// copy of any duplicates if the client asked for them to be collapsed. The
+// "rule" and "sort" query parameters choose and order the tracks, like a smart
+// playlist's, e.g.: ?rule=starred&sort=rating desc
+func tracksForList(c echo.Context, catalogService catalog.CatalogService) ([]catalog.Track, []catalog.Playlist, error) {
+	rule, err := catalog.ParseRule(c.QueryParam("rule"))
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "rule: "+err.Error())
+	}
+	sortOrder, err := catalog.ParseSortOrder(c.QueryParam("sort"))
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "sort: "+err.Error())
+	}
+
+	tracks, playlists := catalogForLibrary(c, catalogService).GetTracks()
+	if collapseDuplicates(c) {
+		groups := catalog.FindDuplicates(tracks)
+		tracks, playlists = catalog.CollapseDuplicates(tracks, groups), catalog.CollapseDuplicatePlaylists(playlists, groups)
+	}
+
+	// Like a smart playlist's, the tracks are the same until the next ChoosingInterval.
+	at := catalog.ChoosingTime(time.Now())
+	matched := make([]catalog.Track, 0, len(tracks))
+	for _, track := range tracks {
+		if rule.Match(track, at) {
+			matched = append(matched, track)
+		}
+	}
+	sortOrder.Sort(matched, at.UTC().Format(time.RFC3339))
+	return matched, playlists, nil
+}
+
+// Data for the lists of tracks and playlists.
+type listPage struct {
+	Libraries []string // All the libraries the user can see
+	Library   string   // The library being shown; empty for all libraries
+	Collapse  bool     // Whether duplicates are shown once
+	Rule      string   // The rule choosing the tracks; empty for all of them
+	Sort      string   // The order of the tracks; empty for the catalog's order
+
+	Tracks    []catalog.Track
+	Playlists []catalog.Playlist
+}
+
+func newListPage(c echo.Context, catalogService catalog.CatalogService) (listPage, error) {
+	tracks, playlists, err := tracksForList(c, catalogService)
+	if err != nil {
+		return listPage{}, err
+	}
+	return listPage{
+		Libraries: libraryNames(catalogService),
+		Library:   c.QueryParam("library"),
+		Collapse:  collapseDuplicates(c),
+		Rule:      c.QueryParam("rule"),
+		Sort:      c.QueryParam("sort"),
+		Tracks:    tracks,
+		Playlists: playlists,
+	}, nil
+}
+
+// Query returns the query string for the list, changed to show another library.
+func (lp listPage) Query(library string) template.URL {
+	return lp.query(library, lp.Collapse)
+}
+
+// ToggleQuery returns the query string for the list, with duplicates shown the other way.
+func (lp listPage) ToggleQuery() template.URL {
+	return lp.query(lp.Library, !lp.Collapse)
+}
+
+func (lp listPage) query(library string, collapse bool) template.URL {
+	q := url.Values{}
+	if library != "" {
+		q.Set("library", library)
+	}
+	if collapse {
+		q.Set("duplicates", "collapse")
+	}
+	if lp.Rule != "" {
+		q.Set("rule", lp.Rule)
+	}
+	if lp.Sort != "" {
+		q.Set("sort", lp.Sort)
+	}
+	return template.URL("?" + q.Encode())
 }
 
 func getTracks(c echo.Context, catalogService catalog.CatalogService) error {
-	// TODO: how to catch errors in template rendering?
-	tracks, _ := catalogService.GetTracks()
-	return c.Render(http.StatusOK, "tracks.tmpl.html", tracks)
+	page, err := newListPage(c, catalogService)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "tracks.tmpl.html", page)
+}
+
+// Data for the track player page.
+type trackPage struct {
+	catalog.Track
+
+	DataURL  string // Path to the track's data, which differs for share links
+	CanShare bool   // Whether to offer a form for creating a share link
+	CanRate  bool   // Whether to offer forms for rating and starring the track
+	Download bool   // Whether to offer a download link
+}
+
+func (tp trackPage) RatingURL() string {
+	return "/tracks/" + tp.ID + "/rating"
 }
 
 func getTracksByID(c echo.Context, catalogService catalog.CatalogService) error {
 	id := c.Param("id")
 	track, err := catalogService.GetTrack(id)
 	if err != nil {
-		// TODO: return appropriate error for e.g.: track that doesn't exist
 		return err
 	}
-	// TODO: available data types => different query parameters in template
-	return c.Render(http.StatusOK, "tracksbyid.tmpl.html", track)
+	return c.Render(http.StatusOK, "tracksbyid.tmpl.html", trackPage{
+		Track:    track,
+		DataURL:  "/tracks/" + track.ID + "/data",
+		CanShare: true,
+		CanRate:  true,
+		Download: true,
+	})
 }
 
-func getTracksByIDData(c echo.Context, catalogService catalog.CatalogService, cacheMaxAge int) error {
+func getTracksByIDData(c echo.Context, catalogService catalog.CatalogService, config Config, metrics *serverMetrics, plays *playRecorder) error {
 	id := c.Param("id")
 	track, err := catalogService.GetTrack(id)
 	if err != nil {
-		// TODO: return appropriate error for e.g.: track that doesn't exist
 		return err
 	}
+	download := c.QueryParam("download") != ""
+	return streamTrackData(c, catalogService, metrics, plays, track, config.cacheMaxAgeFor(track.StorageServiceID), download)
+}
+
+// The usual file extension for a MIME type, or an empty string if it's unknown.
+func trackExtension(mimeType string) string {
+	switch mimeType {
+	case storage.MP3MimeType:
+		return ".mp3"
+	case storage.MP4MimeType:
+		return ".m4a"
+	case storage.OggMimeType:
+		return ".ogg"
+	case storage.FlacMimeType:
+		return ".flac"
+	}
+	return ""
+}
+
+// Suggest a filename for downloading the track.
+func trackFilename(track catalog.Track) string {
+	return track.Name + trackExtension(track.MIMEType)
+}
+
+// templateFormat returns the name of the format for a MIME type, for showing to people.
+func templateFormat(mimeType string) string {
+	switch mimeType {
+	case storage.MP3MimeType:
+		return "MP3"
+	case storage.MP4MimeType:
+		return "AAC"
+	case storage.OggMimeType:
+		return "Ogg Vorbis"
+	case storage.FlacMimeType:
+		return "FLAC"
+	}
+	return mimeType
+}
+
+// templateStars shows a rating as stars, e.g.: ★★★☆☆
+func templateStars(rating int) string {
+	rating = min(max(rating, 0), storage.MaxRating)
+	return strings.Repeat("★", rating) + strings.Repeat("☆", storage.MaxRating-rating)
+}
+
+// templateSize formats a size in bytes.
+func templateSize(size int64) string {
+	if size < 1000*1000 {
+		return fmt.Sprintf("%d kB", (size+500)/1000)
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/(1000*1000))
+}
+
+// streamTrackData sends a track's data. If plays isn't nil, plays of the
+// track are recorded, unless it is being downloaded.
+func streamTrackData(c echo.Context, catalogService catalog.CatalogService, metrics *serverMetrics, plays *playRecorder, track catalog.Track, cacheMaxAge int, download bool) error {
+	var err error
 
 	// Parse any requested byte ranges.
 	// This article was really helpful in adding this functionality;
 	// <https://www.zeng.dev/post/2023-http-range-and-play-mp4-in-browser/>
 	var httpRanges []httprange.HttpRange
 
+	played := track
+	track, err = chooseSource(c, track)
+	if err != nil {
+		return err
+	}
+	c.Set(trackContextKey, track)
+
+	// Allow the track data to be cached by the client, and checked
+	// using the validators once it is stale.
+	etag := trackETag(track)
+	header := c.Response().Header()
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d", cacheMaxAge))
+	setValidators(header, etag, track.ModTime)
+	if notModified(c.Request(), etag, track.ModTime) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	rangeVal := c.Request().Header.Get("Range")
+	if !rangeStillValid(c.Request(), etag, track.ModTime) {
+		// The client's partial copy is out of date, so send all of the data.
+		rangeVal = ""
+	}
 	if rangeVal != "" {
+		c.Set(rangeContextKey, rangeVal)
 		httpRanges, err = httprange.ParseRange(rangeVal, track.DataLen)
 		if err != nil {
-			// TODO: return appropriate error
-			return err
+			c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%d", track.DataLen))
+			return fmt.Errorf("%w: %w", catalog.ErrBadRange, err)
 		}
 	}
 
 	r, err := catalogService.ReadTrack(track)
 	if err != nil {
-		// TODO: return appropriate error for e.g.: track that can't be read
 		return err
 	}
 
@@ -96,89 +364,224 @@ func getTracksByIDData(c echo.Context, catalogService catalog.CatalogService, ca
 		r = offsetlimitreader.New(r, start, length)
 
 		// TODO: test coverage for range header; should use httprange code from go?
-		// TODO: include range in HTTP logs
 		rangeResponse := fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, track.DataLen)
 		c.Response().Header().Add("Content-Range", rangeResponse)
 		c.Response().Header().Add("Content-Length", strconv.FormatInt(length, 10))
 		responseCode = http.StatusPartialContent
 	}
 
+	if download {
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": trackFilename(track)})
+		c.Response().Header().Set(echo.HeaderContentDisposition, disposition)
+	}
+
 	// Allow ranges to be requested.
 	c.Response().Header().Add("Accept-Ranges", "bytes")
-	// Allow the track data to be cached by the client.
-	c.Response().Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", cacheMaxAge))
+
+	r, done := metrics.stream(track, r, len(httpRanges) > 0)
+	defer done()
+	if plays != nil && !download {
+		offset := int64(0)
+		if len(httpRanges) > 0 {
+			offset = httpRanges[0].Start
+		}
+		var donePlaying func()
+		r, donePlaying = plays.stream(c, played, track, offset, r)
+		defer donePlaying()
+	}
 	return c.Stream(responseCode, track.MIMEType, r)
 }
 
 func getPlaylists(c echo.Context, catalogService catalog.CatalogService) error {
-	// TODO: how to catch errors in template rendering?
-	_, playlists := catalogService.GetTracks()
-	return c.Render(http.StatusOK, "playlists.tmpl.html", playlists)
+	page, err := newListPage(c, catalogService)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "playlists.tmpl.html", page)
+}
+
+// Data for the playlist player page.
+type playlistPage struct {
+	catalog.Playlist
+
+	TrackDataURLPrefix string // Prefix for the path to each track's data, which differs for share links
+	ExportURL          string // Path to the playlist as an M3U file
+	CanShare           bool   // Whether to offer a form for creating a share link
+	CanRate            bool   // Whether to offer forms for rating and starring the playlist
+}
+
+func (pp playlistPage) RatingURL() string {
+	return "/playlists/" + pp.ID + "/rating"
+}
+
+func (pp playlistPage) TrackDataURL(id string) string {
+	return pp.TrackDataURLPrefix + id + "/data"
 }
 
 func getPlaylistsByID(c echo.Context, catalogService catalog.CatalogService) error {
 	id := c.Param("id")
 	playlist, err := catalogService.GetPlaylist(id)
 	if err != nil {
-		// TODO: return appropriate error for e.g.: track that doesn't exist
 		return err
 	}
 	// TODO: available data types => different query parameters in template
-	return c.Render(http.StatusOK, "playlistsbyid.tmpl.html", playlist)
+	return c.Render(http.StatusOK, "playlistsbyid.tmpl.html", playlistPage{
+		Playlist:           playlist,
+		TrackDataURLPrefix: "/tracks/",
+		ExportURL:          "/playlists/" + playlist.ID + "/export",
+		CanShare:           true,
+		CanRate:            true,
+	})
+}
+
+// getPlaylistsByIDExport sends a playlist as an M3U file, for other players.
+func getPlaylistsByIDExport(c echo.Context, catalogService catalog.CatalogService) error {
+	playlist, err := catalogService.GetPlaylist(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return writeM3U(c, playlist, externalURLFor(c).absolute("/tracks/"))
+}
+
+// Track names can't span lines in an M3U file.
+var m3uReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// writeM3U sends a playlist in the extended M3U format, with each track's data at
+// trackURLPrefix + the track's ID + "/data". The URLs are absolute, so that the
+// file can be opened anywhere.
+func writeM3U(c echo.Context, playlist catalog.Playlist, trackURLPrefix string) error {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for _, track := range playlist.Tracks {
+		name := track.Name
+		if track.Title != "" && track.Artist != "" {
+			name = track.Artist + " - " + track.Title
+		} else if track.Title != "" {
+			name = track.Title
+		}
+		seconds := -1 // Unknown
+		if track.Duration > 0 {
+			seconds = int(track.Duration.Round(time.Second) / time.Second)
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n", seconds, m3uReplacer.Replace(name))
+		buf.WriteString(trackURLPrefix + url.PathEscape(track.ID) + "/data\n")
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": playlist.Name + ".m3u8"})
+	if disposition == "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": "playlist.m3u8"})
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, disposition)
+	return c.Blob(http.StatusOK, "audio/x-mpegurl; charset=utf-8", buf.Bytes())
 }
 
 func templateAddInt(a, b int) int {
 	return a + b
 }
 
-func setupEndpoints(config Config, catalogService catalog.CatalogService) (*echo.Echo, error) {
-	t := template.New("endpoints").Funcs(template.FuncMap{
-		"addInt": templateAddInt,
-	})
-	t, err := t.ParseFS(templatesContent, "templates/*.tmpl.html")
+// templateKbps formats a bitrate in bits per second.
+func templateKbps(bitrate int) string {
+	if bitrate == 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d kbit/s", (bitrate+500)/1000)
+}
+
+func setupEndpoints(configs *liveConfig, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, ratingsService ratings.RatingsService, metrics *serverMetrics) (*echo.Echo, error) {
+	config := configs.Get()
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
 	if err != nil {
 		return nil, err
 	}
 
-	tr := &TemplateRenderer{
-		templates: t,
+	tr, err := newTemplateRenderer()
+	if err != nil {
+		return nil, err
 	}
 
 	e := echo.New()
 	e.Renderer = tr
+	e.HTTPErrorHandler = httpErrorHandler(slog.Default())
+	e.IPExtractor = ipExtractor(trustedProxies)
 
 	e.Pre(middleware.RemoveTrailingSlash())
 	e.Use(middleware.RequestID())
+	e.Use(proxyMiddleware(config.BasePath, trustedProxies))
+	e.Use(accessLog(slog.Default()))
+	e.Use(metrics.middleware())
+	e.Use(authMiddleware(authService))
 
 	// Don't wait process requests indefinitely.
 	e.Server.ReadTimeout = time.Duration(60 * time.Second)
 	e.Server.WriteTimeout = time.Duration(60 * time.Second)
 
-	e.GET("/", func(c echo.Context) error {
-		return getRoot(c, catalogService)
+	// All of the routes are under the base path, if there is one.
+	g := e.Group(config.BasePath)
+
+	// For pages listing the catalog.
+	withETag := catalogETag(catalogService, plays, ratingsService)
+
+	g.GET("/login", func(c echo.Context) error {
+		return getLogin(c)
+	})
+	g.POST("/login", func(c echo.Context) error {
+		return postLogin(c, authService)
 	})
-	e.GET("/tracks", func(c echo.Context) error {
-		return getTracks(c, catalogService)
+	g.POST("/logout", func(c echo.Context) error {
+		return postLogout(c, authService)
 	})
-	e.GET("/tracks/:id", func(c echo.Context) error {
-		return getTracksByID(c, catalogService)
+	// The trailing slash has been removed, so the root is the base path itself.
+	g.GET("", func(c echo.Context) error {
+		return getRoot(c, catalogFor(c, catalogService, authService, plays, ratingsService))
 	})
-	e.GET("/tracks/:id/data", func(c echo.Context) error {
-		return getTracksByIDData(c, catalogService, config.CacheMaxAge)
+	g.GET("/tracks", func(c echo.Context) error {
+		return getTracks(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/tracks/:id", func(c echo.Context) error {
+		return getTracksByID(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/tracks/:id/data", func(c echo.Context) error {
+		return getTracksByIDData(c, catalogFor(c, catalogService, authService, plays, ratingsService), configs.Get(), metrics, plays)
 	})
-	e.GET("/playlists", func(c echo.Context) error {
-		return getPlaylists(c, catalogService)
+	g.GET("/playlists", func(c echo.Context) error {
+		return getPlaylists(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/playlists/:id", func(c echo.Context) error {
+		return getPlaylistsByID(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	}, withETag)
+	g.GET("/playlists/:id/export", func(c echo.Context) error {
+		return getPlaylistsByIDExport(c, catalogFor(c, catalogService, authService, plays, ratingsService))
 	})
-	e.GET("/playlists/:id", func(c echo.Context) error {
-		return getPlaylistsByID(c, catalogService)
+	g.POST("/shares", func(c echo.Context) error {
+		return postShares(c, catalogFor(c, catalogService, authService, plays, ratingsService), authService)
 	})
-	e.GET("/static/:filename", func(c echo.Context) error {
+	g.GET("/share/:token", func(c echo.Context) error {
+		return getShare(c, catalogService, authService, plays)
+	}, withETag)
+	g.GET("/share/:token/export", func(c echo.Context) error {
+		return getShareExport(c, catalogService, authService, plays)
+	})
+	g.GET("/share/:token/data", func(c echo.Context) error {
+		return getShareData(c, catalogService, authService, plays, configs.Get(), metrics)
+	})
+	g.GET("/share/:token/tracks/:id/data", func(c echo.Context) error {
+		return getShareData(c, catalogService, authService, plays, configs.Get(), metrics)
+	})
+	setupAPIEndpoints(g, catalogService, authService, plays, ratingsService)
+	setupSmartPlaylistEndpoints(g, catalogService, authService, plays, ratingsService, newSmartPlaylistsFile(config.SmartPlaylistsFile))
+	setupPlayEndpoints(g, catalogService, authService, plays, ratingsService)
+	setupRatingEndpoints(g, catalogService, authService, plays, ratingsService)
+	setupAdminEndpoints(g, catalogService, authService)
+	if config.AdminAddr == "" {
+		// Otherwise the metrics are served by the admin server.
+		g.GET("/metrics", metrics.handler())
+	}
+	g.GET("/static/:filename", func(c echo.Context) error {
 		filename := c.Param("filename")
 		path := filepath.Join("static", filename)
 		data, err := staticContent.ReadFile(path)
 		if err != nil {
-			// TODO: return appropriate error for e.g.: file that can't be found
-			return err
+			return echo.ErrNotFound
 		}
 
 		// https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/MIME_types/Common_types
@@ -1,27 +1,78 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
 	"github.com/richdawe/minimediaserver/services/storage"
 )
 
+// Set up the endpoints with a catalog containing NullStorage.
+func setupTestServer(t *testing.T, config Config) (*echo.Echo, catalog.CatalogService) {
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	err = catalogService.AddStorage(nullStorage)
+	require.NoError(t, err)
+
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+	return e, catalogService
+}
+
+// newTestPlays returns a play recorder with an in-memory history.
+func newTestPlays(t *testing.T) *playRecorder {
+	plays, _, err := buildPlays(Config{}, nil)
+	require.NoError(t, err)
+	return plays
+}
+
+func newTestRatings(t *testing.T) *ratings.BasicRatings {
+	ratingsService, err := buildRatings(Config{})
+	require.NoError(t, err)
+	return ratingsService
+}
+
+func newJSONRequest(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+func doRequest(e *echo.Echo, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
 func TestEndpoints(t *testing.T) {
 	var config Config
 
-	catalogService, err := catalog.NewBasicCatalog()
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{})
 	require.NoError(t, err)
 
 	// TODO: need a config file for configuring storage backends
-	nullStorage, err := storage.NewNullStorage()
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
 	require.NoError(t, err)
 	err = catalogService.AddStorage(nullStorage)
 	require.NoError(t, err)
 
-	e, err := setupEndpoints(config, catalogService)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
 	require.NoError(t, err)
 	require.NotNil(t, e) // TODO: remove when something more interesting is happening
 
@@ -31,3 +82,42 @@ func TestEndpoints(t *testing.T) {
 		// TODO: starting point at https://echo.labstack.com/guide/testing/
 	})
 }
+
+func TestCollapseDuplicates(t *testing.T) {
+	catalogService := duplicatesCatalog(t)
+	authService, err := buildAuth(Config{})
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(Config{}), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	t.Run("API", func(t *testing.T) {
+		var tracks []catalog.Track
+		require.NoError(t, json.Unmarshal(get("/api/tracks").Body.Bytes(), &tracks))
+		assert.Len(t, tracks, 6)
+		require.NoError(t, json.Unmarshal(get("/api/tracks?duplicates=collapse").Body.Bytes(), &tracks))
+		assert.Len(t, tracks, 4)
+
+		var playlists []catalog.Playlist
+		require.NoError(t, json.Unmarshal(get("/api/playlists").Body.Bytes(), &playlists))
+		assert.Len(t, playlists, 4)
+		require.NoError(t, json.Unmarshal(get("/api/playlists?duplicates=collapse").Body.Bytes(), &playlists))
+		assert.Len(t, playlists, 3)
+	})
+
+	t.Run("HTML", func(t *testing.T) {
+		body := get("/tracks").Body.String()
+		assert.Equal(t, 6, strings.Count(body, "<li>"))
+		assert.Contains(t, body, `href="?duplicates=collapse"`)
+
+		body = get("/playlists?library=cds&duplicates=collapse").Body.String()
+		assert.Equal(t, 3, strings.Count(body, "<li>"))
+		assert.Contains(t, body, `href="?library=cds"`)
+		assert.Contains(t, body, `href="?duplicates=collapse&amp;library=copies"`)
+	})
+}
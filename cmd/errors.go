@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+)
+
+// Errors from the handlers are turned into responses in one place.
+// Browsers get an HTML error page, and API clients get problem details
+// (RFC 9457). Errors from the catalog and storage services are mapped
+// to the right status code, rather than all of them being a 500.
+
+const problemMIMEType = "application/problem+json"
+
+// problemDetails is an RFC 9457 problem details object.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// errorStatus returns the status code for an error, and any details that can
+// be shown to the client. The details of catalog and storage errors aren't
+// shown, since they may include the locations of files, unless they are about
+// a change the client asked for, e.g.: an invalid smart playlist rule.
+func errorStatus(err error) (int, string) {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		detail := ""
+		if message, ok := he.Message.(string); ok && message != http.StatusText(he.Code) {
+			detail = message
+		}
+		return he.Code, detail
+	}
+
+	switch {
+	case errors.Is(err, catalog.ErrNotFound):
+		return http.StatusNotFound, ""
+	case errors.Is(err, catalog.ErrForbidden):
+		return http.StatusForbidden, ""
+	case errors.Is(err, catalog.ErrBadRange):
+		return http.StatusRequestedRangeNotSatisfiable, ""
+	case errors.Is(err, catalog.ErrUnavailable):
+		return http.StatusServiceUnavailable, ""
+	case errors.Is(err, catalog.ErrInvalid), errors.Is(err, ratings.ErrInvalid):
+		// These are about what the client asked for, so they are worth showing.
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, catalog.ErrExists):
+		return http.StatusConflict, err.Error()
+	}
+	return http.StatusInternalServerError, ""
+}
+
+// prefersHTML returns true if the client is a browser, rather than a script using the API.
+func prefersHTML(c echo.Context) bool {
+	if strings.HasPrefix(externalURLFor(c).routePath(c.Request()), "/api/") {
+		return false
+	}
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML)
+}
+
+// Data for the error page.
+type errorPage struct {
+	Status int
+	Title  string
+	Detail string
+}
+
+// httpErrorHandler sends the response for an error returned by a handler or middleware.
+func httpErrorHandler(logger *slog.Logger) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		code, detail := errorStatus(err)
+		switch {
+		case code >= http.StatusInternalServerError:
+			logger.Error("Request failed", "uri", c.Request().RequestURI, "error", err)
+		case code == http.StatusForbidden:
+			logger.Warn("Request failed", "uri", c.Request().RequestURI, "error", err)
+		}
+
+		res := c.Response()
+		if res.Committed {
+			// Too late to change the response, e.g.: storage failed while streaming a track.
+			return
+		}
+		// The validators are for the response that was going to be sent.
+		res.Header().Del("ETag")
+		res.Header().Del(echo.HeaderLastModified)
+
+		title := http.StatusText(code)
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(code)
+		} else if prefersHTML(c) {
+			err = c.Render(code, "error.tmpl.html", errorPage{Status: code, Title: title, Detail: detail})
+			if err != nil {
+				logger.Error("Unable to render error page", "error", err)
+				err = c.String(code, title)
+			}
+		} else {
+			u := externalURLFor(c)
+			var body []byte
+			body, err = json.Marshal(problemDetails{
+				Type:     "about:blank",
+				Title:    title,
+				Status:   code,
+				Detail:   detail,
+				Instance: u.path(u.routePath(c.Request())),
+			})
+			if err == nil {
+				err = c.Blob(code, problemMIMEType, body)
+			}
+		}
+		if err != nil {
+			logger.Error("Unable to send error response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		detail string
+	}{
+		{echo.ErrNotFound, http.StatusNotFound, ""},
+		{echo.NewHTTPError(http.StatusBadRequest, "unknown scope for share"), http.StatusBadRequest, "unknown scope for share"},
+		{fmt.Errorf("%w: track abc", catalog.ErrNotFound), http.StatusNotFound, ""},
+		{fmt.Errorf("%w: /music/secret.mp3", storage.ErrForbidden), http.StatusForbidden, ""},
+		{fmt.Errorf("%w: invalid range", catalog.ErrBadRange), http.StatusRequestedRangeNotSatisfiable, ""},
+		{fmt.Errorf("%w: mount is down", storage.ErrUnavailable), http.StatusServiceUnavailable, ""},
+		{fmt.Errorf("%w: smart playlist needs a name", catalog.ErrInvalid), http.StatusBadRequest, "invalid: smart playlist needs a name"},
+		{fmt.Errorf("%w: smart playlist Jazz has already been added", catalog.ErrExists), http.StatusConflict, "already exists: smart playlist Jazz has already been added"},
+		{errors.New("template: oops"), http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		status, detail := errorStatus(test.err)
+		assert.Equal(t, test.status, status, test.err.Error())
+		assert.Equal(t, test.detail, detail, test.err.Error())
+	}
+}
+
+// A storage that has gone away since it was scanned, e.g.: a network mount.
+type unavailableStorage struct {
+	storage.StorageService
+}
+
+func (s unavailableStorage) ReadTrack(id string) (io.Reader, error) {
+	return nil, fmt.Errorf("%w: mount is down", storage.ErrUnavailable)
+}
+
+func TestHTTPErrorHandler(t *testing.T) {
+	e, catalogService := setupTestServer(t, Config{})
+	tracks, _ := catalogService.GetTracks()
+	require.Len(t, tracks, 1)
+
+	get := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return doRequest(e, req)
+	}
+	browser := map[string]string{echo.HeaderAccept: "text/html,application/xhtml+xml,*/*;q=0.8"}
+	problem := func(t *testing.T, rec *httptest.ResponseRecorder) problemDetails {
+		assert.Equal(t, problemMIMEType, rec.Header().Get(echo.HeaderContentType))
+		var details problemDetails
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &details))
+		return details
+	}
+
+	t.Run("Browser", func(t *testing.T) {
+		rec := get("/tracks/nope", browser)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Header().Get(echo.HeaderContentType), echo.MIMETextHTML)
+		assert.Contains(t, rec.Body.String(), "404 Not Found")
+		assert.Contains(t, rec.Body.String(), `href="/static/favicon.png"`)
+	})
+
+	t.Run("API", func(t *testing.T) {
+		// API clients get problem details, even if they accept HTML.
+		rec := get("/api/tracks/nope", browser)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, problemDetails{
+			Type:     "about:blank",
+			Title:    "Not Found",
+			Status:   http.StatusNotFound,
+			Instance: "/api/tracks/nope",
+		}, problem(t, rec))
+
+		rec = doRequest(e, newJSONRequest(http.MethodPost, "/api/shares", `{"scope": "album", "id": "abc"}`))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, "unknown scope for share", problem(t, rec).Detail)
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		rec := doRequest(e, httptest.NewRequest(http.MethodHead, "/nope", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Empty(t, rec.Body.String())
+	})
+
+	t.Run("MissingStaticFile", func(t *testing.T) {
+		rec := get("/static/nope.css", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, http.StatusNotFound, problem(t, rec).Status)
+	})
+
+	t.Run("BadRange", func(t *testing.T) {
+		rec := get("/tracks/"+tracks[0].ID+"/data", map[string]string{"Range": "bytes=999999999-"})
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+		assert.Equal(t, fmt.Sprintf("bytes */%d", tracks[0].DataLen), rec.Header().Get("Content-Range"))
+		assert.Empty(t, rec.Header().Get("ETag"))
+	})
+
+	t.Run("TrackRemoved", func(t *testing.T) {
+		dir := t.TempDir()
+		data, err := os.ReadFile("../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track2-example.mp3")
+		require.NoError(t, err)
+		location := filepath.Join(dir, "track.mp3")
+		require.NoError(t, os.WriteFile(location, data, 0o644))
+
+		diskStorage, err := storage.NewDiskStorage(dir, []string{}, storage.Options{Name: "removed"})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(diskStorage))
+		track := diskTrack(t, catalogService)
+		require.NoError(t, os.Remove(location))
+
+		rec := get("/tracks/"+track.ID+"/data", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.NotContains(t, rec.Body.String(), dir)
+	})
+
+	t.Run("StorageUnavailable", func(t *testing.T) {
+		diskStorage, err := storage.NewDiskStorage("../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "unavailable"})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(unavailableStorage{diskStorage}))
+		id := ""
+		tracks, _ := catalogService.GetTracks()
+		for _, track := range tracks {
+			if track.StorageName == "unavailable" {
+				id = track.ID
+			}
+		}
+		require.NotEmpty(t, id)
+
+		rec := get("/tracks/"+id+"/data", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, http.StatusServiceUnavailable, problem(t, rec).Status)
+	})
+
+	t.Run("Committed", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		require.NoError(t, c.String(http.StatusOK, "partial"))
+		httpErrorHandler(slog.Default())(errors.New("write failed"), c)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "partial", rec.Body.String())
+	})
+}
+
+func TestTemplateRendererErrors(t *testing.T) {
+	tr, err := newTemplateRenderer()
+	require.NoError(t, err)
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+
+	// Nothing is written if rendering fails part of the way through.
+	var buf bytes.Buffer
+	err = tr.Render(&buf, "tracksbyid.tmpl.html", 42, c)
+	assert.Error(t, err)
+	assert.Zero(t, buf.Len())
+
+	require.NoError(t, tr.Render(&buf, "error.tmpl.html", errorPage{Status: 500, Title: "Internal Server Error"}, c))
+	assert.Contains(t, buf.String(), "500 Internal Server Error")
+}
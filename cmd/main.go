@@ -1,44 +1,158 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+
+	"github.com/richdawe/minimediaserver/internal/logging"
+	"github.com/richdawe/minimediaserver/services/auth"
 )
 
-func handleErr(err error) {
+// hashPassword reads a password and prints its hash,
+// for use in the "users" section of the configuration file.
+func hashPassword(stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fmt.Fprint(stderr, "Password: ")
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+
+	hash, err := auth.HashPassword(password)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
+	fmt.Fprintln(stdout, hash)
+	return nil
 }
 
-func main() {
-	setLoadConfigOptions()
+// serve runs the server until it is interrupted.
+func serve() error {
 	config, err := loadConfig()
-	handleErr(err)
+	if err != nil {
+		return &configError{err}
+	}
+	if err := validateConfig(config); err != nil {
+		return &configError{err}
+	}
+
+	logger, err := logging.New(config.Log, os.Stderr)
+	if err != nil {
+		return &configError{err}
+	}
+	defer logger.Close()
+	slog.SetDefault(logger.Logger)
 
 	catalogService, err := buildCatalog(config)
-	handleErr(err)
+	if err != nil {
+		return err
+	}
+
+	authService, err := buildAuth(config)
+	if err != nil {
+		return err
+	}
+
+	scrobbles, err := buildScrobbler(config)
+	if err != nil {
+		return err
+	}
+	plays, historyService, err := buildPlays(config, scrobbles)
+	if err != nil {
+		return err
+	}
+	defer historyService.Close()
+	if scrobbles != nil {
+		scrobbleCtx, stopScrobbling := context.WithCancel(context.Background())
+		defer stopScrobbling()
+		go scrobbles.Run(scrobbleCtx, time.Duration(config.ScrobbleRetryInterval)*time.Second)
+	}
 
-	e, err := setupEndpoints(config, catalogService)
-	handleErr(err)
+	ratingsService, err := buildRatings(config)
+	if err != nil {
+		return err
+	}
+
+	configs := newLiveConfig(config)
+	metrics := newServerMetrics(catalogService)
+	e, err := setupEndpoints(configs, catalogService, authService, plays, ratingsService, metrics)
+	if err != nil {
+		return err
+	}
 
 	// TODO: need a config file for specifying HTTP server options
 	e.Use(middleware.Timeout())
-	e.Use(middleware.Logger())
+	e.HideBanner = true
+	e.HidePort = true
+
+	redirectServer, err := setupTLS(e, config)
+	if err != nil {
+		return err
+	}
 
 	// Start server
 	// https://echo.labstack.com/docs/cookbook/graceful-shutdown
 	// https://medium.com/@mokiat/proper-http-shutdown-in-go-bd3bfaade0f2
+	slog.Info("Starting server", "addr", config.Addr, "https", config.TLS.enabled())
 	go func() {
-		if err := e.Start(config.Addr); err != nil && err != http.ErrServerClosed {
-			e.Logger.Fatal(fmt.Sprintf("shutting down the server: %s", err))
+		if err := startServer(e, config); err != nil && err != http.ErrServerClosed {
+			slog.Error("Shutting down the server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	if redirectServer != nil {
+		slog.Info("Starting HTTP to HTTPS redirect server", "addr", redirectServer.Addr)
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Shutting down the redirect server", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	configReloader := newReloader(configs, catalogService, logger, loadConfig)
+
+	var adminServer *echo.Echo
+	if config.AdminAddr != "" {
+		adminServer, err = setupAdminServer(config, catalogService, authService, metrics, configReloader)
+		if err != nil {
+			return err
+		}
+		adminServer.HidePort = true
+		slog.Info("Starting admin server", "addr", config.AdminAddr)
+		go func() {
+			if err := adminServer.Start(config.AdminAddr); err != nil && err != http.ErrServerClosed {
+				slog.Error("Shutting down the admin server", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Reload the configuration on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("Reloading configuration")
+			if err := configReloader.reload(); err != nil {
+				slog.Error("Unable to reload configuration", "error", err)
+			}
 		}
 	}()
 
@@ -49,10 +163,25 @@ func main() {
 	<-quit
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			adminServer.Close()
+		}
+	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			redirectServer.Close()
+		}
+	}
 	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+		slog.Error("Shutting down the server", "error", err)
 		e.Close()
 	}
 
-	fmt.Println("DONE")
+	slog.Info("Server stopped")
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+)
+
+const metricsNamespace = "minimediaserver"
+
+// Prometheus metrics for the server. Each server has its own registry,
+// so that tests can set up as many servers as they like.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	streamedBytes   *prometheus.CounterVec
+	rangeRequests   *prometheus.CounterVec
+	activeStreams   prometheus.Gauge
+}
+
+func newServerMetrics(catalogService catalog.CatalogService) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests, by route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "How long HTTP requests took, by route and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		streamedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "streamed_bytes_total",
+			Help:      "Bytes of track data streamed, by storage and MIME type.",
+		}, []string{"storage", "mime_type"}),
+		rangeRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "range_requests_total",
+			Help:      "Number of requests for part of a track's data, by storage.",
+		}, []string{"storage"}),
+		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_streams",
+			Help:      "Number of tracks currently being streamed.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.streamedBytes,
+		m.rangeRequests,
+		m.activeStreams,
+		newCatalogCollector(catalogService),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// middleware records the count and duration of every request.
+func (m *serverMetrics) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			// The error hasn't been turned into a response yet,
+			// so work out what the status will be.
+			status := c.Response().Status
+			if err != nil && !c.Response().Committed {
+				status, _ = errorStatus(err)
+			}
+
+			// Use the route rather than the path, so that there
+			// isn't a separate metric for every track.
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			labels := prometheus.Labels{
+				"method": c.Request().Method,
+				"route":  route,
+				"status": strconv.Itoa(status),
+			}
+			m.requests.With(labels).Inc()
+			m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (m *serverMetrics) handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// countingReader counts the bytes of track data streamed.
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counter.Add(float64(n))
+	return n, err
+}
+
+// stream records the streaming of a track's data. The returned function
+// must be called when streaming has finished.
+func (m *serverMetrics) stream(track catalog.Track, r io.Reader, ranged bool) (io.Reader, func()) {
+	if ranged {
+		m.rangeRequests.WithLabelValues(track.StorageName).Inc()
+	}
+	m.activeStreams.Inc()
+	counter := m.streamedBytes.WithLabelValues(track.StorageName, track.MIMEType)
+	return &countingReader{r: r, counter: counter}, m.activeStreams.Dec
+}
+
+// catalogCollector reports the size of the catalog and the results
+// of scanning each storage, at the time the metrics are collected.
+type catalogCollector struct {
+	catalogService catalog.CatalogService
+
+	tracks       *prometheus.Desc
+	playlists    *prometheus.Desc
+	ignored      *prometheus.Desc
+	problems     *prometheus.Desc
+	scanDuration *prometheus.Desc
+}
+
+func newCatalogCollector(catalogService catalog.CatalogService) *catalogCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, []string{"storage"}, nil)
+	}
+	return &catalogCollector{
+		catalogService: catalogService,
+		tracks:         desc("catalog_tracks", "Number of tracks in the catalog, by storage."),
+		playlists:      desc("catalog_playlists", "Number of playlists in the catalog, by storage."),
+		ignored:        desc("storage_ignored_files", "Number of files ignored when scanning, by storage."),
+		problems:       desc("storage_scan_problems", "Number of files that could not be scanned properly, by storage."),
+		scanDuration:   desc("storage_scan_duration_seconds", "How long the last scan took, by storage."),
+	}
+}
+
+func (cc *catalogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.tracks
+	ch <- cc.playlists
+	ch <- cc.ignored
+	ch <- cc.problems
+	ch <- cc.scanDuration
+}
+
+func (cc *catalogCollector) Collect(ch chan<- prometheus.Metric) {
+	tracksByStorageID := make(map[string]int, 0)
+	playlistsByStorageID := make(map[string]int, 0)
+	tracks, playlists := cc.catalogService.GetTracks()
+	for _, track := range tracks {
+		tracksByStorageID[track.StorageServiceID]++
+	}
+	for _, playlist := range playlists {
+		playlistsByStorageID[playlist.StorageServiceID]++
+	}
+
+	for _, ss := range cc.catalogService.GetStorages() {
+		name := ss.GetName()
+		stats := ss.GetScanStats()
+		ch <- prometheus.MustNewConstMetric(cc.tracks, prometheus.GaugeValue, float64(tracksByStorageID[ss.GetID()]), name)
+		ch <- prometheus.MustNewConstMetric(cc.playlists, prometheus.GaugeValue, float64(playlistsByStorageID[ss.GetID()]), name)
+		ch <- prometheus.MustNewConstMetric(cc.ignored, prometheus.GaugeValue, float64(stats.Ignored), name)
+		ch <- prometheus.MustNewConstMetric(cc.problems, prometheus.GaugeValue, float64(len(ss.GetScanReport())), name)
+		ch <- prometheus.MustNewConstMetric(cc.scanDuration, prometheus.GaugeValue, stats.Duration.Seconds(), name)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestMetrics(t *testing.T) {
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{})
+	require.NoError(t, err)
+	diskStorage, err := storage.NewDiskStorage("../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+
+	var config Config
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	metrics := newServerMetrics(catalogService)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), metrics)
+	require.NoError(t, err)
+
+	tracks, _ := catalogService.GetTracks()
+	track := tracks[0]
+
+	rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/tracks/"+track.ID+"/data", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	req := httptest.NewRequest(http.MethodGet, "/tracks/"+track.ID+"/data", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	rec = doRequest(e, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	rec = doRequest(e, httptest.NewRequest(http.MethodGet, "/tracks/nope", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doRequest(e, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+
+	assert.Contains(t, body, `minimediaserver_http_requests_total{method="GET",route="/tracks/:id/data",status="200"} 1`)
+	assert.Contains(t, body, `minimediaserver_http_requests_total{method="GET",route="/tracks/:id/data",status="206"} 1`)
+	assert.Contains(t, body, `minimediaserver_http_requests_total{method="GET",route="/tracks/:id",status="404"} 1`)
+	assert.Contains(t, body, `minimediaserver_http_request_duration_seconds_count{method="GET",route="/tracks/:id/data",status="200"} 1`)
+	assert.Contains(t, body, `minimediaserver_range_requests_total{storage="cds"} 1`)
+	assert.Contains(t, body, `minimediaserver_active_streams 0`)
+	assert.Contains(t, body, `minimediaserver_streamed_bytes_total{mime_type="`+track.MIMEType+`",storage="cds"}`)
+	assert.Contains(t, body, `minimediaserver_catalog_tracks{storage="cds"} 4`)
+	assert.Contains(t, body, `minimediaserver_catalog_playlists{storage="cds"}`)
+	assert.Contains(t, body, `minimediaserver_storage_ignored_files{storage="cds"} 2`)
+	assert.Contains(t, body, `minimediaserver_storage_scan_problems{storage="cds"} 0`)
+	assert.Contains(t, body, `minimediaserver_storage_scan_duration_seconds{storage="cds"}`)
+	assert.Contains(t, body, `go_goroutines`)
+
+	t.Run("AdminServer", func(t *testing.T) {
+		config := Config{AdminAddr: "127.0.0.1:0"}
+		e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), metrics)
+		require.NoError(t, err)
+		rec := doRequest(e, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		adminServer, err := setupAdminServer(config, catalogService, authService, metrics, nil)
+		require.NoError(t, err)
+		rec = doRequest(adminServer, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `minimediaserver_catalog_tracks{storage="cds"} 4`)
+	})
+}
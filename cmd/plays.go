@@ -0,0 +1,426 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/history"
+	"github.com/richdawe/minimediaserver/services/ratings"
+	"github.com/richdawe/minimediaserver/services/scrobble"
+)
+
+// Plays are recorded when a client reports them using the API, or when the
+// server has streamed more than half of a track to a user. Browsers fetch
+// tracks in several parts, and may fetch the same part more than once, so
+// the parts streamed are tracked for each user and track until the track
+// hasn't been streamed for a while. Each of these "sessions" counts as
+// at most one play, however it was found out about.
+//
+// If the user has scrobbling services, they are told when a session starts
+// ("now playing"), and the play is queued to be submitted to them.
+
+// How long after a track was last streamed to a user a new session starts.
+const playSessionTimeout = 30 * time.Minute
+
+// How many plays the recently played view shows, by default.
+const defaultRecentPlays = 50
+
+// How far in the future a reported play may be, for clients with clocks that are a little fast.
+const maxPlayClockSkew = 5 * time.Minute
+
+// Used instead of a user's name, for everyone's plays.
+const allUsers = "*"
+
+// byteRanges is a set of byte ranges, sorted and not overlapping.
+type byteRanges []byteRange
+
+type byteRange struct {
+	start int64
+	end   int64 // Exclusive
+}
+
+// add adds a range to the set, merging it with any ranges it touches.
+func (br byteRanges) add(start int64, end int64) byteRanges {
+	if end <= start {
+		return br
+	}
+	merged := make(byteRanges, 0, len(br)+1)
+	for _, r := range br {
+		if r.end < start || r.start > end {
+			merged = append(merged, r)
+			continue
+		}
+		start = min(start, r.start)
+		end = max(end, r.end)
+	}
+	merged = append(merged, byteRange{start: start, end: end})
+	slices.SortFunc(merged, func(a byteRange, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	return merged
+}
+
+// size returns how many bytes are in the set.
+func (br byteRanges) size() int64 {
+	size := int64(0)
+	for _, r := range br {
+		size += r.end - r.start
+	}
+	return size
+}
+
+// playedEnough returns true if enough of a track has been streamed to count
+// as a play: more than half of its data, or more than half of its duration
+// at its average bitrate. The second is less than the first for files with
+// a lot of other data, e.g.: cover art.
+func playedEnough(track catalog.Track, streamed int64) bool {
+	if track.DataLen > 0 && streamed*2 > track.DataLen {
+		return true
+	}
+	if track.Bitrate > 0 && track.Duration > 0 {
+		seconds := float64(streamed) * 8 / float64(track.Bitrate)
+		return seconds*2 > track.Duration.Seconds()
+	}
+	return false
+}
+
+type playSessionKey struct {
+	user    string
+	trackID string
+}
+
+// The parts of a track streamed to a user, and the play if there's been one.
+type playSession struct {
+	streamed  byteRanges
+	lastSeen  time.Time
+	play      *history.Play
+	announced bool // Whether the user's scrobbling services have been told it's playing
+}
+
+// playRecorder records plays in the history, and keeps the play counts for the catalog up to date.
+type playRecorder struct {
+	historyService history.HistoryService
+	scrobbles      scrobble.ScrobbleService // nil if no users have scrobbling services
+
+	mu       sync.Mutex
+	sessions map[playSessionKey]*playSession
+
+	countsMu         sync.Mutex
+	counts           map[string]catalog.PlayCount // Indexed by track ID; never modified, only replaced
+	countsGeneration uint64                       // Incremented whenever a play is recorded
+}
+
+func newPlayRecorder(historyService history.HistoryService, scrobbles scrobble.ScrobbleService) *playRecorder {
+	pr := &playRecorder{
+		historyService: historyService,
+		scrobbles:      scrobbles,
+		sessions:       make(map[playSessionKey]*playSession),
+	}
+	pr.updateCounts()
+	return pr
+}
+
+// updateCounts gets the play counts from the history again.
+func (pr *playRecorder) updateCounts() {
+	counts := make(map[string]catalog.PlayCount)
+	for id, count := range pr.historyService.GetCounts() {
+		counts[id] = catalog.PlayCount{Plays: count.Plays, LastPlayed: count.LastPlayed}
+	}
+	pr.countsMu.Lock()
+	defer pr.countsMu.Unlock()
+	pr.counts = counts
+	pr.countsGeneration++
+}
+
+// catalog returns a view of the catalog with the play counts. The counts
+// change with every play, so they aren't part of the catalog itself; that
+// would mean rebuilding it, and changing its generation, for every play.
+func (pr *playRecorder) catalog(catalogService catalog.CatalogService) catalog.CatalogService {
+	pr.countsMu.Lock()
+	defer pr.countsMu.Unlock()
+	return catalog.NewPlayedCatalog(catalogService, pr.counts)
+}
+
+// generation changes whenever the play counts do, e.g.: for ETags.
+func (pr *playRecorder) generation() uint64 {
+	pr.countsMu.Lock()
+	defer pr.countsMu.Unlock()
+	return pr.countsGeneration
+}
+
+// session returns the current session for a user and track, starting a new
+// one if there isn't one. Must be called with pr.mu held.
+func (pr *playRecorder) session(key playSessionKey, now time.Time) *playSession {
+	for k, s := range pr.sessions {
+		if now.Sub(s.lastSeen) > playSessionTimeout {
+			delete(pr.sessions, k)
+		}
+	}
+	s, ok := pr.sessions[key]
+	if !ok {
+		s = &playSession{}
+		pr.sessions[key] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// record adds a play to the history. Must be called with pr.mu held.
+func (pr *playRecorder) record(play history.Play, track catalog.Track) (history.Play, error) {
+	play.TrackID = track.ID
+	play.Name = track.Name
+	play.Title = track.Title
+	play.Artist = track.Artist
+	play.Album = track.Album
+	play.Duration = track.Duration
+	if err := pr.historyService.Record(play); err != nil {
+		return history.Play{}, err
+	}
+	slog.Debug("Recorded play", "user", play.User, "trackID", play.TrackID, "kind", play.Kind)
+
+	if listen, ok := listenFor(track, play.Time, play.Client); ok && pr.scrobbles != nil {
+		// The play has been recorded, so carry on if it can't be queued.
+		if err := pr.scrobbles.Scrobble(play.User, listen); err != nil {
+			slog.Error("Unable to queue play for scrobbling services", "user", play.User, "trackID", play.TrackID, "error", err)
+		}
+	}
+	pr.updateCounts()
+	return play, nil
+}
+
+// report records a play reported by a client, unless a play has already been
+// recorded for the session, e.g.: because the track was streamed by the server.
+// The play is returned, and whether it was recorded now.
+func (pr *playRecorder) report(play history.Play, track catalog.Track) (history.Play, bool, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	s := pr.session(playSessionKey{user: play.User, trackID: track.ID}, time.Now())
+	if s.play != nil {
+		return *s.play, false, nil
+	}
+	play, err := pr.record(play, track)
+	if err != nil {
+		return history.Play{}, false, err
+	}
+	s.play = &play
+	return play, true, nil
+}
+
+// started records that a track has started being streamed to a user,
+// from offset.
+func (pr *playRecorder) started(user string, client string, track catalog.Track, offset int64) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	now := time.Now()
+	key := playSessionKey{user: user, trackID: track.ID}
+	s := pr.session(key, now)
+	if s.play != nil && offset == 0 {
+		// Starting again from the beginning, so it's another play.
+		s = &playSession{lastSeen: now}
+		pr.sessions[key] = s
+	}
+
+	if s.announced || pr.scrobbles == nil {
+		return
+	}
+	s.announced = true
+	if listen, ok := listenFor(track, now, client); ok {
+		sendNowPlaying(pr.scrobbles, user, listen)
+	}
+}
+
+// streamed records that part of a track's data has been streamed to a user,
+// and records a play if enough of it has been. The source is the copy of the
+// track that was streamed, if duplicates are merged.
+func (pr *playRecorder) streamed(user string, client string, track catalog.Track, source catalog.Track, offset int64, length int64) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	now := time.Now()
+	s := pr.session(playSessionKey{user: user, trackID: track.ID}, now)
+	s.streamed = s.streamed.add(offset, offset+length)
+	if s.play != nil || !playedEnough(source, s.streamed.size()) {
+		return nil
+	}
+	play, err := pr.record(history.Play{Time: now, User: user, Client: client, Kind: history.PlayStreamed}, track)
+	if err != nil {
+		return err
+	}
+	s.play = &play
+	return nil
+}
+
+// playReader counts the bytes of a track's data that have been read.
+type playReader struct {
+	r io.Reader
+	n int64
+}
+
+func (pr *playReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+	return n, err
+}
+
+// stream records the streaming of a track's data, starting at offset, to the
+// logged in user. The returned function must be called when streaming has finished.
+func (pr *playRecorder) stream(c echo.Context, track catalog.Track, source catalog.Track, offset int64, r io.Reader) (io.Reader, func()) {
+	user := playUser(c)
+	client := c.Request().UserAgent()
+	pr.started(user, client, track, offset)
+	reader := &playReader{r: r}
+	return reader, func() {
+		if err := pr.streamed(user, client, track, source, offset, reader.n); err != nil {
+			slog.Error("Unable to record play", "trackID", track.ID, "error", err)
+		}
+	}
+}
+
+// playUser returns the name of the logged in user; empty if authentication is disabled.
+func playUser(c echo.Context) string {
+	if user, ok := currentUser(c); ok {
+		return user.Name
+	}
+	return ""
+}
+
+// playsQuery returns the query for the plays a user asked for. Users can
+// see their own plays. Admins can see anyone's, using ?user=<name>, or
+// everyone's, using ?user=*.
+func playsQuery(c echo.Context, authService auth.AuthService) (history.Query, error) {
+	q := history.Query{User: playUser(c)}
+	if name := c.QueryParam("user"); c.QueryParams().Has("user") && name != q.User {
+		if user, ok := currentUser(c); authService.Enabled() && (!ok || !user.Admin) {
+			return history.Query{}, echo.NewHTTPError(http.StatusForbidden, "only admins can see other users' plays")
+		}
+		q.User = name
+		q.AllUsers = name == allUsers
+	}
+	if since := c.QueryParam("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return history.Query{}, echo.NewHTTPError(http.StatusBadRequest, "since must be a time in RFC 3339 format, e.g.: 2024-01-31T12:00:00Z")
+		}
+		q.Since = t
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return history.Query{}, echo.NewHTTPError(http.StatusBadRequest, "limit must be a number, at least 0")
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+type playRequest struct {
+	TrackID string    `json:"trackId" form:"trackId"`
+	Client  string    `json:"client" form:"client"` // Defaults to the User-Agent
+	Time    time.Time `json:"time" form:"time"`     // When the track was played; defaults to now
+}
+
+// postAPIPlays records a play reported by a client, e.g.: a player that has
+// cached the track. If the server has already recorded the play, e.g.: because
+// it streamed the track, it's not recorded again.
+func postAPIPlays(c echo.Context, catalogService catalog.CatalogService, plays *playRecorder) error {
+	var req playRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	track, err := catalogService.GetTrack(req.TrackID)
+	if err != nil {
+		return err
+	}
+	if req.Client == "" {
+		req.Client = c.Request().UserAgent()
+	}
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	} else if req.Time.After(time.Now().Add(maxPlayClockSkew)) {
+		// A play in the future would be the last play of the track until then.
+		return echo.NewHTTPError(http.StatusBadRequest, "time must not be in the future")
+	}
+
+	play, recorded, err := plays.report(history.Play{Time: req.Time, User: playUser(c), Client: req.Client, Kind: history.PlayReported}, track)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		return c.JSON(http.StatusOK, play)
+	}
+	return c.JSON(http.StatusCreated, play)
+}
+
+// getPlays shows the recently played tracks, most recent first.
+func getPlays(c echo.Context, historyService history.HistoryService, authService auth.AuthService, api bool) error {
+	q, err := playsQuery(c, authService)
+	if err != nil {
+		return err
+	}
+	if q.Limit == 0 && c.QueryParam("limit") == "" {
+		q.Limit = defaultRecentPlays
+	}
+	plays := historyService.GetPlays(q)
+	slices.Reverse(plays)
+
+	if api || wantsJSON(c) {
+		return c.JSON(http.StatusOK, plays)
+	}
+	return c.Render(http.StatusOK, "plays.tmpl.html", plays)
+}
+
+// getPlaysExport sends the whole history, oldest first, as CSV or JSON.
+func getPlaysExport(c echo.Context, historyService history.HistoryService, authService auth.AuthService) error {
+	q, err := playsQuery(c, authService)
+	if err != nil {
+		return err
+	}
+	plays := historyService.GetPlays(q)
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	disposition := func(filename string) string {
+		return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	}
+	switch format {
+	case "csv":
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		c.Response().Header().Set(echo.HeaderContentDisposition, disposition("plays.csv"))
+		c.Response().WriteHeader(http.StatusOK)
+		return history.WriteCSV(c.Response(), plays)
+	case "json":
+		c.Response().Header().Set(echo.HeaderContentDisposition, disposition("plays.json"))
+		return c.JSON(http.StatusOK, plays)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "format must be csv or json")
+}
+
+func setupPlayEndpoints(g *echo.Group, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, ratingsService ratings.RatingsService) {
+	g.GET("/plays", func(c echo.Context) error {
+		return getPlays(c, plays.historyService, authService, false)
+	})
+	g.GET("/api/plays", func(c echo.Context) error {
+		return getPlays(c, plays.historyService, authService, true)
+	})
+	g.POST("/api/plays", func(c echo.Context) error {
+		return postAPIPlays(c, catalogFor(c, catalogService, authService, plays, ratingsService), plays)
+	})
+	g.GET("/api/plays/export", func(c echo.Context) error {
+		return getPlaysExport(c, plays.historyService, authService)
+	})
+}
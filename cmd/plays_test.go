@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/history"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestByteRanges(t *testing.T) {
+	var br byteRanges
+	br = br.add(100, 200)
+	br = br.add(0, 50)
+	br = br.add(300, 300) // Empty
+	assert.Equal(t, byteRanges{{0, 50}, {100, 200}}, br)
+	assert.Equal(t, int64(150), br.size())
+
+	// Fetching the same part again doesn't count twice.
+	br = br.add(120, 180)
+	assert.Equal(t, int64(150), br.size())
+
+	br = br.add(50, 100)
+	assert.Equal(t, byteRanges{{0, 200}}, br)
+	br = br.add(150, 250)
+	assert.Equal(t, byteRanges{{0, 250}}, br)
+}
+
+func TestPlayedEnough(t *testing.T) {
+	track := catalog.Track{DataLen: 1000}
+	assert.False(t, playedEnough(track, 500))
+	assert.True(t, playedEnough(track, 501))
+
+	// 100 seconds at 64 kbit/s is 800,000 bytes, but there's a lot of cover art.
+	track = catalog.Track{DataLen: 3000000, Duration: 100 * time.Second, Bitrate: 64000}
+	assert.False(t, playedEnough(track, 400000))
+	assert.True(t, playedEnough(track, 400008))
+
+	assert.False(t, playedEnough(catalog.Track{}, 1000))
+}
+
+func TestPlayEndpoints(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: "../testdata/services/storage/diskstorage/Music/cds"},
+		},
+		Users: []auth.User{
+			{Name: "parent", PasswordHash: hash, Admin: true},
+			{Name: "kid", PasswordHash: hash},
+		},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	parent := login(t, e, "parent", "secret")
+	kid := login(t, e, "kid", "secret")
+	request := func(method string, target string, body string, cookie *http.Cookie, headers map[string]string) *httptest.ResponseRecorder {
+		req := newJSONRequest(method, target, body)
+		req.AddCookie(cookie)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return doRequest(e, req)
+	}
+	getPlays := func(t *testing.T, target string, cookie *http.Cookie) []history.Play {
+		rec := request(http.MethodGet, target, "", cookie, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var plays []history.Play
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &plays))
+		return plays
+	}
+
+	var mp3, ogg catalog.Track
+	tracks, playlists := catalogService.GetTracks()
+	for _, track := range tracks {
+		switch track.MIMEType {
+		case storage.MP3MimeType:
+			mp3 = track
+		case storage.OggMimeType:
+			ogg = track
+		}
+	}
+	require.NotEmpty(t, mp3.ID)
+	var album catalog.Playlist
+	for _, playlist := range playlists {
+		for _, track := range playlist.Tracks {
+			if track.ID == mp3.ID {
+				album = playlist
+			}
+		}
+	}
+	require.NotEmpty(t, album.ID)
+
+	t.Run("Streamed", func(t *testing.T) {
+		third := mp3.DataLen / 3
+		rec := request(http.MethodGet, "/tracks/"+mp3.ID+"/data", "", kid, map[string]string{"Range": fmt.Sprintf("bytes=0-%d", third-1)})
+		require.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Empty(t, getPlays(t, "/api/plays", kid))
+
+		// Fetching the same part again isn't enough.
+		rec = request(http.MethodGet, "/tracks/"+mp3.ID+"/data", "", kid, map[string]string{"Range": fmt.Sprintf("bytes=100-%d", third-1)})
+		require.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Empty(t, getPlays(t, "/api/plays", kid))
+
+		rec = request(http.MethodGet, "/tracks/"+mp3.ID+"/data", "", kid, map[string]string{"Range": fmt.Sprintf("bytes=%d-", 2*third)})
+		require.Equal(t, http.StatusPartialContent, rec.Code)
+		plays := getPlays(t, "/api/plays", kid)
+		require.Len(t, plays, 1)
+		assert.Equal(t, "kid", plays[0].User)
+		assert.Equal(t, history.PlayStreamed, plays[0].Kind)
+		assert.Equal(t, mp3.ID, plays[0].TrackID)
+		assert.Equal(t, mp3.Title, plays[0].Title)
+
+		// The rest of the same play doesn't count again.
+		rec = request(http.MethodGet, "/tracks/"+mp3.ID+"/data", "", kid, map[string]string{"Range": "bytes=1000-"})
+		require.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Len(t, getPlays(t, "/api/plays", kid), 1)
+
+		// Downloads aren't plays.
+		rec = request(http.MethodGet, "/tracks/"+ogg.ID+"/data?download=1", "", kid, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, getPlays(t, "/api/plays", kid), 1)
+	})
+
+	t.Run("Reported", func(t *testing.T) {
+		// The server has already recorded this play.
+		rec := request(http.MethodPost, "/api/plays", `{"trackId": "`+mp3.ID+`"}`, kid, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, getPlays(t, "/api/plays", kid), 1)
+
+		rec = request(http.MethodPost, "/api/plays", `{"trackId": "`+mp3.ID+`", "client": "car stereo", "time": "2024-01-31T12:00:00Z"}`, parent, nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var play history.Play
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &play))
+		assert.Equal(t, "parent", play.User)
+		assert.Equal(t, "car stereo", play.Client)
+		assert.Equal(t, history.PlayReported, play.Kind)
+		assert.Equal(t, time.Date(2024, time.January, 31, 12, 0, 0, 0, time.UTC), play.Time.UTC())
+
+		rec = request(http.MethodPost, "/api/plays", `{"trackId": "`+mp3.ID+`"}`, parent, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = request(http.MethodPost, "/api/plays", `{"trackId": "nope"}`, parent, nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		future := time.Now().Add(time.Hour).Format(time.RFC3339)
+		rec = request(http.MethodPost, "/api/plays", `{"trackId": "`+mp3.ID+`", "time": "`+future+`"}`, parent, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "time must not be in the future")
+
+		// Clocks may be a little fast.
+		slightlyFast := time.Now().Add(time.Minute).Format(time.RFC3339)
+		rec = request(http.MethodPost, "/api/plays", `{"trackId": "`+mp3.ID+`", "time": "`+slightlyFast+`"}`, parent, nil)
+		assert.NotEqual(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+	})
+
+	t.Run("Counts", func(t *testing.T) {
+		rec := request(http.MethodGet, "/api/tracks/"+mp3.ID, "", kid, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var track catalog.Track
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &track))
+		assert.Equal(t, 2, track.Plays)
+		assert.False(t, track.LastPlayed.IsZero())
+
+		rec = request(http.MethodGet, "/api/playlists/"+album.ID, "", kid, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var playlist catalog.Playlist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &playlist))
+		assert.Equal(t, 2, playlist.Plays)
+
+		rec = request(http.MethodGet, "/api/tracks/"+ogg.ID, "", kid, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &track))
+		assert.Zero(t, track.Plays)
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		rec := request(http.MethodGet, "/api/plays?user=parent", "", kid, nil)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Len(t, getPlays(t, "/api/plays?user=kid", kid), 1)
+
+		plays := getPlays(t, "/api/plays?user=kid", parent)
+		require.Len(t, plays, 1)
+		assert.Equal(t, "kid", plays[0].User)
+
+		// Most recent first.
+		plays = getPlays(t, "/api/plays?user=*", parent)
+		require.Len(t, plays, 2)
+		assert.Equal(t, "kid", plays[0].User)
+		assert.Equal(t, "parent", plays[1].User)
+		assert.Len(t, getPlays(t, "/api/plays?user=*&limit=1", parent), 1)
+		assert.Len(t, getPlays(t, "/api/plays?user=*&since=2024-06-01T00:00:00Z", parent), 1)
+
+		rec = request(http.MethodGet, "/api/plays?limit=lots", "", parent, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = request(http.MethodGet, "/api/plays?since=yesterday", "", parent, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		rec := request(http.MethodGet, "/plays", "", kid, map[string]string{"Accept": "text/html"})
+		require.Equal(t, http.StatusOK, rec.Code)
+		body := rec.Body.String()
+		assert.Contains(t, body, "Recently played")
+		assert.Contains(t, body, `/tracks/`+mp3.ID+`">`)
+
+		rec = request(http.MethodGet, "/plays?user=nobody", "", parent, map[string]string{"Accept": "text/html"})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Nothing has been played yet.")
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		rec := request(http.MethodGet, "/api/plays/export?user=*", "", parent, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, `attachment; filename=plays.csv`, rec.Header().Get(echo.HeaderContentDisposition))
+		records, err := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		assert.Equal(t, "time", records[0][0])
+		// Oldest first.
+		assert.Equal(t, "parent", records[1][1])
+		assert.Equal(t, "kid", records[2][1])
+
+		rec = request(http.MethodGet, "/api/plays/export?format=json", "", kid, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, `attachment; filename=plays.json`, rec.Header().Get(echo.HeaderContentDisposition))
+		var plays []history.Play
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &plays))
+		assert.Len(t, plays, 1)
+
+		rec = request(http.MethodGet, "/api/plays/export?format=xml", "", kid, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("ETag", func(t *testing.T) {
+		rec := request(http.MethodGet, "/api/tracks", "", kid, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		etag := rec.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		// Plays change the play counts, but not the catalog.
+		generation := catalogService.Generation()
+		rec = request(http.MethodPost, "/api/plays", `{"trackId": "`+ogg.ID+`"}`, kid, nil)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		assert.Equal(t, generation, catalogService.Generation())
+
+		rec = request(http.MethodGet, "/api/tracks", "", kid, map[string]string{"If-None-Match": etag})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+		var tracks []catalog.Track
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tracks))
+		for _, track := range tracks {
+			if track.ID == ogg.ID {
+				assert.Equal(t, 1, track.Plays)
+			}
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Running behind a reverse proxy, e.g.: nginx serving the server under /music/.
+// The server's URLs can be moved under basePath, and the proxy can tell the server
+// how the client sees it using the X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Prefix headers. The headers are only used from trusted proxies,
+// since anyone can send them.
+
+const externalURLContextKey = "externalURL" // Key for the request's externalURL in echo.Context
+
+// Where the server is, as the client sees it.
+type externalURL struct {
+	Scheme string // http or https
+	Host   string // Host name, and port if not the default
+	Prefix string // Prefix for all paths, i.e. X-Forwarded-Prefix followed by basePath; empty if none
+
+	basePath string
+}
+
+// path returns the path that the client should use for a path on the server, e.g.: /static/favicon.png.
+func (u externalURL) path(p string) string {
+	return u.Prefix + p
+}
+
+// absolute returns the absolute URL for a path on the server, e.g.: for share links.
+func (u externalURL) absolute(p string) string {
+	return u.Scheme + "://" + u.Host + u.path(p)
+}
+
+// routePath returns the request's path relative to basePath, e.g.: /login.
+func (u externalURL) routePath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, u.basePath)
+}
+
+// requestURI returns the request's path and query, as the client sees it.
+func (u externalURL) requestURI(r *http.Request) string {
+	return u.Prefix + strings.TrimPrefix(r.URL.RequestURI(), u.basePath)
+}
+
+// cookiePath returns the path for cookies covering the whole server.
+func (u externalURL) cookiePath() string {
+	if u.Prefix == "" {
+		return "/"
+	}
+	return u.Prefix
+}
+
+// cleanBasePath makes sure that a base path starts with a slash, and doesn't end with one.
+// "/" is the same as no base path.
+func cleanBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// parseTrustedProxies parses IP addresses and CIDR ranges, e.g.: 10.0.0.0/8.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func isTrusted(trustedProxies []netip.Prefix, remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first of a comma-separated list of values,
+// as added by each proxy in turn.
+func firstHeaderValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// newExternalURL works out where the server is, as the client sees it.
+func newExternalURL(r *http.Request, basePath string, trusted bool) externalURL {
+	u := externalURL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Prefix:   basePath,
+		basePath: basePath,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if !trusted {
+		return u
+	}
+
+	if proto := strings.ToLower(firstHeaderValue(r, echo.HeaderXForwardedProto)); proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+		u.Host = host
+	}
+	if prefix := firstHeaderValue(r, "X-Forwarded-Prefix"); strings.HasPrefix(prefix, "/") && !strings.HasPrefix(prefix, "//") {
+		u.Prefix = cleanBasePath(prefix) + basePath
+	}
+	return u
+}
+
+// externalURLFor returns where the server is, as seen by the client making the request.
+func externalURLFor(c echo.Context) externalURL {
+	if u, ok := c.Get(externalURLContextKey).(externalURL); ok {
+		return u
+	}
+	return newExternalURL(c.Request(), "", false)
+}
+
+// proxyMiddleware works out the external URL for each request.
+// The forwarding headers are removed from requests that aren't from
+// trusted proxies, so that nothing else uses them.
+func proxyMiddleware(basePath string, trustedProxies []netip.Prefix) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			trusted := isTrusted(trustedProxies, r.RemoteAddr)
+			if !trusted {
+				for _, name := range []string{echo.HeaderXForwardedProto, echo.HeaderXForwardedProtocol, echo.HeaderXForwardedSsl, echo.HeaderXUrlScheme, "X-Forwarded-Host", "X-Forwarded-Prefix"} {
+					r.Header.Del(name)
+				}
+			}
+			c.Set(externalURLContextKey, newExternalURL(r, basePath, trusted))
+			return next(c)
+		}
+	}
+}
+
+// ipExtractor finds the client's IP address, using the X-Forwarded-For header from trusted proxies.
+func ipExtractor(trustedProxies []netip.Prefix) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, prefix := range trustedProxies {
+		options = append(options, echo.TrustIPRange(&net.IPNet{
+			IP:   prefix.Addr().AsSlice(),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+		}))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
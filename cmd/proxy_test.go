@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+)
+
+func TestCleanBasePath(t *testing.T) {
+	assert.Equal(t, "", cleanBasePath(""))
+	assert.Equal(t, "", cleanBasePath("/"))
+	assert.Equal(t, "/music", cleanBasePath("/music"))
+	assert.Equal(t, "/music", cleanBasePath("/music/"))
+	assert.Equal(t, "/music", cleanBasePath("music"))
+	assert.Equal(t, "/home/music", cleanBasePath("/home/music/"))
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"127.0.0.1", "10.1.2.3/8", "::1", "fd00::/8"})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("fd00::/8"),
+	}, proxies)
+
+	assert.True(t, isTrusted(proxies, "127.0.0.1:12345"))
+	assert.True(t, isTrusted(proxies, "10.9.8.7:12345"))
+	assert.True(t, isTrusted(proxies, "[::1]:12345"))
+	assert.True(t, isTrusted(proxies, "[::ffff:127.0.0.1]:12345"))
+	assert.False(t, isTrusted(proxies, "192.168.1.2:12345"))
+	assert.False(t, isTrusted(proxies, "garbage"))
+	assert.False(t, isTrusted(nil, "127.0.0.1:12345"))
+
+	_, err = parseTrustedProxies([]string{"localhost"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestNewExternalURL(t *testing.T) {
+	newRequest := func(target string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = "backend:1323"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+	forwarded := map[string]string{
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "music.example.com, proxy.internal",
+		"X-Forwarded-Prefix": "/family/",
+	}
+
+	t.Run("Direct", func(t *testing.T) {
+		req := newRequest("/music/tracks?library=cds", nil)
+		u := newExternalURL(req, "/music", false)
+		assert.Equal(t, externalURL{Scheme: "http", Host: "backend:1323", Prefix: "/music", basePath: "/music"}, u)
+		assert.Equal(t, "/music/static/favicon.png", u.path("/static/favicon.png"))
+		assert.Equal(t, "http://backend:1323/music/share/abc", u.absolute("/share/abc"))
+		assert.Equal(t, "/tracks", u.routePath(req))
+		assert.Equal(t, "/music/tracks?library=cds", u.requestURI(req))
+		assert.Equal(t, "/music", u.cookiePath())
+
+		req.TLS = &tls.ConnectionState{}
+		assert.Equal(t, "https", newExternalURL(req, "", false).Scheme)
+		assert.Equal(t, "/", newExternalURL(req, "", false).cookiePath())
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		u := newExternalURL(newRequest("/tracks", forwarded), "", false)
+		assert.Equal(t, externalURL{Scheme: "http", Host: "backend:1323"}, u)
+	})
+
+	t.Run("Trusted", func(t *testing.T) {
+		req := newRequest("/music/tracks?library=cds", forwarded)
+		u := newExternalURL(req, "/music", true)
+		assert.Equal(t, externalURL{Scheme: "https", Host: "music.example.com", Prefix: "/family/music", basePath: "/music"}, u)
+		assert.Equal(t, "https://music.example.com/family/music/share/abc", u.absolute("/share/abc"))
+		assert.Equal(t, "/tracks", u.routePath(req))
+		assert.Equal(t, "/family/music/tracks?library=cds", u.requestURI(req))
+	})
+
+	t.Run("TrustedBadHeaders", func(t *testing.T) {
+		u := newExternalURL(newRequest("/tracks", map[string]string{
+			"X-Forwarded-Proto":  "gopher",
+			"X-Forwarded-Prefix": "//evil.example.com",
+		}), "", true)
+		assert.Equal(t, externalURL{Scheme: "http", Host: "backend:1323"}, u)
+	})
+}
+
+func TestIPExtractor(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.2:12345"
+	req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7, 10.0.0.1")
+
+	assert.Equal(t, "10.0.0.2", ipExtractor(nil)(req))
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", ipExtractor(proxies)(req))
+
+	req.RemoteAddr = "192.168.1.2:12345"
+	assert.Equal(t, "192.168.1.2", ipExtractor(proxies)(req))
+}
+
+func TestBasePath(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	e, catalogService := setupTestServer(t, Config{
+		BasePath:       "/music",
+		TrustedProxies: []string{"192.0.2.0/24"}, // The address used by httptest
+		Users:          []auth.User{{Name: "fred", PasswordHash: hash}},
+		SessionMaxAge:  3600,
+		Secret:         "test secret",
+	})
+	tracks, playlists := catalogService.GetTracks()
+	require.Len(t, tracks, 1)
+	require.Len(t, playlists, 1)
+
+	form := url.Values{"username": {"fred"}, "password": {"secret"}, "next": {"/music/playlists"}}
+	req := httptest.NewRequest(http.MethodPost, "/music/login", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := doRequest(e, req)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/music/playlists", rec.Header().Get(echo.HeaderLocation))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	cookie := cookies[0]
+	assert.Equal(t, "/music", cookie.Path)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(cookie)
+		return doRequest(e, req)
+	}
+
+	t.Run("Routes", func(t *testing.T) {
+		for _, target := range []string{"/music", "/music/", "/music/tracks", "/music/playlists/" + playlists[0].ID, "/music/api/tracks", "/music/static/favicon.png"} {
+			assert.Equal(t, http.StatusOK, get(target).Code, target)
+		}
+		for _, target := range []string{"/", "/tracks", "/static/favicon.png", "/musicians"} {
+			assert.Equal(t, http.StatusNotFound, get(target).Code, target)
+		}
+	})
+
+	t.Run("Links", func(t *testing.T) {
+		body := get("/music").Body.String()
+		assert.Contains(t, body, `href="/music/static/favicon.png"`)
+		assert.Contains(t, body, `href="/music/tracks"`)
+		assert.Contains(t, body, `action="/music/logout"`)
+
+		body = get("/music/tracks").Body.String()
+		assert.Contains(t, body, `href="/music/tracks/`+tracks[0].ID+`"`)
+
+		body = get("/music/tracks/" + tracks[0].ID).Body.String()
+		assert.Contains(t, body, `src="/music/tracks/`+tracks[0].ID+`/data"`)
+		assert.Contains(t, body, `action="/music/shares"`)
+
+		body = get("/music/playlists/" + playlists[0].ID).Body.String()
+		assert.Contains(t, body, `src="/music/tracks/`+tracks[0].ID+`/data"`)
+		assert.Contains(t, body, `src="/music/static/playlistsbyid.js"`)
+		assert.Contains(t, body, `href="/music/playlists/`+playlists[0].ID+`/export"`)
+
+		body = get("/music/playlists/" + playlists[0].ID + "/export").Body.String()
+		assert.Contains(t, body, "\nhttp://example.com/music/tracks/"+tracks[0].ID+"/data\n")
+	})
+
+	t.Run("LoginRedirect", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/music/tracks?library=null", nil)
+		req.Header.Set(echo.HeaderAccept, echo.MIMETextHTML)
+		rec := doRequest(e, req)
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "/music/login?next=%2Fmusic%2Ftracks%3Flibrary%3Dnull", rec.Header().Get(echo.HeaderLocation))
+
+		body := doRequest(e, httptest.NewRequest(http.MethodGet, "/music/login", nil)).Body.String()
+		assert.Contains(t, body, `action="/music/login"`)
+		assert.Contains(t, body, `value="/music/"`)
+	})
+
+	t.Run("ForwardedHeaders", func(t *testing.T) {
+		req := newJSONRequest(http.MethodPost, "/music/api/shares", `{"scope": "track", "id": "`+tracks[0].ID+`"}`)
+		req.AddCookie(cookie)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "music.example.com")
+		req.Header.Set("X-Forwarded-Prefix", "/apps")
+		rec := doRequest(e, req)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var share shareResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &share))
+		assert.Equal(t, "https://music.example.com/apps/music/share/"+share.Token, share.URL)
+
+		req = httptest.NewRequest(http.MethodGet, "/music/share/"+share.Token, nil)
+		req.Header.Set("X-Forwarded-Prefix", "/apps")
+		body := doRequest(e, req).Body.String()
+		assert.Contains(t, body, `src="/apps/music/share/`+share.Token+`/data"`)
+		assert.Contains(t, body, `href="/apps/music/static/favicon.png"`)
+	})
+
+	t.Run("UntrustedForwardedHeaders", func(t *testing.T) {
+		req := newJSONRequest(http.MethodPost, "/music/api/shares", `{"scope": "track", "id": "`+tracks[0].ID+`"}`)
+		req.RemoteAddr = "198.51.100.1:1234"
+		req.AddCookie(cookie)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "evil.example.com")
+		rec := doRequest(e, req)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var share shareResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &share))
+		assert.Equal(t, "http://example.com/music/share/"+share.Token, share.URL)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+)
+
+// Users can rate tracks and playlists, e.g.: albums, from 1 to 5 stars, and
+// star them, from the player pages and using the API. Each user has their
+// own ratings. A user's rating of a track replaces the rating from its tags,
+// which everyone sees until they rate the track themselves.
+
+// ratedCatalog returns the catalog with the user's ratings.
+func ratedCatalog(catalogService catalog.CatalogService, ratingsService ratings.RatingsService, user string) catalog.CatalogService {
+	userRatings := ratingsService.Get(user)
+	catalogRatings := make(map[string]catalog.Rating, len(userRatings))
+	for id, rating := range userRatings {
+		catalogRatings[id] = catalog.Rating{Stars: rating.Stars, Starred: rating.Starred}
+	}
+	return catalog.NewRatedCatalog(catalogService, catalogRatings)
+}
+
+// ratingsUser returns the name of the user whose ratings to use;
+// empty when authentication is disabled.
+func ratingsUser(c echo.Context) string {
+	user, _ := currentUser(c)
+	return user.Name
+}
+
+// ratedID returns the ID to rate a track or playlist with, if the user can see it.
+// Tracks may be rated using the ID of any of their copies, if duplicates are merged.
+func ratedID(catalogService catalog.CatalogService, id string) (string, error) {
+	track, err := catalogService.GetTrack(id)
+	if err == nil {
+		return track.ID, nil
+	}
+	if !errors.Is(err, catalog.ErrNotFound) {
+		return "", err
+	}
+	playlist, err := catalogService.GetPlaylist(id)
+	if err != nil {
+		return "", err
+	}
+	return playlist.ID, nil
+}
+
+// updateRating changes the user's rating of a track or playlist. If stars or
+// starred are nil, they are left as they were.
+func updateRating(catalogService catalog.CatalogService, ratingsService ratings.RatingsService, user string, id string, stars *int, starred *bool) (apiRating, error) {
+	id, err := ratedID(catalogService, id)
+	if err != nil {
+		return apiRating{}, err
+	}
+	var updated ratings.Rating
+	err = ratingsService.Update(user, id, func(rating ratings.Rating) ratings.Rating {
+		if stars != nil {
+			rating.Stars = *stars
+		}
+		if starred != nil {
+			rating.Starred = *starred
+		}
+		updated = rating
+		return rating
+	})
+	if err != nil {
+		return apiRating{}, err
+	}
+	return apiRating{ID: id, Rating: updated}, nil
+}
+
+type apiRating struct {
+	ID string `json:"id"`
+	ratings.Rating
+}
+
+type ratingRequest struct {
+	Rating  *int  `json:"rating"`
+	Starred *bool `json:"starred"`
+}
+
+func getAPIRatings(c echo.Context, ratingsService ratings.RatingsService) error {
+	return c.JSON(http.StatusOK, ratingsService.Get(ratingsUser(c)))
+}
+
+// putAPIRatings rates or stars a track or playlist. Fields left out are unchanged.
+func putAPIRatings(c echo.Context, catalogService catalog.CatalogService, ratingsService ratings.RatingsService) error {
+	var req ratingRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	rating, err := updateRating(catalogService, ratingsService, ratingsUser(c), c.Param("id"), req.Rating, req.Starred)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, rating)
+}
+
+func deleteAPIRatings(c echo.Context, catalogService catalog.CatalogService, ratingsService ratings.RatingsService) error {
+	none, unstarred := 0, false
+	if _, err := updateRating(catalogService, ratingsService, ratingsUser(c), c.Param("id"), &none, &unstarred); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// postRating handles the rating and star forms on the player pages, which send
+// either the rating or whether the track or playlist is starred, then shows
+// the page again.
+func postRating(c echo.Context, catalogService catalog.CatalogService, ratingsService ratings.RatingsService, page string) error {
+	var stars *int
+	var starred *bool
+	if value := c.FormValue("rating"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "rating must be a number of stars")
+		}
+		stars = &n
+	}
+	if value := c.FormValue("starred"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "starred must be true or false")
+		}
+		starred = &b
+	}
+
+	id := c.Param("id")
+	if _, err := updateRating(catalogService, ratingsService, ratingsUser(c), id, stars, starred); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, externalURLFor(c).path(page+id))
+}
+
+func setupRatingEndpoints(g *echo.Group, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, ratingsService ratings.RatingsService) {
+	g.POST("/tracks/:id/rating", func(c echo.Context) error {
+		return postRating(c, catalogFor(c, catalogService, authService, plays, ratingsService), ratingsService, "/tracks/")
+	})
+	g.POST("/playlists/:id/rating", func(c echo.Context) error {
+		return postRating(c, catalogFor(c, catalogService, authService, plays, ratingsService), ratingsService, "/playlists/")
+	})
+	g.GET("/api/ratings", func(c echo.Context) error {
+		return getAPIRatings(c, ratingsService)
+	})
+	g.PUT("/api/ratings/:id", func(c echo.Context) error {
+		return putAPIRatings(c, catalogFor(c, catalogService, authService, plays, ratingsService), ratingsService)
+	})
+	g.DELETE("/api/ratings/:id", func(c echo.Context) error {
+		return deleteAPIRatings(c, catalogFor(c, catalogService, authService, plays, ratingsService), ratingsService)
+	})
+}
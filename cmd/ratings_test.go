@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestRatingEndpoints(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: "../testdata/services/storage/diskstorage/Music/cds"},
+		},
+		SmartPlaylists: []SmartPlaylistConfig{
+			{Name: "Favourites", Rule: "starred", Sort: "rating desc"},
+		},
+		Users: []auth.User{
+			{Name: "fred", PasswordHash: hash},
+			{Name: "wilma", PasswordHash: hash},
+		},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	fred := login(t, e, "fred", "secret")
+	wilma := login(t, e, "wilma", "secret")
+	request := func(method string, target string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := newJSONRequest(method, target, body)
+		req.AddCookie(cookie)
+		return doRequest(e, req)
+	}
+	getJSON := func(t *testing.T, target string, cookie *http.Cookie, v any) {
+		rec := request(http.MethodGet, target, "", cookie)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	getTrack := func(t *testing.T, id string, cookie *http.Cookie) catalog.Track {
+		var track catalog.Track
+		getJSON(t, "/api/tracks/"+id, cookie, &track)
+		return track
+	}
+
+	var mp3, flac catalog.Track
+	tracks, playlists := catalogService.GetTracks()
+	for _, track := range tracks {
+		switch track.MIMEType {
+		case storage.MP3MimeType:
+			mp3 = track
+		case storage.FlacMimeType:
+			flac = track
+		}
+	}
+	require.NotEmpty(t, mp3.ID)
+	require.NotEmpty(t, flac.ID)
+	var album, favourites catalog.Playlist
+	for _, playlist := range playlists {
+		if playlist.Smart {
+			favourites = playlist
+		} else if len(playlist.Tracks) > 0 && playlist.Tracks[0].ID == mp3.ID {
+			album = playlist
+		}
+	}
+	require.NotEmpty(t, album.ID)
+	require.NotEmpty(t, favourites.ID)
+
+	t.Run("Rate", func(t *testing.T) {
+		rec := request(http.MethodPut, "/api/ratings/"+mp3.ID, `{"rating": 4, "starred": true}`, fred)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.JSONEq(t, `{"id": "`+mp3.ID+`", "rating": 4, "starred": true}`, rec.Body.String())
+
+		track := getTrack(t, mp3.ID, fred)
+		assert.Equal(t, 4, track.Rating)
+		assert.True(t, track.Starred)
+
+		// Each user has their own ratings.
+		track = getTrack(t, mp3.ID, wilma)
+		assert.Zero(t, track.Rating)
+		assert.False(t, track.Starred)
+
+		// Fields left out are unchanged.
+		rec = request(http.MethodPut, "/api/ratings/"+mp3.ID, `{"starred": false}`, fred)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		track = getTrack(t, mp3.ID, fred)
+		assert.Equal(t, 4, track.Rating)
+		assert.False(t, track.Starred)
+
+		rec = request(http.MethodPut, "/api/ratings/"+flac.ID, `{"rating": 2, "starred": true}`, fred)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var fredRatings map[string]ratings.Rating
+		getJSON(t, "/api/ratings", fred, &fredRatings)
+		assert.Equal(t, map[string]ratings.Rating{mp3.ID: {Stars: 4}, flac.ID: {Stars: 2, Starred: true}}, fredRatings)
+	})
+
+	t.Run("Albums", func(t *testing.T) {
+		rec := request(http.MethodPut, "/api/ratings/"+album.ID, `{"rating": 5, "starred": true}`, fred)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var playlist catalog.Playlist
+		getJSON(t, "/api/playlists/"+album.ID, fred, &playlist)
+		assert.Equal(t, 5, playlist.Rating)
+		assert.True(t, playlist.Starred)
+		assert.Equal(t, 4, playlist.Tracks[0].Rating)
+
+		var unrated catalog.Playlist
+		getJSON(t, "/api/playlists/"+album.ID, wilma, &unrated)
+		assert.Zero(t, unrated.Rating)
+		assert.False(t, unrated.Starred)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		rec := request(http.MethodPut, "/api/ratings/"+mp3.ID, `{"rating": 6}`, fred)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "rating must be from 1 to 5 stars")
+
+		rec = request(http.MethodPut, "/api/ratings/missing", `{"rating": 3}`, fred)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		rec = request(http.MethodPut, "/api/ratings/"+mp3.ID, `{"rating": "lots"}`, fred)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Queries", func(t *testing.T) {
+		ids := func(t *testing.T, query url.Values, cookie *http.Cookie) []string {
+			var tracks []catalog.Track
+			getJSON(t, "/api/tracks?"+query.Encode(), cookie, &tracks)
+			ids := make([]string, 0)
+			for _, track := range tracks {
+				ids = append(ids, track.ID)
+			}
+			return ids
+		}
+		assert.Equal(t, []string{mp3.ID, flac.ID}, ids(t, url.Values{"rule": {"rating > 0"}, "sort": {"rating desc"}}, fred))
+		assert.Equal(t, []string{flac.ID, mp3.ID}, ids(t, url.Values{"rule": {"rating > 0"}, "sort": {"rating"}}, fred))
+		assert.Equal(t, []string{flac.ID}, ids(t, url.Values{"rule": {"starred"}}, fred))
+		assert.Empty(t, ids(t, url.Values{"rule": {"starred"}}, wilma))
+		assert.Len(t, ids(t, url.Values{"rule": {"NOT starred"}}, wilma), len(tracks))
+
+		rec := request(http.MethodGet, "/api/tracks?rule=rating+%3E", "", fred)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "rule: expected a value after rating")
+		rec = request(http.MethodGet, "/api/tracks?sort=colour", "", fred)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `sort: unknown field \"colour\"`)
+	})
+
+	t.Run("SmartPlaylists", func(t *testing.T) {
+		var playlist catalog.Playlist
+		getJSON(t, "/api/playlists/"+favourites.ID, fred, &playlist)
+		require.Len(t, playlist.Tracks, 1)
+		assert.Equal(t, flac.ID, playlist.Tracks[0].ID)
+
+		getJSON(t, "/api/playlists/"+favourites.ID, wilma, &playlist)
+		assert.Empty(t, playlist.Tracks)
+	})
+
+	t.Run("ETag", func(t *testing.T) {
+		rec := request(http.MethodGet, "/api/tracks", "", fred)
+		require.Equal(t, http.StatusOK, rec.Code)
+		etag := rec.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		rec = request(http.MethodPut, "/api/ratings/"+mp3.ID, `{"rating": 3}`, fred)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		req := newJSONRequest(http.MethodGet, "/api/tracks", "")
+		req.AddCookie(fred)
+		req.Header.Set("If-None-Match", etag)
+		rec = doRequest(e, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		postForm := func(target string, form url.Values) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			req.AddCookie(wilma)
+			return doRequest(e, req)
+		}
+		rec := postForm("/tracks/"+mp3.ID+"/rating", url.Values{"rating": {"2"}})
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "/tracks/"+mp3.ID, rec.Header().Get(echo.HeaderLocation))
+		rec = postForm("/tracks/"+mp3.ID+"/rating", url.Values{"starred": {"true"}})
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		track := getTrack(t, mp3.ID, wilma)
+		assert.Equal(t, 2, track.Rating)
+		assert.True(t, track.Starred)
+
+		rec = postForm("/playlists/"+album.ID+"/rating", url.Values{"rating": {"3"}})
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "/playlists/"+album.ID, rec.Header().Get(echo.HeaderLocation))
+
+		rec = postForm("/tracks/"+mp3.ID+"/rating", url.Values{"starred": {"maybe"}})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = request(http.MethodGet, "/tracks/"+mp3.ID, "", wilma)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "★★☆☆☆ - starred")
+		assert.Contains(t, rec.Body.String(), `<option value="2" selected>`)
+		assert.Contains(t, rec.Body.String(), ">Unstar</button>")
+
+		rec = request(http.MethodGet, "/playlists/"+album.ID, "", wilma)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "★★★☆☆")
+		assert.Contains(t, rec.Body.String(), ">Star</button>")
+
+		rec = request(http.MethodGet, "/tracks?rule=starred", "", wilma)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `<a href="/tracks/`+mp3.ID+`">`)
+		assert.Contains(t, rec.Body.String(), "</a> ★★☆☆☆ - starred")
+		assert.NotContains(t, rec.Body.String(), flac.ID)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		rec := request(http.MethodDelete, "/api/ratings/"+mp3.ID, "", wilma)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		var wilmaRatings map[string]ratings.Rating
+		getJSON(t, "/api/ratings", wilma, &wilmaRatings)
+		assert.Equal(t, map[string]ratings.Rating{album.ID: {Stars: 3}}, wilmaRatings)
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/internal/logging"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// liveConfig holds the current configuration, which can change
+// while the server is running when the configuration is reloaded.
+type liveConfig struct {
+	mu     sync.RWMutex
+	config Config
+}
+
+func newLiveConfig(config Config) *liveConfig {
+	return &liveConfig{config: config}
+}
+
+func (lc *liveConfig) Get() Config {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.config
+}
+
+func (lc *liveConfig) set(config Config) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.config = config
+}
+
+// reloader re-reads the configuration and applies it to the running server.
+type reloader struct {
+	mu sync.Mutex // Only one reload at a time
+
+	configs        *liveConfig
+	catalogService catalog.CatalogService
+	logger         *logging.Logger
+	loadConfig     func() (Config, error)
+}
+
+func newReloader(configs *liveConfig, catalogService catalog.CatalogService, logger *logging.Logger, loadConfig func() (Config, error)) *reloader {
+	return &reloader{
+		configs:        configs,
+		catalogService: catalogService,
+		logger:         logger,
+		loadConfig:     loadConfig,
+	}
+}
+
+// Whether a storage needs to be rebuilt for its new configuration.
+// The cache max age is looked up for each request, so changing it
+// doesn't need the storage to be scanned again.
+func storageConfigChanged(oldConfig StorageServiceConfig, newConfig StorageServiceConfig) bool {
+	oldConfig.CacheMaxAge = nil
+	newConfig.CacheMaxAge = nil
+	return !reflect.DeepEqual(oldConfig, newConfig)
+}
+
+// keepSetting keeps the old value of a setting that can't be changed
+// without restarting the server, and records the name of the setting
+// if it has been changed.
+func keepSetting[T any](changed *[]string, name string, oldValue T, newValue *T) {
+	if !reflect.DeepEqual(oldValue, *newValue) {
+		*changed = append(*changed, name)
+		*newValue = oldValue
+	}
+}
+
+// Keep the settings which can't be changed without restarting the server,
+// so that the live configuration has the settings that are actually in use.
+// The names of any settings which were changed are returned.
+func keepRestartSettings(oldConfig Config, newConfig Config) (Config, []string) {
+	changed := make([]string, 0)
+	keepSetting(&changed, "host/port", oldConfig.Addr, &newConfig.Addr)
+	keepSetting(&changed, "adminHost/adminPort", oldConfig.AdminAddr, &newConfig.AdminAddr)
+	keepSetting(&changed, "users", oldConfig.Users, &newConfig.Users)
+	keepSetting(&changed, "groups", oldConfig.Groups, &newConfig.Groups)
+	keepSetting(&changed, "usersFile", oldConfig.UsersFile, &newConfig.UsersFile)
+	keepSetting(&changed, "sessionMaxAge", oldConfig.SessionMaxAge, &newConfig.SessionMaxAge)
+	keepSetting(&changed, "secret", oldConfig.Secret, &newConfig.Secret)
+	keepSetting(&changed, "denylistFile", oldConfig.DenylistFile, &newConfig.DenylistFile)
+	keepSetting(&changed, "logFormat", oldConfig.Log.Format, &newConfig.Log.Format)
+	keepSetting(&changed, "logFile", oldConfig.Log.File, &newConfig.Log.File)
+	keepSetting(&changed, "logMaxSize", oldConfig.Log.MaxSize, &newConfig.Log.MaxSize)
+	keepSetting(&changed, "logMaxBackups", oldConfig.Log.MaxBackups, &newConfig.Log.MaxBackups)
+	keepSetting(&changed, "basePath", oldConfig.BasePath, &newConfig.BasePath)
+	keepSetting(&changed, "trustedProxies", oldConfig.TrustedProxies, &newConfig.TrustedProxies)
+	keepSetting(&changed, "tls", oldConfig.TLS, &newConfig.TLS)
+	keepSetting(&changed, "idCollisions", oldConfig.IDCollisions, &newConfig.IDCollisions)
+	keepSetting(&changed, "mergeDuplicates", oldConfig.MergeDuplicates, &newConfig.MergeDuplicates)
+	keepSetting(&changed, "smartPlaylistsFile", oldConfig.SmartPlaylistsFile, &newConfig.SmartPlaylistsFile)
+	keepSetting(&changed, "playsFile", oldConfig.PlaysFile, &newConfig.PlaysFile)
+	keepSetting(&changed, "ratingsFile", oldConfig.RatingsFile, &newConfig.RatingsFile)
+	keepSetting(&changed, "scrobblers", oldConfig.Scrobblers, &newConfig.Scrobblers)
+	keepSetting(&changed, "scrobbleQueueFile", oldConfig.ScrobbleQueueFile, &newConfig.ScrobbleQueueFile)
+	keepSetting(&changed, "scrobbleRetryInterval", oldConfig.ScrobbleRetryInterval, &newConfig.ScrobbleRetryInterval)
+	return newConfig, changed
+}
+
+// reload re-reads the configuration, and applies it to the running server.
+// Only the storages that have been added, removed or changed are rebuilt;
+// the other storages are left alone. The storages and the smart playlists
+// are replaced in the catalog in one step, in the order they are configured,
+// so that it is the same as after a restart. If the new configuration is
+// invalid, or a storage can't be loaded, nothing is changed.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	newConfig, err := r.loadConfig()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := validateConfig(newConfig); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	level, err := logging.ParseLevel(newConfig.Log.Level)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	newStorageConfigs := newConfig.storageConfigs()
+	oldConfig := r.configs.Get()
+
+	oldStorageConfigs := make(map[string]StorageServiceConfig, 0)
+	for _, css := range oldConfig.storageConfigs() {
+		oldStorageConfigs[css.storageName()] = css
+	}
+	currentStorages := make(map[string]storage.StorageService, 0)
+	for _, ss := range r.catalogService.GetStorages() {
+		currentStorages[ss.GetName()] = ss
+	}
+
+	// Build the new and changed storages, and any that couldn't be loaded before,
+	// before changing anything.
+	toLoad := make([]StorageServiceConfig, 0)
+	kept := make(map[string]storage.StorageService, 0)
+	for _, css := range newStorageConfigs {
+		name := css.storageName()
+		oldCSS, wasConfigured := oldStorageConfigs[name]
+		if ss, ok := currentStorages[name]; ok && wasConfigured && !storageConfigChanged(oldCSS, css) {
+			kept[name] = ss
+			continue
+		}
+		toLoad = append(toLoad, css)
+	}
+	loading := loadStorages(toLoad)
+	loaded := make(map[string]storage.StorageService, len(loading))
+	for _, ls := range loading {
+		if ls.err != nil {
+			if !ls.config.IgnoreErrors {
+				return ls.err
+			}
+			// As when starting up, storages that can't be loaded are left out.
+			slog.Warn("Ignoring storage that could not be loaded", "error", ls.err)
+			continue
+		}
+		loaded[ls.config.storageName()] = ls.ss
+	}
+
+	// The storages are in the order they are configured, since that says
+	// which copy of a track is used when more than one storage has it.
+	storages := make([]storage.StorageService, 0, len(newStorageConfigs))
+	for _, css := range newStorageConfigs {
+		name := css.storageName()
+		if ss, ok := kept[name]; ok {
+			storages = append(storages, ss)
+		} else if ss, ok := loaded[name]; ok {
+			storages = append(storages, ss)
+		}
+	}
+	if err := r.catalogService.Reconfigure(storages, newConfig.smartPlaylists()); err != nil {
+		return err
+	}
+	for name := range currentStorages {
+		if _, ok := kept[name]; !ok {
+			if _, ok := loaded[name]; !ok {
+				slog.Info("Removed storage", "storage", name)
+			}
+		}
+	}
+	warnCollisions(r.catalogService)
+
+	newConfig, changed := keepRestartSettings(oldConfig, newConfig)
+	if len(changed) > 0 {
+		slog.Warn("Some settings will only change after a restart", "settings", changed)
+	}
+	r.configs.set(newConfig)
+	r.logger.SetLevel(level)
+	slog.Info("Reloaded configuration", "storagesLoaded", len(loaded), "storages", len(storages))
+	return nil
+}
+
+func postReload(c echo.Context, r *reloader) error {
+	if err := r.reload(); err != nil {
+		slog.Error("Unable to reload configuration", "error", err)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
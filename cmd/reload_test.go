@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/internal/logging"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestReload(t *testing.T) {
+	cdsPath := "../testdata/services/storage/diskstorage/Music/cds"
+	musicPath := t.TempDir()
+	data, err := os.ReadFile(filepath.Join(cdsPath, "Artist/Album1/track1-example.ogg"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(musicPath, "track.ogg"), data, 0o644))
+
+	oneDay := 86400
+	config := Config{
+		Addr:        ":1323",
+		CacheMaxAge: 3600,
+		StorageServices: []StorageServiceConfig{
+			{Type: "nullStorage"},
+			{Type: "diskStorage", Name: "cds", Path: cdsPath},
+		},
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	configs := newLiveConfig(config)
+	logger, err := logging.New(logging.Options{}, io.Discard)
+	require.NoError(t, err)
+
+	var newConfig Config
+	var loadErr error
+	r := newReloader(configs, catalogService, logger, func() (Config, error) {
+		return newConfig, loadErr
+	})
+
+	storageByName := func(name string) storage.StorageService {
+		for _, ss := range catalogService.GetStorages() {
+			if ss.GetName() == name {
+				return ss
+			}
+		}
+		return nil
+	}
+	cds := storageByName("cds")
+	require.NotNil(t, cds)
+
+	t.Run("LiveSettings", func(t *testing.T) {
+		newConfig = config
+		newConfig.StorageServices = []StorageServiceConfig{
+			{Type: "nullStorage"},
+			{Type: "diskStorage", Name: "cds", Path: cdsPath, CacheMaxAge: &oneDay},
+		}
+		newConfig.Log.Level = "debug"
+		require.NoError(t, r.reload())
+
+		// The storage doesn't need to be scanned again.
+		assert.Same(t, cds, storageByName("cds"))
+		assert.Equal(t, oneDay, configs.Get().cacheMaxAgeFor(cds.GetID()))
+		assert.True(t, logger.Enabled(context.Background(), slog.LevelDebug))
+	})
+
+	t.Run("AddAndRemoveStorages", func(t *testing.T) {
+		newConfig.StorageServices = []StorageServiceConfig{
+			{Type: "diskStorage", Name: "music", Path: musicPath},
+			{Type: "diskStorage", Name: "cds", Path: cdsPath, CacheMaxAge: &oneDay},
+		}
+		require.NoError(t, r.reload())
+
+		assert.Nil(t, storageByName("null"))
+		assert.Same(t, cds, storageByName("cds"))
+		music := storageByName("music")
+		require.NotNil(t, music)
+
+		// The new storage goes where it is in the configuration, as after a restart.
+		assert.Equal(t, []storage.StorageService{music, cds}, catalogService.GetStorages())
+
+		tracks, _ := catalogService.GetTracks()
+		assert.Len(t, tracks, 5)
+	})
+
+	t.Run("ChangeStorage", func(t *testing.T) {
+		newConfig.StorageServices = []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: cdsPath, CacheMaxAge: &oneDay, IgnorePatterns: []string{"Album2"}},
+			{Type: "diskStorage", Name: "music", Path: musicPath},
+		}
+		generation := catalogService.Generation()
+		require.NoError(t, r.reload())
+
+		newCDs := storageByName("cds")
+		require.NotNil(t, newCDs)
+		assert.NotSame(t, cds, newCDs)
+		assert.Equal(t, cds.GetID(), newCDs.GetID())
+
+		// The storages are replaced and reordered in one step.
+		assert.Equal(t, generation+1, catalogService.Generation())
+		assert.Same(t, newCDs, catalogService.GetStorages()[0])
+
+		tracks, _ := catalogService.GetTracks()
+		assert.Len(t, tracks, 3)
+	})
+
+	t.Run("SmartPlaylists", func(t *testing.T) {
+		newConfig.SmartPlaylists = []SmartPlaylistConfig{{Name: "Oggs", Rule: "format = ogg"}}
+		require.NoError(t, r.reload())
+		smartPlaylists := catalogService.GetSmartPlaylists()
+		require.Len(t, smartPlaylists, 1)
+		playlist, err := catalogService.GetPlaylist(smartPlaylists[0].ID)
+		require.NoError(t, err)
+		assert.Len(t, playlist.Tracks, 2)
+
+		// Reloading the same configuration doesn't change the catalog.
+		generation := catalogService.Generation()
+		require.NoError(t, r.reload())
+		assert.Equal(t, generation, catalogService.Generation())
+
+		// Smart playlists added using the API are kept.
+		_, err = catalogService.AddSmartPlaylist(catalog.SmartPlaylist{Name: "Added"})
+		require.NoError(t, err)
+		newConfig.SmartPlaylists = nil
+		require.NoError(t, r.reload())
+		smartPlaylists = catalogService.GetSmartPlaylists()
+		require.Len(t, smartPlaylists, 1)
+		assert.Equal(t, "Added", smartPlaylists[0].Name)
+
+		newConfig.SmartPlaylists = []SmartPlaylistConfig{{Name: "Added"}}
+		assert.ErrorIs(t, r.reload(), catalog.ErrExists)
+		newConfig.SmartPlaylists = []SmartPlaylistConfig{{Name: "Bad", Rule: "colour = red"}}
+		assert.ErrorIs(t, r.reload(), catalog.ErrInvalid)
+		newConfig.SmartPlaylists = nil
+		require.NoError(t, catalogService.RemoveSmartPlaylist(smartPlaylists[0].ID))
+	})
+
+	t.Run("RestartSettings", func(t *testing.T) {
+		newConfig.Addr = ":1337"
+		newConfig.CacheMaxAge = 60
+		newConfig.IDCollisions = "namespace"
+		newConfig.MergeDuplicates = true
+		newConfig.SmartPlaylistsFile = "/tmp/smartplaylists.json"
+		newConfig.PlaysFile = "/tmp/plays.jsonl"
+		newConfig.RatingsFile = "/tmp/ratings.json"
+		newConfig.Scrobblers = []ScrobblerConfig{{Type: "listenbrainz", Token: "abc"}}
+		require.NoError(t, r.reload())
+		assert.Equal(t, ":1323", configs.Get().Addr)
+		assert.Empty(t, configs.Get().IDCollisions)
+		assert.False(t, configs.Get().MergeDuplicates)
+		assert.Empty(t, configs.Get().SmartPlaylistsFile)
+		assert.Empty(t, configs.Get().PlaysFile)
+		assert.Empty(t, configs.Get().RatingsFile)
+		assert.Empty(t, configs.Get().Scrobblers)
+		assert.Equal(t, 60, configs.Get().CacheMaxAge)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		before := configs.Get()
+		tracksBefore, _ := catalogService.GetTracks()
+		storagesBefore := catalogService.GetStorages()
+
+		loadErr = errors.New("bad JSON")
+		assert.Error(t, r.reload())
+		loadErr = nil
+
+		valid := newConfig
+		newConfig.Log.Level = "loud"
+		assert.Error(t, r.reload())
+		newConfig = valid
+
+		newConfig.StorageServices = []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: cdsPath},
+			{Type: "diskStorage", Name: "cds", Path: musicPath},
+		}
+		assert.Error(t, r.reload())
+
+		newConfig.StorageServices = []StorageServiceConfig{
+			{Type: "diskStorage", Name: "missing", Path: "../testdata/__DOES_NOT_EXIST__"},
+		}
+		assert.Error(t, r.reload())
+		newConfig = valid
+
+		// Nothing has changed.
+		assert.Equal(t, before, configs.Get())
+		tracksAfter, _ := catalogService.GetTracks()
+		assert.Equal(t, tracksBefore, tracksAfter)
+		assert.Equal(t, storagesBefore, catalogService.GetStorages())
+	})
+
+	t.Run("IgnoreErrors", func(t *testing.T) {
+		newConfig.StorageServices = []StorageServiceConfig{
+			{Type: "diskStorage", Name: "music", Path: musicPath},
+			{Type: "diskStorage", Name: "missing", Path: "../testdata/__DOES_NOT_EXIST__", IgnoreErrors: true},
+		}
+		require.NoError(t, r.reload())
+		require.Len(t, catalogService.GetStorages(), 1)
+		assert.Equal(t, "music", catalogService.GetStorages()[0].GetName())
+	})
+
+	t.Run("AdminEndpoint", func(t *testing.T) {
+		adminConfig := Config{AdminAddr: "127.0.0.1:9090"}
+		authService, err := buildAuth(adminConfig)
+		require.NoError(t, err)
+		adminServer, err := setupAdminServer(adminConfig, catalogService, authService, newServerMetrics(catalogService), r)
+		require.NoError(t, err)
+
+		rec := doRequest(adminServer, httptest.NewRequest(http.MethodPost, "/reload", nil))
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		loadErr = errors.New("bad JSON")
+		rec = doRequest(adminServer, httptest.NewRequest(http.MethodPost, "/reload", nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		loadErr = nil
+	})
+}
+
+func TestStorageConfigChanged(t *testing.T) {
+	oneDay := 86400
+	css := StorageServiceConfig{Type: "diskStorage", Name: "cds", Path: "/music"}
+
+	changed := css
+	changed.CacheMaxAge = &oneDay
+	assert.False(t, storageConfigChanged(css, changed))
+
+	changed.Regexps = []string{"(?P<title>.+)"}
+	assert.True(t, storageConfigChanged(css, changed))
+}
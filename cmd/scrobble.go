@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/scrobble"
+)
+
+// How long a "now playing" notification can take. It's sent in the background,
+// and it's out of date soon anyway.
+const nowPlayingTimeout = 30 * time.Second
+
+// newScrobbleClient returns the client for a user's scrobbling service.
+func newScrobbleClient(sc ScrobblerConfig) scrobble.Client {
+	switch sc.Type {
+	case "listenbrainz":
+		return scrobble.NewListenBrainz(sc.BaseURL, sc.Token, nil)
+	case "librefm":
+		if sc.BaseURL == "" {
+			sc.BaseURL = scrobble.DefaultLibreFMURL
+		}
+	}
+	return scrobble.NewAudioscrobbler(sc.BaseURL, scrobble.AudioscrobblerCredentials{
+		APIKey:     sc.APIKey,
+		Secret:     sc.Secret,
+		SessionKey: sc.SessionKey,
+		Username:   sc.Username,
+		Password:   sc.Password,
+	}, nil)
+}
+
+// listenFor returns the listen to submit for a track. The scrobbling services
+// need an artist and a title, so tracks without an artist can't be submitted.
+func listenFor(track catalog.Track, played time.Time, client string) (scrobble.Listen, bool) {
+	title := track.Title
+	if title == "" {
+		title = track.Name
+	}
+	return scrobble.Listen{
+		Time:     played,
+		Artist:   track.Artist,
+		Title:    title,
+		Album:    track.Album,
+		Duration: track.Duration,
+		Client:   client,
+	}, track.Artist != ""
+}
+
+// sendNowPlaying tells a user's scrobbling services that they've started
+// playing a track, in the background.
+func sendNowPlaying(scrobbles scrobble.ScrobbleService, user string, listen scrobble.Listen) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), nowPlayingTimeout)
+		defer cancel()
+		if err := scrobbles.NowPlaying(ctx, user, listen); err != nil {
+			slog.Warn("Unable to send now playing to scrobbling services", "user", user, "error", err)
+		}
+	}()
+}
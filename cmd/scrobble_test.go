@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/scrobble"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestNewScrobbleClient(t *testing.T) {
+	assert.Equal(t, scrobble.DefaultListenBrainzURL, newScrobbleClient(ScrobblerConfig{Type: "listenbrainz"}).Name())
+	assert.Equal(t, scrobble.DefaultLastFMURL, newScrobbleClient(ScrobblerConfig{Type: "lastfm"}).Name())
+	assert.Equal(t, scrobble.DefaultLibreFMURL, newScrobbleClient(ScrobblerConfig{Type: "librefm"}).Name())
+	assert.Equal(t, "https://music.example.com/2.0/", newScrobbleClient(ScrobblerConfig{Type: "librefm", BaseURL: "https://music.example.com/2.0/"}).Name())
+}
+
+func TestListenFor(t *testing.T) {
+	played := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	listen, ok := listenFor(catalog.Track{Name: "01 So What", Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Duration: time.Minute}, played, "Firefox")
+	assert.True(t, ok)
+	assert.Equal(t, scrobble.Listen{Time: played, Artist: "Miles Davis", Title: "So What", Album: "Kind of Blue", Duration: time.Minute, Client: "Firefox"}, listen)
+
+	listen, ok = listenFor(catalog.Track{Name: "01 So What", Artist: "Miles Davis"}, played, "")
+	assert.True(t, ok)
+	assert.Equal(t, "01 So What", listen.Title)
+
+	_, ok = listenFor(catalog.Track{Name: "track01"}, played, "")
+	assert.False(t, ok)
+}
+
+func TestValidateScrobblers(t *testing.T) {
+	config := Config{
+		Users: []auth.User{{Name: "fred", PasswordHash: "x"}},
+		Scrobblers: []ScrobblerConfig{
+			{User: "fred", Type: "listenbrainz", Token: "a"},
+			{User: "fred", Type: "lastfm", APIKey: "k", Secret: "s", SessionKey: "sk"},
+			{User: "fred", Type: "listenbrainz", BaseURL: "https://api.listenbrainz.org/", Token: "b"},
+			{User: "barney", Type: "listenbrainz", Token: "c"},
+		},
+	}
+	err := validateConfig(config)
+	assert.ErrorContains(t, err, `scrobbler https://api.listenbrainz.org for user "fred" is configured more than once`)
+	assert.ErrorContains(t, err, `scrobbler for unknown user "barney"`)
+
+	config.Scrobblers = config.Scrobblers[:2]
+	assert.NoError(t, validateConfig(config))
+}
+
+func TestScrobbling(t *testing.T) {
+	var mu sync.Mutex
+	down := false
+	received := make([]map[string]any, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			http.Error(w, `{"code": 503, "error": "Down for maintenance"}`, http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Token fred-token" {
+			http.Error(w, `{"code": 401, "error": "Invalid authorization token."}`, http.StatusUnauthorized)
+			return
+		}
+		var submission map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = append(received, submission)
+		fmt.Fprint(w, `{"status": "ok"}`)
+	}))
+	defer server.Close()
+	listenTypes := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		types := make([]string, 0)
+		for _, submission := range received {
+			types = append(types, submission["listen_type"].(string))
+		}
+		return types
+	}
+	setDown := func(d bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		down = d
+	}
+
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: "../testdata/services/storage/diskstorage/Music/cds"},
+		},
+		Users: []auth.User{
+			{Name: "fred", PasswordHash: hash},
+			{Name: "wilma", PasswordHash: hash},
+		},
+		Scrobblers: []ScrobblerConfig{
+			{User: "fred", Type: "listenbrainz", BaseURL: server.URL, Token: "fred-token"},
+		},
+		ScrobbleQueueFile: filepath.Join(t.TempDir(), "scrobbles.json"),
+		SessionMaxAge:     3600,
+		Secret:            "test secret",
+	}
+	require.NoError(t, validateConfig(config))
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	scrobbles, err := buildScrobbler(config)
+	require.NoError(t, err)
+	plays, _, err := buildPlays(config, scrobbles)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, plays, newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	fred := login(t, e, "fred", "secret")
+	wilma := login(t, e, "wilma", "secret")
+	var mp3, flac catalog.Track
+	tracks, _ := catalogService.GetTracks()
+	for _, track := range tracks {
+		switch track.MIMEType {
+		case storage.MP3MimeType:
+			mp3 = track
+		case storage.FlacMimeType:
+			flac = track
+		}
+	}
+	require.NotEmpty(t, mp3.ID)
+	require.NotEmpty(t, flac.ID)
+	play := func(cookie *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/tracks/"+mp3.ID+"/data", nil)
+		req.AddCookie(cookie)
+		rec := doRequest(e, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	ctx := context.Background()
+
+	t.Run("Streamed", func(t *testing.T) {
+		play(fred)
+		assert.Eventually(t, func() bool { return len(listenTypes()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, scrobbles.Flush(ctx))
+		assert.Equal(t, []string{"playing_now", "single"}, listenTypes())
+
+		mu.Lock()
+		payload := received[1]["payload"].([]any)[0].(map[string]any)
+		mu.Unlock()
+		assert.Equal(t, mp3.Title, payload["track_metadata"].(map[string]any)["track_name"])
+
+		// Users without scrobbling services are left alone.
+		play(wilma)
+		require.NoError(t, scrobbles.Flush(ctx))
+		assert.Len(t, listenTypes(), 2)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		setDown(true)
+		rec := doRequest(e, func() *http.Request {
+			req := newJSONRequest(http.MethodPost, "/api/plays", `{"trackId": "`+flac.ID+`", "time": "2024-01-31T12:00:00Z"}`)
+			req.AddCookie(fred)
+			return req
+		}())
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		assert.Error(t, scrobbles.Flush(ctx))
+
+		// The listen is still queued after a restart.
+		restarted, err := buildScrobbler(config)
+		require.NoError(t, err)
+		setDown(false)
+		require.NoError(t, restarted.Flush(ctx))
+		types := listenTypes()
+		require.Len(t, types, 3)
+		assert.Equal(t, "single", types[2])
+		mu.Lock()
+		payload := received[2]["payload"].([]any)[0].(map[string]any)
+		mu.Unlock()
+		assert.Equal(t, float64(time.Date(2024, time.January, 31, 12, 0, 0, 0, time.UTC).Unix()), payload["listened_at"])
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+)
+
+const (
+	defaultShareExpiresIn = 7 * 24 * 60 * 60   // 1 week, in seconds
+	maxShareExpiresIn     = 365 * 24 * 60 * 60 // 1 year, in seconds
+)
+
+// Request to create a share link, from the HTML form or the API.
+type shareRequest struct {
+	Scope     string `json:"scope" form:"scope"`         // auth.ScopeTrack or auth.ScopePlaylist
+	ID        string `json:"id" form:"id"`               // Track or playlist ID
+	ExpiresIn int64  `json:"expiresIn" form:"expiresIn"` // Seconds until the link expires
+	Download  bool   `json:"download" form:"download"`   // Whether the link allows downloads
+}
+
+type shareResponse struct {
+	Name    string    `json:"name"`
+	Token   string    `json:"token"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// The absolute URL for a share link, for sending to someone else.
+func shareURL(c echo.Context, token string) string {
+	return externalURLFor(c).absolute("/share/" + token)
+}
+
+// createShare checks that the thing being shared exists, and signs a token for it.
+func createShare(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService, req shareRequest) (shareResponse, error) {
+	var name string
+	switch req.Scope {
+	case auth.ScopeTrack:
+		track, err := catalogService.GetTrack(req.ID)
+		if err != nil {
+			return shareResponse{}, err
+		}
+		name = track.Name
+	case auth.ScopePlaylist:
+		playlist, err := catalogService.GetPlaylist(req.ID)
+		if err != nil {
+			return shareResponse{}, err
+		}
+		name = playlist.Name
+	default:
+		return shareResponse{}, echo.NewHTTPError(http.StatusBadRequest, "unknown scope for share")
+	}
+
+	expiresIn := req.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = defaultShareExpiresIn
+	}
+	if expiresIn > maxShareExpiresIn {
+		expiresIn = maxShareExpiresIn
+	}
+	expires := time.Now().Add(time.Duration(expiresIn) * time.Second)
+
+	claims := auth.TokenClaims{
+		Kind:     auth.TokenKindShare,
+		Scope:    req.Scope,
+		ScopeID:  req.ID,
+		Expires:  expires.Unix(),
+		Download: req.Download,
+	}
+	if user, ok := currentUser(c); ok {
+		claims.Subject = user.Name
+	}
+
+	token, _, err := authService.NewToken(claims)
+	if err != nil {
+		return shareResponse{}, err
+	}
+	return shareResponse{
+		Name:    name,
+		Token:   token,
+		URL:     shareURL(c, token),
+		Expires: time.Unix(claims.Expires, 0),
+	}, nil
+}
+
+func postShares(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService) error {
+	var req shareRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	share, err := createShare(c, catalogService, authService, req)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "shared.tmpl.html", share)
+}
+
+// verifyShare checks the share token in the request.
+func verifyShare(c echo.Context, authService auth.AuthService) (auth.TokenClaims, error) {
+	claims, err := authService.VerifyToken(c.Param("token"))
+	if err == nil && claims.Kind != auth.TokenKindShare {
+		err = auth.ErrInvalidToken
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrExpiredToken) || errors.Is(err, auth.ErrRevokedToken) {
+			return auth.TokenClaims{}, echo.NewHTTPError(http.StatusGone, err.Error())
+		}
+		return auth.TokenClaims{}, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return claims, nil
+}
+
+func getShare(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder) error {
+	claims, err := verifyShare(c, authService)
+	if err != nil {
+		return err
+	}
+	catalogService = catalogForShare(catalogService, authService, plays, claims)
+	prefix := "/share/" + c.Param("token")
+
+	switch claims.Scope {
+	case auth.ScopeTrack:
+		track, err := catalogService.GetTrack(claims.ScopeID)
+		if err != nil {
+			return err
+		}
+		return c.Render(http.StatusOK, "tracksbyid.tmpl.html", trackPage{
+			Track:    track,
+			DataURL:  prefix + "/data",
+			Download: claims.Download,
+		})
+	case auth.ScopePlaylist:
+		playlist, err := catalogService.GetPlaylist(claims.ScopeID)
+		if err != nil {
+			return err
+		}
+		return c.Render(http.StatusOK, "playlistsbyid.tmpl.html", playlistPage{
+			Playlist:           playlist,
+			TrackDataURLPrefix: prefix + "/tracks/",
+			ExportURL:          prefix + "/export",
+		})
+	}
+	return echo.NewHTTPError(http.StatusNotFound)
+}
+
+// getShareExport sends a shared playlist as an M3U file, linking to the tracks through the share.
+func getShareExport(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder) error {
+	claims, err := verifyShare(c, authService)
+	if err != nil {
+		return err
+	}
+	if claims.Scope != auth.ScopePlaylist {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	playlist, err := catalogForShare(catalogService, authService, plays, claims).GetPlaylist(claims.ScopeID)
+	if err != nil {
+		return err
+	}
+	return writeM3U(c, playlist, externalURLFor(c).absolute("/share/"+c.Param("token")+"/tracks/"))
+}
+
+// sharedTrack finds the track being requested, checking that it is covered by the share.
+func sharedTrack(c echo.Context, catalogService catalog.CatalogService, claims auth.TokenClaims) (catalog.Track, error) {
+	switch claims.Scope {
+	case auth.ScopeTrack:
+		if id := c.Param("id"); id != "" && id != claims.ScopeID {
+			return catalog.Track{}, echo.NewHTTPError(http.StatusNotFound)
+		}
+		track, err := catalogService.GetTrack(claims.ScopeID)
+		if err != nil {
+			return catalog.Track{}, err
+		}
+		return track, nil
+	case auth.ScopePlaylist:
+		playlist, err := catalogService.GetPlaylist(claims.ScopeID)
+		if err != nil {
+			return catalog.Track{}, err
+		}
+		id := c.Param("id")
+		for _, track := range playlist.Tracks {
+			if track.ID == id {
+				return track, nil
+			}
+		}
+	}
+	return catalog.Track{}, echo.NewHTTPError(http.StatusNotFound)
+}
+
+func getShareData(c echo.Context, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, config Config, metrics *serverMetrics) error {
+	claims, err := verifyShare(c, authService)
+	if err != nil {
+		return err
+	}
+	catalogService = catalogForShare(catalogService, authService, plays, claims)
+	track, err := sharedTrack(c, catalogService, claims)
+	if err != nil {
+		return err
+	}
+
+	download := c.QueryParam("download") != ""
+	if download && !claims.Download {
+		return echo.NewHTTPError(http.StatusForbidden, "downloads are not allowed for this share")
+	}
+	// Share links aren't for a user, so plays of them aren't recorded.
+	return streamTrackData(c, catalogService, metrics, nil, track, config.cacheMaxAgeFor(track.StorageServiceID), download)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareEndpoints(t *testing.T) {
+	e, catalogService := setupTestServer(t, Config{Secret: "test secret"})
+	tracks, playlists := catalogService.GetTracks()
+	require.Len(t, tracks, 1)
+	require.Len(t, playlists, 1)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		return doRequest(e, httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	createShare := func(body string) shareResponse {
+		rec := doRequest(e, newJSONRequest(http.MethodPost, "/api/shares", body))
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var share shareResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &share))
+		return share
+	}
+
+	t.Run("TrackShare", func(t *testing.T) {
+		share := createShare(`{"scope": "track", "id": "` + tracks[0].ID + `"}`)
+		assert.Equal(t, "ExAmPlE", share.Name)
+		assert.Equal(t, "http://example.com/share/"+share.Token, share.URL)
+
+		rec := get("/share/" + share.Token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "/share/"+share.Token+"/data")
+
+		rec = get("/share/" + share.Token + "/data")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, int(tracks[0].DataLen), rec.Body.Len())
+
+		rec = get("/share/" + share.Token + "/data?download=1")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		// Only playlists can be exported.
+		rec = get("/share/" + share.Token + "/export")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("PlaylistShareWithDownload", func(t *testing.T) {
+		share := createShare(`{"scope": "playlist", "id": "` + playlists[0].ID + `", "download": true}`)
+
+		rec := get("/share/" + share.Token)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = get("/share/" + share.Token + "/tracks/" + tracks[0].ID + "/data?download=1")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Header().Get(echo.HeaderContentDisposition), "attachment")
+
+		rec = get("/share/" + share.Token + "/tracks/nope/data")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		rec = get("/share/" + share.Token + "/export")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "#EXTM3U\n#EXTINF:6,ExAmPlE\nhttp://example.com/share/"+share.Token+"/tracks/"+tracks[0].ID+"/data\n", rec.Body.String())
+	})
+
+	t.Run("BadShares", func(t *testing.T) {
+		rec := doRequest(e, newJSONRequest(http.MethodPost, "/api/shares", `{"scope": "track", "id": "nope"}`))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		rec = doRequest(e, newJSONRequest(http.MethodPost, "/api/shares", `{"scope": "everything"}`))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = get("/share/garbage")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		share := createShare(`{"scope": "track", "id": "` + tracks[0].ID + `"}`)
+
+		rec := doRequest(e, newJSONRequest(http.MethodPost, "/api/tokens/revoke", `{"token": "`+share.Token+`"}`))
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		rec = get("/share/" + share.Token)
+		assert.Equal(t, http.StatusGone, rec.Code)
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/internal/atomicfile"
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/ratings"
+)
+
+// Smart playlists can be configured, or added and removed using the API.
+// The ones added using the API are persisted to the smart playlists file,
+// if there is one, so that they are kept when the server is restarted.
+
+type smartPlaylistsFileData struct {
+	SmartPlaylists []catalog.SmartPlaylist `json:"smartPlaylists"`
+}
+
+// loadSmartPlaylists reads the smart playlists added using the API from path, if it exists.
+func loadSmartPlaylists(path string) ([]catalog.SmartPlaylist, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f smartPlaylistsFileData
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return f.SmartPlaylists, nil
+}
+
+// smartPlaylistsFile keeps the smart playlists file up to date with the catalog.
+type smartPlaylistsFile struct {
+	path string
+
+	mu sync.Mutex // So that the changes are written in the order they are made
+}
+
+func newSmartPlaylistsFile(path string) *smartPlaylistsFile {
+	return &smartPlaylistsFile{path: path}
+}
+
+func (spf *smartPlaylistsFile) add(catalogService catalog.CatalogService, sp catalog.SmartPlaylist) (catalog.SmartPlaylist, error) {
+	spf.mu.Lock()
+	defer spf.mu.Unlock()
+
+	sp, err := catalogService.AddSmartPlaylist(sp)
+	if err != nil {
+		return catalog.SmartPlaylist{}, err
+	}
+	// Undo the change if it can't be saved, so that it isn't lost on a restart.
+	if err := spf.save(catalogService); err != nil {
+		if removeErr := catalogService.RemoveSmartPlaylist(sp.ID); removeErr != nil {
+			return catalog.SmartPlaylist{}, errors.Join(err, removeErr)
+		}
+		return catalog.SmartPlaylist{}, err
+	}
+	return sp, nil
+}
+
+func (spf *smartPlaylistsFile) remove(catalogService catalog.CatalogService, id string) error {
+	spf.mu.Lock()
+	defer spf.mu.Unlock()
+
+	var removed catalog.SmartPlaylist
+	for _, sp := range catalogService.GetSmartPlaylists() {
+		if sp.ID == id {
+			removed = sp
+		}
+	}
+	if err := catalogService.RemoveSmartPlaylist(id); err != nil {
+		return err
+	}
+	if err := spf.save(catalogService); err != nil {
+		if _, addErr := catalogService.AddSmartPlaylist(removed); addErr != nil {
+			return errors.Join(err, addErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Write the smart playlists that weren't configured to disk. Must be called with spf.mu held.
+func (spf *smartPlaylistsFile) save(catalogService catalog.CatalogService) error {
+	if spf.path == "" {
+		return nil
+	}
+
+	added := make([]catalog.SmartPlaylist, 0)
+	for _, sp := range catalogService.GetSmartPlaylists() {
+		if !sp.Configured {
+			added = append(added, sp)
+		}
+	}
+	data, err := json.MarshalIndent(smartPlaylistsFileData{SmartPlaylists: added}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(spf.path, data)
+}
+
+func getAPISmartPlaylists(c echo.Context, catalogService catalog.CatalogService) error {
+	return c.JSON(http.StatusOK, catalogService.GetSmartPlaylists())
+}
+
+type smartPlaylistRequest struct {
+	Name  string `json:"name"`
+	Rule  string `json:"rule"`
+	Sort  string `json:"sort"`
+	Limit int    `json:"limit"`
+}
+
+func postAPISmartPlaylists(c echo.Context, catalogService catalog.CatalogService, spf *smartPlaylistsFile) error {
+	var req smartPlaylistRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	sp, err := spf.add(catalogService, catalog.SmartPlaylist{
+		Name:  req.Name,
+		Rule:  req.Rule,
+		Sort:  req.Sort,
+		Limit: req.Limit,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, sp)
+}
+
+func deleteAPISmartPlaylists(c echo.Context, catalogService catalog.CatalogService, spf *smartPlaylistsFile) error {
+	if err := spf.remove(catalogService, c.Param("id")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Anyone can see the smart playlists' rules, but only admins can change them,
+// since they are shared by all the users.
+func setupSmartPlaylistEndpoints(g *echo.Group, catalogService catalog.CatalogService, authService auth.AuthService, plays *playRecorder, ratingsService ratings.RatingsService, spf *smartPlaylistsFile) {
+	g.GET("/api/smartplaylists", func(c echo.Context) error {
+		return getAPISmartPlaylists(c, catalogFor(c, catalogService, authService, plays, ratingsService))
+	})
+	g.POST("/api/smartplaylists", func(c echo.Context) error {
+		return postAPISmartPlaylists(c, catalogService, spf)
+	}, requireAdmin(authService))
+	g.DELETE("/api/smartplaylists/:id", func(c echo.Context) error {
+		return deleteAPISmartPlaylists(c, catalogService, spf)
+	}, requireAdmin(authService))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/auth"
+	"github.com/richdawe/minimediaserver/services/catalog"
+)
+
+func TestSmartPlaylistEndpoints(t *testing.T) {
+	hash, err := auth.HashPassword("secret")
+	require.NoError(t, err)
+
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "nullStorage"},
+			{Type: "diskStorage", Name: "cds", Path: "../testdata/services/storage/diskstorage/Music/cds"},
+		},
+		SmartPlaylists: []SmartPlaylistConfig{
+			{Name: "Examples", Rule: "genre contains example", Sort: "tracknumber desc"},
+		},
+		SmartPlaylistsFile: filepath.Join(t.TempDir(), "smartplaylists.json"),
+		Users: []auth.User{
+			{Name: "parent", PasswordHash: hash, Admin: true},
+			{Name: "kid", PasswordHash: hash, Groups: []string{"kids"}},
+		},
+		Groups: []auth.Group{
+			{Name: "kids", Storages: []string{"null"}},
+		},
+		SessionMaxAge: 3600,
+		Secret:        "test secret",
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	parent := login(t, e, "parent", "secret")
+	kid := login(t, e, "kid", "secret")
+	request := func(method string, target string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := newJSONRequest(method, target, body)
+		req.AddCookie(cookie)
+		return doRequest(e, req)
+	}
+	examplesID := catalogService.GetSmartPlaylists()[0].ID
+
+	t.Run("Configured", func(t *testing.T) {
+		rec := request(http.MethodGet, "/api/smartplaylists", "", kid)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var smartPlaylists []catalog.SmartPlaylist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &smartPlaylists))
+		assert.Equal(t, []catalog.SmartPlaylist{
+			{ID: examplesID, Name: "Examples", Rule: "genre contains example", Sort: "tracknumber desc", Configured: true},
+		}, smartPlaylists)
+
+		rec = request(http.MethodGet, "/api/playlists/"+examplesID, "", parent)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var playlist catalog.Playlist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &playlist))
+		assert.True(t, playlist.Smart)
+		require.Len(t, playlist.Tracks, 3)
+		assert.Equal(t, 2, playlist.Tracks[0].TrackNumber)
+		assert.Equal(t, 1, playlist.Tracks[2].TrackNumber)
+
+		// Users only see the tracks they are allowed to.
+		rec = request(http.MethodGet, "/api/playlists/"+examplesID, "", kid)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &playlist))
+		assert.Empty(t, playlist.Tracks)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		rec := request(http.MethodGet, "/playlists", "", parent)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `/playlists/`+examplesID+`">Examples</a> (smart)`)
+
+		rec = request(http.MethodGet, "/playlists/"+examplesID, "", parent)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `id="player"`)
+
+		rec = request(http.MethodGet, "/playlists/"+examplesID, "", kid)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "There are no tracks in this playlist.")
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		rec := request(http.MethodPost, "/api/smartplaylists", `{"name": "Oggs", "rule": "format = ogg", "limit": 1}`, kid)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		rec = request(http.MethodPost, "/api/smartplaylists", `{"name": "Oggs", "rule": "format = ogg", "limit": 1}`, parent)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var sp catalog.SmartPlaylist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sp))
+		assert.Equal(t, "Oggs", sp.Name)
+		assert.False(t, sp.Configured)
+
+		rec = request(http.MethodGet, "/api/playlists/"+sp.ID, "", parent)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var playlist catalog.Playlist
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &playlist))
+		assert.Len(t, playlist.Tracks, 1)
+
+		// It's kept when the server is restarted.
+		restarted, err := buildCatalog(config)
+		require.NoError(t, err)
+		smartPlaylists := restarted.GetSmartPlaylists()
+		require.Len(t, smartPlaylists, 2)
+		assert.Equal(t, sp, smartPlaylists[1])
+		restartedPlaylist, err := restarted.GetPlaylist(sp.ID)
+		require.NoError(t, err)
+		assert.Equal(t, playlist, restartedPlaylist)
+	})
+
+	t.Run("BadRequests", func(t *testing.T) {
+		rec := request(http.MethodPost, "/api/smartplaylists", `{"name": "Oggs"}`, parent)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+
+		rec = request(http.MethodPost, "/api/smartplaylists", `{"name": "Bad", "rule": "genre is jazz"}`, parent)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `expected a comparison after genre, got \"is\"`)
+
+		rec = request(http.MethodDelete, "/api/smartplaylists/"+examplesID, "", parent)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		rec = request(http.MethodDelete, "/api/smartplaylists/nope", "", parent)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		id := catalogService.GetSmartPlaylists()[1].ID
+		rec := request(http.MethodDelete, "/api/smartplaylists/"+id, "", kid)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		rec = request(http.MethodDelete, "/api/smartplaylists/"+id, "", parent)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		rec = request(http.MethodGet, "/api/playlists/"+id, "", parent)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		saved, err := loadSmartPlaylists(config.SmartPlaylistsFile)
+		require.NoError(t, err)
+		assert.Empty(t, saved)
+	})
+}
+
+func TestSmartPlaylistsFileSaveFails(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "smartplaylists")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	spf := newSmartPlaylistsFile(filepath.Join(dir, "smartplaylists.json"))
+	catalogService, err := catalog.NewBasicCatalog(catalog.Options{})
+	require.NoError(t, err)
+	kept, err := spf.add(catalogService, catalog.SmartPlaylist{Name: "Kept", Rule: "starred"})
+	require.NoError(t, err)
+
+	// The directory has gone, so the changes can't be saved, and are undone.
+	require.NoError(t, os.RemoveAll(dir))
+	_, err = spf.add(catalogService, catalog.SmartPlaylist{Name: "Lost", Rule: "starred"})
+	assert.Error(t, err)
+	assert.Error(t, spf.remove(catalogService, kept.ID))
+	assert.Equal(t, []catalog.SmartPlaylist{kept}, catalogService.GetSmartPlaylists())
+	_, err = catalogService.GetPlaylist(kept.ID)
+	assert.NoError(t, err)
+}
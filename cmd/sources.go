@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// When duplicates are merged, a track may have several sources, e.g.: a FLAC
+// copy in one storage and an MP3 copy in another. Its data is sent from the
+// source that suits the client best: the one named in the "source" query
+// parameter, or the one the client prefers in its Accept header, or the
+// preferred source that the client's browser can play.
+
+// Other names for the MIME types of the formats, e.g.: in Accept headers.
+var mimeTypeAliases = map[string]string{
+	"audio/mpeg":      storage.MP3MimeType,
+	"audio/mpeg3":     storage.MP3MimeType,
+	"audio/x-mpeg-3":  storage.MP3MimeType,
+	"audio/x-flac":    storage.FlacMimeType,
+	"audio/m4a":       storage.MP4MimeType,
+	"audio/x-m4a":     storage.MP4MimeType,
+	"audio/aac":       storage.MP4MimeType,
+	"audio/vorbis":    storage.OggMimeType,
+	"application/ogg": storage.OggMimeType,
+}
+
+func canonicalMIMEType(mimeType string) string {
+	mimeType = strings.ToLower(mimeType)
+	if canonical, ok := mimeTypeAliases[mimeType]; ok {
+		return canonical
+	}
+	return mimeType
+}
+
+// A media range from an Accept header, e.g.: audio/*;q=0.9
+type acceptRange struct {
+	mimeType string
+	q        float64
+}
+
+func parseAccept(header string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mimeType: canonicalMIMEType(mediaType), q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality the client gave a MIME type, using the
+// most specific media range that matches it. The client has no preference
+// if it only sent */*, or no Accept header.
+func acceptQuality(ranges []acceptRange, mimeType string) float64 {
+	majorType, _, _ := strings.Cut(mimeType, "/")
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch r.mimeType {
+		case mimeType:
+			s = 2
+		case majorType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// hasPreference returns true if the Accept header says more than "anything".
+func hasPreference(ranges []acceptRange) bool {
+	for _, r := range ranges {
+		if r.mimeType != "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// browserCanPlay returns false if the browser with the user agent is known
+// not to be able to play the format. Safari, and every browser on iOS,
+// can't play Ogg Vorbis.
+func browserCanPlay(userAgent string, mimeType string) bool {
+	if mimeType != storage.OggMimeType {
+		return true
+	}
+	iOS := strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "iPod")
+	safari := strings.Contains(userAgent, "Safari/") &&
+		!strings.Contains(userAgent, "Chrome/") && !strings.Contains(userAgent, "Chromium/") &&
+		!strings.Contains(userAgent, "Firefox/") && !strings.Contains(userAgent, "Edg/")
+	return !iOS && !safari
+}
+
+// findSource finds a track's source by its ID, or by the name of its
+// format, e.g.: "mp3" or "flac".
+func findSource(track catalog.Track, name string) (catalog.Track, bool) {
+	for _, source := range track.GetSources() {
+		if source.ID == name || trackExtension(source.MIMEType) == "."+strings.ToLower(name) {
+			return track.WithSource(source.ID)
+		}
+	}
+	return catalog.Track{}, false
+}
+
+// chooseSource returns the track with the source that suits the client best.
+func chooseSource(c echo.Context, track catalog.Track) (catalog.Track, error) {
+	if name := c.QueryParam("source"); name != "" {
+		sourceTrack, ok := findSource(track, name)
+		if !ok {
+			return catalog.Track{}, fmt.Errorf("%w: source %s for track %s", catalog.ErrNotFound, name, track.ID)
+		}
+		return sourceTrack, nil
+	}
+
+	sources := track.GetSources()
+	if len(sources) == 1 {
+		return track, nil
+	}
+	// The response depends on who is asking, so caches mustn't share it.
+	c.Response().Header().Add("Vary", "Accept, User-Agent")
+
+	// The client's preferences come first, then the preferred source.
+	candidates := make([]catalog.Source, 0, len(sources))
+	ranges := parseAccept(c.Request().Header.Get("Accept"))
+	if hasPreference(ranges) {
+		for _, source := range sources {
+			if acceptQuality(ranges, source.MIMEType) > 0 {
+				candidates = append(candidates, source)
+			}
+		}
+		sort.SliceStable(candidates, func(i int, j int) bool {
+			return acceptQuality(ranges, candidates[i].MIMEType) > acceptQuality(ranges, candidates[j].MIMEType)
+		})
+	}
+	if len(candidates) == 0 {
+		candidates = sources
+	}
+
+	userAgent := c.Request().UserAgent()
+	for _, source := range candidates {
+		if browserCanPlay(userAgent, source.MIMEType) {
+			sourceTrack, _ := track.WithSource(source.ID)
+			return sourceTrack, nil
+		}
+	}
+	sourceTrack, _ := track.WithSource(candidates[0].ID)
+	return sourceTrack, nil
+}
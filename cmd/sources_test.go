@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/catalog"
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+const (
+	safariUserAgent  = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15"
+	chromeUserAgent  = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	firefoxAccept    = "audio/webm,audio/ogg,audio/wav,audio/*;q=0.9,application/ogg;q=0.7,video/*;q=0.6,*/*;q=0.5"
+	iPhoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0.6367.88 Mobile/15E148 Safari/604.1"
+	firefoxUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	ranges := parseAccept(firefoxAccept)
+	assert.True(t, hasPreference(ranges))
+	assert.Equal(t, 1.0, acceptQuality(ranges, storage.OggMimeType))
+	assert.Equal(t, 0.9, acceptQuality(ranges, storage.MP3MimeType))
+	assert.Equal(t, 0.5, acceptQuality(ranges, "text/plain"))
+
+	ranges = parseAccept("audio/mpeg, audio/flac;q=0.5, audio/ogg;q=0")
+	assert.Equal(t, 1.0, acceptQuality(ranges, storage.MP3MimeType))
+	assert.Equal(t, 0.5, acceptQuality(ranges, storage.FlacMimeType))
+	assert.Equal(t, 0.0, acceptQuality(ranges, storage.OggMimeType))
+	assert.Equal(t, 0.0, acceptQuality(ranges, storage.MP4MimeType))
+
+	assert.False(t, hasPreference(parseAccept("*/*")))
+	assert.False(t, hasPreference(parseAccept("")))
+}
+
+func TestBrowserCanPlay(t *testing.T) {
+	assert.True(t, browserCanPlay(chromeUserAgent, storage.OggMimeType))
+	assert.True(t, browserCanPlay(firefoxUserAgent, storage.OggMimeType))
+	assert.True(t, browserCanPlay("curl/8.5.0", storage.OggMimeType))
+	assert.False(t, browserCanPlay(safariUserAgent, storage.OggMimeType))
+	assert.False(t, browserCanPlay(iPhoneUserAgent, storage.OggMimeType))
+	assert.True(t, browserCanPlay(safariUserAgent, storage.FlacMimeType))
+	assert.True(t, browserCanPlay(safariUserAgent, storage.MP3MimeType))
+}
+
+func TestChooseSource(t *testing.T) {
+	track := catalog.Track{ID: "ogg", MIMEType: storage.OggMimeType, Bitrate: 320000}
+	track.Sources = []catalog.Source{
+		{ID: "ogg", MIMEType: storage.OggMimeType, Bitrate: 320000},
+		{ID: "aac", MIMEType: storage.MP4MimeType, Bitrate: 256000},
+		{ID: "mp3", MIMEType: storage.MP3MimeType, Bitrate: 192000},
+	}
+	choose := func(target string, headers map[string]string) (catalog.Track, *httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		chosen, err := chooseSource(echo.New().NewContext(req, rec), track)
+		return chosen, rec, err
+	}
+	sourceID := func(target string, headers map[string]string) string {
+		chosen, _, err := choose(target, headers)
+		require.NoError(t, err)
+		return chosen.ID
+	}
+
+	t.Run("Preferred", func(t *testing.T) {
+		chosen, rec, err := choose("/", map[string]string{"User-Agent": chromeUserAgent, "Accept": "*/*"})
+		require.NoError(t, err)
+		assert.Equal(t, "ogg", chosen.ID)
+		assert.Equal(t, "Accept, User-Agent", rec.Header().Get("Vary"))
+	})
+
+	t.Run("UserAgent", func(t *testing.T) {
+		assert.Equal(t, "aac", sourceID("/", map[string]string{"User-Agent": safariUserAgent}))
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		assert.Equal(t, "mp3", sourceID("/", map[string]string{"Accept": "audio/mpeg"}))
+		assert.Equal(t, "aac", sourceID("/", map[string]string{"Accept": "audio/mpeg;q=0.5, audio/mp4"}))
+		assert.Equal(t, "ogg", sourceID("/", map[string]string{"Accept": firefoxAccept, "User-Agent": firefoxUserAgent}))
+
+		// The client's preferences come before what the browser is thought to be able to play...
+		assert.Equal(t, "mp3", sourceID("/", map[string]string{"Accept": "audio/ogg, audio/mpeg", "User-Agent": safariUserAgent}))
+		// ...and if nothing is acceptable, the browser gets something it can play anyway.
+		assert.Equal(t, "aac", sourceID("/", map[string]string{"Accept": "audio/wav", "User-Agent": safariUserAgent}))
+	})
+
+	t.Run("Parameter", func(t *testing.T) {
+		chosen, rec, err := choose("/?source=mp3", map[string]string{"User-Agent": chromeUserAgent})
+		require.NoError(t, err)
+		assert.Equal(t, "mp3", chosen.ID)
+		assert.Equal(t, storage.MP3MimeType, chosen.MIMEType)
+		assert.Equal(t, 192000, chosen.Bitrate)
+		assert.Empty(t, rec.Header().Get("Vary"))
+
+		// By format, as well as ID.
+		track.Sources[2].ID = "abc123"
+		assert.Equal(t, "abc123", sourceID("/?source=MP3", nil))
+		assert.Equal(t, "aac", sourceID("/?source=m4a", nil))
+
+		_, _, err = choose("/?source=wav", nil)
+		assert.ErrorIs(t, err, catalog.ErrNotFound)
+	})
+
+	t.Run("OneSource", func(t *testing.T) {
+		track := catalog.Track{ID: "ogg", MIMEType: storage.OggMimeType}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("User-Agent", safariUserAgent)
+		rec := httptest.NewRecorder()
+		chosen, err := chooseSource(echo.New().NewContext(req, rec), track)
+		require.NoError(t, err)
+		assert.Equal(t, track, chosen)
+		assert.Empty(t, rec.Header().Get("Vary"))
+	})
+}
+
+func TestTrackSources(t *testing.T) {
+	// A FLAC copy of the MP3 in cds, in another storage.
+	cdsPath := "../testdata/services/storage/diskstorage/Music/cds"
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "the-artist", "album1"), 0o755))
+	data, err := os.ReadFile(filepath.Join(cdsPath, "Artist/Album1/track2-example.flac"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "the-artist", "album1", "track2.flac"), data, 0o644))
+
+	config := Config{
+		StorageServices: []StorageServiceConfig{
+			{Type: "diskStorage", Name: "cds", Path: cdsPath},
+			{Type: "diskStorage", Name: "flac", Path: dir},
+		},
+		MergeDuplicates: true,
+	}
+	catalogService, err := buildCatalog(config)
+	require.NoError(t, err)
+	authService, err := buildAuth(config)
+	require.NoError(t, err)
+	e, err := setupEndpoints(newLiveConfig(config), catalogService, authService, newTestPlays(t), newTestRatings(t), newServerMetrics(catalogService))
+	require.NoError(t, err)
+
+	var track catalog.Track
+	tracks, _ := catalogService.GetTracks()
+	for _, t := range tracks {
+		if len(t.Sources) > 1 {
+			track = t
+		}
+	}
+	require.Len(t, track.Sources, 2)
+	mp3 := track.Sources[1]
+
+	get := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return doRequest(e, req)
+	}
+
+	t.Run("Data", func(t *testing.T) {
+		rec := get("/tracks/"+track.ID+"/data", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, storage.FlacMimeType, rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, int(track.DataLen), rec.Body.Len())
+		assert.Equal(t, `"`+track.Version+`"`, rec.Header().Get("ETag"))
+
+		rec = get("/tracks/"+track.ID+"/data", map[string]string{"Accept": "audio/mpeg"})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, storage.MP3MimeType, rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, int(mp3.DataLen), rec.Body.Len())
+		assert.Equal(t, `"`+mp3.Version+`"`, rec.Header().Get("ETag"))
+
+		rec = get("/tracks/"+track.ID+"/data?source="+mp3.ID+"&download=1", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, storage.MP3MimeType, rec.Header().Get(echo.HeaderContentType))
+		assert.Contains(t, rec.Header().Get(echo.HeaderContentDisposition), ".mp3")
+
+		rec = get("/tracks/"+track.ID+"/data?source=nope", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		rec := get("/tracks/"+mp3.ID, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		body := rec.Body.String()
+		assert.Contains(t, body, `/tracks/`+track.ID+`/data?source=`+mp3.ID+`" type="audio/mp3"`)
+		assert.Contains(t, body, "FLAC, 1281 kbit/s, 980 kB (flac)")
+		assert.Contains(t, body, "MP3, 210 kbit/s, 162 kB (cds)")
+	})
+}
@@ -78,6 +78,11 @@ function changePosition(n) {
 // initAudioPlayer is called from the HTML generated from playlistsbyid.tmpl.html
 // eslint-disable-next-line no-unused-vars
 function initAudioPlayer(availableTracks, n) {
+    // Smart playlists may have no tracks, so there's nothing to play.
+    if (availableTracks.length === 0) {
+        return;
+    }
+
     // Initial state
     tracks = availableTracks;
     trackNumber = n;
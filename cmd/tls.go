@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/richdawe/minimediaserver/internal/selfsigned"
+)
+
+// HTTPS is needed for some browser features on phones (e.g.: the Media Session API),
+// and to avoid sending passwords in the clear. The certificate can come from
+// files, be obtained automatically using ACME (e.g.: from Let's Encrypt),
+// or be a self-signed certificate for development.
+
+type TLSConfig struct {
+	Cert       string `mapstructure:"cert"`       // Certificate file, in PEM format
+	Key        string `mapstructure:"key"`        // Private key file, in PEM format
+	SelfSigned bool   `mapstructure:"selfSigned"` // Generate a self-signed certificate, if there isn't one already
+	CacheDir   string `mapstructure:"cacheDir"`   // Where generated and automatic certificates are kept
+
+	AutocertDomains      []string `mapstructure:"autocertDomains"`      // Get certificates for these domains automatically using ACME
+	AutocertEmail        string   `mapstructure:"autocertEmail"`        // Contact address for the ACME account; optional
+	AutocertDirectoryURL string   `mapstructure:"autocertDirectoryUrl"` // ACME directory; defaults to Let's Encrypt
+
+	RedirectAddr string `mapstructure:"-"`          // Server IP + port for redirecting HTTP to HTTPS; disabled if empty
+	HSTSMaxAge   int    `mapstructure:"hstsMaxAge"` // Strict-Transport-Security max age in seconds; disabled if 0
+}
+
+// enabled returns true if the server uses HTTPS.
+func (tc TLSConfig) enabled() bool {
+	return tc.Cert != "" || tc.SelfSigned || tc.autocert()
+}
+
+func (tc TLSConfig) autocert() bool {
+	return len(tc.AutocertDomains) > 0
+}
+
+func (tc TLSConfig) cacheDir() string {
+	if tc.CacheDir != "" {
+		return tc.CacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "minimediaserver")
+}
+
+// certFiles returns the certificate and key files. A self-signed certificate
+// is kept in the cache directory, unless its files are given.
+func (tc TLSConfig) certFiles() (string, string) {
+	if tc.SelfSigned && tc.Cert == "" {
+		return filepath.Join(tc.cacheDir(), "selfsigned-cert.pem"), filepath.Join(tc.cacheDir(), "selfsigned-key.pem")
+	}
+	return tc.Cert, tc.Key
+}
+
+// selfSignedHosts returns the names a self-signed certificate is for:
+// this machine, and the address the server listens on.
+func selfSignedHosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// httpsRedirect redirects requests to the same URL using HTTPS,
+// on the port that the HTTPS server listens on.
+func httpsRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 address
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// setupTLS prepares the server for HTTPS: it generates a self-signed certificate
+// or sets up getting certificates automatically, and adds the HSTS header.
+// It returns the server for redirecting HTTP to HTTPS, if there is one.
+func setupTLS(e *echo.Echo, config Config) (*http.Server, error) {
+	tlsConfig := config.TLS
+	if !tlsConfig.enabled() {
+		return nil, nil
+	}
+
+	if tlsConfig.SelfSigned {
+		certFile, keyFile := tlsConfig.certFiles()
+		generated, err := selfsigned.Ensure(certFile, keyFile, selfSignedHosts(config.Addr))
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate a self-signed certificate: %w", err)
+		}
+		if generated {
+			slog.Warn("Generated a self-signed certificate - browsers will warn that it is not trusted", "cert", certFile, "key", keyFile)
+		}
+	}
+
+	if tlsConfig.autocert() {
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(tlsConfig.AutocertDomains...)
+		e.AutoTLSManager.Cache = autocert.DirCache(filepath.Join(tlsConfig.cacheDir(), "autocert"))
+		e.AutoTLSManager.Email = tlsConfig.AutocertEmail
+		if tlsConfig.AutocertDirectoryURL != "" {
+			e.AutoTLSManager.Client = &acme.Client{DirectoryURL: tlsConfig.AutocertDirectoryURL}
+		}
+	}
+
+	if tlsConfig.HSTSMaxAge > 0 {
+		e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+			HSTSMaxAge:            tlsConfig.HSTSMaxAge,
+			HSTSExcludeSubdomains: true,
+		}))
+	}
+
+	if tlsConfig.RedirectAddr == "" {
+		return nil, nil
+	}
+	_, httpsPort, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	handler := httpsRedirect(httpsPort)
+	if tlsConfig.autocert() {
+		// Also answer the ACME HTTP challenges.
+		handler = e.AutoTLSManager.HTTPHandler(handler)
+	}
+	return &http.Server{
+		Addr:              tlsConfig.RedirectAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// startServer starts the server, using HTTPS if it is configured.
+func startServer(e *echo.Echo, config Config) error {
+	switch {
+	case config.TLS.autocert():
+		return e.StartAutoTLS(config.Addr)
+	case config.TLS.enabled():
+		certFile, keyFile := config.TLS.certFiles()
+		return e.StartTLS(config.Addr, certFile, keyFile)
+	}
+	return e.Start(config.Addr)
+}
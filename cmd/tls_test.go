@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfig(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		tc := TLSConfig{HSTSMaxAge: 3600}
+		assert.False(t, tc.enabled())
+		assert.False(t, tc.autocert())
+	})
+
+	t.Run("CertFiles", func(t *testing.T) {
+		tc := TLSConfig{Cert: "/etc/cert.pem", Key: "/etc/key.pem"}
+		assert.True(t, tc.enabled())
+		cert, key := tc.certFiles()
+		assert.Equal(t, "/etc/cert.pem", cert)
+		assert.Equal(t, "/etc/key.pem", key)
+	})
+
+	t.Run("SelfSigned", func(t *testing.T) {
+		tc := TLSConfig{SelfSigned: true, CacheDir: "/var/cache/mms"}
+		assert.True(t, tc.enabled())
+		cert, key := tc.certFiles()
+		assert.Equal(t, "/var/cache/mms/selfsigned-cert.pem", cert)
+		assert.Equal(t, "/var/cache/mms/selfsigned-key.pem", key)
+
+		tc = TLSConfig{SelfSigned: true}
+		cert, _ = tc.certFiles()
+		assert.Equal(t, "minimediaserver", filepath.Base(filepath.Dir(cert)))
+	})
+
+	t.Run("Autocert", func(t *testing.T) {
+		tc := TLSConfig{AutocertDomains: []string{"music.example.com"}}
+		assert.True(t, tc.enabled())
+		assert.True(t, tc.autocert())
+	})
+}
+
+func TestSelfSignedHosts(t *testing.T) {
+	hosts := selfSignedHosts(":8443")
+	assert.Subset(t, hosts, []string{"localhost", "127.0.0.1", "::1"})
+	assert.NotContains(t, hosts, "")
+
+	assert.NotContains(t, selfSignedHosts("0.0.0.0:8443"), "0.0.0.0")
+	assert.Contains(t, selfSignedHosts("192.168.1.2:8443"), "192.168.1.2")
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort string
+		host      string
+		location  string
+	}{
+		{name: "Port", httpsPort: "8443", host: "music.example.com:8080", location: "https://music.example.com:8443/albums?sort=artist"},
+		{name: "DefaultPort", httpsPort: "443", host: "music.example.com", location: "https://music.example.com/albums?sort=artist"},
+		{name: "IPv6", httpsPort: "8443", host: "[::1]:8080", location: "https://[::1]:8443/albums?sort=artist"},
+		{name: "IPv6DefaultPort", httpsPort: "443", host: "[::1]:80", location: "https://[::1]/albums?sort=artist"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/albums?sort=artist", nil)
+			req.Host = test.host
+			rec := httptest.NewRecorder()
+			httpsRedirect(test.httpsPort).ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+			assert.Equal(t, test.location, rec.Header().Get(echo.HeaderLocation))
+		})
+	}
+}
+
+func TestSetupTLS(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		e := echo.New()
+		redirectServer, err := setupTLS(e, Config{Addr: ":8080", TLS: TLSConfig{HSTSMaxAge: 3600}})
+		require.NoError(t, err)
+		assert.Nil(t, redirectServer)
+
+		e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Empty(t, rec.Header().Get(echo.HeaderStrictTransportSecurity))
+	})
+
+	t.Run("SelfSigned", func(t *testing.T) {
+		cacheDir := filepath.Join(t.TempDir(), "cache")
+		config := Config{
+			Addr: "127.0.0.1:8443",
+			TLS: TLSConfig{
+				SelfSigned:   true,
+				CacheDir:     cacheDir,
+				RedirectAddr: "127.0.0.1:8080",
+				HSTSMaxAge:   3600,
+			},
+		}
+
+		e := echo.New()
+		redirectServer, err := setupTLS(e, config)
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(cacheDir, "selfsigned-cert.pem"))
+		assert.FileExists(t, filepath.Join(cacheDir, "selfsigned-key.pem"))
+
+		// The certificate is kept for next time.
+		info, err := os.Stat(filepath.Join(cacheDir, "selfsigned-cert.pem"))
+		require.NoError(t, err)
+		_, err = setupTLS(echo.New(), config)
+		require.NoError(t, err)
+		info2, err := os.Stat(filepath.Join(cacheDir, "selfsigned-cert.pem"))
+		require.NoError(t, err)
+		assert.Equal(t, info.ModTime(), info2.ModTime())
+
+		e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.TLS = &tls.ConnectionState{}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, "max-age=3600", rec.Header().Get(echo.HeaderStrictTransportSecurity))
+
+		require.NotNil(t, redirectServer)
+		assert.Equal(t, "127.0.0.1:8080", redirectServer.Addr)
+		req = httptest.NewRequest(http.MethodGet, "/albums", nil)
+		req.Host = "127.0.0.1:8080"
+		rec = httptest.NewRecorder()
+		redirectServer.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+		assert.Equal(t, "https://127.0.0.1:8443/albums", rec.Header().Get(echo.HeaderLocation))
+	})
+
+	t.Run("Autocert", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		e := echo.New()
+		redirectServer, err := setupTLS(e, Config{
+			Addr: ":443",
+			TLS: TLSConfig{
+				AutocertDomains:      []string{"music.example.com"},
+				AutocertEmail:        "fred@example.com",
+				AutocertDirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
+				CacheDir:             cacheDir,
+				RedirectAddr:         ":80",
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "fred@example.com", e.AutoTLSManager.Email)
+		assert.Equal(t, "https://acme-staging-v02.api.letsencrypt.org/directory", e.AutoTLSManager.Client.DirectoryURL)
+		assert.NoError(t, e.AutoTLSManager.HostPolicy(nil, "music.example.com"))
+		assert.Error(t, e.AutoTLSManager.HostPolicy(nil, "other.example.com"))
+
+		// Requests other than ACME challenges are redirected.
+		require.NotNil(t, redirectServer)
+		req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+		req.Host = "music.example.com"
+		rec := httptest.NewRecorder()
+		redirectServer.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+		assert.Equal(t, "https://music.example.com/albums", rec.Header().Get(echo.HeaderLocation))
+	})
+}
+
+func TestStartServerTLS(t *testing.T) {
+	config := Config{
+		Addr: "127.0.0.1:0",
+		TLS:  TLSConfig{SelfSigned: true, CacheDir: t.TempDir()},
+	}
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "hello") })
+	_, err := setupTLS(e, config)
+	require.NoError(t, err)
+
+	go func() {
+		_ = startServer(e, config)
+	}()
+	t.Cleanup(func() { e.Close() })
+
+	var addr string
+	require.Eventually(t, func() bool {
+		if a := e.TLSListenerAddr(); a != nil {
+			addr = a.String()
+			return true
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := &http.Client{Transport: &http.Transport{
+		// The certificate is self-signed.
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + addr + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, resp.TLS)
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options for the logger.
+type Options struct {
+	Level  string // debug, info, warn or error; defaults to info
+	Format string // text or json; defaults to text
+
+	File       string // Log to this file instead of stderr, if set
+	MaxSize    int    // Rotate the log file when it reaches this many megabytes; defaults to 100
+	MaxBackups int    // How many rotated log files to keep; defaults to keeping them all
+}
+
+// Logger is a slog.Logger whose level can be changed while it is in use.
+type Logger struct {
+	*slog.Logger
+
+	level  *slog.LevelVar
+	closer io.Closer
+}
+
+// ParseLevel converts a level name into a slog.Level.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %s", level)
+	}
+	return l, nil
+}
+
+// SetLevel changes the level of the logger. Use ParseLevel to check
+// a level name first.
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level.Set(level)
+}
+
+// Close closes the log file, if any.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// New creates a logger. Logs are written to w, unless options.File is set.
+func New(options Options, w io.Writer) (*Logger, error) {
+	level, err := ParseLevel(options.Level)
+	if err != nil {
+		return nil, err
+	}
+	l := &Logger{
+		level: new(slog.LevelVar),
+	}
+	l.SetLevel(level)
+
+	if options.File != "" {
+		file := &lumberjack.Logger{
+			Filename:   options.File,
+			MaxSize:    options.MaxSize,
+			MaxBackups: options.MaxBackups,
+		}
+		w = file
+		l.closer = file
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: l.level}
+	switch strings.ToLower(options.Format) {
+	case "", FormatText:
+		l.Logger = slog.New(slog.NewTextHandler(w, handlerOptions))
+	case FormatJSON:
+		l.Logger = slog.New(slog.NewJSONHandler(w, handlerOptions))
+	default:
+		return nil, fmt.Errorf("unknown log format %s", options.Format)
+	}
+	return l, nil
+}
+
+// NewDefault creates a logger for stderr, for use until the configuration is loaded.
+func NewDefault() *Logger {
+	l, _ := New(Options{}, os.Stderr)
+	return l
+}
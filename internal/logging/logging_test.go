@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	t.Run("Levels", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := New(Options{Level: "warn"}, &buf)
+		require.NoError(t, err)
+
+		logger.Info("hidden")
+		logger.Warn("shown", "storage", "cds")
+		assert.NotContains(t, buf.String(), "hidden")
+		assert.Contains(t, buf.String(), "level=WARN msg=shown storage=cds")
+
+		logger.SetLevel(slog.LevelDebug)
+		logger.Debug("now shown")
+		assert.Contains(t, buf.String(), "now shown")
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := New(Options{Format: "json"}, &buf)
+		require.NoError(t, err)
+
+		logger.Info("hello", "trackID", "1234")
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		assert.Equal(t, "hello", entry["msg"])
+		assert.Equal(t, "1234", entry["trackID"])
+	})
+
+	t.Run("File", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "minimediaserver.log")
+		logger, err := New(Options{File: path, MaxSize: 1}, os.Stderr)
+		require.NoError(t, err)
+		logger.Info("to file")
+		require.NoError(t, logger.Close())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "to file")
+	})
+
+	t.Run("BadOptions", func(t *testing.T) {
+		_, err := New(Options{Level: "loud"}, os.Stderr)
+		assert.Error(t, err)
+		_, err = New(Options{Format: "xml"}, os.Stderr)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelInfo, level)
+
+	level, err = ParseLevel("DEBUG")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+
+	_, err = ParseLevel("loud")
+	assert.Error(t, err)
+}
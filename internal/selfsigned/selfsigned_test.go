@@ -0,0 +1,61 @@
+package selfsigned
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls", "cert.pem")
+	keyFile := filepath.Join(dir, "tls", "key.pem")
+
+	require.NoError(t, Generate(certFile, keyFile, []string{"localhost", "127.0.0.1", "::1"}))
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+	assert.NoError(t, cert.VerifyHostname("localhost"))
+	assert.NoError(t, cert.VerifyHostname("127.0.0.1"))
+	assert.NoError(t, cert.VerifyHostname("::1"))
+	assert.Error(t, cert.VerifyHostname("example.com"))
+
+	info, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	assert.Error(t, Generate(certFile, keyFile, []string{}))
+}
+
+func TestEnsure(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	generated, err := Ensure(certFile, keyFile, []string{"localhost"})
+	require.NoError(t, err)
+	assert.True(t, generated)
+	before, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+
+	// The existing certificate is kept.
+	generated, err = Ensure(certFile, keyFile, []string{"localhost"})
+	require.NoError(t, err)
+	assert.False(t, generated)
+	after, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// A missing key means a new certificate.
+	require.NoError(t, os.Remove(keyFile))
+	generated, err = Ensure(certFile, keyFile, []string{"localhost"})
+	require.NoError(t, err)
+	assert.True(t, generated)
+}
@@ -0,0 +1,17 @@
+package auth
+
+type AuthService interface {
+	Enabled() bool // Whether any users are configured; if not, authentication is disabled
+
+	Authenticate(username string, password string) (User, error) // Check a user's password
+	GetUser(username string) (User, error)                       // Get info for a user, by name
+	AllowedStorages(user User) ([]string, bool)                  // Storage services a user may access; false if unrestricted
+
+	NewSession(user User) (Session, error) // Start a new session for an authenticated user
+	GetSession(id string) (Session, error) // Get a session that has not expired, by session ID
+	DeleteSession(id string)               // End a session (e.g.: on logout)
+
+	NewToken(claims TokenClaims) (string, TokenClaims, error) // Sign a new API token or share link token
+	VerifyToken(token string) (TokenClaims, error)            // Check a token is valid and return its claims
+	RevokeToken(claims TokenClaims) error                     // Prevent a token from being used again
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrSessionNotFound    = errors.New("session not found")
+)
+
+// Used when authenticating unknown users, so that the time taken
+// to reject them is similar to the time taken to reject a bad password.
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashErr  error
+	dummyPasswordHashOnce sync.Once
+)
+
+type BasicAuth struct {
+	usersByName   map[string]User
+	groupsByName  map[string]Group
+	sessionMaxAge time.Duration
+	tokenSigner   *TokenSigner
+
+	mu           sync.Mutex
+	sessionsByID map[string]Session
+}
+
+func (as *BasicAuth) Enabled() bool {
+	return len(as.usersByName) > 0
+}
+
+func (as *BasicAuth) Authenticate(username string, password string) (User, error) {
+	user, ok := as.usersByName[username]
+	if !ok {
+		_ = checkPassword(dummyPasswordHash, password)
+		return User{}, ErrInvalidCredentials
+	}
+	if err := checkPassword(user.PasswordHash, password); err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+func (as *BasicAuth) GetUser(username string) (User, error) {
+	user, ok := as.usersByName[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (as *BasicAuth) AllowedStorages(user User) ([]string, bool) {
+	storages := make([]string, 0)
+	storages = append(storages, user.Storages...)
+	for _, groupName := range user.Groups {
+		storages = append(storages, as.groupsByName[groupName].Storages...)
+	}
+
+	if len(storages) == 0 {
+		return nil, false
+	}
+	for _, storage := range storages {
+		if storage == AllStorages {
+			return nil, false
+		}
+	}
+	return storages, true
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (as *BasicAuth) NewSession(user User) (Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{
+		ID:       id,
+		Username: user.Name,
+		Expires:  time.Now().Add(as.sessionMaxAge),
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.expireSessions()
+	as.sessionsByID[session.ID] = session
+	return session, nil
+}
+
+func (as *BasicAuth) GetSession(id string) (Session, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	session, ok := as.sessionsByID[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	if time.Now().After(session.Expires) {
+		delete(as.sessionsByID, id)
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (as *BasicAuth) DeleteSession(id string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	delete(as.sessionsByID, id)
+}
+
+// Remove any expired sessions. Must be called with as.mu held.
+func (as *BasicAuth) expireSessions() {
+	now := time.Now()
+	for id, session := range as.sessionsByID {
+		if now.After(session.Expires) {
+			delete(as.sessionsByID, id)
+		}
+	}
+}
+
+func (as *BasicAuth) NewToken(claims TokenClaims) (string, TokenClaims, error) {
+	return as.tokenSigner.Sign(claims)
+}
+
+func (as *BasicAuth) VerifyToken(token string) (TokenClaims, error) {
+	return as.tokenSigner.Verify(token)
+}
+
+func (as *BasicAuth) RevokeToken(claims TokenClaims) error {
+	return as.tokenSigner.Revoke(claims)
+}
+
+func NewBasicAuth(users []User, groups []Group, sessionMaxAge time.Duration, tokenSigner *TokenSigner) (AuthService, error) {
+	groupsByName := make(map[string]Group, 0)
+	for _, group := range groups {
+		if group.Name == "" {
+			return nil, errors.New("group with empty name")
+		}
+		if _, ok := groupsByName[group.Name]; ok {
+			return nil, fmt.Errorf("group %s is defined more than once", group.Name)
+		}
+		groupsByName[group.Name] = group
+	}
+
+	usersByName := make(map[string]User, 0)
+	for _, user := range users {
+		if user.Name == "" {
+			return nil, errors.New("user with empty name")
+		}
+		if user.PasswordHash == "" {
+			return nil, fmt.Errorf("user %s has no password hash", user.Name)
+		}
+		if _, ok := usersByName[user.Name]; ok {
+			return nil, fmt.Errorf("user %s is defined more than once", user.Name)
+		}
+		for _, groupName := range user.Groups {
+			if _, ok := groupsByName[groupName]; !ok {
+				return nil, fmt.Errorf("user %s is in unknown group %s", user.Name, groupName)
+			}
+		}
+		usersByName[user.Name] = user
+	}
+
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, dummyPasswordHashErr = HashPassword("not a real password")
+	})
+	if dummyPasswordHashErr != nil {
+		return nil, dummyPasswordHashErr
+	}
+
+	if tokenSigner == nil {
+		return nil, errors.New("no token signer")
+	}
+
+	return &BasicAuth{
+		usersByName:   usersByName,
+		groupsByName:  groupsByName,
+		sessionMaxAge: sessionMaxAge,
+		tokenSigner:   tokenSigner,
+		sessionsByID:  make(map[string]Session),
+	}, nil
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTokenSigner(t *testing.T) *TokenSigner {
+	denylist, err := NewDenylist("")
+	require.NoError(t, err)
+	tokenSigner, err := NewTokenSigner([]byte("test secret"), denylist)
+	require.NoError(t, err)
+	return tokenSigner
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := HashPassword("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, "secret", hash)
+
+	authService, err := NewBasicAuth([]User{
+		{Name: "fred", PasswordHash: hash},
+	}, nil, time.Hour, newTestTokenSigner(t))
+	require.NoError(t, err)
+	assert.True(t, authService.Enabled())
+
+	t.Run("Authenticate", func(t *testing.T) {
+		user, err := authService.Authenticate("fred", "secret")
+		require.NoError(t, err)
+		assert.Equal(t, "fred", user.Name)
+
+		_, err = authService.Authenticate("fred", "wrong")
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+		_, err = authService.Authenticate("nope", "secret")
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	t.Run("GetUser", func(t *testing.T) {
+		user, err := authService.GetUser("fred")
+		require.NoError(t, err)
+		assert.Equal(t, "fred", user.Name)
+
+		_, err = authService.GetUser("nope")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		user, err := authService.GetUser("fred")
+		require.NoError(t, err)
+
+		session, err := authService.NewSession(user)
+		require.NoError(t, err)
+		assert.NotEmpty(t, session.ID)
+		assert.Equal(t, "fred", session.Username)
+
+		session2, err := authService.GetSession(session.ID)
+		require.NoError(t, err)
+		assert.Equal(t, session, session2)
+
+		authService.DeleteSession(session.ID)
+		_, err = authService.GetSession(session.ID)
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+	})
+
+	t.Run("ExpiredSession", func(t *testing.T) {
+		expiringAuthService, err := NewBasicAuth([]User{
+			{Name: "fred", PasswordHash: hash},
+		}, nil, -time.Second, newTestTokenSigner(t))
+		require.NoError(t, err)
+
+		session, err := expiringAuthService.NewSession(User{Name: "fred"})
+		require.NoError(t, err)
+		_, err = expiringAuthService.GetSession(session.ID)
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+	})
+}
+
+func TestBasicAuthDisabled(t *testing.T) {
+	authService, err := NewBasicAuth(nil, nil, time.Hour, newTestTokenSigner(t))
+	require.NoError(t, err)
+	assert.False(t, authService.Enabled())
+}
+
+func TestBasicAuthBadUsers(t *testing.T) {
+	_, err := NewBasicAuth([]User{{Name: "", PasswordHash: "x"}}, nil, time.Hour, newTestTokenSigner(t))
+	assert.Error(t, err)
+
+	_, err = NewBasicAuth([]User{{Name: "fred"}}, nil, time.Hour, newTestTokenSigner(t))
+	assert.Error(t, err)
+
+	_, err = NewBasicAuth([]User{
+		{Name: "fred", PasswordHash: "x"},
+		{Name: "fred", PasswordHash: "y"},
+	}, nil, time.Hour, newTestTokenSigner(t))
+	assert.Error(t, err)
+
+	_, err = NewBasicAuth(nil, nil, time.Hour, nil)
+	assert.Error(t, err)
+}
+
+func TestAllowedStorages(t *testing.T) {
+	authService, err := NewBasicAuth([]User{
+		{Name: "parent", PasswordHash: "x"},
+		{Name: "kid", PasswordHash: "x", Groups: []string{"kids"}},
+		{Name: "teen", PasswordHash: "x", Groups: []string{"kids"}, Storages: []string{"storage3"}},
+		{Name: "guest", PasswordHash: "x", Groups: []string{"everything"}},
+	}, []Group{
+		{Name: "kids", Storages: []string{"storage1", "storage2"}},
+		{Name: "everything", Storages: []string{AllStorages}},
+	}, time.Hour, newTestTokenSigner(t))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Username         string
+		ExpectedStorages []string
+		ExpectRestricted bool
+	}{
+		{"parent", nil, false},
+		{"kid", []string{"storage1", "storage2"}, true},
+		{"teen", []string{"storage3", "storage1", "storage2"}, true},
+		{"guest", nil, false},
+	}
+	for _, testCase := range testCases {
+		user, err := authService.GetUser(testCase.Username)
+		require.NoError(t, err)
+		storages, restricted := authService.AllowedStorages(user)
+		assert.Equal(t, testCase.ExpectedStorages, storages, testCase.Username)
+		assert.Equal(t, testCase.ExpectRestricted, restricted, testCase.Username)
+	}
+
+	_, err = NewBasicAuth([]User{
+		{Name: "kid", PasswordHash: "x", Groups: []string{"nope"}},
+	}, nil, time.Hour, newTestTokenSigner(t))
+	assert.Error(t, err)
+}
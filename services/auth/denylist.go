@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/richdawe/minimediaserver/internal/atomicfile"
+)
+
+// Denylist is a list of revoked token IDs. If it has a path,
+// it is persisted to disk whenever a token is revoked.
+type Denylist struct {
+	path string
+
+	mu      sync.Mutex
+	revoked map[string]int64 // Token ID => token expiry (unix time; 0 means never)
+}
+
+type denylistFile struct {
+	Revoked map[string]int64 `json:"revoked"`
+}
+
+func (dl *Denylist) IsRevoked(id string) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	_, ok := dl.revoked[id]
+	return ok
+}
+
+func (dl *Denylist) Revoke(id string, expires int64) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	dl.revoked[id] = expires
+	dl.prune(time.Now())
+	return dl.save()
+}
+
+// Forget about tokens that have expired anyway. Must be called with dl.mu held.
+func (dl *Denylist) prune(now time.Time) {
+	for id, expires := range dl.revoked {
+		if expires != 0 && now.Unix() >= expires {
+			delete(dl.revoked, id)
+		}
+	}
+}
+
+// Write the denylist to disk. Must be called with dl.mu held.
+func (dl *Denylist) save() error {
+	if dl.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(denylistFile{Revoked: dl.revoked}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(dl.path, data)
+}
+
+// NewDenylist loads the denylist from path, if it exists.
+// If path is empty, revocations only last until the server is restarted.
+func NewDenylist(path string) (*Denylist, error) {
+	dl := &Denylist{
+		path:    path,
+		revoked: make(map[string]int64),
+	}
+	if path == "" {
+		return dl, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return dl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f denylistFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for id, expires := range f.Revoked {
+		dl.revoked[id] = expires
+	}
+	dl.prune(time.Now())
+	return dl, nil
+}
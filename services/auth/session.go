@@ -0,0 +1,10 @@
+package auth
+
+import "time"
+
+type Session struct {
+	ID       string // Random ID, stored in a cookie in the client
+	Username string
+
+	Expires time.Time
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrRevokedToken = errors.New("token has been revoked")
+)
+
+const (
+	TokenKindAPI   = "api"   // Long-lived token for scripts, acting as a user
+	TokenKindShare = "share" // Share link for a single track or playlist
+)
+
+const (
+	ScopeTrack    = "track"
+	ScopePlaylist = "playlist"
+)
+
+// TokenClaims is the signed content of a token.
+type TokenClaims struct {
+	ID      string `json:"jti"`           // Random ID, used for revocation
+	Kind    string `json:"kind"`          // TokenKindAPI or TokenKindShare
+	Subject string `json:"sub,omitempty"` // User the token was issued to (or by, for shares)
+
+	Scope   string `json:"scope,omitempty"`   // ScopeTrack or ScopePlaylist, for shares
+	ScopeID string `json:"scopeId,omitempty"` // Track or playlist ID, for shares
+
+	Expires  int64 `json:"exp,omitempty"` // Unix time; 0 means never
+	Download bool  `json:"dl,omitempty"`  // Whether a share allows downloading
+}
+
+func (tc TokenClaims) Expired(now time.Time) bool {
+	return tc.Expires != 0 && now.Unix() >= tc.Expires
+}
+
+// TokenSigner creates and verifies tokens, which are HMAC-signed
+// using the server secret. Tokens look like <payload>.<signature>,
+// both base64url-encoded, so they can be used directly in URLs.
+type TokenSigner struct {
+	secret   []byte
+	denylist *Denylist
+}
+
+func (ts *TokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, ts.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Sign generates a token for the claims. If the claims do not
+// have an ID, a random one is generated.
+func (ts *TokenSigner) Sign(claims TokenClaims) (string, TokenClaims, error) {
+	if claims.ID == "" {
+		id, err := newTokenID()
+		if err != nil {
+			return "", TokenClaims{}, err
+		}
+		claims.ID = id
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", TokenClaims{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + ts.sign(payload), claims, nil
+}
+
+// Verify checks the token's signature, expiry and revocation status,
+// and returns its claims.
+func (ts *TokenSigner) Verify(token string) (TokenClaims, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(signature), []byte(ts.sign(payload))) {
+		return TokenClaims{}, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+
+	if claims.Expired(time.Now()) {
+		return TokenClaims{}, ErrExpiredToken
+	}
+	if ts.denylist.IsRevoked(claims.ID) {
+		return TokenClaims{}, ErrRevokedToken
+	}
+	return claims, nil
+}
+
+// Revoke adds the token to the denylist, so that it can no longer be used.
+func (ts *TokenSigner) Revoke(claims TokenClaims) error {
+	return ts.denylist.Revoke(claims.ID, claims.Expires)
+}
+
+func NewTokenSigner(secret []byte, denylist *Denylist) (*TokenSigner, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret for signing tokens")
+	}
+	return &TokenSigner{
+		secret:   secret,
+		denylist: denylist,
+	}, nil
+}
+
+// NewRandomSecret generates a secret for signing tokens, for use when
+// no secret has been configured. Tokens signed with it will not be valid
+// after a restart.
+func NewRandomSecret() ([]byte, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSigner(t *testing.T) {
+	tokenSigner := newTestTokenSigner(t)
+
+	t.Run("SignAndVerify", func(t *testing.T) {
+		token, claims, err := tokenSigner.Sign(TokenClaims{
+			Kind:    TokenKindShare,
+			Scope:   ScopePlaylist,
+			ScopeID: "1234",
+			Expires: time.Now().Add(time.Hour).Unix(),
+		})
+		require.NoError(t, err)
+		assert.NotEmpty(t, claims.ID)
+
+		verified, err := tokenSigner.Verify(token)
+		require.NoError(t, err)
+		assert.Equal(t, claims, verified)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		token, _, err := tokenSigner.Sign(TokenClaims{Kind: TokenKindAPI, Subject: "fred"})
+		require.NoError(t, err)
+
+		otherToken, _, err := tokenSigner.Sign(TokenClaims{Kind: TokenKindAPI, Subject: "admin"})
+		require.NoError(t, err)
+
+		payload, _, _ := strings.Cut(otherToken, ".")
+		_, signature, _ := strings.Cut(token, ".")
+		_, err = tokenSigner.Verify(payload + "." + signature)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+
+		_, err = tokenSigner.Verify("garbage")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("DifferentSecret", func(t *testing.T) {
+		token, _, err := tokenSigner.Sign(TokenClaims{Kind: TokenKindAPI, Subject: "fred"})
+		require.NoError(t, err)
+
+		denylist, err := NewDenylist("")
+		require.NoError(t, err)
+		otherSigner, err := NewTokenSigner([]byte("another secret"), denylist)
+		require.NoError(t, err)
+		_, err = otherSigner.Verify(token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		token, _, err := tokenSigner.Sign(TokenClaims{
+			Kind:    TokenKindShare,
+			Expires: time.Now().Add(-time.Minute).Unix(),
+		})
+		require.NoError(t, err)
+		_, err = tokenSigner.Verify(token)
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		token, claims, err := tokenSigner.Sign(TokenClaims{Kind: TokenKindAPI, Subject: "fred"})
+		require.NoError(t, err)
+		require.NoError(t, tokenSigner.Revoke(claims))
+		_, err = tokenSigner.Verify(token)
+		assert.ErrorIs(t, err, ErrRevokedToken)
+	})
+}
+
+func TestDenylistPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.json")
+
+	denylist, err := NewDenylist(path)
+	require.NoError(t, err)
+	require.NoError(t, denylist.Revoke("forever", 0))
+	require.NoError(t, denylist.Revoke("later", time.Now().Add(time.Hour).Unix()))
+	require.NoError(t, denylist.Revoke("expired", time.Now().Add(-time.Hour).Unix()))
+
+	reloaded, err := NewDenylist(path)
+	require.NoError(t, err)
+	assert.True(t, reloaded.IsRevoked("forever"))
+	assert.True(t, reloaded.IsRevoked("later"))
+	assert.False(t, reloaded.IsRevoked("expired"))
+	assert.False(t, reloaded.IsRevoked("nope"))
+}
@@ -0,0 +1,21 @@
+package auth
+
+type User struct {
+	Name         string `mapstructure:"name"`
+	PasswordHash string `mapstructure:"passwordHash"` // bcrypt hash, see HashPassword()
+	Admin        bool   `mapstructure:"admin"`        // Whether the user can access the /admin pages
+
+	// Storage services the user may access, by ID or name. Combined with those of
+	// the user's groups. If neither the user nor their groups list any storages,
+	// the user can access everything. "*" means all storage services.
+	Storages []string `mapstructure:"storages"`
+	Groups   []string `mapstructure:"groups"`
+}
+
+type Group struct {
+	Name     string   `mapstructure:"name"`
+	Storages []string `mapstructure:"storages"` // By ID or name, as for User.Storages
+}
+
+// AllStorages is used in a storage allow-list to allow every storage service.
+const AllStorages = "*"
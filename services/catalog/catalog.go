@@ -1,76 +1,399 @@
 package catalog
 
 import (
-	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"slices"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/richdawe/minimediaserver/services/storage"
 )
 
+// BasicCatalog can be used while storages are being added, removed or replaced.
+// Changes are made under the write lock, and build new maps and slices rather
+// than modifying the old ones, so that readers see either the old catalog
+// or the new one, and anything already returned to them stays the same.
 type BasicCatalog struct {
+	options Options
+
+	mu sync.RWMutex // Storages can be added and removed while the catalog is in use
+
 	storageByID map[string]storage.StorageService // Indexed by storage ID
+	storages    []storage.StorageService          // In the order they were added; never modified, only replaced
 
 	// TODO: is this even needed? vvv
 	tracksByStorageServiceID    map[string][]storage.Track    // Indexed by storage ID
 	playlistsByStorageServiceID map[string][]storage.Playlist // Indexed by storage ID
 
-	tracksByID    map[string]Track    // Indexed by track ID
-	playlistsByID map[string]Playlist // Indexed by playlist ID
-	allTracks     []Track
-	allPlaylists  []Playlist
+	tracksByID      map[string]Track    // Indexed by track ID
+	copiesByID      map[string]Track    // Every copy of every track, before duplicates are merged; indexed by track ID
+	aliases         map[string]string   // The merged track's ID for the other copies of it
+	playlistsByID   map[string]Playlist // Indexed by playlist ID
+	allTracks       []Track
+	allPlaylists    []Playlist
+	storageTrackIDs map[string]string // The storage's ID for tracks with a different ID in the catalog
+	collisions      []Collision       // IDs found in more than one storage
+
+	configuredSmartPlaylists []compiledSmartPlaylist // From the configuration; never modified, only replaced
+	addedSmartPlaylists      []compiledSmartPlaylist // Added using AddSmartPlaylist; never modified, only replaced
+
+	generation uint64    // Incremented whenever the indexes are rebuilt
+	chosenAt   time.Time // When the smart playlists which change over time were chosen; see ChoosingTime
 }
 
-// Assumptions:
-// * No ID collisions of tracks from different storage services
+// AddStorage adds a storage service, its tracks and its playlists to the catalog.
+// If its tracks or playlists have the same IDs as ones from other storages,
+// the catalog's collision policy says which copy is used.
 func (cs *BasicCatalog) AddStorage(ss storage.StorageService) error {
 	ssid := ss.GetID()
-	cs.storageByID[ssid] = ss
+	ssname := ss.GetName()
+	cs.mu.RLock()
+	_, ok := cs.storageByID[ssid]
+	cs.mu.RUnlock()
+	if ok {
+		return fmt.Errorf("storage %s has already been added", ssname)
+	}
 
+	// Finding the tracks may take a while, so don't hold the lock.
 	storageTracks, storagePlaylists, err := ss.FindTracks()
 	if err != nil {
-		return err
+		return fmt.Errorf("storage %s: %w", ssname, err)
 	}
 
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.storageByID[ssid]; ok {
+		return fmt.Errorf("storage %s has already been added", ssname)
+	}
+	cs.storageByID[ssid] = ss
+	cs.storages = append(slices.Clip(cs.storages), ss)
 	cs.tracksByStorageServiceID[ssid] = storageTracks
-	for _, storageTrack := range storageTracks {
-		track := Track{
-			ID:               storageTrack.ID,
-			StorageServiceID: ssid,
-			Name:             storageTrack.Name,
-			MIMEType:         storageTrack.MIMEType,
-			DataLen:          storageTrack.DataLen,
+	cs.playlistsByStorageServiceID[ssid] = storagePlaylists
+	cs.reindex()
+
+	return nil
+}
+
+// RemoveStorage removes a storage service, its tracks and its playlists from the catalog.
+func (cs *BasicCatalog) RemoveStorage(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.storageByID[id]; !ok {
+		return fmt.Errorf("%w: storage %s", ErrNotFound, id)
+	}
+	delete(cs.storageByID, id)
+	delete(cs.tracksByStorageServiceID, id)
+	delete(cs.playlistsByStorageServiceID, id)
+
+	storages := make([]storage.StorageService, 0, len(cs.storages))
+	for _, ss := range cs.storages {
+		if ss.GetID() != id {
+			storages = append(storages, ss)
 		}
-		cs.tracksByID[track.ID] = track
-		cs.allTracks = append(cs.allTracks, track)
 	}
+	cs.storages = storages
+	cs.reindex()
 
+	return nil
+}
+
+// ReplaceStorage replaces a storage service with a new one, e.g.: when its
+// configuration has changed. The new storage takes the old one's place in
+// the order of storages. Readers see either the old storage's tracks and
+// playlists or the new storage's, never neither.
+func (cs *BasicCatalog) ReplaceStorage(id string, ss storage.StorageService) error {
+	ssid := ss.GetID()
+	ssname := ss.GetName()
+
+	// Finding the tracks may take a while, so don't hold the lock.
+	storageTracks, storagePlaylists, err := ss.FindTracks()
+	if err != nil {
+		return fmt.Errorf("storage %s: %w", ssname, err)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.storageByID[id]; !ok {
+		return fmt.Errorf("%w: storage %s", ErrNotFound, id)
+	}
+	if _, ok := cs.storageByID[ssid]; ok && ssid != id {
+		return fmt.Errorf("storage %s has already been added", ssname)
+	}
+	delete(cs.storageByID, id)
+	delete(cs.tracksByStorageServiceID, id)
+	delete(cs.playlistsByStorageServiceID, id)
+	cs.storageByID[ssid] = ss
+	cs.tracksByStorageServiceID[ssid] = storageTracks
 	cs.playlistsByStorageServiceID[ssid] = storagePlaylists
-	for _, storagePlaylist := range storagePlaylists {
-		playlist := Playlist{
-			ID:               storagePlaylist.ID,
-			StorageServiceID: ssid,
-			Name:             storagePlaylist.Name,
-			Tracks:           make([]Track, 0),
-		}
-		for _, storageTrack := range storagePlaylist.Tracks {
-			track := Track{
-				ID:               storageTrack.ID,
-				StorageServiceID: ssid,
-				Name:             storageTrack.Name,
-				MIMEType:         storageTrack.MIMEType,
-				DataLen:          storageTrack.DataLen,
+
+	storages := slices.Clone(cs.storages)
+	for i, old := range storages {
+		if old.GetID() == id {
+			storages[i] = ss
+		}
+	}
+	cs.storages = storages
+	cs.reindex()
+
+	return nil
+}
+
+// Reconfigure replaces all the storage services and the configured smart
+// playlists in one step, e.g.: when the configuration is reloaded. The storages
+// are used in the order given, as if they had been added in that order.
+// Storages which are already in the catalog keep the tracks and playlists
+// found when they were added; the others are scanned first. If anything
+// fails, the catalog isn't changed.
+func (cs *BasicCatalog) Reconfigure(storages []storage.StorageService, playlists []SmartPlaylist) error {
+	configured, err := compileSmartPlaylists(playlists, true)
+	if err != nil {
+		return err
+	}
+
+	cs.mu.RLock()
+	current := cs.storageByID
+	cs.mu.RUnlock()
+
+	// Finding the tracks may take a while, so don't hold the lock.
+	storageByID := make(map[string]storage.StorageService, len(storages))
+	tracksByStorageServiceID := make(map[string][]storage.Track, len(storages))
+	playlistsByStorageServiceID := make(map[string][]storage.Playlist, len(storages))
+	for _, ss := range storages {
+		ssid := ss.GetID()
+		if _, ok := storageByID[ssid]; ok {
+			return fmt.Errorf("storage %s has already been added", ss.GetName())
+		}
+		storageByID[ssid] = ss
+		if current[ssid] == ss {
+			continue
+		}
+		storageTracks, storagePlaylists, err := ss.FindTracks()
+		if err != nil {
+			return fmt.Errorf("storage %s: %w", ss.GetName(), err)
+		}
+		tracksByStorageServiceID[ssid] = storageTracks
+		playlistsByStorageServiceID[ssid] = storagePlaylists
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, csp := range configured {
+		for _, added := range cs.addedSmartPlaylists {
+			if added.ID == csp.ID {
+				return fmt.Errorf("%w: smart playlist %s has already been added", ErrExists, csp.Name)
 			}
-			playlist.Tracks = append(playlist.Tracks, track)
 		}
+	}
+	for ssid, ss := range storageByID {
+		if _, ok := tracksByStorageServiceID[ssid]; ok {
+			continue
+		}
+		if cs.storageByID[ssid] != ss {
+			return fmt.Errorf("storage %s was removed while the catalog was being reconfigured", ss.GetName())
+		}
+		tracksByStorageServiceID[ssid] = cs.tracksByStorageServiceID[ssid]
+		playlistsByStorageServiceID[ssid] = cs.playlistsByStorageServiceID[ssid]
+	}
 
-		cs.playlistsByID[playlist.ID] = playlist
+	// Reloading the configuration shouldn't change the catalog if nothing in it has changed.
+	unchanged := slices.Equal(cs.storages, storages) &&
+		slices.EqualFunc(cs.configuredSmartPlaylists, configured, func(a compiledSmartPlaylist, b compiledSmartPlaylist) bool {
+			return a.SmartPlaylist == b.SmartPlaylist
+		})
+	if unchanged {
+		return nil
 	}
-	cs.allPlaylists = sortPlaylists(cs.playlistsByID)
+	cs.storageByID = storageByID
+	cs.storages = slices.Clone(storages)
+	cs.tracksByStorageServiceID = tracksByStorageServiceID
+	cs.playlistsByStorageServiceID = playlistsByStorageServiceID
+	cs.configuredSmartPlaylists = configured
+	cs.reindex()
 
 	return nil
 }
 
+// newTrack builds the catalog's view of a track from a storage service.
+func newTrack(storageTrack storage.Track, ssid string, ssname string) Track {
+	return Track{
+		ID:               storageTrack.ID,
+		StorageServiceID: ssid,
+		StorageName:      ssname,
+		Name:             storageTrack.Name,
+		Title:            storageTrack.Title,
+		Artist:           storageTrack.Artist,
+		Album:            storageTrack.Album,
+		AlbumArtist:      storageTrack.AlbumArtist,
+		Genre:            storageTrack.Genre,
+		Year:             storageTrack.Year,
+		DiscNumber:       storageTrack.DiscNumber,
+		TrackNumber:      storageTrack.TrackNumber,
+		Rating:           storageTrack.Rating,
+		MIMEType:         storageTrack.MIMEType,
+		DataLen:          storageTrack.DataLen,
+		Duration:         storageTrack.Duration,
+		Bitrate:          storageTrack.Bitrate,
+		ModTime:          storageTrack.ModTime,
+		Version:          storageTrack.Version,
+	}
+}
+
+// Rebuild the indexes of tracks and playlists from the storages' tracks
+// and playlists. New maps and slices are built, so that any returned
+// to callers before are not modified. Must be called with the lock held.
+func (cs *BasicCatalog) reindex() {
+	tracksByID := make(map[string]Track)
+	playlistsByID := make(map[string]Playlist)
+	allTracks := make([]Track, 0)
+	storageTrackIDs := make(map[string]string)
+
+	// Find the tracks and playlists with the same IDs in more than one storage.
+	resolver := newIDResolver(cs.options.collisionPolicy(), cs.storages)
+	for i, ss := range cs.storages {
+		for _, storageTrack := range cs.tracksByStorageServiceID[ss.GetID()] {
+			resolver.add(CollisionKindTrack, storageTrack.ID, storageTrack.Name, i)
+		}
+		for _, storagePlaylist := range cs.playlistsByStorageServiceID[ss.GetID()] {
+			resolver.add(CollisionKindPlaylist, storagePlaylist.ID, storagePlaylist.Name, i)
+		}
+	}
+
+	for i, ss := range cs.storages {
+		ssid := ss.GetID()
+		ssname := ss.GetName()
+
+		for _, storageTrack := range cs.tracksByStorageServiceID[ssid] {
+			id := resolver.catalogID(CollisionKindTrack, storageTrack.ID, i)
+			if id == "" {
+				continue
+			}
+			track := newTrack(storageTrack, ssid, ssname)
+			if id != track.ID {
+				storageTrackIDs[id] = track.ID
+				track.ID = id
+			}
+			tracksByID[track.ID] = track
+			allTracks = append(allTracks, track)
+		}
+	}
+
+	// Merge the copies of each track, e.g.: in different formats in different storages.
+	copiesByID := tracksByID
+	aliases := make(map[string]string)
+	if cs.options.MergeDuplicates {
+		allTracks, aliases = mergeSources(allTracks)
+		tracksByID = make(map[string]Track, len(allTracks))
+		for _, track := range allTracks {
+			tracksByID[track.ID] = track
+		}
+	}
+
+	// The playlists' tracks are the copies in the catalog, so that
+	// playing a playlist plays the same data as playing its tracks.
+	for i, ss := range cs.storages {
+		ssid := ss.GetID()
+		ssname := ss.GetName()
+
+		for _, storagePlaylist := range cs.playlistsByStorageServiceID[ssid] {
+			id := resolver.catalogID(CollisionKindPlaylist, storagePlaylist.ID, i)
+			if id == "" {
+				continue
+			}
+			playlist := Playlist{
+				ID:               id,
+				StorageServiceID: ssid,
+				StorageName:      ssname,
+				Name:             storagePlaylist.Name,
+				Tracks:           make([]Track, 0),
+			}
+			for _, storageTrack := range storagePlaylist.Tracks {
+				trackID := resolver.catalogID(CollisionKindTrack, storageTrack.ID, i)
+				if trackID == "" {
+					trackID = storageTrack.ID
+				}
+				if alias, ok := aliases[trackID]; ok {
+					trackID = alias
+				}
+				track, ok := tracksByID[trackID]
+				if !ok {
+					track = newTrack(storageTrack, ssid, ssname)
+				}
+				playlist.Tracks = append(playlist.Tracks, track)
+			}
+			playlist.Plays = totalPlays(playlist.Tracks)
+
+			playlistsByID[playlist.ID] = playlist
+		}
+	}
+
+	// The smart playlists choose from all of the tracks.
+	at := ChoosingTime(timeNow())
+	for _, csp := range cs.smartPlaylists() {
+		playlistsByID[csp.ID] = csp.evaluate(allTracks, at)
+	}
+
+	cs.tracksByID = tracksByID
+	cs.copiesByID = copiesByID
+	cs.aliases = aliases
+	cs.playlistsByID = playlistsByID
+	cs.allTracks = allTracks
+	cs.allPlaylists = sortPlaylists(playlistsByID)
+	cs.storageTrackIDs = storageTrackIDs
+	cs.collisions = resolver.collisions()
+	cs.chosenAt = at
+	cs.generation++
+}
+
+// chooseChangingTracks chooses the tracks again for the smart playlists which
+// change over time, e.g.: "added in last 30 days", if they were chosen before
+// the current ChoosingInterval. The catalog hasn't changed, so neither does
+// its generation; callers caching responses need to check the ChoosingTime too.
+func (cs *BasicCatalog) chooseChangingTracks() {
+	at := ChoosingTime(timeNow())
+	cs.mu.RLock()
+	due := !cs.chosenAt.Equal(at) && slices.ContainsFunc(cs.smartPlaylists(), compiledSmartPlaylist.changesOverTime)
+	cs.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.chosenAt.Equal(at) {
+		return
+	}
+	playlistsByID := maps.Clone(cs.playlistsByID)
+	for _, csp := range cs.smartPlaylists() {
+		if csp.changesOverTime() {
+			playlistsByID[csp.ID] = csp.evaluate(cs.allTracks, at)
+		}
+	}
+	cs.playlistsByID = playlistsByID
+	cs.allPlaylists = sortPlaylists(playlistsByID)
+	cs.chosenAt = at
+}
+
+// smartPlaylists returns all the smart playlists, configured ones first.
+// Must be called with the lock held.
+func (cs *BasicCatalog) smartPlaylists() []compiledSmartPlaylist {
+	return append(slices.Clip(cs.configuredSmartPlaylists), cs.addedSmartPlaylists...)
+}
+
+// findSmartPlaylist returns the smart playlist with the ID, if there is one.
+// Must be called with the lock held.
+func (cs *BasicCatalog) findSmartPlaylist(id string) (compiledSmartPlaylist, bool) {
+	for _, csp := range cs.smartPlaylists() {
+		if csp.ID == id {
+			return csp, true
+		}
+	}
+	return compiledSmartPlaylist{}, false
+}
+
 // Find and sort the playlist IDs based on the name
 // of the playlist. Then build list of sorted playlists
 // using the sorted list of playlist IDs.
@@ -92,44 +415,168 @@ func sortPlaylists(playlistsByID map[string]Playlist) []Playlist {
 	return playlists
 }
 
+func (cs *BasicCatalog) GetStorages() []storage.StorageService {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.storages
+}
+
 func (cs *BasicCatalog) GetTracks() ([]Track, []Playlist) {
+	cs.chooseChangingTracks()
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
 	return cs.allTracks, cs.allPlaylists
 }
 
 func (cs *BasicCatalog) GetTrack(id string) (Track, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if alias, ok := cs.aliases[id]; ok {
+		id = alias
+	}
 	track, ok := cs.tracksByID[id]
 	if !ok {
-		return Track{}, errors.New("unable to find track by ID")
+		return Track{}, fmt.Errorf("%w: track %s", ErrNotFound, id)
 	}
 	return track, nil
 }
 
 func (cs *BasicCatalog) GetPlaylist(id string) (Playlist, error) {
+	cs.chooseChangingTracks()
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
 	playlist, ok := cs.playlistsByID[id]
 	if !ok {
-		return Playlist{}, errors.New("unable to find playlist by ID")
+		return Playlist{}, fmt.Errorf("%w: playlist %s", ErrNotFound, id)
 	}
 	return playlist, nil
 }
 
-func (cs *BasicCatalog) ReadTrack(track Track) (io.Reader, error) {
-	_, err := cs.GetTrack(track.ID)
+func (cs *BasicCatalog) GetSmartPlaylists() []SmartPlaylist {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	playlists := make([]SmartPlaylist, 0)
+	for _, csp := range cs.smartPlaylists() {
+		playlists = append(playlists, csp.SmartPlaylist)
+	}
+	return playlists
+}
+
+// AddSmartPlaylist adds a smart playlist, and chooses its tracks. If it hasn't
+// got an ID, it is given one based on its name.
+func (cs *BasicCatalog) AddSmartPlaylist(sp SmartPlaylist) (SmartPlaylist, error) {
+	sp.Configured = false
+	csp, err := compileSmartPlaylist(sp)
 	if err != nil {
-		return nil, err
+		return SmartPlaylist{}, err
 	}
-	ss, ok := cs.storageByID[track.StorageServiceID]
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.findSmartPlaylist(csp.ID); ok {
+		return SmartPlaylist{}, fmt.Errorf("%w: smart playlist %s", ErrExists, csp.Name)
+	}
+	cs.addedSmartPlaylists = append(slices.Clip(cs.addedSmartPlaylists), csp)
+	cs.reindex()
+	return csp.SmartPlaylist, nil
+}
+
+// RemoveSmartPlaylist removes a smart playlist added using AddSmartPlaylist.
+// Configured smart playlists can only be removed from the configuration.
+func (cs *BasicCatalog) RemoveSmartPlaylist(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	csp, ok := cs.findSmartPlaylist(id)
 	if !ok {
-		return nil, errors.New("unable to find storage service for track")
+		return fmt.Errorf("%w: smart playlist %s", ErrNotFound, id)
+	}
+	if csp.Configured {
+		return fmt.Errorf("%w: smart playlist %s is in the configuration", ErrForbidden, csp.Name)
+	}
+	added := make([]compiledSmartPlaylist, 0, len(cs.addedSmartPlaylists))
+	for _, other := range cs.addedSmartPlaylists {
+		if other.ID != id {
+			added = append(added, other)
+		}
+	}
+	cs.addedSmartPlaylists = added
+	cs.reindex()
+	return nil
+}
+
+// ConfigureSmartPlaylists replaces the smart playlists from the configuration,
+// e.g.: when it is reloaded. The smart playlists added using AddSmartPlaylist
+// are kept, so none of the new ones may have the same ID as one of them.
+func (cs *BasicCatalog) ConfigureSmartPlaylists(playlists []SmartPlaylist) error {
+	configured, err := compileSmartPlaylists(playlists, true)
+	if err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, csp := range configured {
+		for _, added := range cs.addedSmartPlaylists {
+			if added.ID == csp.ID {
+				return fmt.Errorf("%w: smart playlist %s has already been added", ErrExists, csp.Name)
+			}
+		}
+	}
+	// Reloading the configuration shouldn't change the catalog if the smart playlists are the same.
+	unchanged := slices.EqualFunc(cs.configuredSmartPlaylists, configured, func(a compiledSmartPlaylist, b compiledSmartPlaylist) bool {
+		return a.SmartPlaylist == b.SmartPlaylist
+	})
+	if unchanged {
+		return nil
 	}
-	return ss.ReadTrack(track.ID)
+	cs.configuredSmartPlaylists = configured
+	cs.reindex()
+	return nil
 }
 
-func NewBasicCatalog() (CatalogService, error) {
+func (cs *BasicCatalog) GetCollisions() []Collision {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.collisions
+}
+
+func (cs *BasicCatalog) Generation() uint64 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.generation
+}
+
+// ReadTrack reads the data for a copy of a track. To read a copy other
+// than the merged track's preferred one, use Track.WithSource.
+func (cs *BasicCatalog) ReadTrack(track Track) (io.Reader, error) {
+	cs.mu.RLock()
+	trackCopy, found := cs.copiesByID[track.ID]
+	ss, ok := cs.storageByID[track.StorageServiceID]
+	id, renamed := cs.storageTrackIDs[track.ID]
+	cs.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("%w: track %s", ErrNotFound, track.ID)
+	}
+	if !ok || trackCopy.StorageServiceID != track.StorageServiceID {
+		return nil, fmt.Errorf("%w: storage %s for track %s", ErrNotFound, track.StorageServiceID, track.ID)
+	}
+	if !renamed {
+		id = track.ID
+	}
+	return ss.ReadTrack(id)
+}
+
+func NewBasicCatalog(options Options) (CatalogService, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
 	return &BasicCatalog{
+		options:                     options,
 		storageByID:                 make(map[string]storage.StorageService, 0),
 		tracksByStorageServiceID:    make(map[string][]storage.Track),
 		playlistsByStorageServiceID: make(map[string][]storage.Playlist),
 		tracksByID:                  make(map[string]Track),
+		copiesByID:                  make(map[string]Track),
 		playlistsByID:               make(map[string]Playlist),
 	}, nil
 }
@@ -2,6 +2,8 @@ package catalog
 
 import (
 	"io"
+	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,9 +13,9 @@ import (
 )
 
 func TestCatalogService(t *testing.T) {
-	catalogService, err := NewBasicCatalog()
+	catalogService, err := NewBasicCatalog(Options{})
 	assert.Nil(t, err)
-	nullStorage, err := storage.NewNullStorage()
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
 	assert.Nil(t, err)
 	err = catalogService.AddStorage(nullStorage)
 	assert.Nil(t, err)
@@ -32,8 +34,12 @@ func TestCatalogService(t *testing.T) {
 			Name:             "ExAmPlE",
 			ID:               id,
 			StorageServiceID: nullStorage.GetID(),
+			StorageName:      "null",
 			MIMEType:         "audio/ogg",
 			DataLen:          105269,
+			Duration:         6104036281,
+			Bitrate:          160003,
+			Version:          "f580c9d43da097d9",
 		}, tracks[0])
 
 		playlistID := playlists[0].ID
@@ -43,10 +49,25 @@ func TestCatalogService(t *testing.T) {
 			Name:             "null-playlist",
 			ID:               playlistID,
 			StorageServiceID: nullStorage.GetID(),
+			StorageName:      "null",
 			Tracks:           []Track{tracks[0]},
 		}, playlists[0])
 	})
 
+	t.Run("Generation", func(t *testing.T) {
+		generation := catalogService.Generation()
+		assert.NotZero(t, generation)
+
+		otherStorage, err := storage.NewNullStorage(storage.Options{Name: "other"})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(otherStorage))
+		assert.Greater(t, catalogService.Generation(), generation)
+		generation = catalogService.Generation()
+
+		require.NoError(t, catalogService.RemoveStorage(otherStorage.GetID()))
+		assert.Greater(t, catalogService.Generation(), generation)
+	})
+
 	t.Run("GetTrack", func(t *testing.T) {
 		tracks, _ := catalogService.GetTracks()
 		require.NotNil(t, tracks)
@@ -57,7 +78,7 @@ func TestCatalogService(t *testing.T) {
 		assert.Equal(t, tracks[0], track)
 
 		_, err = catalogService.GetTrack("nope")
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
 	})
 
 	t.Run("GetPlaylist", func(t *testing.T) {
@@ -70,7 +91,7 @@ func TestCatalogService(t *testing.T) {
 		assert.Equal(t, playlists[0], playlist)
 
 		_, err = catalogService.GetPlaylist("nope")
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
 	})
 
 	t.Run("ReadTrack", func(t *testing.T) {
@@ -89,12 +110,234 @@ func TestCatalogService(t *testing.T) {
 		// Invalid track ID
 		track := Track{ID: "nope", MIMEType: "audio/nope"}
 		_, err = catalogService.ReadTrack(track)
-		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
 
 		// Invalid storage service ID
 		track = tracks[0]
 		track.StorageServiceID = "nope"
 		_, err = catalogService.ReadTrack(track)
-		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestRemoveStorage(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(nullStorage))
+	diskStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+
+	tracks, playlists := catalogService.GetTracks()
+	require.Len(t, tracks, 5)
+	nullTrack := tracks[0]
+
+	require.NoError(t, catalogService.RemoveStorage(nullStorage.GetID()))
+	assert.Error(t, catalogService.RemoveStorage(nullStorage.GetID()))
+
+	storages := catalogService.GetStorages()
+	require.Len(t, storages, 1)
+	assert.Equal(t, "cds", storages[0].GetName())
+
+	newTracks, newPlaylists := catalogService.GetTracks()
+	assert.Len(t, newTracks, 4)
+	assert.Len(t, newPlaylists, len(playlists)-1)
+	for _, track := range newTracks {
+		assert.Equal(t, diskStorage.GetID(), track.StorageServiceID)
+	}
+	_, err = catalogService.GetTrack(nullTrack.ID)
+	assert.Error(t, err)
+
+	// Tracks returned before the storage was removed are unchanged.
+	assert.Len(t, tracks, 5)
+
+	// The storage can be added again.
+	require.NoError(t, catalogService.AddStorage(nullStorage))
+	newTracks, _ = catalogService.GetTracks()
+	assert.Len(t, newTracks, 5)
+}
+
+func TestReplaceStorage(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(nullStorage))
+	diskStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+
+	tracks, playlists := catalogService.GetTracks()
+	require.Len(t, tracks, 5)
+	nullTrack := tracks[0]
+
+	t.Run("SameStorage", func(t *testing.T) {
+		// E.g.: its configuration has changed.
+		generation := catalogService.Generation()
+		newDiskStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.ReplaceStorage(diskStorage.GetID(), newDiskStorage))
+		assert.Equal(t, generation+1, catalogService.Generation())
+
+		storages := catalogService.GetStorages()
+		require.Len(t, storages, 2)
+		assert.Equal(t, nullStorage, storages[0])
+		assert.Equal(t, newDiskStorage, storages[1])
+		newTracks, newPlaylists := catalogService.GetTracks()
+		assert.Equal(t, tracks, newTracks)
+		assert.Equal(t, playlists, newPlaylists)
+	})
+
+	t.Run("DifferentStorage", func(t *testing.T) {
+		otherStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "other"})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.ReplaceStorage(nullStorage.GetID(), otherStorage))
+
+		storages := catalogService.GetStorages()
+		require.Len(t, storages, 2)
+		assert.Equal(t, "other", storages[0].GetName())
+		assert.Equal(t, "cds", storages[1].GetName())
+		_, err = catalogService.GetTrack(nullTrack.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		// Tracks returned before the storage was replaced are unchanged.
+		assert.Len(t, tracks, 5)
+		assert.Equal(t, nullTrack, tracks[0])
 	})
+
+	t.Run("Errors", func(t *testing.T) {
+		generation := catalogService.Generation()
+		assert.ErrorIs(t, catalogService.ReplaceStorage(nullStorage.GetID(), nullStorage), ErrNotFound)
+
+		// The new storage is already in the catalog, in a different place.
+		storages := catalogService.GetStorages()
+		assert.Error(t, catalogService.ReplaceStorage(storages[0].GetID(), storages[1]))
+		assert.Equal(t, generation, catalogService.Generation())
+		assert.Equal(t, storages, catalogService.GetStorages())
+	})
+}
+
+func TestReconfigure(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(nullStorage))
+	diskStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+
+	t.Run("StoragesAndSmartPlaylists", func(t *testing.T) {
+		generation := catalogService.Generation()
+		storages := []storage.StorageService{diskStorage, nullStorage}
+		smartPlaylists := []SmartPlaylist{{Name: "Oggs", Rule: "format = ogg"}}
+		require.NoError(t, catalogService.Reconfigure(storages, smartPlaylists))
+		assert.Equal(t, generation+1, catalogService.Generation())
+
+		// The storages are in the order given, not the order they were added.
+		assert.Equal(t, storages, catalogService.GetStorages())
+		tracks, _ := catalogService.GetTracks()
+		assert.Len(t, tracks, 5)
+		require.Len(t, catalogService.GetSmartPlaylists(), 1)
+		playlist, err := catalogService.GetPlaylist(catalogService.GetSmartPlaylists()[0].ID)
+		require.NoError(t, err)
+		assert.Len(t, playlist.Tracks, 3)
+
+		// Nothing has changed.
+		require.NoError(t, catalogService.Reconfigure(storages, smartPlaylists))
+		assert.Equal(t, generation+1, catalogService.Generation())
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		generation := catalogService.Generation()
+		storages := catalogService.GetStorages()
+		smartPlaylists := catalogService.GetSmartPlaylists()
+
+		dir := t.TempDir()
+		missing, err := storage.NewDiskStorage(dir, []string{}, storage.Options{Name: "missing"})
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(dir))
+		assert.Error(t, catalogService.Reconfigure([]storage.StorageService{missing}, nil))
+
+		assert.Error(t, catalogService.Reconfigure([]storage.StorageService{nullStorage, nullStorage}, nil))
+		assert.ErrorIs(t, catalogService.Reconfigure(nil, []SmartPlaylist{{Name: "Bad", Rule: "colour = red"}}), ErrInvalid)
+
+		_, err = catalogService.AddSmartPlaylist(SmartPlaylist{Name: "Added"})
+		require.NoError(t, err)
+		assert.ErrorIs(t, catalogService.Reconfigure(nil, []SmartPlaylist{{Name: "Added"}}), ErrExists)
+		generation++
+
+		// The catalog is unchanged.
+		assert.Equal(t, generation, catalogService.Generation())
+		assert.Equal(t, storages, catalogService.GetStorages())
+		assert.Equal(t, smartPlaylists, catalogService.GetSmartPlaylists()[:len(smartPlaylists)])
+	})
+}
+
+// Run with -race to check that readers and writers don't interfere.
+func TestConcurrentAccess(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(nullStorage))
+	diskStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(diskStorage))
+	otherStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "other"})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// The storage being replaced is always there, so there
+				// are always the null storage's track and its tracks.
+				generation := catalogService.Generation()
+				tracks, playlists := catalogService.GetTracks()
+				if !assert.Len(t, tracks, 5) {
+					return
+				}
+				assert.Len(t, playlists, 4)
+				assert.Len(t, catalogService.GetStorages(), 2)
+				for _, track := range tracks {
+					if _, err := catalogService.GetTrack(track.ID); err != nil {
+						// Only possible if the catalog changed in between.
+						assert.NotEqual(t, generation, catalogService.Generation())
+						continue
+					}
+					if r, err := catalogService.ReadTrack(track); err == nil {
+						_, err = io.Copy(io.Discard, r)
+						assert.NoError(t, err)
+					}
+				}
+				for _, playlist := range playlists {
+					_, _ = catalogService.GetPlaylist(playlist.ID)
+				}
+			}
+		}()
+	}
+
+	// Swap the disk storage back and forth, while the readers are running.
+	current := storage.StorageService(diskStorage)
+	for i := 0; i < 50; i++ {
+		next := storage.StorageService(otherStorage)
+		if current == otherStorage {
+			next = diskStorage
+		}
+		require.NoError(t, catalogService.ReplaceStorage(current.GetID(), next))
+		current = next
+	}
+	close(done)
+	wg.Wait()
 }
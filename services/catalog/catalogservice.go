@@ -7,11 +7,25 @@ import (
 )
 
 type CatalogService interface {
-	AddStorage(ss storage.StorageService) error // Add a storage service, its tracks and its playlists to the catalog
+	AddStorage(ss storage.StorageService) error                // Add a storage service, its tracks and its playlists to the catalog
+	RemoveStorage(id string) error                             // Remove a storage service, its tracks and its playlists from the catalog
+	ReplaceStorage(id string, ss storage.StorageService) error // Replace a storage service with a new one, in one step
+	GetStorages() []storage.StorageService                     // Return all the storage services in the catalog
+
+	Reconfigure(storages []storage.StorageService, playlists []SmartPlaylist) error // Replace all the storage services and the configured smart playlists, in one step
 
 	GetTracks() ([]Track, []Playlist)         // Return all the tracks an playlists in the catalog
 	GetTrack(id string) (Track, error)        // Get info for a track, by track ID
 	ReadTrack(track Track) (io.Reader, error) // Read the track data, using data returned by GetTrack()
 
 	GetPlaylist(id string) (Playlist, error) // Get info for a playlist, by playlist ID
+
+	GetSmartPlaylists() []SmartPlaylist                       // The definitions of the smart playlists, configured ones first
+	AddSmartPlaylist(sp SmartPlaylist) (SmartPlaylist, error) // Add a smart playlist, and choose its tracks
+	RemoveSmartPlaylist(id string) error                      // Remove a smart playlist added using AddSmartPlaylist
+	ConfigureSmartPlaylists(playlists []SmartPlaylist) error  // Replace the configured smart playlists, in one step
+
+	GetCollisions() []Collision // Tracks and playlists with the same ID in more than one storage
+
+	Generation() uint64 // Changes whenever tracks or playlists are added or removed, e.g.: for HTTP ETags
 }
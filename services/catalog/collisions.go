@@ -0,0 +1,149 @@
+package catalog
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// CollisionPolicy says what to do when tracks or playlists from different storages
+// have the same ID, e.g.: storages for a directory and a bind mount of it.
+type CollisionPolicy string
+
+const (
+	CollisionPolicyFirst     CollisionPolicy = "first"     // Use the copy from the storage added first
+	CollisionPolicyPriority  CollisionPolicy = "priority"  // Use the copy from the storage with the highest priority, or the first of those
+	CollisionPolicyNamespace CollisionPolicy = "namespace" // Keep all the copies; the ones from later storages get new IDs
+)
+
+func (p CollisionPolicy) valid() bool {
+	switch p {
+	case "", CollisionPolicyFirst, CollisionPolicyPriority, CollisionPolicyNamespace:
+		return true
+	}
+	return false
+}
+
+// What kind of thing has an ID that collides.
+const (
+	CollisionKindTrack    = "track"
+	CollisionKindPlaylist = "playlist"
+)
+
+// Collision is a track or playlist ID found in more than one storage.
+type Collision struct {
+	Kind   string          `json:"kind"`   // CollisionKindTrack or CollisionKindPlaylist
+	ID     string          `json:"id"`     // The ID the storages use
+	Name   string          `json:"name"`   // The name of the first copy
+	Copies []CollisionCopy `json:"copies"` // In the order the storages were added
+}
+
+// CollisionCopy is one storage's copy of a track or playlist with a colliding ID.
+type CollisionCopy struct {
+	StorageServiceID string `json:"storageServiceId"`
+	StorageName      string `json:"library"`
+	ID               string `json:"catalogId,omitempty"` // The copy's ID in the catalog; empty if it isn't used
+}
+
+// namespacedID derives a stable ID for a storage's copy of a track or playlist,
+// so that it stays the same across restarts.
+func namespacedID(storageServiceID string, id string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("storage:"+storageServiceID+"/"+id)).String()
+}
+
+// idResolver decides which copies of tracks and playlists with the same ID
+// are used, and what their IDs in the catalog are.
+type idResolver struct {
+	policy   CollisionPolicy
+	storages []storage.StorageService
+
+	copies map[resolverKey][]int  // Indexes of the storages with each ID
+	names  map[resolverKey]string // Name of the first copy
+}
+
+type resolverKey struct {
+	kind string
+	id   string
+}
+
+func newIDResolver(policy CollisionPolicy, storages []storage.StorageService) *idResolver {
+	return &idResolver{
+		policy:   policy,
+		storages: storages,
+		copies:   make(map[resolverKey][]int),
+		names:    make(map[resolverKey]string),
+	}
+}
+
+// add records that a storage has a track or playlist. Storages must be added in order.
+func (r *idResolver) add(kind string, id string, name string, storageIndex int) {
+	key := resolverKey{kind, id}
+	copies := r.copies[key]
+	if len(copies) > 0 && copies[len(copies)-1] == storageIndex {
+		return
+	}
+	if len(copies) == 0 {
+		r.names[key] = name
+	}
+	r.copies[key] = append(copies, storageIndex)
+}
+
+// catalogID returns the ID in the catalog for a storage's copy of a track
+// or playlist, or an empty string if that copy isn't used.
+func (r *idResolver) catalogID(kind string, id string, storageIndex int) string {
+	copies := r.copies[resolverKey{kind, id}]
+	if len(copies) < 2 {
+		return id
+	}
+
+	winner := copies[0]
+	switch r.policy {
+	case CollisionPolicyNamespace:
+		if storageIndex == winner {
+			return id
+		}
+		return namespacedID(r.storages[storageIndex].GetID(), id)
+	case CollisionPolicyPriority:
+		for _, i := range copies[1:] {
+			if r.storages[i].GetOptions().Priority > r.storages[winner].GetOptions().Priority {
+				winner = i
+			}
+		}
+	}
+	if storageIndex == winner {
+		return id
+	}
+	return ""
+}
+
+// collisions returns the IDs found in more than one storage, tracks first, sorted by ID.
+func (r *idResolver) collisions() []Collision {
+	keys := make([]resolverKey, 0)
+	for key, copies := range r.copies {
+		if len(copies) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i int, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind == CollisionKindTrack
+		}
+		return keys[i].id < keys[j].id
+	})
+
+	collisions := make([]Collision, 0, len(keys))
+	for _, key := range keys {
+		collision := Collision{Kind: key.kind, ID: key.id, Name: r.names[key]}
+		for _, i := range r.copies[key] {
+			collision.Copies = append(collision.Copies, CollisionCopy{
+				StorageServiceID: r.storages[i].GetID(),
+				StorageName:      r.storages[i].GetName(),
+				ID:               r.catalogID(key.kind, key.id, i),
+			})
+		}
+		collisions = append(collisions, collision)
+	}
+	return collisions
+}
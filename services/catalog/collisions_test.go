@@ -0,0 +1,137 @@
+package catalog
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// Two storages for the same directory, so all of their tracks and playlists have the same IDs.
+func overlappingCatalog(t *testing.T, policy CollisionPolicy, mirrorPriority int) (CatalogService, storage.StorageService, storage.StorageService) {
+	catalogService, err := NewBasicCatalog(Options{CollisionPolicy: policy})
+	require.NoError(t, err)
+	cds, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(cds))
+	mirror, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{Name: "mirror", Priority: mirrorPriority})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(mirror))
+	return catalogService, cds, mirror
+}
+
+// Check that each playlist's tracks are the ones in the catalog.
+func assertPlaylistsConsistent(t *testing.T, catalogService CatalogService) {
+	_, playlists := catalogService.GetTracks()
+	for _, playlist := range playlists {
+		for _, track := range playlist.Tracks {
+			catalogTrack, err := catalogService.GetTrack(track.ID)
+			if assert.NoError(t, err) {
+				assert.Equal(t, catalogTrack, track)
+			}
+		}
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	t.Run("First", func(t *testing.T) {
+		catalogService, cds, mirror := overlappingCatalog(t, "", 1)
+		tracks, playlists := catalogService.GetTracks()
+		assert.Len(t, tracks, 4)
+		assert.Len(t, playlists, 3)
+		for _, track := range tracks {
+			assert.Equal(t, "cds", track.StorageName)
+		}
+		assertPlaylistsConsistent(t, catalogService)
+
+		collisions := catalogService.GetCollisions()
+		require.Len(t, collisions, 7)
+		assert.Equal(t, CollisionKindTrack, collisions[0].Kind)
+		assert.Equal(t, CollisionKindPlaylist, collisions[6].Kind)
+		assert.Equal(t, []CollisionCopy{
+			{StorageServiceID: cds.GetID(), StorageName: "cds", ID: collisions[0].ID},
+			{StorageServiceID: mirror.GetID(), StorageName: "mirror"},
+		}, collisions[0].Copies)
+	})
+
+	t.Run("Priority", func(t *testing.T) {
+		catalogService, _, _ := overlappingCatalog(t, CollisionPolicyPriority, 1)
+		tracks, playlists := catalogService.GetTracks()
+		assert.Len(t, tracks, 4)
+		for _, track := range tracks {
+			assert.Equal(t, "mirror", track.StorageName)
+		}
+		for _, playlist := range playlists {
+			assert.Equal(t, "mirror", playlist.StorageName)
+		}
+		assertPlaylistsConsistent(t, catalogService)
+
+		// Ties go to the first storage.
+		catalogService, _, _ = overlappingCatalog(t, CollisionPolicyPriority, 0)
+		tracks, _ = catalogService.GetTracks()
+		assert.Equal(t, "cds", tracks[0].StorageName)
+	})
+
+	t.Run("Namespace", func(t *testing.T) {
+		catalogService, _, _ := overlappingCatalog(t, CollisionPolicyNamespace, 0)
+		tracks, playlists := catalogService.GetTracks()
+		require.Len(t, tracks, 8)
+		assert.Len(t, playlists, 6)
+		assertPlaylistsConsistent(t, catalogService)
+
+		// The first storage's copies keep their IDs.
+		ids := make(map[string]bool, 0)
+		for i, track := range tracks {
+			ids[track.ID] = true
+			if i < 4 {
+				assert.Equal(t, "cds", track.StorageName)
+				continue
+			}
+			assert.Equal(t, "mirror", track.StorageName)
+			assert.Equal(t, tracks[i-4].Name, track.Name)
+
+			// The storage's own ID is used to read the data.
+			r, err := catalogService.ReadTrack(track)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Len(t, data, int(track.DataLen))
+		}
+		assert.Len(t, ids, 8)
+
+		for _, collision := range catalogService.GetCollisions() {
+			require.Len(t, collision.Copies, 2)
+			assert.Equal(t, collision.ID, collision.Copies[0].ID)
+			assert.NotEqual(t, collision.ID, collision.Copies[1].ID)
+			assert.NotEmpty(t, collision.Copies[1].ID)
+		}
+
+		// The new IDs are the same when the catalog is built again.
+		again, _, _ := overlappingCatalog(t, CollisionPolicyNamespace, 0)
+		againTracks, _ := again.GetTracks()
+		assert.Equal(t, tracks, againTracks)
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		catalogService, cds, mirror := overlappingCatalog(t, "", 0)
+		assert.Empty(t, NewFilteredCatalog(catalogService, func(id string) bool { return id == mirror.GetID() }).GetCollisions())
+		assert.Len(t, NewFilteredCatalog(catalogService, func(id string) bool { return id == mirror.GetID() || id == cds.GetID() }).GetCollisions(), 7)
+	})
+
+	t.Run("RemoveStorage", func(t *testing.T) {
+		catalogService, cds, _ := overlappingCatalog(t, "", 0)
+		require.NoError(t, catalogService.RemoveStorage(cds.GetID()))
+		assert.Empty(t, catalogService.GetCollisions())
+		tracks, _ := catalogService.GetTracks()
+		require.Len(t, tracks, 4)
+		assert.Equal(t, "mirror", tracks[0].StorageName)
+	})
+
+	t.Run("UnknownPolicy", func(t *testing.T) {
+		_, err := NewBasicCatalog(Options{CollisionPolicy: "last"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,273 @@
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// How tracks are matched when looking for duplicates.
+type DuplicateMatch string
+
+const (
+	DuplicateMatchTags    DuplicateMatch = "tags"    // Same album artist, album, disc, track number and title, ignoring case and punctuation
+	DuplicateMatchContent DuplicateMatch = "content" // Same track data, byte for byte
+)
+
+// DuplicateGroup is a set of tracks that look like copies of the same recording,
+// e.g.: an album ripped as FLAC in one library and as MP3 in another.
+type DuplicateGroup struct {
+	Key    string  `json:"key"`    // What the tracks have in common
+	Name   string  `json:"name"`   // The name of the preferred copy
+	Tracks []Track `json:"tracks"` // The preferred copy first; see preferTrack
+}
+
+// UnreadableTrack is a track whose data couldn't be read when looking for
+// duplicates by content, so it was left out.
+type UnreadableTrack struct {
+	Track Track  `json:"track"`
+	Error string `json:"error"`
+}
+
+// normalize folds case, and reduces punctuation and runs of spaces
+// to a single space, so that e.g.: "Don't Stop" and "dont  stop" match.
+func normalize(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		case r == '\'' || r == '’':
+			// Apostrophes join words rather than separating them.
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// tagsKey returns the key for matching tracks by their tags, or an empty
+// string if the track doesn't have enough of them to match reliably.
+func tagsKey(track Track) string {
+	title := normalize(track.Title)
+	album := normalize(track.Album)
+	if title == "" || album == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s / %s / %d / %d / %s", normalize(track.AlbumArtist), album, track.DiscNumber, track.TrackNumber, title)
+}
+
+// isLossless returns true for formats that keep all of the original audio.
+func isLossless(mimeType string) bool {
+	return mimeType == storage.FlacMimeType
+}
+
+// preferTrack returns true if track a is a better copy to keep than track b:
+// lossless formats first, then the highest bitrate.
+func preferTrack(a Track, b Track) bool {
+	if isLossless(a.MIMEType) != isLossless(b.MIMEType) {
+		return isLossless(a.MIMEType)
+	}
+	return a.Bitrate > b.Bitrate
+}
+
+// groupTracks builds the groups of tracks with the same key. Tracks with
+// an empty key aren't grouped. Groups are in the order of their first
+// track, and the tracks in each group are sorted with the preferred copy
+// first; ties keep the catalog's order.
+func groupTracks(tracks []Track, key func(Track) string) []DuplicateGroup {
+	keys := make([]string, 0)
+	byKey := make(map[string][]Track)
+	for _, track := range tracks {
+		k := key(track)
+		if k == "" {
+			continue
+		}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], track)
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	for _, k := range keys {
+		group := byKey[k]
+		if len(group) < 2 {
+			continue
+		}
+		sort.SliceStable(group, func(i int, j int) bool {
+			return preferTrack(group[i], group[j])
+		})
+		groups = append(groups, DuplicateGroup{Key: k, Name: group[0].Name, Tracks: group})
+	}
+	return groups
+}
+
+// FindDuplicates groups the tracks that have the same tags.
+func FindDuplicates(tracks []Track) []DuplicateGroup {
+	return groupTracks(tracks, tagsKey)
+}
+
+// ContentHashes finds tracks with the same data. Hashing the data means
+// reading all of it, so the hashes are kept until the track changes.
+type ContentHashes struct {
+	mu     sync.Mutex
+	hashes map[string]string // Indexed by storage ID, track ID and version
+}
+
+func NewContentHashes() *ContentHashes {
+	return &ContentHashes{hashes: make(map[string]string)}
+}
+
+// hash returns the SHA-256 hash of a track's data.
+func (ch *ContentHashes) hash(cs CatalogService, track Track) (string, error) {
+	cacheKey := track.StorageServiceID + "/" + track.ID + "/" + track.Version
+	ch.mu.Lock()
+	hash, ok := ch.hashes[cacheKey]
+	ch.mu.Unlock()
+	if ok && track.Version != "" {
+		return hash, nil
+	}
+
+	r, err := cs.ReadTrack(track)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("track %s: %w", track.ID, err)
+	}
+	hash = "sha256:" + hex.EncodeToString(h.Sum(nil))
+
+	ch.mu.Lock()
+	ch.hashes[cacheKey] = hash
+	ch.mu.Unlock()
+	return hash, nil
+}
+
+// FindDuplicates groups the tracks that have the same data. Only tracks
+// with the same size as another track are read. Tracks that can't be read
+// are left out, and returned so that they can be reported. Hashing stops
+// if the context is cancelled, e.g.: if the request for the report is.
+func (ch *ContentHashes) FindDuplicates(ctx context.Context, cs CatalogService, tracks []Track) ([]DuplicateGroup, []UnreadableTrack, error) {
+	sizes := make(map[int64]int)
+	for _, track := range tracks {
+		sizes[track.DataLen]++
+	}
+
+	hashes := make(map[string]string) // Indexed by track ID
+	unreadable := make([]UnreadableTrack, 0)
+	for _, track := range tracks {
+		if sizes[track.DataLen] < 2 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		hash, err := ch.hash(cs, track)
+		if err != nil {
+			unreadable = append(unreadable, UnreadableTrack{Track: track, Error: err.Error()})
+			continue
+		}
+		hashes[track.ID] = hash
+	}
+	return groupTracks(tracks, func(track Track) string {
+		return hashes[track.ID]
+	}), unreadable, nil
+}
+
+// groupIndexes maps the IDs of duplicate tracks to the index of their group.
+func groupIndexes(groups []DuplicateGroup) map[string]int {
+	groupOf := make(map[string]int)
+	for i, group := range groups {
+		for _, track := range group.Tracks {
+			groupOf[track.ID] = i
+		}
+	}
+	return groupOf
+}
+
+// CollapseDuplicates returns the tracks with only the preferred copy
+// from each group of duplicates, in the place of the group's first track.
+func CollapseDuplicates(tracks []Track, groups []DuplicateGroup) []Track {
+	groupOf := groupIndexes(groups)
+	shown := make(map[int]bool)
+	collapsed := make([]Track, 0, len(tracks))
+	for _, track := range tracks {
+		i, ok := groupOf[track.ID]
+		if !ok {
+			collapsed = append(collapsed, track)
+		} else if !shown[i] {
+			collapsed = append(collapsed, groups[i].Tracks[0])
+			shown[i] = true
+		}
+	}
+	return collapsed
+}
+
+// CollapseDuplicatePlaylists returns the playlists without the ones whose
+// tracks are all copies of the tracks in another playlist, e.g.: the same
+// album in two formats, or in two storages when duplicates are merged.
+// The playlist with the most preferred copies from its own storage is kept.
+func CollapseDuplicatePlaylists(playlists []Playlist, groups []DuplicateGroup) []Playlist {
+	groupOf := groupIndexes(groups)
+
+	// Playlists with the same set of tracks, or copies of them, are copies of each other.
+	signature := func(playlist Playlist) string {
+		if len(playlist.Tracks) == 0 {
+			return "playlist:" + playlist.ID
+		}
+		ids := make([]string, 0, len(playlist.Tracks))
+		for _, track := range playlist.Tracks {
+			if i, ok := groupOf[track.ID]; ok {
+				ids = append(ids, "group:"+strconv.Itoa(i))
+			} else {
+				ids = append(ids, "track:"+track.ID)
+			}
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	preferred := func(playlist Playlist) int {
+		n := 0
+		for _, track := range playlist.Tracks {
+			if track.StorageServiceID != playlist.StorageServiceID {
+				continue
+			}
+			if i, ok := groupOf[track.ID]; !ok || groups[i].Tracks[0].ID == track.ID {
+				n++
+			}
+		}
+		return n
+	}
+
+	best := make(map[string]Playlist) // Indexed by signature
+	for _, playlist := range playlists {
+		sig := signature(playlist)
+		if other, ok := best[sig]; !ok || preferred(playlist) > preferred(other) {
+			best[sig] = playlist
+		}
+	}
+
+	collapsed := make([]Playlist, 0, len(playlists))
+	for _, playlist := range playlists {
+		if best[signature(playlist)].ID == playlist.ID {
+			collapsed = append(collapsed, playlist)
+		}
+	}
+	return collapsed
+}
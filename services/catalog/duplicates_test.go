@@ -0,0 +1,184 @@
+package catalog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// A storage with an album ripped in one format.
+func albumStorage(t *testing.T, name string, mimeType string, bitrate int, titles ...string) storage.StorageService {
+	ss, err := storage.NewNullStorage(storage.Options{Name: name})
+	require.NoError(t, err)
+	playlist := storage.Playlist{ID: name + "-album", Name: "The Artist :: The Album"}
+	for i, title := range titles {
+		track := storage.Track{
+			ID:          name + "-" + title,
+			Name:        title,
+			Title:       title,
+			Artist:      "The Artist",
+			Album:       "The Album",
+			AlbumArtist: "The Artist",
+			TrackNumber: i + 1,
+			MIMEType:    mimeType,
+			Bitrate:     bitrate,
+		}
+		ss.Tracks = append(ss.Tracks, track)
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+	ss.Playlists = []storage.Playlist{playlist}
+	return ss
+}
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(t, "dont stop me now", normalize("  Don't Stop  Me-Now! "))
+	assert.Equal(t, "dont stop me now", normalize("DON’T STOP (ME) NOW"))
+	assert.Equal(t, "café del mar 2", normalize("Café del Mar, #2"))
+	assert.Equal(t, "", normalize("..."))
+}
+
+func TestFindDuplicates(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(albumStorage(t, "mp3", storage.MP3MimeType, 192000, "Intro", "Don't Stop")))
+	require.NoError(t, catalogService.AddStorage(albumStorage(t, "cds", storage.FlacMimeType, 900000, "intro", "Dont Stop", "Bonus Track")))
+	require.NoError(t, catalogService.AddStorage(albumStorage(t, "itunes", storage.MP4MimeType, 256000, "Intro")))
+	tracks, playlists := catalogService.GetTracks()
+	require.Len(t, tracks, 6)
+
+	groups := FindDuplicates(tracks)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "the artist / the album / 0 / 1 / intro", groups[0].Key)
+	assert.Equal(t, "intro", groups[0].Name)
+
+	// Lossless first, then by bitrate.
+	storageNames := func(group DuplicateGroup) []string {
+		names := make([]string, 0)
+		for _, track := range group.Tracks {
+			names = append(names, track.StorageName)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"cds", "itunes", "mp3"}, storageNames(groups[0]))
+	assert.Equal(t, []string{"cds", "mp3"}, storageNames(groups[1]))
+
+	t.Run("CollapseDuplicates", func(t *testing.T) {
+		collapsed := CollapseDuplicates(tracks, groups)
+		require.Len(t, collapsed, 3)
+		assert.Equal(t, groups[0].Tracks[0], collapsed[0])
+		assert.Equal(t, groups[1].Tracks[0], collapsed[1])
+		assert.Equal(t, "Bonus Track", collapsed[2].Name)
+
+		assert.Equal(t, tracks, CollapseDuplicates(tracks, nil))
+	})
+
+	t.Run("CollapseDuplicatePlaylists", func(t *testing.T) {
+		// The cds album has a track that the others don't, so it isn't a copy of them.
+		// The itunes album only has a copy of the first track, so it isn't a copy of mp3's.
+		require.Len(t, playlists, 3)
+		assert.Len(t, CollapseDuplicatePlaylists(playlists, groups), 3)
+
+		// Without the bonus track, the albums in cds and mp3 are the same.
+		catalogService, err := NewBasicCatalog(Options{})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(albumStorage(t, "mp3", storage.MP3MimeType, 192000, "Intro", "Don't Stop")))
+		require.NoError(t, catalogService.AddStorage(albumStorage(t, "cds", storage.FlacMimeType, 900000, "intro", "Dont Stop")))
+		tracks, playlists := catalogService.GetTracks()
+		collapsed := CollapseDuplicatePlaylists(playlists, FindDuplicates(tracks))
+		require.Len(t, collapsed, 1)
+		assert.Equal(t, "cds", collapsed[0].StorageName)
+	})
+
+	t.Run("NotEnoughTags", func(t *testing.T) {
+		untagged := []Track{{ID: "a", Name: "track1"}, {ID: "b", Name: "track1"}}
+		assert.Empty(t, FindDuplicates(untagged))
+	})
+}
+
+func TestTagDuplicatesMP4(t *testing.T) {
+	// An iTunes copy of a track in cds, found using the tags read from the files.
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	for _, name := range []string{"cds", "itunes"} {
+		ss, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/"+name, []string{}, storage.Options{Name: name})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(ss))
+	}
+	tracks, _ := catalogService.GetTracks()
+	require.Len(t, tracks, 5)
+
+	groups := FindDuplicates(tracks)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "artist / album1 / 0 / 2 / album1 track2 example", groups[0].Key)
+	require.Len(t, groups[0].Tracks, 2)
+	assert.Equal(t, storage.FlacMimeType, groups[0].Tracks[0].MIMEType)
+	assert.Equal(t, storage.MP4MimeType, groups[0].Tracks[1].MIMEType)
+	assert.Equal(t, "itunes", groups[0].Tracks[1].StorageName)
+}
+
+func TestContentDuplicates(t *testing.T) {
+	// The same file in two storages, at different locations, so they have different IDs.
+	cdsPath := "../../testdata/services/storage/diskstorage/Music/cds"
+	dir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join(cdsPath, "Artist/Album1/track1-example.ogg"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "copy.ogg"), data, 0o644))
+
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	cds, err := storage.NewDiskStorage(cdsPath, []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(cds))
+	copies, err := storage.NewDiskStorage(dir, []string{}, storage.Options{Name: "copies"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(copies))
+	tracks, _ := catalogService.GetTracks()
+	require.Len(t, tracks, 5)
+
+	contentHashes := NewContentHashes()
+	groups, unreadable, err := contentHashes.FindDuplicates(context.Background(), catalogService, tracks)
+	require.NoError(t, err)
+	assert.Empty(t, unreadable)
+	require.Len(t, groups, 1)
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", groups[0].Key)
+	require.Len(t, groups[0].Tracks, 2)
+	assert.Equal(t, "cds", groups[0].Tracks[0].StorageName)
+	assert.Equal(t, "copies", groups[0].Tracks[1].StorageName)
+
+	// Only the tracks with the same size were read.
+	assert.Len(t, contentHashes.hashes, 2)
+
+	// The hashes are remembered, so the data isn't read again.
+	require.NoError(t, os.Remove(filepath.Join(dir, "copy.ogg")))
+	again, _, err := contentHashes.FindDuplicates(context.Background(), catalogService, tracks)
+	require.NoError(t, err)
+	assert.Equal(t, groups, again)
+
+	// Tracks that can't be read are left out, rather than failing the whole report.
+	changed := groups[0].Tracks[1]
+	changed.Version = "changed"
+	withChanged := make([]Track, 0, len(tracks))
+	for _, track := range tracks {
+		if track.ID == changed.ID {
+			track = changed
+		}
+		withChanged = append(withChanged, track)
+	}
+	groups, unreadable, err = contentHashes.FindDuplicates(context.Background(), catalogService, withChanged)
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+	require.Len(t, unreadable, 1)
+	assert.Equal(t, changed, unreadable[0].Track)
+	assert.NotEmpty(t, unreadable[0].Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = contentHashes.FindDuplicates(ctx, catalogService, tracks)
+	assert.ErrorIs(t, err, context.Canceled)
+}
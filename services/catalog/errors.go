@@ -0,0 +1,22 @@
+package catalog
+
+import (
+	"errors"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// Errors returned by the catalog. They are the same as the storage services'
+// errors, so that callers can use errors.Is without caring which one failed.
+var (
+	ErrNotFound    = storage.ErrNotFound    // Unknown track, playlist or storage, or one that is hidden
+	ErrForbidden   = storage.ErrForbidden   // The track can't be read
+	ErrUnavailable = storage.ErrUnavailable // The track's storage can't be reached right now
+	ErrBadRange    = storage.ErrBadRange    // The requested part of the track doesn't exist
+)
+
+// Errors for changes to the catalog that can't be made.
+var (
+	ErrInvalid = errors.New("invalid")        // E.g.: a smart playlist with a rule that can't be parsed
+	ErrExists  = errors.New("already exists") // E.g.: a smart playlist with the same name as another one
+)
@@ -0,0 +1,165 @@
+package catalog
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// StorageFilter decides whether the tracks and playlists from a storage service are visible.
+type StorageFilter func(storageServiceID string) bool
+
+// FilteredCatalog is a view of another catalog, which only contains the tracks
+// and playlists from some of its storage services. E.g.: for restricting
+// which parts of the library a user can see.
+type FilteredCatalog struct {
+	readOnlyView
+	filter StorageFilter
+}
+
+func (fc *FilteredCatalog) GetStorages() []storage.StorageService {
+	storages := make([]storage.StorageService, 0)
+	for _, ss := range fc.catalogService.GetStorages() {
+		if fc.filter(ss.GetID()) {
+			storages = append(storages, ss)
+		}
+	}
+	return storages
+}
+
+// filterTrack returns the track with only the sources in the storages that
+// pass the filter, and false if there are none. If the preferred source is
+// filtered out, the track becomes the first of the remaining sources.
+func (fc *FilteredCatalog) filterTrack(track Track) (Track, bool) {
+	if len(track.Sources) == 0 {
+		return track, fc.filter(track.StorageServiceID)
+	}
+
+	sources := make([]Source, 0, len(track.Sources))
+	for _, source := range track.Sources {
+		if fc.filter(source.StorageServiceID) {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		return Track{}, false
+	}
+	track, _ = track.WithSource(sources[0].ID)
+	track.Sources = sources
+	if len(sources) == 1 {
+		track.Sources = nil
+	}
+	return track, true
+}
+
+// filterPlaylist returns the playlist with only the tracks that pass the filter,
+// and false if the playlist itself doesn't. Smart playlists aren't in a storage,
+// so they always pass, but need to choose their tracks again; see GetTracks.
+func (fc *FilteredCatalog) filterPlaylist(playlist Playlist) (Playlist, bool) {
+	if !playlist.Smart && !fc.filter(playlist.StorageServiceID) {
+		return Playlist{}, false
+	}
+	tracks := make([]Track, 0, len(playlist.Tracks))
+	for _, track := range playlist.Tracks {
+		if track, ok := fc.filterTrack(track); ok {
+			tracks = append(tracks, track)
+		}
+	}
+	playlist.Tracks = tracks
+	playlist.Plays = totalPlays(tracks)
+	return playlist, true
+}
+
+func (fc *FilteredCatalog) GetTracks() ([]Track, []Playlist) {
+	allTracks, allPlaylists := fc.catalogService.GetTracks()
+
+	tracks := make([]Track, 0)
+	for _, track := range allTracks {
+		if track, ok := fc.filterTrack(track); ok {
+			tracks = append(tracks, track)
+		}
+	}
+	playlists := make([]Playlist, 0)
+	for _, playlist := range allPlaylists {
+		if playlist, ok := fc.filterPlaylist(playlist); ok {
+			playlists = append(playlists, playlist)
+		}
+	}
+	// E.g.: the 25 most played tracks are the ones that pass the filter,
+	// not the ones left after removing the rest of the catalog's top 25.
+	chooseTracksAgain(playlists, tracks, viewSmartPlaylists(fc.catalogService, func(compiledSmartPlaylist) bool {
+		return true
+	}))
+	return tracks, playlists
+}
+
+func (fc *FilteredCatalog) GetTrack(id string) (Track, error) {
+	track, err := fc.catalogService.GetTrack(id)
+	if err != nil {
+		return Track{}, err
+	}
+	track, ok := fc.filterTrack(track)
+	if !ok {
+		// Don't reveal that the track exists.
+		return Track{}, fmt.Errorf("%w: track %s", ErrNotFound, id)
+	}
+	return track, nil
+}
+
+func (fc *FilteredCatalog) ReadTrack(track Track) (io.Reader, error) {
+	// Look the track up again, in case the caller has modified it,
+	// and check that the copy being read passes the filter.
+	id := track.ID
+	merged, err := fc.GetTrack(id)
+	if err != nil {
+		return nil, err
+	}
+	track, ok := merged.WithSource(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: track %s", ErrNotFound, id)
+	}
+	return fc.catalogService.ReadTrack(track)
+}
+
+func (fc *FilteredCatalog) GetPlaylist(id string) (Playlist, error) {
+	playlist, err := fc.catalogService.GetPlaylist(id)
+	if err != nil {
+		return Playlist{}, err
+	}
+	if playlist.Smart {
+		_, playlists := fc.GetTracks()
+		return findPlaylist(playlists, playlist.ID)
+	}
+	playlist, ok := fc.filterPlaylist(playlist)
+	if !ok {
+		return Playlist{}, fmt.Errorf("%w: playlist %s", ErrNotFound, id)
+	}
+	return playlist, nil
+}
+
+// Only the copies in the storages that pass the filter are included,
+// and only collisions between those storages.
+func (fc *FilteredCatalog) GetCollisions() []Collision {
+	collisions := make([]Collision, 0)
+	for _, collision := range fc.catalogService.GetCollisions() {
+		copies := make([]CollisionCopy, 0)
+		for _, c := range collision.Copies {
+			if fc.filter(c.StorageServiceID) {
+				copies = append(copies, c)
+			}
+		}
+		if len(copies) > 1 {
+			collision.Copies = copies
+			collisions = append(collisions, collision)
+		}
+	}
+	return collisions
+}
+
+func NewFilteredCatalog(cs CatalogService, filter StorageFilter) CatalogService {
+	return &FilteredCatalog{
+		readOnlyView: readOnlyView{catalogService: cs, kind: "filtered"},
+		filter:       filter,
+	}
+}
@@ -0,0 +1,118 @@
+package catalog
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestFilteredCatalog(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	nullStorage, err := storage.NewNullStorage(storage.Options{})
+	require.NoError(t, err)
+	err = catalogService.AddStorage(nullStorage)
+	require.NoError(t, err)
+	diskStorage, err := storage.NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, storage.Options{})
+	require.NoError(t, err)
+	err = catalogService.AddStorage(diskStorage)
+	require.NoError(t, err)
+
+	allTracks, allPlaylists := catalogService.GetTracks()
+	require.Len(t, allTracks, 5)
+	require.Len(t, allPlaylists, 4)
+
+	filteredCatalog := NewFilteredCatalog(catalogService, func(storageServiceID string) bool {
+		return storageServiceID == diskStorage.GetID()
+	})
+
+	t.Run("AddStorage", func(t *testing.T) {
+		err := filteredCatalog.AddStorage(nullStorage)
+		assert.Error(t, err)
+		err = filteredCatalog.RemoveStorage(diskStorage.GetID())
+		assert.Error(t, err)
+		err = filteredCatalog.ReplaceStorage(diskStorage.GetID(), nullStorage)
+		assert.Error(t, err)
+	})
+
+	t.Run("GetStorages", func(t *testing.T) {
+		storages := filteredCatalog.GetStorages()
+		require.Len(t, storages, 1)
+		assert.Equal(t, diskStorage.GetID(), storages[0].GetID())
+	})
+
+	t.Run("GetTracks", func(t *testing.T) {
+		tracks, playlists := filteredCatalog.GetTracks()
+		assert.Len(t, tracks, 4)
+		assert.Len(t, playlists, 3)
+		for _, track := range tracks {
+			assert.Equal(t, diskStorage.GetID(), track.StorageServiceID)
+		}
+		for _, playlist := range playlists {
+			assert.Equal(t, diskStorage.GetID(), playlist.StorageServiceID)
+		}
+	})
+
+	t.Run("GetTrackAndPlaylist", func(t *testing.T) {
+		for _, track := range allTracks {
+			_, err := filteredCatalog.GetTrack(track.ID)
+			if track.StorageServiceID == diskStorage.GetID() {
+				assert.NoError(t, err)
+			} else {
+				// Hidden things look the same as ones that don't exist.
+				assert.ErrorIs(t, err, ErrNotFound)
+			}
+		}
+		for _, playlist := range allPlaylists {
+			_, err := filteredCatalog.GetPlaylist(playlist.ID)
+			if playlist.StorageServiceID == diskStorage.GetID() {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrNotFound)
+			}
+		}
+	})
+
+	t.Run("ReadTrack", func(t *testing.T) {
+		for _, track := range allTracks {
+			r, err := filteredCatalog.ReadTrack(track)
+			if track.StorageServiceID != diskStorage.GetID() {
+				assert.ErrorIs(t, err, ErrNotFound)
+				continue
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Len(t, data, int(track.DataLen))
+		}
+	})
+
+	t.Run("SmartPlaylists", func(t *testing.T) {
+		// The null storage's track comes first in the catalog's playlist,
+		// but the filtered catalog chooses both tracks from the ones it has.
+		require.NoError(t, catalogService.ConfigureSmartPlaylists([]SmartPlaylist{
+			{Name: "Last Library", Sort: "library desc", Limit: 2},
+		}))
+		id := smartPlaylistID("Last Library")
+		all, err := catalogService.GetPlaylist(id)
+		require.NoError(t, err)
+		require.Len(t, all.Tracks, 2)
+		assert.Equal(t, nullStorage.GetID(), all.Tracks[0].StorageServiceID)
+
+		filtered, err := filteredCatalog.GetPlaylist(id)
+		require.NoError(t, err)
+		require.Len(t, filtered.Tracks, 2)
+		for _, track := range filtered.Tracks {
+			assert.Equal(t, diskStorage.GetID(), track.StorageServiceID)
+		}
+
+		_, playlists := filteredCatalog.GetTracks()
+		playlist, err := findPlaylist(playlists, id)
+		require.NoError(t, err)
+		assert.Equal(t, filtered.Tracks, playlist.Tracks)
+	})
+}
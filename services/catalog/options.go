@@ -0,0 +1,23 @@
+package catalog
+
+import "fmt"
+
+// Options are the settings for a catalog.
+type Options struct {
+	CollisionPolicy CollisionPolicy // What to do about tracks and playlists with the same ID; defaults to CollisionPolicyFirst
+	MergeDuplicates bool            // Whether copies of the same track (see FindDuplicates) are merged into one track with several sources
+}
+
+func (o Options) collisionPolicy() CollisionPolicy {
+	if o.CollisionPolicy == "" {
+		return CollisionPolicyFirst
+	}
+	return o.CollisionPolicy
+}
+
+func (o Options) validate() error {
+	if !o.CollisionPolicy.valid() {
+		return fmt.Errorf("unknown collision policy %s", o.CollisionPolicy)
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
 package catalog
 
 type Playlist struct {
-	ID               string // Unique ID from storage service
-	StorageServiceID string // Storage service's ID
+	ID               string `json:"id"`               // Unique ID from storage service
+	StorageServiceID string `json:"storageServiceId"` // Storage service's ID
+	StorageName      string `json:"library"`          // Storage service's name
 
-	Name   string
-	Tracks []Track
+	Name    string  `json:"name"`
+	Smart   bool    `json:"smart,omitempty"`   // Chosen by a rule, rather than from a storage; see SmartPlaylist
+	Plays   int     `json:"plays"`             // How many times its tracks have been played, by all users
+	Rating  int     `json:"rating,omitempty"`  // 1 to storage.MaxRating stars, from the user; 0 means unrated
+	Starred bool    `json:"starred,omitempty"` // Starred by the user; see NewRatedCatalog
+	Tracks  []Track `json:"tracks"`
 }
@@ -0,0 +1,109 @@
+package catalog
+
+import (
+	"time"
+)
+
+// PlayCount is how many times a track has been played, e.g.: from the play history.
+type PlayCount struct {
+	Plays      int
+	LastPlayed time.Time // Zero if never played
+}
+
+// playCountFor adds up the plays of a track, including the plays of its
+// other copies if duplicates are merged.
+func playCountFor(track Track, counts map[string]PlayCount) PlayCount {
+	count := counts[track.ID]
+	for _, source := range track.Sources {
+		if source.ID == track.ID {
+			continue
+		}
+		sourceCount := counts[source.ID]
+		count.Plays += sourceCount.Plays
+		if sourceCount.LastPlayed.After(count.LastPlayed) {
+			count.LastPlayed = sourceCount.LastPlayed
+		}
+	}
+	return count
+}
+
+// totalPlays adds up the plays of a playlist's tracks.
+func totalPlays(tracks []Track) int {
+	plays := 0
+	for _, track := range tracks {
+		plays += track.Plays
+	}
+	return plays
+}
+
+// PlayedCatalog is a view of another catalog, with how many times its tracks
+// have been played. The counts change much more often than the catalog, so
+// they are added when the catalog is read, rather than being part of it.
+// Smart playlists whose rules or sort orders use the counts choose their
+// tracks again.
+type PlayedCatalog struct {
+	readOnlyView
+	counts map[string]PlayCount // Indexed by track ID
+}
+
+func (pc *PlayedCatalog) countTrack(track Track) Track {
+	count := playCountFor(track, pc.counts)
+	track.Plays = count.Plays
+	track.LastPlayed = count.LastPlayed
+	return track
+}
+
+func (pc *PlayedCatalog) countTracks(tracks []Track) []Track {
+	counted := make([]Track, 0, len(tracks))
+	for _, track := range tracks {
+		counted = append(counted, pc.countTrack(track))
+	}
+	return counted
+}
+
+func (pc *PlayedCatalog) countPlaylist(playlist Playlist) Playlist {
+	playlist.Tracks = pc.countTracks(playlist.Tracks)
+	playlist.Plays = totalPlays(playlist.Tracks)
+	return playlist
+}
+
+func (pc *PlayedCatalog) GetTracks() ([]Track, []Playlist) {
+	allTracks, allPlaylists := pc.catalogService.GetTracks()
+	tracks := pc.countTracks(allTracks)
+
+	playlists := make([]Playlist, 0, len(allPlaylists))
+	for _, playlist := range allPlaylists {
+		playlists = append(playlists, pc.countPlaylist(playlist))
+	}
+	chooseTracksAgain(playlists, tracks, viewSmartPlaylists(pc.catalogService, compiledSmartPlaylist.played))
+	return tracks, playlists
+}
+
+func (pc *PlayedCatalog) GetTrack(id string) (Track, error) {
+	track, err := pc.catalogService.GetTrack(id)
+	if err != nil {
+		return Track{}, err
+	}
+	return pc.countTrack(track), nil
+}
+
+func (pc *PlayedCatalog) GetPlaylist(id string) (Playlist, error) {
+	playlist, err := pc.catalogService.GetPlaylist(id)
+	if err != nil {
+		return Playlist{}, err
+	}
+	if _, ok := viewSmartPlaylists(pc.catalogService, compiledSmartPlaylist.played)[playlist.ID]; ok && playlist.Smart {
+		_, playlists := pc.GetTracks()
+		return findPlaylist(playlists, playlist.ID)
+	}
+	return pc.countPlaylist(playlist), nil
+}
+
+// NewPlayedCatalog returns a view of the catalog with how many times each
+// track has been played, indexed by track ID, e.g.: from the play history.
+func NewPlayedCatalog(cs CatalogService, counts map[string]PlayCount) CatalogService {
+	return &PlayedCatalog{
+		readOnlyView: readOnlyView{catalogService: cs, kind: "played"},
+		counts:       counts,
+	}
+}
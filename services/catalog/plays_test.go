@@ -0,0 +1,96 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestPlayedCatalog(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	mp3 := albumStorage(t, "mp3", storage.MP3MimeType, 192000, "Intro", "Don't Stop", "Outro")
+	require.NoError(t, catalogService.AddStorage(mp3))
+	require.NoError(t, catalogService.ConfigureSmartPlaylists([]SmartPlaylist{
+		{Name: "Unplayed", Rule: "never played"},
+		{Name: "Openers", Rule: "tracknumber = 1"},
+	}))
+
+	played := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	generation := catalogService.Generation()
+	playedCatalog := NewPlayedCatalog(catalogService, map[string]PlayCount{
+		"mp3-Intro": {Plays: 3, LastPlayed: played},
+		"mp3-Outro": {Plays: 1, LastPlayed: played.Add(-time.Hour)},
+		"unknown":   {Plays: 7, LastPlayed: played},
+	})
+	// The catalog itself doesn't change.
+	assert.Equal(t, generation, playedCatalog.Generation())
+	track, err := catalogService.GetTrack("mp3-Intro")
+	require.NoError(t, err)
+	assert.Zero(t, track.Plays)
+
+	track, err = playedCatalog.GetTrack("mp3-Intro")
+	require.NoError(t, err)
+	assert.Equal(t, 3, track.Plays)
+	assert.Equal(t, played, track.LastPlayed)
+	track, err = playedCatalog.GetTrack("mp3-Don't Stop")
+	require.NoError(t, err)
+	assert.Zero(t, track.Plays)
+	assert.True(t, track.LastPlayed.IsZero())
+	assertPlaylistsConsistent(t, playedCatalog)
+
+	album, err := playedCatalog.GetPlaylist("mp3-album")
+	require.NoError(t, err)
+	assert.Equal(t, 4, album.Plays)
+
+	// The smart playlists using the counts are chosen again.
+	unplayed, err := playedCatalog.GetPlaylist(smartPlaylistID("Unplayed"))
+	require.NoError(t, err)
+	require.Len(t, unplayed.Tracks, 1)
+	assert.Equal(t, "mp3-Don't Stop", unplayed.Tracks[0].ID)
+	assert.Zero(t, unplayed.Plays)
+	openers, err := playedCatalog.GetPlaylist(smartPlaylistID("Openers"))
+	require.NoError(t, err)
+	require.Len(t, openers.Tracks, 1)
+	assert.Equal(t, 3, openers.Plays)
+
+	t.Run("Filtered", func(t *testing.T) {
+		filtered := NewFilteredCatalog(playedCatalog, func(id string) bool { return false })
+		unplayed, err := filtered.GetPlaylist(smartPlaylistID("Unplayed"))
+		require.NoError(t, err)
+		assert.Empty(t, unplayed.Tracks)
+		assert.Zero(t, unplayed.Plays)
+	})
+
+	t.Run("Mutations", func(t *testing.T) {
+		assert.Error(t, playedCatalog.AddStorage(mp3))
+		assert.Error(t, playedCatalog.RemoveStorage(mp3.GetID()))
+		assert.Error(t, playedCatalog.ReplaceStorage(mp3.GetID(), mp3))
+		_, err := playedCatalog.AddSmartPlaylist(SmartPlaylist{Name: "More"})
+		assert.Error(t, err)
+		assert.Error(t, playedCatalog.RemoveSmartPlaylist(smartPlaylistID("Unplayed")))
+		assert.Error(t, playedCatalog.ConfigureSmartPlaylists(nil))
+	})
+
+	t.Run("MergedDuplicates", func(t *testing.T) {
+		catalogService, _, _ := mergedCatalog(t)
+		tracks, _ := catalogService.GetTracks()
+		merged := tracks[3]
+		require.Len(t, merged.Sources, 2)
+
+		// Plays of either copy count as plays of the merged track.
+		playedCatalog := NewPlayedCatalog(catalogService, map[string]PlayCount{
+			merged.Sources[0].ID: {Plays: 1, LastPlayed: played.Add(-time.Hour)},
+			merged.Sources[1].ID: {Plays: 2, LastPlayed: played},
+		})
+		track, err := playedCatalog.GetTrack(merged.Sources[1].ID)
+		require.NoError(t, err)
+		assert.Equal(t, 3, track.Plays)
+		assert.Equal(t, played, track.LastPlayed)
+		assertPlaylistsConsistent(t, playedCatalog)
+	})
+}
@@ -0,0 +1,99 @@
+package catalog
+
+// Rating is a user's rating of a track or playlist.
+type Rating struct {
+	Stars   int // 1 to storage.MaxRating; 0 keeps the rating from the track's tags
+	Starred bool
+}
+
+// RatedCatalog is a view of another catalog, with a user's ratings and stars
+// of its tracks and playlists. The user's rating of a track replaces the
+// rating from its tags. Smart playlists whose rules or sort orders use the
+// ratings choose their tracks again, using the user's ratings.
+type RatedCatalog struct {
+	readOnlyView
+	ratings map[string]Rating // Indexed by track or playlist ID
+}
+
+// ratingFor finds the user's rating of a track, which may be of any of its copies
+// if duplicates are merged.
+func (rc *RatedCatalog) ratingFor(track Track) (Rating, bool) {
+	if rating, ok := rc.ratings[track.ID]; ok {
+		return rating, true
+	}
+	for _, source := range track.Sources {
+		if rating, ok := rc.ratings[source.ID]; ok {
+			return rating, true
+		}
+	}
+	return Rating{}, false
+}
+
+func (rc *RatedCatalog) rateTrack(track Track) Track {
+	rating, ok := rc.ratingFor(track)
+	if !ok {
+		return track
+	}
+	if rating.Stars != 0 {
+		track.Rating = rating.Stars
+	}
+	track.Starred = rating.Starred
+	return track
+}
+
+func (rc *RatedCatalog) rateTracks(tracks []Track) []Track {
+	rated := make([]Track, 0, len(tracks))
+	for _, track := range tracks {
+		rated = append(rated, rc.rateTrack(track))
+	}
+	return rated
+}
+
+func (rc *RatedCatalog) ratePlaylist(playlist Playlist) Playlist {
+	rating := rc.ratings[playlist.ID]
+	playlist.Rating = rating.Stars
+	playlist.Starred = rating.Starred
+	playlist.Tracks = rc.rateTracks(playlist.Tracks)
+	return playlist
+}
+
+func (rc *RatedCatalog) GetTracks() ([]Track, []Playlist) {
+	allTracks, allPlaylists := rc.catalogService.GetTracks()
+	tracks := rc.rateTracks(allTracks)
+
+	playlists := make([]Playlist, 0, len(allPlaylists))
+	for _, playlist := range allPlaylists {
+		playlists = append(playlists, rc.ratePlaylist(playlist))
+	}
+	chooseTracksAgain(playlists, tracks, viewSmartPlaylists(rc.catalogService, compiledSmartPlaylist.perUser))
+	return tracks, playlists
+}
+
+func (rc *RatedCatalog) GetTrack(id string) (Track, error) {
+	track, err := rc.catalogService.GetTrack(id)
+	if err != nil {
+		return Track{}, err
+	}
+	return rc.rateTrack(track), nil
+}
+
+func (rc *RatedCatalog) GetPlaylist(id string) (Playlist, error) {
+	playlist, err := rc.catalogService.GetPlaylist(id)
+	if err != nil {
+		return Playlist{}, err
+	}
+	if _, ok := viewSmartPlaylists(rc.catalogService, compiledSmartPlaylist.perUser)[playlist.ID]; ok && playlist.Smart {
+		_, playlists := rc.GetTracks()
+		return findPlaylist(playlists, playlist.ID)
+	}
+	return rc.ratePlaylist(playlist), nil
+}
+
+// NewRatedCatalog returns a view of the catalog with a user's ratings,
+// indexed by track or playlist ID.
+func NewRatedCatalog(cs CatalogService, ratings map[string]Rating) CatalogService {
+	return &RatedCatalog{
+		readOnlyView: readOnlyView{catalogService: cs, kind: "rated"},
+		ratings:      ratings,
+	}
+}
@@ -0,0 +1,128 @@
+package catalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestRatedCatalog(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	ss := albumStorage(t, "mp3", storage.MP3MimeType, 192000, "Intro", "Don't Stop", "Outro")
+	// "Don't Stop" was rated in its tags.
+	ns := ss.(*storage.NullStorage)
+	ns.Tracks[1].Rating = 3
+	ns.Playlists[0].Tracks[1].Rating = 3
+	require.NoError(t, catalogService.AddStorage(ss))
+	require.NoError(t, catalogService.ConfigureSmartPlaylists([]SmartPlaylist{
+		{Name: "Starred", Rule: "starred"},
+		{Name: "Best", Sort: "rating desc", Limit: 1},
+		{Name: "Openers", Rule: "tracknumber = 1"},
+	}))
+
+	ratings := map[string]Rating{
+		"mp3-Intro":      {Stars: 5},
+		"mp3-Don't Stop": {Starred: true}, // Keeps the rating from the tags
+		"mp3-Outro":      {Stars: 1, Starred: true},
+		"mp3-album":      {Stars: 4, Starred: true},
+	}
+	ratedCatalog := NewRatedCatalog(catalogService, ratings)
+	trackIDs := func(playlist Playlist) []string {
+		ids := make([]string, 0)
+		for _, track := range playlist.Tracks {
+			ids = append(ids, track.ID)
+		}
+		return ids
+	}
+
+	t.Run("GetTracks", func(t *testing.T) {
+		tracks, _ := catalogService.GetTracks()
+		require.Len(t, tracks, 3)
+		assert.Equal(t, []int{0, 3, 0}, []int{tracks[0].Rating, tracks[1].Rating, tracks[2].Rating})
+
+		tracks, playlists := ratedCatalog.GetTracks()
+		require.Len(t, tracks, 3)
+		assert.Equal(t, []int{5, 3, 1}, []int{tracks[0].Rating, tracks[1].Rating, tracks[2].Rating})
+		assert.Equal(t, []bool{false, true, true}, []bool{tracks[0].Starred, tracks[1].Starred, tracks[2].Starred})
+		require.Len(t, playlists, 4)
+	})
+
+	t.Run("GetTrack", func(t *testing.T) {
+		track, err := ratedCatalog.GetTrack("mp3-Outro")
+		require.NoError(t, err)
+		assert.Equal(t, 1, track.Rating)
+		assert.True(t, track.Starred)
+
+		_, err = ratedCatalog.GetTrack("missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("GetPlaylist", func(t *testing.T) {
+		album, err := ratedCatalog.GetPlaylist("mp3-album")
+		require.NoError(t, err)
+		assert.Equal(t, 4, album.Rating)
+		assert.True(t, album.Starred)
+		require.Len(t, album.Tracks, 3)
+		assert.Equal(t, 5, album.Tracks[0].Rating)
+
+		openers, err := ratedCatalog.GetPlaylist(smartPlaylistID("Openers"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Intro"}, trackIDs(openers))
+		assert.Equal(t, 5, openers.Tracks[0].Rating)
+	})
+
+	t.Run("SmartPlaylists", func(t *testing.T) {
+		// Without the user's ratings, only the ratings from the tags are used.
+		starred, err := catalogService.GetPlaylist(smartPlaylistID("Starred"))
+		require.NoError(t, err)
+		assert.Empty(t, starred.Tracks)
+		best, err := catalogService.GetPlaylist(smartPlaylistID("Best"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Don't Stop"}, trackIDs(best))
+
+		starred, err = ratedCatalog.GetPlaylist(smartPlaylistID("Starred"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Don't Stop", "mp3-Outro"}, trackIDs(starred))
+		assert.True(t, starred.Smart)
+		best, err = ratedCatalog.GetPlaylist(smartPlaylistID("Best"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Intro"}, trackIDs(best))
+
+		_, playlists := ratedCatalog.GetTracks()
+		for _, playlist := range playlists {
+			if playlist.ID == smartPlaylistID("Starred") {
+				assert.Equal(t, []string{"mp3-Don't Stop", "mp3-Outro"}, trackIDs(playlist))
+			}
+		}
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		// Restricting the user's access keeps their ratings.
+		filtered := NewRatedCatalog(NewFilteredCatalog(catalogService, func(string) bool { return true }), ratings)
+		track, err := filtered.GetTrack("mp3-Intro")
+		require.NoError(t, err)
+		assert.Equal(t, 5, track.Rating)
+
+		hidden := NewRatedCatalog(NewFilteredCatalog(catalogService, func(string) bool { return false }), ratings)
+		tracks, _ := hidden.GetTracks()
+		assert.Empty(t, tracks)
+		starred, err := hidden.GetPlaylist(smartPlaylistID("Starred"))
+		require.NoError(t, err)
+		assert.Empty(t, starred.Tracks)
+	})
+
+	t.Run("Mutations", func(t *testing.T) {
+		assert.Error(t, ratedCatalog.AddStorage(ss))
+		assert.Error(t, ratedCatalog.RemoveStorage(ss.GetID()))
+		assert.Error(t, ratedCatalog.ReplaceStorage(ss.GetID(), ss))
+		_, err := ratedCatalog.AddSmartPlaylist(SmartPlaylist{Name: "More"})
+		assert.Error(t, err)
+		assert.Error(t, ratedCatalog.RemoveSmartPlaylist(smartPlaylistID("Best")))
+		assert.Error(t, ratedCatalog.ConfigureSmartPlaylists(nil))
+		assert.Equal(t, catalogService.Generation(), ratedCatalog.Generation())
+	})
+}
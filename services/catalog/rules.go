@@ -0,0 +1,690 @@
+package catalog
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Smart playlists choose their tracks using a rule, e.g.:
+//
+//	genre = Jazz AND year < 1970
+//	added in last 30 days
+//	never played OR lastPlayed < 2024-01-01
+//	starred OR rating >= 4
+//	(artist = "Miles Davis" OR artist = "John Coltrane") AND NOT title contains live
+//
+// A condition compares one of a track's fields with a value. Text is compared
+// ignoring case; values with spaces in them need quotes. Conditions are combined
+// using AND, OR and NOT, and grouped using brackets. AND is applied before OR.
+
+// Rule decides whether a track belongs in a smart playlist. Times in the
+// rule, e.g.: "in last 30 days", are relative to now.
+type Rule interface {
+	Match(track Track, now time.Time) bool
+}
+
+// The types of value a track's field can have.
+type fieldKind int
+
+const (
+	fieldText     fieldKind = iota
+	fieldNumber             // Values are numbers, e.g.: 1970
+	fieldDuration           // Values are seconds, or durations, e.g.: 90 or 1m30s
+	fieldTime               // Values are dates, e.g.: 2024-01-31, or times in RFC 3339 format
+)
+
+// A field of a track that rules can use.
+type ruleField struct {
+	kind        fieldKind
+	text        func(track Track) string    // For fieldText
+	number      func(track Track) float64   // For fieldNumber and fieldDuration
+	time        func(track Track) time.Time // For fieldTime
+	zeroUnknown bool                        // 0 means unknown, e.g.: for the year
+	perUser     bool                        // Differs for each user, e.g.: their ratings; see NewRatedCatalog
+	played      bool                        // From the play history; see NewPlayedCatalog
+}
+
+func textField(text func(track Track) string) ruleField {
+	return ruleField{kind: fieldText, text: text}
+}
+
+// A number where 0 means unknown. Unknown values only match = and != conditions.
+func numberField(number func(track Track) float64) ruleField {
+	return ruleField{kind: fieldNumber, number: number, zeroUnknown: true}
+}
+
+// ruleFields are the fields that rules and sort orders can use, in lower case.
+var ruleFields = map[string]ruleField{
+	"name":        textField(func(t Track) string { return t.Name }),
+	"title":       textField(func(t Track) string { return t.Title }),
+	"artist":      textField(func(t Track) string { return t.Artist }),
+	"album":       textField(func(t Track) string { return t.Album }),
+	"albumartist": textField(func(t Track) string { return t.AlbumArtist }),
+	"genre":       textField(func(t Track) string { return t.Genre }),
+	"library":     textField(func(t Track) string { return t.StorageName }),
+	"format":      textField(func(t Track) string { return strings.TrimPrefix(t.MIMEType, "audio/") }),
+	"year":        numberField(func(t Track) float64 { return float64(t.Year) }),
+	"discnumber":  numberField(func(t Track) float64 { return float64(t.DiscNumber) }),
+	"tracknumber": numberField(func(t Track) float64 { return float64(t.TrackNumber) }),
+	"bitrate":     numberField(func(t Track) float64 { return float64(t.Bitrate) / 1000 }), // In kbit/s
+	"size":        numberField(func(t Track) float64 { return float64(t.DataLen) }),
+	"duration": {
+		kind:        fieldDuration,
+		number:      func(t Track) float64 { return t.Duration.Seconds() },
+		zeroUnknown: true,
+	},
+	"added": {
+		kind: fieldTime,
+		time: func(t Track) time.Time { return t.ModTime },
+	},
+	"plays": {
+		kind:   fieldNumber,
+		number: func(t Track) float64 { return float64(t.Plays) },
+		played: true,
+	},
+	"lastplayed": {
+		kind:   fieldTime,
+		time:   func(t Track) time.Time { return t.LastPlayed },
+		played: true,
+	},
+	"rating": {
+		kind:        fieldNumber,
+		number:      func(t Track) float64 { return float64(t.Rating) },
+		zeroUnknown: true,
+		perUser:     true,
+	},
+	"starred": {
+		kind:    fieldNumber,
+		perUser: true,
+		number: func(t Track) float64 {
+			if t.Starred {
+				return 1
+			}
+			return 0
+		},
+	},
+}
+
+func lookupField(name string) (ruleField, error) {
+	field, ok := ruleFields[strings.ToLower(name)]
+	if !ok {
+		return ruleField{}, fmt.Errorf("unknown field %q", name)
+	}
+	return field, nil
+}
+
+// foldText prepares text for comparing, e.g.: removing the NULs some ID3 tags end with.
+func foldText(s string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimRight(s, "\x00")))
+}
+
+// A condition comparing a field with a value, e.g.: year < 1970
+type comparison struct {
+	field  ruleField
+	op     string // =, !=, <, <=, >, >= or contains
+	text   string // For text fields, folded
+	number float64
+	time   time.Time
+}
+
+func (c comparison) Match(track Track, now time.Time) bool {
+	var order int
+	switch c.field.kind {
+	case fieldText:
+		value := foldText(c.field.text(track))
+		if c.op == "contains" {
+			return strings.Contains(value, c.text)
+		}
+		order = cmp.Compare(value, c.text)
+	case fieldNumber, fieldDuration:
+		value := c.field.number(track)
+		if value == 0 && c.field.zeroUnknown && c.op != "=" && c.op != "!=" {
+			return false
+		}
+		order = cmp.Compare(value, c.number)
+	case fieldTime:
+		value := c.field.time(track)
+		if value.IsZero() {
+			return false
+		}
+		order = value.Compare(c.time)
+	}
+
+	switch c.op {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
+
+// A condition on how recent a time is, e.g.: added in last 30 days
+type recentCondition struct {
+	field  ruleField
+	within time.Duration
+}
+
+func (rc recentCondition) Match(track Track, now time.Time) bool {
+	value := rc.field.time(track)
+	return !value.IsZero() && !value.Before(now.Add(-rc.within))
+}
+
+type andRule []Rule
+
+func (ar andRule) Match(track Track, now time.Time) bool {
+	for _, r := range ar {
+		if !r.Match(track, now) {
+			return false
+		}
+	}
+	return true
+}
+
+type orRule []Rule
+
+func (or orRule) Match(track Track, now time.Time) bool {
+	for _, r := range or {
+		if r.Match(track, now) {
+			return true
+		}
+	}
+	return false
+}
+
+type notRule struct {
+	rule Rule
+}
+
+func (nr notRule) Match(track Track, now time.Time) bool {
+	return !nr.rule.Match(track, now)
+}
+
+// matchAll is the rule for an empty rule.
+type matchAll struct{}
+
+func (matchAll) Match(track Track, now time.Time) bool {
+	return true
+}
+
+// ruleUses returns true if the rule uses any fields that uses is true for,
+// e.g.: fields that differ for each user.
+func ruleUses(rule Rule, uses func(field ruleField) bool) bool {
+	usedBy := func(rule Rule) bool {
+		return ruleUses(rule, uses)
+	}
+	switch r := rule.(type) {
+	case comparison:
+		return uses(r.field)
+	case recentCondition:
+		return uses(r.field)
+	case andRule:
+		return slices.ContainsFunc(r, usedBy)
+	case orRule:
+		return slices.ContainsFunc(r, usedBy)
+	case notRule:
+		return ruleUses(r.rule, uses)
+	}
+	return false
+}
+
+// ruleUsesNow returns true if the rule depends on the current time,
+// e.g.: added in last 30 days.
+func ruleUsesNow(rule Rule) bool {
+	switch r := rule.(type) {
+	case recentCondition:
+		return true
+	case andRule:
+		return slices.ContainsFunc(r, ruleUsesNow)
+	case orRule:
+		return slices.ContainsFunc(r, ruleUsesNow)
+	case notRule:
+		return ruleUsesNow(r.rule)
+	}
+	return false
+}
+
+// A word, quoted string, operator or bracket in a rule.
+type ruleToken struct {
+	text   string
+	quoted bool
+}
+
+// Other ways of writing the operators.
+var operatorAliases = map[string]string{
+	"==": "=",
+	"≠":  "!=",
+	"≤":  "<=",
+	"≥":  ">=",
+}
+
+func isOperatorRune(r rune) bool {
+	return strings.ContainsRune("=!<>≠≤≥", r)
+}
+
+func tokenizeRule(s string) ([]ruleToken, error) {
+	tokens := make([]ruleToken, 0)
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, ruleToken{text: string(r)})
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("missing closing %c", r)
+			}
+			tokens = append(tokens, ruleToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+		case isOperatorRune(r):
+			end := i + 1
+			for end < len(runes) && isOperatorRune(runes[end]) {
+				end++
+			}
+			op := string(runes[i:end])
+			if alias, ok := operatorAliases[op]; ok {
+				op = alias
+			}
+			tokens = append(tokens, ruleToken{text: op})
+			i = end
+		default:
+			// Apostrophes in words, e.g.: Don't, don't start a quoted string.
+			end := i + 1
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !isOperatorRune(runes[end]) && !strings.ContainsRune("()\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, ruleToken{text: string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	next   int
+}
+
+var errEndOfRule = errors.New("unexpected end of rule")
+
+func (p *ruleParser) token() (ruleToken, error) {
+	if p.next >= len(p.tokens) {
+		return ruleToken{}, errEndOfRule
+	}
+	token := p.tokens[p.next]
+	p.next++
+	return token, nil
+}
+
+// keyword skips the next token if it is the keyword, e.g.: AND, in any case.
+func (p *ruleParser) keyword(keyword string) bool {
+	if p.next >= len(p.tokens) {
+		return false
+	}
+	token := p.tokens[p.next]
+	if token.quoted || !strings.EqualFold(token.text, keyword) {
+		return false
+	}
+	p.next++
+	return true
+}
+
+// comparing returns true if the next token compares a field with a value, e.g.: >=
+func (p *ruleParser) comparing() bool {
+	if p.next >= len(p.tokens) || p.tokens[p.next].quoted {
+		return false
+	}
+	switch strings.ToLower(p.tokens[p.next].text) {
+	case "=", "!=", "<", "<=", ">", ">=", "contains", "in":
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) expect(keyword string) error {
+	if p.keyword(keyword) {
+		return nil
+	}
+	token, err := p.token()
+	if err != nil {
+		return fmt.Errorf("expected %s: %w", keyword, err)
+	}
+	return fmt.Errorf("expected %s, got %q", keyword, token.text)
+}
+
+func (p *ruleParser) parseOr() (Rule, error) {
+	rules := make(orRule, 0)
+	for {
+		rule, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+		if !p.keyword("or") {
+			break
+		}
+	}
+	if len(rules) == 1 {
+		return rules[0], nil
+	}
+	return rules, nil
+}
+
+func (p *ruleParser) parseAnd() (Rule, error) {
+	rules := make(andRule, 0)
+	for {
+		rule, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+		if !p.keyword("and") {
+			break
+		}
+	}
+	if len(rules) == 1 {
+		return rules[0], nil
+	}
+	return rules, nil
+}
+
+func (p *ruleParser) parseNot() (Rule, error) {
+	if p.keyword("not") {
+		rule, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notRule{rule: rule}, nil
+	}
+	if p.keyword("(") {
+		rule, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return rule, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *ruleParser) parseCondition() (Rule, error) {
+	// A shorter way of writing plays = 0.
+	if p.keyword("never") {
+		if err := p.expect("played"); err != nil {
+			return nil, err
+		}
+		return comparison{field: ruleFields["plays"], op: "=", number: 0}, nil
+	}
+	// A shorter way of writing starred = 1.
+	if p.keyword("starred") {
+		if !p.comparing() {
+			return comparison{field: ruleFields["starred"], op: "=", number: 1}, nil
+		}
+		p.next--
+	}
+
+	name, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	field, err := lookupField(name.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("in") {
+		if field.kind != fieldTime {
+			return nil, fmt.Errorf("%s is not a time, so can't be used with in last", name.text)
+		}
+		if err := p.expect("last"); err != nil {
+			return nil, err
+		}
+		within, err := p.parsePeriod()
+		if err != nil {
+			return nil, err
+		}
+		return recentCondition{field: field, within: within}, nil
+	}
+
+	op, err := p.token()
+	if err != nil {
+		return nil, fmt.Errorf("expected a comparison after %s: %w", name.text, err)
+	}
+	c := comparison{field: field, op: op.text}
+	if strings.EqualFold(op.text, "contains") && !op.quoted {
+		c.op = "contains"
+	}
+	switch c.op {
+	case "=", "!=", "<", "<=", ">", ">=":
+	case "contains":
+		if field.kind != fieldText {
+			return nil, fmt.Errorf("%s is not text, so can't be used with contains", name.text)
+		}
+	default:
+		return nil, fmt.Errorf("expected a comparison after %s, got %q", name.text, op.text)
+	}
+
+	value, err := p.token()
+	if err != nil {
+		return nil, fmt.Errorf("expected a value after %s %s: %w", name.text, c.op, err)
+	}
+	switch field.kind {
+	case fieldText:
+		c.text = foldText(value.text)
+	case fieldNumber:
+		c.number, err = strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, got %q", name.text, value.text)
+		}
+	case fieldDuration:
+		c.number, err = strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			d, durationErr := time.ParseDuration(value.text)
+			if durationErr != nil {
+				return nil, fmt.Errorf("%s needs a number of seconds or a duration, e.g.: 1m30s, got %q", name.text, value.text)
+			}
+			c.number = d.Seconds()
+		}
+	case fieldTime:
+		c.time, err = parseRuleTime(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a date, e.g.: 2024-01-31, got %q", name.text, value.text)
+		}
+	}
+	return c, nil
+}
+
+// The units for "in last", in lower case, and without any plural "s".
+var periodUnits = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+}
+
+// parsePeriod parses a period of time, e.g.: 30 days
+func (p *ruleParser) parsePeriod() (time.Duration, error) {
+	number, err := p.token()
+	if err != nil {
+		return 0, fmt.Errorf("expected a period, e.g.: 30 days: %w", err)
+	}
+	n, err := strconv.Atoi(number.text)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a period, e.g.: 30 days, got %q", number.text)
+	}
+	unit, err := p.token()
+	if err != nil {
+		return 0, fmt.Errorf("expected a unit after %d: %w", n, err)
+	}
+	d, ok := periodUnits[strings.TrimSuffix(strings.ToLower(unit.text), "s")]
+	if !ok || unit.quoted {
+		return 0, fmt.Errorf("unknown unit %q, expected hours, days, weeks, months or years", unit.text)
+	}
+	return time.Duration(n) * d, nil
+}
+
+func parseRuleTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ParseRule parses a smart playlist's rule. An empty rule matches every track.
+func ParseRule(s string) (Rule, error) {
+	tokens, err := tokenizeRule(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return matchAll{}, nil
+	}
+	p := &ruleParser{tokens: tokens}
+	rule, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.next].text)
+	}
+	return rule, nil
+}
+
+// A field to sort by, and which way.
+type sortKey struct {
+	field      ruleField
+	descending bool
+}
+
+// SortOrder is the order of the tracks in a smart playlist.
+type SortOrder struct {
+	keys   []sortKey
+	random bool
+}
+
+// ParseSortOrder parses a smart playlist's sort order: a list of fields,
+// each optionally followed by asc or desc, e.g.: "year desc, album, tracknumber".
+// "random" shuffles the tracks. An empty sort order keeps the catalog's order.
+func ParseSortOrder(s string) (SortOrder, error) {
+	if strings.EqualFold(strings.TrimSpace(s), "random") {
+		return SortOrder{random: true}, nil
+	}
+	so := SortOrder{}
+	if strings.TrimSpace(s) == "" {
+		return so, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 || len(words) > 2 {
+			return SortOrder{}, fmt.Errorf("expected a field and optionally asc or desc, got %q", strings.TrimSpace(part))
+		}
+		field, err := lookupField(words[0])
+		if err != nil {
+			return SortOrder{}, err
+		}
+		key := sortKey{field: field}
+		if len(words) == 2 {
+			switch strings.ToLower(words[1]) {
+			case "asc":
+			case "desc":
+				key.descending = true
+			default:
+				return SortOrder{}, fmt.Errorf("expected asc or desc after %s, got %q", words[0], words[1])
+			}
+		}
+		so.keys = append(so.keys, key)
+	}
+	return so, nil
+}
+
+// uses returns true if the order uses any fields that uses is true for.
+func (so SortOrder) uses(uses func(field ruleField) bool) bool {
+	return slices.ContainsFunc(so.keys, func(key sortKey) bool {
+		return uses(key.field)
+	})
+}
+
+// compareTracks compares a field of two tracks. Unknown values come last, whichever way the tracks are sorted.
+func (key sortKey) compareTracks(a Track, b Track) int {
+	var order int
+	switch key.field.kind {
+	case fieldText:
+		order = cmp.Compare(foldText(key.field.text(a)), foldText(key.field.text(b)))
+	case fieldNumber, fieldDuration:
+		va, vb := key.field.number(a), key.field.number(b)
+		if key.field.zeroUnknown && (va == 0) != (vb == 0) {
+			return cmp.Compare(vb, va) // Zero last
+		}
+		order = cmp.Compare(va, vb)
+	case fieldTime:
+		ta, tb := key.field.time(a), key.field.time(b)
+		if ta.IsZero() != tb.IsZero() {
+			if ta.IsZero() {
+				return 1
+			}
+			return -1
+		}
+		order = ta.Compare(tb)
+	}
+	if key.descending {
+		return -order
+	}
+	return order
+}
+
+// Sort sorts the tracks in place. Tracks which are the same for all the
+// fields keep their order. A random order is the same for the same seed,
+// and any of the tracks are in the same order as they are in all of them,
+// e.g.: so that users who can only see some of the tracks see them in the
+// same order as everyone else.
+func (so SortOrder) Sort(tracks []Track, seed string) {
+	if so.random {
+		keys := make(map[string]uint64, len(tracks))
+		for _, track := range tracks {
+			h := fnv.New64a()
+			h.Write([]byte(seed + "\x00" + track.ID))
+			keys[track.ID] = h.Sum64()
+		}
+		sort.SliceStable(tracks, func(i int, j int) bool {
+			return keys[tracks[i].ID] < keys[tracks[j].ID]
+		})
+		return
+	}
+	if len(so.keys) == 0 {
+		return
+	}
+	sort.SliceStable(tracks, func(i int, j int) bool {
+		for _, key := range so.keys {
+			if order := key.compareTracks(tracks[i], tracks[j]); order != 0 {
+				return order < 0
+			}
+		}
+		return false
+	})
+}
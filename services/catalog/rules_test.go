@@ -0,0 +1,152 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func ruleTracks(now time.Time) []Track {
+	return []Track{
+		{ID: "so-what", Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Genre: "Jazz", Year: 1959, TrackNumber: 1,
+			MIMEType: storage.FlacMimeType, Bitrate: 900000, Duration: 562 * time.Second, ModTime: now.Add(-400 * 24 * time.Hour),
+			Plays: 12, LastPlayed: now.Add(-3 * time.Hour), Rating: 5, Starred: true},
+		{ID: "giant-steps", Title: "Giant Steps", Artist: "John Coltrane", Album: "Giant Steps", Genre: "jazz\x00", Year: 1960, TrackNumber: 1,
+			MIMEType: storage.MP3MimeType, Bitrate: 192000, Duration: 286 * time.Second, ModTime: now.Add(-10 * 24 * time.Hour),
+			Plays: 1, LastPlayed: now.Add(-9 * 24 * time.Hour), Rating: 3},
+		{ID: "teen-spirit", Title: "Smells Like Teen Spirit", Artist: "Nirvana", Album: "Nevermind", Genre: "Rock", Year: 1991, TrackNumber: 1,
+			MIMEType: storage.OggMimeType, Bitrate: 160000, Duration: 301 * time.Second, ModTime: now.Add(-2 * time.Hour), Starred: true},
+		{ID: "untagged", Title: "track01", MIMEType: storage.MP3MimeType},
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	tracks := ruleTracks(now)
+	matching := func(t *testing.T, s string) []string {
+		rule, err := ParseRule(s)
+		require.NoError(t, err, s)
+		ids := make([]string, 0)
+		for _, track := range tracks {
+			if rule.Match(track, now) {
+				ids = append(ids, track.ID)
+			}
+		}
+		return ids
+	}
+
+	t.Run("Comparisons", func(t *testing.T) {
+		assert.Equal(t, []string{"so-what", "giant-steps"}, matching(t, "genre = Jazz"))
+		assert.Equal(t, []string{"teen-spirit", "untagged"}, matching(t, "genre != jazz"))
+		assert.Equal(t, []string{"so-what", "giant-steps"}, matching(t, "year < 1970"))
+		assert.Equal(t, []string{"giant-steps", "teen-spirit"}, matching(t, "year ≥ 1960"))
+		assert.Equal(t, []string{"untagged"}, matching(t, "year = 0"))
+		assert.Equal(t, []string{"so-what"}, matching(t, `artist = "Miles Davis"`))
+		assert.Equal(t, []string{"so-what"}, matching(t, "album contains BLUE"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "format = flac"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "bitrate > 320"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "duration >= 9m"))
+		assert.Equal(t, []string{"giant-steps", "teen-spirit"}, matching(t, "duration < 302"))
+		assert.Equal(t, []string{"teen-spirit"}, matching(t, "title = 'Smells Like Teen Spirit'"))
+		assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit", "untagged"}, matching(t, ""))
+	})
+
+	t.Run("Times", func(t *testing.T) {
+		assert.Equal(t, []string{"giant-steps", "teen-spirit"}, matching(t, "added in last 30 days"))
+		assert.Equal(t, []string{"teen-spirit"}, matching(t, "added in last 1 day"))
+		assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit"}, matching(t, "added IN LAST 2 years"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "added < 2024-01-01"))
+		assert.Equal(t, []string{"teen-spirit"}, matching(t, "added > 2024-06-01T09:00:00Z"))
+	})
+
+	t.Run("Plays", func(t *testing.T) {
+		assert.Equal(t, []string{"teen-spirit", "untagged"}, matching(t, "never played"))
+		assert.Equal(t, []string{"teen-spirit", "untagged"}, matching(t, "plays = 0"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "plays >= 4"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "lastPlayed in last 7 days"))
+		assert.Equal(t, []string{"giant-steps", "teen-spirit", "untagged"}, matching(t, "NOT lastPlayed in last 7 days"))
+		assert.Equal(t, []string{"giant-steps", "teen-spirit"}, matching(t, "never played and year > 0 or plays < 2 and genre = jazz"))
+	})
+
+	t.Run("Ratings", func(t *testing.T) {
+		assert.Equal(t, []string{"so-what", "teen-spirit"}, matching(t, "starred"))
+		assert.Equal(t, []string{"giant-steps", "untagged"}, matching(t, "NOT starred"))
+		assert.Equal(t, []string{"so-what", "teen-spirit"}, matching(t, "starred = 1"))
+		assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit"}, matching(t, "starred OR rating >= 3"))
+		assert.Equal(t, []string{"giant-steps"}, matching(t, "rating < 4"))
+		assert.Equal(t, []string{"teen-spirit", "untagged"}, matching(t, "rating = 0"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "starred AND rating = 5"))
+	})
+
+	t.Run("Combinations", func(t *testing.T) {
+		assert.Equal(t, []string{"so-what"}, matching(t, "genre = Jazz AND year < 1960"))
+		assert.Equal(t, []string{"so-what", "teen-spirit"}, matching(t, "year < 1960 or genre = rock"))
+		assert.Equal(t, []string{"giant-steps", "teen-spirit", "untagged"}, matching(t, "NOT artist = 'Miles Davis'"))
+		// AND before OR, unless there are brackets.
+		assert.Equal(t, []string{"so-what", "teen-spirit"}, matching(t, "genre = rock OR genre = jazz AND year < 1960"))
+		assert.Equal(t, []string{"so-what"}, matching(t, "(genre = rock OR genre = jazz) AND year < 1960"))
+		assert.Equal(t, []string{"giant-steps"}, matching(t, "genre=jazz AND NOT (year<1960 OR format=flac)"))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for s, message := range map[string]string{
+			"colour = red":              `unknown field "colour"`,
+			"genre":                     "expected a comparison after genre: unexpected end of rule",
+			"genre is jazz":             `expected a comparison after genre, got "is"`,
+			"genre =":                   "expected a value after genre =: unexpected end of rule",
+			"year < nineteen":           `year needs a number, got "nineteen"`,
+			"duration > long":           `duration needs a number of seconds or a duration, e.g.: 1m30s, got "long"`,
+			"added > yesterday":         `added needs a date, e.g.: 2024-01-31, got "yesterday"`,
+			"year in last 3 days":       "year is not a time, so can't be used with in last",
+			"added in last 3 fortnight": `unknown unit "fortnight", expected hours, days, weeks, months or years`,
+			"year contains 19":          "year is not text, so can't be used with contains",
+			"(genre = jazz":             "expected ): unexpected end of rule",
+			"genre = jazz)":             `unexpected ")"`,
+			"genre = 'jazz":             "missing closing '",
+			"genre = jazz year = 1959":  `unexpected "year"`,
+			"starred rating = 5":        `unexpected "rating"`,
+			"rating > five":             `rating needs a number, got "five"`,
+		} {
+			_, err := ParseRule(s)
+			assert.EqualError(t, err, message, s)
+		}
+	})
+}
+
+func TestParseSortOrder(t *testing.T) {
+	now := time.Now()
+	ids := func(t *testing.T, s string) []string {
+		so, err := ParseSortOrder(s)
+		require.NoError(t, err, s)
+		tracks := ruleTracks(now)
+		so.Sort(tracks, "seed")
+		ids := make([]string, 0)
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit", "untagged"}, ids(t, ""))
+	assert.Equal(t, []string{"teen-spirit", "giant-steps", "so-what", "untagged"}, ids(t, "year desc"))
+	assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit", "untagged"}, ids(t, "Year ASC"))
+	assert.Equal(t, []string{"teen-spirit", "giant-steps", "so-what", "untagged"}, ids(t, "added desc"))
+	assert.Equal(t, []string{"teen-spirit", "giant-steps", "so-what", "untagged"}, ids(t, "genre desc, year desc"))
+	assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit", "untagged"}, ids(t, "plays desc"))
+	assert.Equal(t, []string{"so-what", "giant-steps", "teen-spirit", "untagged"}, ids(t, "lastPlayed desc"))
+	assert.Equal(t, []string{"giant-steps", "so-what", "teen-spirit", "untagged"}, ids(t, "rating, starred desc"))
+	assert.Equal(t, []string{"so-what", "teen-spirit", "giant-steps", "untagged"}, ids(t, "starred desc, rating desc"))
+	assert.ElementsMatch(t, []string{"so-what", "giant-steps", "teen-spirit", "untagged"}, ids(t, "random"))
+	assert.Equal(t, ids(t, "random"), ids(t, "random"))
+
+	_, err := ParseSortOrder("colour")
+	assert.EqualError(t, err, `unknown field "colour"`)
+	_, err = ParseSortOrder("year upwards")
+	assert.EqualError(t, err, `expected asc or desc after year, got "upwards"`)
+	_, err = ParseSortOrder("year,")
+	assert.EqualError(t, err, `expected a field and optionally asc or desc, got ""`)
+}
@@ -0,0 +1,176 @@
+package catalog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SmartPlaylist is a playlist whose tracks are chosen by a rule, rather than
+// by where they are stored, e.g.: the jazz from before 1970, most recent first.
+// Its tracks are chosen again whenever the catalog changes, and every
+// ChoosingInterval if they change over time.
+type SmartPlaylist struct {
+	ID         string `json:"id"` // Based on the name, if not given
+	Name       string `json:"name"`
+	Rule       string `json:"rule"`            // See ParseRule; empty for every track
+	Sort       string `json:"sort,omitempty"`  // See ParseSortOrder; empty for the catalog's order
+	Limit      int    `json:"limit,omitempty"` // The most tracks to include; 0 for no limit
+	Configured bool   `json:"configured"`      // From the configuration, rather than added using AddSmartPlaylist
+}
+
+// A smart playlist with its rule and sort order parsed.
+type compiledSmartPlaylist struct {
+	SmartPlaylist
+	rule      Rule
+	sortOrder SortOrder
+}
+
+// ChoosingInterval is how often tracks which change over time are chosen
+// again, e.g.: for a rule with "added in last 30 days", or a random order.
+const ChoosingInterval = time.Hour
+
+// timeNow is replaced by tests which need time to pass.
+var timeNow = time.Now
+
+// ChoosingTime returns the time that tracks which change over time are chosen
+// for: the start of the ChoosingInterval that now is in. They are the same
+// for every request and every user until the next interval, so that e.g.:
+// a random order doesn't change each time a smart playlist is fetched.
+func ChoosingTime(now time.Time) time.Time {
+	return now.Truncate(ChoosingInterval)
+}
+
+// smartPlaylistID returns the ID for a smart playlist with the name, which
+// stays the same when the server restarts.
+func smartPlaylistID(name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("smartplaylist:"+name)).String()
+}
+
+func compileSmartPlaylist(sp SmartPlaylist) (compiledSmartPlaylist, error) {
+	if sp.Name == "" {
+		return compiledSmartPlaylist{}, fmt.Errorf("%w: smart playlist needs a name", ErrInvalid)
+	}
+	if sp.ID == "" {
+		sp.ID = smartPlaylistID(sp.Name)
+	}
+	rule, err := ParseRule(sp.Rule)
+	if err != nil {
+		return compiledSmartPlaylist{}, fmt.Errorf("%w: smart playlist %s: rule: %w", ErrInvalid, sp.Name, err)
+	}
+	sortOrder, err := ParseSortOrder(sp.Sort)
+	if err != nil {
+		return compiledSmartPlaylist{}, fmt.Errorf("%w: smart playlist %s: sort: %w", ErrInvalid, sp.Name, err)
+	}
+	if sp.Limit < 0 {
+		return compiledSmartPlaylist{}, fmt.Errorf("%w: smart playlist %s: limit must be at least 0", ErrInvalid, sp.Name)
+	}
+	return compiledSmartPlaylist{SmartPlaylist: sp, rule: rule, sortOrder: sortOrder}, nil
+}
+
+// Validate checks the smart playlist's rule, sort order and limit.
+func (sp SmartPlaylist) Validate() error {
+	_, err := compileSmartPlaylist(sp)
+	return err
+}
+
+// uses returns true if the rule or sort order use any fields that uses is true for.
+func (csp compiledSmartPlaylist) uses(uses func(field ruleField) bool) bool {
+	return ruleUses(csp.rule, uses) || csp.sortOrder.uses(uses)
+}
+
+// perUser returns true if the tracks chosen differ for each user, e.g.: if
+// the rule uses their ratings.
+func (csp compiledSmartPlaylist) perUser() bool {
+	return csp.uses(func(field ruleField) bool { return field.perUser })
+}
+
+// played returns true if the tracks chosen depend on the play history.
+func (csp compiledSmartPlaylist) played() bool {
+	return csp.uses(func(field ruleField) bool { return field.played })
+}
+
+// changesOverTime returns true if the tracks chosen change over time, even
+// if the catalog doesn't, e.g.: if the rule is "added in last 30 days", or
+// the order is random.
+func (csp compiledSmartPlaylist) changesOverTime() bool {
+	return ruleUsesNow(csp.rule) || csp.sortOrder.random
+}
+
+// evaluate builds the playlist from the tracks that match the rule,
+// at a time from ChoosingTime.
+func (csp compiledSmartPlaylist) evaluate(tracks []Track, at time.Time) Playlist {
+	matched := make([]Track, 0)
+	for _, track := range tracks {
+		if csp.rule.Match(track, at) {
+			matched = append(matched, track)
+		}
+	}
+	csp.sortOrder.Sort(matched, csp.ID+"@"+at.UTC().Format(time.RFC3339))
+	if csp.Limit > 0 && len(matched) > csp.Limit {
+		matched = matched[:csp.Limit]
+	}
+	return Playlist{
+		ID:     csp.ID,
+		Name:   csp.Name,
+		Smart:  true,
+		Plays:  totalPlays(matched),
+		Tracks: matched,
+	}
+}
+
+// viewSmartPlaylists returns the catalog's smart playlists which a view of it
+// needs to choose the tracks for again, indexed by ID.
+func viewSmartPlaylists(cs CatalogService, again func(csp compiledSmartPlaylist) bool) map[string]compiledSmartPlaylist {
+	smartPlaylists := make(map[string]compiledSmartPlaylist)
+	for _, sp := range cs.GetSmartPlaylists() {
+		csp, err := compileSmartPlaylist(sp)
+		if err == nil && again(csp) {
+			smartPlaylists[csp.ID] = csp
+		}
+	}
+	return smartPlaylists
+}
+
+// chooseTracksAgain replaces the tracks of the smart playlists with the ones
+// chosen from the tracks in a view of the catalog, so that sort orders and
+// limits apply to the view's tracks rather than the whole catalog's.
+func chooseTracksAgain(playlists []Playlist, tracks []Track, smartPlaylists map[string]compiledSmartPlaylist) {
+	at := ChoosingTime(timeNow())
+	for i, playlist := range playlists {
+		if csp, ok := smartPlaylists[playlist.ID]; ok && playlist.Smart {
+			playlists[i].Tracks = csp.evaluate(tracks, at).Tracks
+			playlists[i].Plays = totalPlays(playlists[i].Tracks)
+		}
+	}
+}
+
+// findPlaylist returns the playlist with the ID from a view's playlists.
+func findPlaylist(playlists []Playlist, id string) (Playlist, error) {
+	for _, playlist := range playlists {
+		if playlist.ID == id {
+			return playlist, nil
+		}
+	}
+	return Playlist{}, fmt.Errorf("%w: playlist %s", ErrNotFound, id)
+}
+
+// compileSmartPlaylists compiles the smart playlists, checking that their IDs are different.
+func compileSmartPlaylists(playlists []SmartPlaylist, configured bool) ([]compiledSmartPlaylist, error) {
+	compiled := make([]compiledSmartPlaylist, 0, len(playlists))
+	ids := make(map[string]bool)
+	for _, sp := range playlists {
+		sp.Configured = configured
+		csp, err := compileSmartPlaylist(sp)
+		if err != nil {
+			return nil, err
+		}
+		if ids[csp.ID] {
+			return nil, fmt.Errorf("%w: smart playlist %s is defined more than once", ErrExists, csp.Name)
+		}
+		ids[csp.ID] = true
+		compiled = append(compiled, csp)
+	}
+	return compiled, nil
+}
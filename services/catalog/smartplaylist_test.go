@@ -0,0 +1,178 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+func TestSmartPlaylists(t *testing.T) {
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	mp3 := albumStorage(t, "mp3", storage.MP3MimeType, 192000, "Intro", "Don't Stop", "Outro")
+	require.NoError(t, catalogService.AddStorage(mp3))
+	require.NoError(t, catalogService.AddStorage(albumStorage(t, "cds", storage.FlacMimeType, 900000, "Intro", "Bonus Track")))
+
+	trackIDs := func(playlist Playlist) []string {
+		ids := make([]string, 0)
+		for _, track := range playlist.Tracks {
+			ids = append(ids, track.ID)
+		}
+		return ids
+	}
+
+	t.Run("Configure", func(t *testing.T) {
+		generation := catalogService.Generation()
+		require.NoError(t, catalogService.ConfigureSmartPlaylists([]SmartPlaylist{
+			{Name: "Openers", Rule: "tracknumber = 1", Sort: "bitrate desc"},
+			{Name: "Everything", Sort: "title desc, library", Limit: 3},
+		}))
+		assert.Greater(t, catalogService.Generation(), generation)
+
+		smartPlaylists := catalogService.GetSmartPlaylists()
+		require.Len(t, smartPlaylists, 2)
+		assert.Equal(t, SmartPlaylist{ID: smartPlaylistID("Openers"), Name: "Openers", Rule: "tracknumber = 1", Sort: "bitrate desc", Configured: true}, smartPlaylists[0])
+
+		openers, err := catalogService.GetPlaylist(smartPlaylists[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Openers", openers.Name)
+		assert.True(t, openers.Smart)
+		assert.Empty(t, openers.StorageServiceID)
+		assert.Equal(t, []string{"cds-Intro", "mp3-Intro"}, trackIDs(openers))
+
+		everything, err := catalogService.GetPlaylist(smartPlaylists[1].ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Outro", "cds-Intro", "mp3-Intro"}, trackIDs(everything))
+
+		// The smart playlists are listed with the others, sorted by name.
+		_, playlists := catalogService.GetTracks()
+		names := make([]string, 0)
+		for _, playlist := range playlists {
+			names = append(names, playlist.Name)
+		}
+		assert.Equal(t, []string{"Everything", "Openers", "The Artist :: The Album", "The Artist :: The Album"}, names)
+	})
+
+	t.Run("CatalogChanges", func(t *testing.T) {
+		// The tracks are chosen again when the storages change.
+		require.NoError(t, catalogService.RemoveStorage(mp3.GetID()))
+		openers, err := catalogService.GetPlaylist(smartPlaylistID("Openers"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"cds-Intro"}, trackIDs(openers))
+		require.NoError(t, catalogService.AddStorage(mp3))
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		sp, err := catalogService.AddSmartPlaylist(SmartPlaylist{Name: "Not on CD", Rule: "library != cds", Configured: true})
+		require.NoError(t, err)
+		assert.Equal(t, smartPlaylistID("Not on CD"), sp.ID)
+		assert.False(t, sp.Configured)
+		playlist, err := catalogService.GetPlaylist(sp.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Intro", "mp3-Don't Stop", "mp3-Outro"}, trackIDs(playlist))
+		assert.Len(t, catalogService.GetSmartPlaylists(), 3)
+
+		_, err = catalogService.AddSmartPlaylist(SmartPlaylist{Name: "Not on CD", Rule: "library = mp3"})
+		assert.ErrorIs(t, err, ErrExists)
+		_, err = catalogService.AddSmartPlaylist(SmartPlaylist{Name: "Bad", Rule: "colour = red"})
+		assert.ErrorIs(t, err, ErrInvalid)
+		assert.EqualError(t, err, `invalid: smart playlist Bad: rule: unknown field "colour"`)
+		_, err = catalogService.AddSmartPlaylist(SmartPlaylist{Name: "Bad", Limit: -1})
+		assert.ErrorIs(t, err, ErrInvalid)
+		_, err = catalogService.AddSmartPlaylist(SmartPlaylist{Rule: "year > 2000"})
+		assert.ErrorIs(t, err, ErrInvalid)
+
+		// Reconfiguring keeps the added smart playlists, but mustn't clash with them.
+		require.NoError(t, catalogService.ConfigureSmartPlaylists([]SmartPlaylist{{Name: "Openers", Rule: "tracknumber = 1"}}))
+		assert.Len(t, catalogService.GetSmartPlaylists(), 2)
+		err = catalogService.ConfigureSmartPlaylists([]SmartPlaylist{{Name: "Not on CD"}})
+		assert.ErrorIs(t, err, ErrExists)
+		err = catalogService.ConfigureSmartPlaylists([]SmartPlaylist{{Name: "Twice"}, {Name: "Twice"}})
+		assert.ErrorIs(t, err, ErrExists)
+		assert.Len(t, catalogService.GetSmartPlaylists(), 2)
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		filtered := NewFilteredCatalog(catalogService, func(id string) bool { return id == mp3.GetID() })
+		openers, err := filtered.GetPlaylist(smartPlaylistID("Openers"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mp3-Intro"}, trackIDs(openers))
+		_, playlists := filtered.GetTracks()
+		assert.Len(t, playlists, 3)
+		assertPlaylistsConsistent(t, filtered)
+
+		assert.Equal(t, catalogService.GetSmartPlaylists(), filtered.GetSmartPlaylists())
+		_, err = filtered.AddSmartPlaylist(SmartPlaylist{Name: "Mine"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		assert.ErrorIs(t, catalogService.RemoveSmartPlaylist(smartPlaylistID("Openers")), ErrForbidden)
+		assert.ErrorIs(t, catalogService.RemoveSmartPlaylist("nope"), ErrNotFound)
+		require.NoError(t, catalogService.RemoveSmartPlaylist(smartPlaylistID("Not on CD")))
+		_, err := catalogService.GetPlaylist(smartPlaylistID("Not on CD"))
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Len(t, catalogService.GetSmartPlaylists(), 1)
+	})
+}
+
+func TestSmartPlaylistsChangingOverTime(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 12, 30, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	catalogService, err := NewBasicCatalog(Options{})
+	require.NoError(t, err)
+	recent, err := storage.NewNullStorage(storage.Options{Name: "recent"})
+	require.NoError(t, err)
+	recent.Tracks = []storage.Track{
+		{ID: "yesterday", Name: "Yesterday", ModTime: now.Add(-24 * time.Hour)},
+		{ID: "last-month", Name: "Last Month", ModTime: now.Add(-30*24*time.Hour + 10*time.Minute)},
+	}
+	recent.Playlists = []storage.Playlist{}
+	require.NoError(t, catalogService.AddStorage(recent))
+	older := albumStorage(t, "older", storage.MP3MimeType, 192000, "One", "Two", "Three", "Four", "Five", "Six")
+	require.NoError(t, catalogService.AddStorage(older))
+	require.NoError(t, catalogService.ConfigureSmartPlaylists([]SmartPlaylist{
+		{Name: "New Arrivals", Rule: "added in last 30 days"},
+		{Name: "Shuffled", Sort: "random"},
+	}))
+
+	trackIDs := func(cs CatalogService, name string) []string {
+		playlist, err := cs.GetPlaylist(smartPlaylistID(name))
+		require.NoError(t, err)
+		ids := make([]string, 0)
+		for _, track := range playlist.Tracks {
+			ids = append(ids, track.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"yesterday", "last-month"}, trackIDs(catalogService, "New Arrivals"))
+
+	// Everyone sees the same random order until the next interval, even if
+	// they can only see some of the tracks.
+	shuffled := trackIDs(catalogService, "Shuffled")
+	assert.Len(t, shuffled, 8)
+	assert.Equal(t, shuffled, trackIDs(catalogService, "Shuffled"))
+	filtered := NewFilteredCatalog(catalogService, func(id string) bool { return id == older.GetID() })
+	olderShuffled := make([]string, 0)
+	for _, id := range shuffled {
+		if id != "yesterday" && id != "last-month" {
+			olderShuffled = append(olderShuffled, id)
+		}
+	}
+	assert.Equal(t, olderShuffled, trackIDs(filtered, "Shuffled"))
+
+	// The tracks are chosen again in the next interval, without the catalog changing.
+	generation := catalogService.Generation()
+	now = now.Add(ChoosingInterval)
+	assert.Equal(t, []string{"yesterday"}, trackIDs(catalogService, "New Arrivals"))
+	assert.ElementsMatch(t, shuffled, trackIDs(catalogService, "Shuffled"))
+	assert.NotEqual(t, shuffled, trackIDs(catalogService, "Shuffled"))
+	assert.Equal(t, generation, catalogService.Generation())
+	assertPlaylistsConsistent(t, filtered)
+}
@@ -0,0 +1,102 @@
+package catalog
+
+import "time"
+
+// Source is one copy of a track's data, e.g.: the FLAC copy in one storage,
+// when the same track is also in another storage as an MP3.
+type Source struct {
+	ID               string `json:"id"` // The copy's track ID; GetTrack returns the merged track for it
+	StorageServiceID string `json:"storageServiceId"`
+	StorageName      string `json:"library"`
+
+	MIMEType string `json:"mimeType"`
+	DataLen  int64  `json:"dataLen"`
+	Bitrate  int    `json:"bitrate,omitempty"` // Average bits per second; 0 means unknown
+
+	ModTime time.Time `json:"modTime"`
+	Version string    `json:"version"`
+}
+
+func sourceOf(track Track) Source {
+	return Source{
+		ID:               track.ID,
+		StorageServiceID: track.StorageServiceID,
+		StorageName:      track.StorageName,
+		MIMEType:         track.MIMEType,
+		DataLen:          track.DataLen,
+		Bitrate:          track.Bitrate,
+		ModTime:          track.ModTime,
+		Version:          track.Version,
+	}
+}
+
+// GetSources returns the copies of the track's data, the preferred copy first.
+// A track that hasn't been merged with any others has one source: itself.
+func (t Track) GetSources() []Source {
+	if len(t.Sources) == 0 {
+		return []Source{sourceOf(t)}
+	}
+	return t.Sources
+}
+
+// WithSource returns the track with the data from one of its sources, e.g.:
+// for reading that copy with ReadTrack. It returns false if the track has
+// no source with that ID.
+func (t Track) WithSource(id string) (Track, bool) {
+	for _, source := range t.GetSources() {
+		if source.ID == id {
+			t.ID = source.ID
+			t.StorageServiceID = source.StorageServiceID
+			t.StorageName = source.StorageName
+			t.MIMEType = source.MIMEType
+			t.DataLen = source.DataLen
+			t.Bitrate = source.Bitrate
+			t.ModTime = source.ModTime
+			t.Version = source.Version
+			return t, true
+		}
+	}
+	return Track{}, false
+}
+
+// ExpandSources returns a track for each source of the tracks, e.g.: for
+// finding the duplicates that have been merged.
+func ExpandSources(tracks []Track) []Track {
+	expanded := make([]Track, 0, len(tracks))
+	for _, track := range tracks {
+		if len(track.Sources) == 0 {
+			expanded = append(expanded, track)
+			continue
+		}
+		for _, source := range track.Sources {
+			sourceTrack, _ := track.WithSource(source.ID)
+			sourceTrack.Sources = nil
+			expanded = append(expanded, sourceTrack)
+		}
+	}
+	return expanded
+}
+
+// mergeSources merges the duplicates of each track into one track, with
+// a source for each copy. The merged track is the preferred copy, in the
+// place of the first copy, with the rating of the first copy that has one
+// if the preferred copy isn't rated. It also returns the merged track's ID for each
+// of the other copies.
+func mergeSources(tracks []Track) ([]Track, map[string]string) {
+	groups := FindDuplicates(tracks)
+	aliases := make(map[string]string)
+	for i, group := range groups {
+		merged := group.Tracks[0]
+		for _, track := range group.Tracks {
+			merged.Sources = append(merged.Sources, sourceOf(track))
+			if track.ID != merged.ID {
+				aliases[track.ID] = merged.ID
+			}
+			if merged.Rating == 0 {
+				merged.Rating = track.Rating
+			}
+		}
+		groups[i].Tracks[0] = merged
+	}
+	return CollapseDuplicates(tracks, groups), aliases
+}
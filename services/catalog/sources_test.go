@@ -0,0 +1,163 @@
+package catalog
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// The MP3 in cds has the same tags as a FLAC copy in another storage,
+// once the FLAC's album artist comes from its directory.
+func mergedCatalog(t *testing.T) (CatalogService, storage.StorageService, storage.StorageService) {
+	cdsPath := "../../testdata/services/storage/diskstorage/Music/cds"
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "the-artist", "album1"), 0o755))
+	data, err := os.ReadFile(filepath.Join(cdsPath, "Artist/Album1/track2-example.flac"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "the-artist", "album1", "track2.flac"), data, 0o644))
+
+	catalogService, err := NewBasicCatalog(Options{MergeDuplicates: true})
+	require.NoError(t, err)
+	cds, err := storage.NewDiskStorage(cdsPath, []string{}, storage.Options{Name: "cds"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(cds))
+	flac, err := storage.NewDiskStorage(dir, []string{}, storage.Options{Name: "flac"})
+	require.NoError(t, err)
+	require.NoError(t, catalogService.AddStorage(flac))
+	return catalogService, cds, flac
+}
+
+func TestMergeDuplicates(t *testing.T) {
+	catalogService, cds, flac := mergedCatalog(t)
+	tracks, playlists := catalogService.GetTracks()
+	require.Len(t, tracks, 4)
+	assert.Len(t, playlists, 4)
+	assertPlaylistsConsistent(t, catalogService)
+
+	// The FLAC copy is preferred, and takes the place of the MP3.
+	merged := tracks[3]
+	assert.Equal(t, "flac", merged.StorageName)
+	assert.Equal(t, storage.FlacMimeType, merged.MIMEType)
+	require.Len(t, merged.Sources, 2)
+	assert.Equal(t, sourceOf(Track{
+		ID:               merged.ID,
+		StorageServiceID: flac.GetID(),
+		StorageName:      "flac",
+		MIMEType:         storage.FlacMimeType,
+		DataLen:          merged.DataLen,
+		Bitrate:          merged.Bitrate,
+		ModTime:          merged.ModTime,
+		Version:          merged.Version,
+	}), merged.Sources[0])
+	mp3 := merged.Sources[1]
+	assert.Equal(t, cds.GetID(), mp3.StorageServiceID)
+	assert.Equal(t, storage.MP3MimeType, mp3.MIMEType)
+	assert.Equal(t, int64(161632), mp3.DataLen)
+	assert.Equal(t, 209744, mp3.Bitrate)
+
+	t.Run("GetTrack", func(t *testing.T) {
+		// The MP3's ID still works, and finds the merged track.
+		track, err := catalogService.GetTrack(mp3.ID)
+		require.NoError(t, err)
+		assert.Equal(t, merged, track)
+	})
+
+	t.Run("Playlists", func(t *testing.T) {
+		// Both albums play the merged track.
+		for _, playlist := range playlists {
+			if playlist.StorageName == "flac" || playlist.Name == "the-artist\x00 :: album1\x00" {
+				require.Len(t, playlist.Tracks, 1)
+				assert.Equal(t, merged, playlist.Tracks[0])
+			}
+		}
+		assert.Len(t, CollapseDuplicatePlaylists(playlists, nil), 3)
+	})
+
+	t.Run("ReadTrack", func(t *testing.T) {
+		r, err := catalogService.ReadTrack(merged)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Len(t, data, int(merged.DataLen))
+
+		track, ok := merged.WithSource(mp3.ID)
+		require.True(t, ok)
+		assert.Equal(t, storage.MP3MimeType, track.MIMEType)
+		assert.Equal(t, mp3.DataLen, track.DataLen)
+		r, err = catalogService.ReadTrack(track)
+		require.NoError(t, err)
+		data, err = io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Len(t, data, int(mp3.DataLen))
+
+		_, ok = merged.WithSource("nope")
+		assert.False(t, ok)
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		// Only the MP3 is visible, so it is the track.
+		filtered := NewFilteredCatalog(catalogService, func(id string) bool { return id == cds.GetID() })
+		tracks, playlists := filtered.GetTracks()
+		require.Len(t, tracks, 4)
+		assert.Equal(t, mp3.ID, tracks[3].ID)
+		assert.Equal(t, storage.MP3MimeType, tracks[3].MIMEType)
+		assert.Empty(t, tracks[3].Sources)
+		assert.Len(t, playlists, 3)
+		assertPlaylistsConsistent(t, filtered)
+
+		track, err := filtered.GetTrack(merged.ID)
+		require.NoError(t, err)
+		assert.Equal(t, tracks[3], track)
+
+		r, err := filtered.ReadTrack(track)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Len(t, data, int(mp3.DataLen))
+
+		// The FLAC can't be read, even by asking for it.
+		flacTrack, _ := merged.WithSource(merged.ID)
+		_, err = filtered.ReadTrack(flacTrack)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("ExpandSources", func(t *testing.T) {
+		expanded := ExpandSources(tracks)
+		require.Len(t, expanded, 5)
+		assert.Equal(t, storage.FlacMimeType, expanded[3].MIMEType)
+		assert.Equal(t, mp3.ID, expanded[4].ID)
+		assert.Empty(t, expanded[4].Sources)
+		assert.Len(t, FindDuplicates(expanded), 1)
+	})
+
+	t.Run("Rating", func(t *testing.T) {
+		// The preferred copy isn't rated, so the rating comes from another copy.
+		copies := []Track{
+			{ID: "mp3", Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", MIMEType: storage.MP3MimeType, Rating: 4},
+			{ID: "flac", Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", MIMEType: storage.FlacMimeType},
+		}
+		merged, _ := mergeSources(copies)
+		require.Len(t, merged, 1)
+		assert.Equal(t, "flac", merged[0].ID)
+		assert.Equal(t, 4, merged[0].Rating)
+	})
+
+	t.Run("NotMerged", func(t *testing.T) {
+		catalogService, err := NewBasicCatalog(Options{})
+		require.NoError(t, err)
+		require.NoError(t, catalogService.AddStorage(cds))
+		require.NoError(t, catalogService.AddStorage(flac))
+		tracks, _ := catalogService.GetTracks()
+		assert.Len(t, tracks, 5)
+		for _, track := range tracks {
+			assert.Empty(t, track.Sources)
+			assert.Len(t, track.GetSources(), 1)
+		}
+	})
+}
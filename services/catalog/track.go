@@ -1,10 +1,35 @@
 package catalog
 
+import "time"
+
 type Track struct {
-	ID               string // Unique ID from storage service
-	StorageServiceID string // Storage service's ID
+	ID               string `json:"id"`               // Unique ID from storage service
+	StorageServiceID string `json:"storageServiceId"` // Storage service's ID
+	StorageName      string `json:"library"`          // Storage service's name
+
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	AlbumArtist string `json:"albumArtist,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+	Year        int    `json:"year,omitempty"`        // 0 means unknown
+	DiscNumber  int    `json:"discNumber,omitempty"`  // 0 means unknown
+	TrackNumber int    `json:"trackNumber,omitempty"` // 0 means unknown
+
+	MIMEType string        `json:"mimeType"`           // MIME type for data, see https://www.iana.org/assignments/media-types/media-types.xhtml#audio
+	DataLen  int64         `json:"dataLen"`            // Size of track data
+	Duration time.Duration `json:"duration,omitempty"` // In nanoseconds; 0 means unknown
+	Bitrate  int           `json:"bitrate,omitempty"`  // Average bits per second; 0 means unknown
+
+	ModTime time.Time `json:"modTime"` // When the track data was last modified; zero if unknown
+	Version string    `json:"version"` // Changes whenever the track data changes
+
+	Plays      int       `json:"plays"`      // How many times the track has been played, by all users; see NewPlayedCatalog
+	LastPlayed time.Time `json:"lastPlayed"` // Zero if never played
+
+	Rating  int  `json:"rating,omitempty"`  // 1 to storage.MaxRating stars, from the user or the track's tags; 0 means unrated
+	Starred bool `json:"starred,omitempty"` // Starred by the user; see NewRatedCatalog
 
-	Name     string
-	MIMEType string // MIME type for data, see https://www.iana.org/assignments/media-types/media-types.xhtml#audio
-	DataLen  int64  // Size of track data
+	Sources []Source `json:"sources,omitempty"` // All the copies of the track, if there is more than one; see Options.MergeDuplicates
 }
@@ -0,0 +1,68 @@
+package catalog
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+// readOnlyView is embedded in the views of another catalog, e.g.: FilteredCatalog.
+// Reads are passed through to the other catalog, and changes are refused,
+// since they have to be made to the other catalog. Views override the
+// methods whose results they change.
+type readOnlyView struct {
+	catalogService CatalogService
+	kind           string // E.g.: "filtered", for errors
+}
+
+func (v readOnlyView) AddStorage(ss storage.StorageService) error {
+	return fmt.Errorf("unable to add storage to a %s catalog", v.kind)
+}
+
+func (v readOnlyView) RemoveStorage(id string) error {
+	return fmt.Errorf("unable to remove storage from a %s catalog", v.kind)
+}
+
+func (v readOnlyView) ReplaceStorage(id string, ss storage.StorageService) error {
+	return fmt.Errorf("unable to replace storage in a %s catalog", v.kind)
+}
+
+func (v readOnlyView) Reconfigure(storages []storage.StorageService, playlists []SmartPlaylist) error {
+	return fmt.Errorf("unable to reconfigure a %s catalog", v.kind)
+}
+
+func (v readOnlyView) GetStorages() []storage.StorageService {
+	return v.catalogService.GetStorages()
+}
+
+func (v readOnlyView) ReadTrack(track Track) (io.Reader, error) {
+	return v.catalogService.ReadTrack(track)
+}
+
+func (v readOnlyView) GetSmartPlaylists() []SmartPlaylist {
+	return v.catalogService.GetSmartPlaylists()
+}
+
+func (v readOnlyView) AddSmartPlaylist(sp SmartPlaylist) (SmartPlaylist, error) {
+	return SmartPlaylist{}, fmt.Errorf("unable to add smart playlist to a %s catalog", v.kind)
+}
+
+func (v readOnlyView) RemoveSmartPlaylist(id string) error {
+	return fmt.Errorf("unable to remove smart playlist from a %s catalog", v.kind)
+}
+
+func (v readOnlyView) ConfigureSmartPlaylists(playlists []SmartPlaylist) error {
+	return fmt.Errorf("unable to configure smart playlists in a %s catalog", v.kind)
+}
+
+func (v readOnlyView) GetCollisions() []Collision {
+	return v.catalogService.GetCollisions()
+}
+
+// A view's generation is the same as the other catalog's. Anything a view adds
+// that isn't part of the catalog, e.g.: ratings or play counts, isn't part of
+// the generation, so callers caching responses need to check it too.
+func (v readOnlyView) Generation() uint64 {
+	return v.catalogService.Generation()
+}
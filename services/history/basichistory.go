@@ -0,0 +1,148 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+)
+
+// BasicHistory keeps the plays in memory. If it has a path, each play is
+// also appended to the file as a line of JSON, so that the history is kept
+// when the server is restarted. Appending means that a play is never lost
+// by rewriting the file, however long the history gets.
+type BasicHistory struct {
+	path string
+
+	mu     sync.RWMutex
+	file   *os.File         // Open for appending; nil if there is no path
+	plays  []Play           // Oldest first
+	counts map[string]Count // Indexed by track ID
+}
+
+// NewBasicHistory loads the history from path, if it exists.
+// If path is empty, plays are only kept until the server is restarted.
+func NewBasicHistory(path string) (*BasicHistory, error) {
+	h := &BasicHistory{
+		path:   path,
+		plays:  make([]Play, 0),
+		counts: make(map[string]Count),
+	}
+	if path == "" {
+		return h, nil
+	}
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+// Read the plays already in the file.
+func (h *BasicHistory) load() error {
+	file, err := os.Open(h.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var play Play
+		if err := json.Unmarshal(scanner.Bytes(), &play); err != nil {
+			return fmt.Errorf("%s:%d: %w", h.path, line, err)
+		}
+		h.add(play)
+	}
+	return scanner.Err()
+}
+
+// Add a play to the history in memory, keeping the plays in order.
+// Must be called with the lock held, or before the history is used.
+func (h *BasicHistory) add(play Play) {
+	i := len(h.plays)
+	for i > 0 && h.plays[i-1].Time.After(play.Time) {
+		i--
+	}
+	h.plays = slices.Insert(h.plays, i, play)
+
+	count := h.counts[play.TrackID]
+	count.Plays++
+	if play.Time.After(count.LastPlayed) {
+		count.LastPlayed = play.Time
+	}
+	h.counts[play.TrackID] = count
+}
+
+func (h *BasicHistory) Record(play Play) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file != nil {
+		data, err := json.Marshal(play)
+		if err != nil {
+			return err
+		}
+		if _, err := h.file.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	h.add(play)
+	return nil
+}
+
+func (h *BasicHistory) GetPlays(q Query) []Play {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	plays := make([]Play, 0)
+	for i := len(h.plays) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(plays) == q.Limit {
+			break
+		}
+		if q.matches(h.plays[i]) {
+			plays = append(plays, h.plays[i])
+		}
+	}
+	slices.Reverse(plays)
+	return plays
+}
+
+func (h *BasicHistory) GetCounts() map[string]Count {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	counts := make(map[string]Count, len(h.counts))
+	for id, count := range h.counts {
+		counts[id] = count
+	}
+	return counts
+}
+
+// Close closes the history's file. The history can't be used afterwards.
+func (h *BasicHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
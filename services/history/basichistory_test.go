@@ -0,0 +1,69 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasicHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plays.jsonl")
+	h, err := NewBasicHistory(path)
+	require.NoError(t, err)
+
+	start := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	plays := []Play{
+		{Time: start, User: "fred", Kind: PlayStreamed, TrackID: "a", Name: "A"},
+		{Time: start.Add(10 * time.Minute), User: "wilma", Kind: PlayStreamed, TrackID: "b", Name: "B"},
+		{Time: start.Add(20 * time.Minute), User: "fred", Kind: PlayReported, TrackID: "a", Name: "A"},
+		// Reported late, e.g.: by a client that was offline.
+		{Time: start.Add(5 * time.Minute), User: "fred", Kind: PlayReported, TrackID: "c", Name: "C"},
+	}
+	for _, play := range plays {
+		require.NoError(t, h.Record(play))
+	}
+
+	t.Run("GetPlays", func(t *testing.T) {
+		assert.Equal(t, []Play{plays[0], plays[3], plays[2]}, h.GetPlays(Query{User: "fred"}))
+		assert.Equal(t, []Play{plays[3], plays[2]}, h.GetPlays(Query{User: "fred", Limit: 2}))
+		assert.Equal(t, []Play{plays[1], plays[2]}, h.GetPlays(Query{AllUsers: true, Since: start.Add(10 * time.Minute)}))
+		assert.Len(t, h.GetPlays(Query{AllUsers: true}), 4)
+		assert.Empty(t, h.GetPlays(Query{}))
+	})
+
+	t.Run("GetCounts", func(t *testing.T) {
+		assert.Equal(t, map[string]Count{
+			"a": {Plays: 2, LastPlayed: start.Add(20 * time.Minute)},
+			"b": {Plays: 1, LastPlayed: start.Add(10 * time.Minute)},
+			"c": {Plays: 1, LastPlayed: start.Add(5 * time.Minute)},
+		}, h.GetCounts())
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		require.NoError(t, h.Close())
+		reloaded, err := NewBasicHistory(path)
+		require.NoError(t, err)
+		defer reloaded.Close()
+		assert.Equal(t, h.GetPlays(Query{AllUsers: true}), reloaded.GetPlays(Query{AllUsers: true}))
+		assert.Equal(t, h.GetCounts(), reloaded.GetCounts())
+	})
+
+	t.Run("BadFile", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "plays.jsonl")
+		require.NoError(t, os.WriteFile(bad, []byte(`{"trackId": "a"}`+"\n\nnot JSON\n"), 0o600))
+		_, err := NewBasicHistory(bad)
+		assert.ErrorContains(t, err, bad+":3: ")
+	})
+
+	t.Run("InMemory", func(t *testing.T) {
+		h, err := NewBasicHistory("")
+		require.NoError(t, err)
+		require.NoError(t, h.Record(plays[0]))
+		assert.Equal(t, []Play{plays[0]}, h.GetPlays(Query{User: "fred"}))
+		assert.NoError(t, h.Close())
+	})
+}
@@ -0,0 +1,43 @@
+package history
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// The columns of a CSV export of the history.
+var csvHeader = []string{"time", "user", "client", "kind", "trackId", "name", "title", "artist", "album", "duration"}
+
+// WriteCSV writes the plays as CSV, with a header row. Times are in RFC 3339
+// format, and durations are in seconds.
+func WriteCSV(w io.Writer, plays []Play) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, play := range plays {
+		duration := ""
+		if play.Duration > 0 {
+			duration = strconv.FormatFloat(play.Duration.Seconds(), 'f', -1, 64)
+		}
+		record := []string{
+			play.Time.Format(time.RFC3339),
+			play.User,
+			play.Client,
+			string(play.Kind),
+			play.TrackID,
+			play.Name,
+			play.Title,
+			play.Artist,
+			play.Album,
+			duration,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
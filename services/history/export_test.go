@@ -0,0 +1,30 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCSV(t *testing.T) {
+	plays := []Play{
+		{
+			Time: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC), User: "fred", Client: "Firefox", Kind: PlayStreamed,
+			TrackID: "abc", Name: "Miles Davis - So What", Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Duration: 562500 * time.Millisecond,
+		},
+		{
+			Time: time.Date(2024, time.June, 1, 12, 10, 0, 0, time.UTC), Kind: PlayReported,
+			TrackID: "def", Name: "track01, \"live\"",
+		},
+	}
+
+	var sb strings.Builder
+	require.NoError(t, WriteCSV(&sb, plays))
+	assert.Equal(t, `time,user,client,kind,trackId,name,title,artist,album,duration
+2024-06-01T12:00:00Z,fred,Firefox,streamed,abc,Miles Davis - So What,So What,Miles Davis,Kind of Blue,562.5
+2024-06-01T12:10:00Z,,,reported,def,"track01, ""live""",,,,
+`, sb.String())
+}
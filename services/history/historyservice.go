@@ -0,0 +1,7 @@
+package history
+
+type HistoryService interface {
+	Record(play Play) error      // Add a play to the history
+	GetPlays(q Query) []Play     // The plays chosen by the query, oldest first
+	GetCounts() map[string]Count // How many times each track has been played, by track ID, for all users
+}
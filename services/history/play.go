@@ -0,0 +1,51 @@
+package history
+
+import "time"
+
+// PlayKind says how the server found out about a play.
+type PlayKind string
+
+const (
+	PlayReported PlayKind = "reported" // The client said it played the track, using the API
+	PlayStreamed PlayKind = "streamed" // The server streamed enough of the track for it to count
+)
+
+// Play is one listen to a track. The track's details are kept with the play,
+// so that the history still makes sense if the track is removed or renamed.
+type Play struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`   // Empty if authentication is disabled
+	Client string    `json:"client,omitempty"` // E.g.: the User-Agent, or the name the client gave
+	Kind   PlayKind  `json:"kind"`
+
+	TrackID  string        `json:"trackId"`
+	Name     string        `json:"name"`
+	Title    string        `json:"title,omitempty"`
+	Artist   string        `json:"artist,omitempty"`
+	Album    string        `json:"album,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"` // In nanoseconds; 0 means unknown
+}
+
+// Count is how many times a track has been played.
+type Count struct {
+	Plays      int
+	LastPlayed time.Time
+}
+
+// Query chooses plays from the history.
+type Query struct {
+	User     string    // Only this user's plays, unless AllUsers is set
+	AllUsers bool      // Everyone's plays
+	Since    time.Time // Only plays at or after this time, if not zero
+	Limit    int       // Only the most recent plays; 0 for no limit
+}
+
+func (q Query) matches(play Play) bool {
+	if !q.AllUsers && play.User != q.User {
+		return false
+	}
+	if !q.Since.IsZero() && play.Time.Before(q.Since) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package ratings
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/richdawe/minimediaserver/internal/atomicfile"
+)
+
+// BasicRatings keeps the ratings in memory. If it has a path, they are also
+// written to the file whenever they change, so that they are kept when the
+// server is restarted.
+type BasicRatings struct {
+	path string
+
+	mu         sync.RWMutex
+	ratings    map[string]map[string]Rating // Indexed by user, then by track or playlist ID
+	generation uint64
+}
+
+type ratingsFile struct {
+	Users map[string]map[string]Rating `json:"users"`
+}
+
+// NewBasicRatings loads the ratings from path, if it exists.
+// If path is empty, ratings are only kept until the server is restarted.
+func NewBasicRatings(path string) (*BasicRatings, error) {
+	br := &BasicRatings{
+		path:    path,
+		ratings: make(map[string]map[string]Rating),
+	}
+	if path == "" {
+		return br, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return br, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f ratingsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for user, userRatings := range f.Users {
+		for id, rating := range userRatings {
+			if err := rating.Validate(); err != nil {
+				return nil, err
+			}
+			if !rating.IsZero() {
+				br.set(user, id, rating)
+			}
+		}
+	}
+	return br, nil
+}
+
+func (br *BasicRatings) Get(user string) map[string]Rating {
+	br.mu.RLock()
+	defer br.mu.RUnlock()
+
+	ratings := make(map[string]Rating, len(br.ratings[user]))
+	for id, rating := range br.ratings[user] {
+		ratings[id] = rating
+	}
+	return ratings
+}
+
+func (br *BasicRatings) Set(user string, id string, rating Rating) error {
+	return br.Update(user, id, func(Rating) Rating { return rating })
+}
+
+func (br *BasicRatings) Update(user string, id string, update func(rating Rating) Rating) error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	old := br.ratings[user][id]
+	rating := update(old)
+	if err := rating.Validate(); err != nil {
+		return err
+	}
+	if old == rating {
+		return nil
+	}
+	// Only change the rating if it can be saved, so that it isn't lost on a restart.
+	br.set(user, id, rating)
+	if err := br.save(); err != nil {
+		br.set(user, id, old)
+		return err
+	}
+	br.generation++
+	return nil
+}
+
+func (br *BasicRatings) Generation() uint64 {
+	br.mu.RLock()
+	defer br.mu.RUnlock()
+	return br.generation
+}
+
+// Change a rating in memory, removing zero ratings.
+// Must be called with the lock held, or before the ratings are used.
+func (br *BasicRatings) set(user string, id string, rating Rating) {
+	if rating.IsZero() {
+		delete(br.ratings[user], id)
+		if len(br.ratings[user]) == 0 {
+			delete(br.ratings, user)
+		}
+		return
+	}
+	if br.ratings[user] == nil {
+		br.ratings[user] = make(map[string]Rating)
+	}
+	br.ratings[user][id] = rating
+}
+
+// Write the ratings to disk. Must be called with the lock held.
+func (br *BasicRatings) save() error {
+	if br.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ratingsFile{Users: br.ratings}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(br.path, data)
+}
@@ -0,0 +1,129 @@
+package ratings
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasicRatings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	br, err := NewBasicRatings(path)
+	require.NoError(t, err)
+	assert.Empty(t, br.Get("fred"))
+
+	require.NoError(t, br.Set("fred", "so-what", Rating{Stars: 5, Starred: true}))
+	require.NoError(t, br.Set("fred", "kind-of-blue", Rating{Starred: true}))
+	require.NoError(t, br.Set("wilma", "so-what", Rating{Stars: 2}))
+
+	t.Run("Get", func(t *testing.T) {
+		assert.Equal(t, map[string]Rating{
+			"so-what":      {Stars: 5, Starred: true},
+			"kind-of-blue": {Starred: true},
+		}, br.Get("fred"))
+		assert.Equal(t, map[string]Rating{"so-what": {Stars: 2}}, br.Get("wilma"))
+		assert.Empty(t, br.Get("barney"))
+
+		// Changing the returned ratings doesn't change the stored ones.
+		br.Get("wilma")["so-what"] = Rating{Stars: 1}
+		assert.Equal(t, 2, br.Get("wilma")["so-what"].Stars)
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		generation := br.Generation()
+		require.NoError(t, br.Set("fred", "so-what", Rating{Stars: 5, Starred: true}))
+		assert.Equal(t, generation, br.Generation())
+
+		require.NoError(t, br.Set("fred", "so-what", Rating{Stars: 4}))
+		assert.Greater(t, br.Generation(), generation)
+		assert.Equal(t, Rating{Stars: 4}, br.Get("fred")["so-what"])
+
+		// The zero rating removes it.
+		require.NoError(t, br.Set("wilma", "so-what", Rating{}))
+		assert.Empty(t, br.Get("wilma"))
+
+		err := br.Set("fred", "so-what", Rating{Stars: 6})
+		assert.ErrorIs(t, err, ErrInvalid)
+		assert.EqualError(t, err, "invalid rating: rating must be from 1 to 5 stars, or 0 for none")
+		assert.ErrorIs(t, br.Set("fred", "so-what", Rating{Stars: -1}), ErrInvalid)
+		assert.Equal(t, 4, br.Get("fred")["so-what"].Stars)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		// Changes made at the same time to different fields are all kept.
+		var wg sync.WaitGroup
+		for stars := 1; stars <= 5; stars++ {
+			wg.Add(2)
+			go func(stars int) {
+				defer wg.Done()
+				assert.NoError(t, br.Update("barney", "freddie-freeloader", func(rating Rating) Rating {
+					rating.Stars = max(rating.Stars, stars)
+					return rating
+				}))
+			}(stars)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, br.Update("barney", "freddie-freeloader", func(rating Rating) Rating {
+					rating.Starred = true
+					return rating
+				}))
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, Rating{Stars: 5, Starred: true}, br.Get("barney")["freddie-freeloader"])
+
+		err := br.Update("barney", "freddie-freeloader", func(rating Rating) Rating {
+			rating.Stars++
+			return rating
+		})
+		assert.ErrorIs(t, err, ErrInvalid)
+		assert.Equal(t, 5, br.Get("barney")["freddie-freeloader"].Stars)
+		require.NoError(t, br.Set("barney", "freddie-freeloader", Rating{}))
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		reloaded, err := NewBasicRatings(path)
+		require.NoError(t, err)
+		assert.Equal(t, br.Get("fred"), reloaded.Get("fred"))
+		assert.Empty(t, reloaded.Get("wilma"))
+	})
+
+	t.Run("BadFile", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "ratings.json")
+		require.NoError(t, os.WriteFile(bad, []byte(`{"users": {"fred": {"so-what": {"rating": 9}}}}`), 0o600))
+		_, err := NewBasicRatings(bad)
+		assert.ErrorIs(t, err, ErrInvalid)
+
+		require.NoError(t, os.WriteFile(bad, []byte("not JSON"), 0o600))
+		_, err = NewBasicRatings(bad)
+		assert.Error(t, err)
+	})
+
+	t.Run("SaveFails", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "ratings")
+		require.NoError(t, os.Mkdir(dir, 0o700))
+		br, err := NewBasicRatings(filepath.Join(dir, "ratings.json"))
+		require.NoError(t, err)
+		require.NoError(t, br.Set("fred", "so-what", Rating{Stars: 3}))
+		generation := br.Generation()
+
+		// The directory has gone, so the changes can't be saved, and are undone.
+		require.NoError(t, os.RemoveAll(dir))
+		assert.Error(t, br.Set("fred", "so-what", Rating{Stars: 5}))
+		assert.Error(t, br.Set("fred", "kind-of-blue", Rating{Starred: true}))
+		assert.Error(t, br.Set("fred", "so-what", Rating{}))
+		assert.Equal(t, map[string]Rating{"so-what": {Stars: 3}}, br.Get("fred"))
+		assert.Equal(t, generation, br.Generation())
+	})
+
+	t.Run("InMemory", func(t *testing.T) {
+		br, err := NewBasicRatings("")
+		require.NoError(t, err)
+		require.NoError(t, br.Set("", "so-what", Rating{Stars: 3}))
+		assert.Equal(t, map[string]Rating{"so-what": {Stars: 3}}, br.Get(""))
+	})
+}
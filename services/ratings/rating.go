@@ -0,0 +1,29 @@
+package ratings
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/richdawe/minimediaserver/services/storage"
+)
+
+var ErrInvalid = errors.New("invalid rating")
+
+// Rating is a user's rating of a track or playlist, e.g.: an album.
+type Rating struct {
+	Stars   int  `json:"rating,omitempty"` // 1 to storage.MaxRating; 0 means unrated
+	Starred bool `json:"starred,omitempty"`
+}
+
+// IsZero returns true if the rating doesn't rate or star anything.
+func (r Rating) IsZero() bool {
+	return r == Rating{}
+}
+
+// Validate checks the number of stars.
+func (r Rating) Validate() error {
+	if r.Stars < 0 || r.Stars > storage.MaxRating {
+		return fmt.Errorf("%w: rating must be from 1 to %d stars, or 0 for none", ErrInvalid, storage.MaxRating)
+	}
+	return nil
+}
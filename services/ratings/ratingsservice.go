@@ -0,0 +1,8 @@
+package ratings
+
+type RatingsService interface {
+	Get(user string) map[string]Rating                                      // A user's ratings, by track or playlist ID
+	Set(user string, id string, rating Rating) error                        // Replace a user's rating of a track or playlist; the zero Rating removes it
+	Update(user string, id string, update func(rating Rating) Rating) error // Change a user's rating using its current value, atomically
+	Generation() uint64                                                     // Changes whenever anyone's ratings change, e.g.: for HTTP ETags
+}
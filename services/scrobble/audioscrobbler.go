@@ -0,0 +1,221 @@
+package scrobble
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The base URLs of the services which have an audioscrobbler 2.0 API.
+const (
+	DefaultLastFMURL  = "https://ws.audioscrobbler.com/2.0/"
+	DefaultLibreFMURL = "https://libre.fm/2.0/"
+)
+
+// How many listens track.scrobble accepts at once.
+const audioscrobblerMaxListens = 50
+
+// Error codes which mean that the request may work if it's tried again later;
+// see https://www.last.fm/api/errorcodes.
+var audioscrobblerTemporaryErrors = []int{
+	8,  // Operation failed
+	11, // Service offline
+	16, // Temporarily unavailable
+	29, // Rate limit exceeded
+}
+
+// AudioscrobblerCredentials are a user's credentials for an audioscrobbler
+// service. The API key and secret are for the application, and the session
+// key is for the user. If there's no session key, one is fetched using the
+// user's name and password.
+type AudioscrobblerCredentials struct {
+	APIKey     string
+	Secret     string
+	SessionKey string
+	Username   string
+	Password   string
+}
+
+// Audioscrobbler submits listens using the audioscrobbler 2.0 API, which is
+// used by Last.fm and Libre.fm; see https://www.last.fm/api/scrobbling.
+type Audioscrobbler struct {
+	baseURL     string
+	credentials AudioscrobblerCredentials
+	httpClient  *http.Client
+
+	mu         sync.Mutex
+	sessionKey string
+}
+
+// NewAudioscrobbler returns a client for a user. If baseURL is empty,
+// DefaultLastFMURL is used. If httpClient is nil, http.DefaultClient is used.
+func NewAudioscrobbler(baseURL string, credentials AudioscrobblerCredentials, httpClient *http.Client) *Audioscrobbler {
+	if baseURL == "" {
+		baseURL = DefaultLastFMURL
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Audioscrobbler{
+		baseURL:     baseURL,
+		credentials: credentials,
+		httpClient:  httpClient,
+		sessionKey:  credentials.SessionKey,
+	}
+}
+
+func (as *Audioscrobbler) Name() string {
+	return as.baseURL
+}
+
+func (as *Audioscrobbler) MaxListens() int {
+	return audioscrobblerMaxListens
+}
+
+func (as *Audioscrobbler) NowPlaying(ctx context.Context, listen Listen) error {
+	params := url.Values{}
+	params.Set("method", "track.updateNowPlaying")
+	params.Set("artist", listen.Artist)
+	params.Set("track", listen.Title)
+	if listen.Album != "" {
+		params.Set("album", listen.Album)
+	}
+	if seconds := int(listen.Duration.Seconds()); seconds > 0 {
+		params.Set("duration", strconv.Itoa(seconds))
+	}
+	return as.callWithSession(ctx, params, nil)
+}
+
+func (as *Audioscrobbler) Submit(ctx context.Context, listens []Listen) error {
+	params := url.Values{}
+	params.Set("method", "track.scrobble")
+	for i, listen := range listens {
+		index := func(name string) string {
+			return fmt.Sprintf("%s[%d]", name, i)
+		}
+		params.Set(index("artist"), listen.Artist)
+		params.Set(index("track"), listen.Title)
+		params.Set(index("timestamp"), strconv.FormatInt(listen.Time.Unix(), 10))
+		if listen.Album != "" {
+			params.Set(index("album"), listen.Album)
+		}
+		if seconds := int(listen.Duration.Seconds()); seconds > 0 {
+			params.Set(index("duration"), strconv.Itoa(seconds))
+		}
+	}
+	return as.callWithSession(ctx, params, nil)
+}
+
+// session returns the user's session key, fetching it if necessary.
+func (as *Audioscrobbler) session(ctx context.Context) (string, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.sessionKey != "" {
+		return as.sessionKey, nil
+	}
+	if as.credentials.Username == "" || as.credentials.Password == "" {
+		return "", fmt.Errorf("%w: no session key, or username and password", ErrRejected)
+	}
+
+	params := url.Values{}
+	params.Set("method", "auth.getMobileSession")
+	params.Set("username", as.credentials.Username)
+	params.Set("password", as.credentials.Password)
+	var result struct {
+		Session struct {
+			Key string `json:"key"`
+		} `json:"session"`
+	}
+	if err := as.call(ctx, params, &result); err != nil {
+		return "", err
+	}
+	if result.Session.Key == "" {
+		return "", fmt.Errorf("no session key in response to auth.getMobileSession")
+	}
+	as.sessionKey = result.Session.Key
+	return as.sessionKey, nil
+}
+
+// callWithSession calls an API method which needs the user's session key.
+func (as *Audioscrobbler) callWithSession(ctx context.Context, params url.Values, result any) error {
+	sessionKey, err := as.session(ctx)
+	if err != nil {
+		return err
+	}
+	params.Set("sk", sessionKey)
+	return as.call(ctx, params, result)
+}
+
+// call calls an API method, and decodes the response into result if it isn't nil.
+func (as *Audioscrobbler) call(ctx context.Context, params url.Values, result any) error {
+	params.Set("api_key", as.credentials.APIKey)
+	params.Set("api_sig", as.signature(params))
+	params.Set("format", "json")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, as.baseURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", submissionClient)
+
+	resp, err := as.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+
+	// Errors are like {"error": 9, "message": "Invalid session key - Please re-authenticate"},
+	// which may be sent with any status.
+	var apiError struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &apiError) == nil && apiError.Error != 0 {
+		if slices.Contains(audioscrobblerTemporaryErrors, apiError.Error) {
+			return fmt.Errorf("error %d: %s", apiError.Error, apiError.Message)
+		}
+		return fmt.Errorf("%w: error %d: %s", ErrRejected, apiError.Error, apiError.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// signature signs the parameters of a call with the secret; see
+// https://www.last.fm/api/authspec#_8-signing-calls.
+func (as *Audioscrobbler) signature(params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "format" && name != "callback" && name != "api_sig" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteString(params.Get(name))
+	}
+	sb.WriteString(as.credentials.Secret)
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
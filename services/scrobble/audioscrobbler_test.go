@@ -0,0 +1,172 @@
+package scrobble
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// audioscrobblerServer is a stand-in for an audioscrobbler 2.0 API, e.g.: Last.fm.
+type audioscrobblerServer struct {
+	*httptest.Server
+	credentials AudioscrobblerCredentials
+
+	mu        sync.Mutex
+	errorCode int
+	calls     []url.Values
+}
+
+func newAudioscrobblerServer(t *testing.T, credentials AudioscrobblerCredentials) *audioscrobblerServer {
+	as := &audioscrobblerServer{credentials: credentials}
+	signer := NewAudioscrobbler("", credentials, nil)
+	as.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		as.mu.Lock()
+		defer as.mu.Unlock()
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params := r.PostForm
+		as.calls = append(as.calls, params)
+		apiError := func(status int, code int, message string) {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"error": %d, "message": %q}`, code, message)
+		}
+
+		switch {
+		case as.errorCode != 0:
+			apiError(http.StatusServiceUnavailable, as.errorCode, "Something went wrong")
+		case params.Get("format") != "json":
+			apiError(http.StatusBadRequest, 6, "Invalid parameters")
+		case params.Get("api_key") != as.credentials.APIKey:
+			apiError(http.StatusForbidden, 10, "Invalid API key")
+		case params.Get("api_sig") != signer.signature(params):
+			apiError(http.StatusForbidden, 13, "Invalid method signature supplied")
+		case params.Get("method") == "auth.getMobileSession":
+			if params.Get("username") != as.credentials.Username || params.Get("password") != as.credentials.Password {
+				apiError(http.StatusForbidden, 4, "Authentication Failed")
+				return
+			}
+			fmt.Fprintf(w, `{"session": {"name": %q, "key": %q, "subscriber": 0}}`, as.credentials.Username, as.credentials.SessionKey)
+		case params.Get("sk") != as.credentials.SessionKey:
+			apiError(http.StatusForbidden, 9, "Invalid session key - Please re-authenticate")
+		case params.Get("method") == "track.updateNowPlaying":
+			fmt.Fprint(w, `{"nowplaying": {"ignoredMessage": {"code": "0", "#text": ""}}}`)
+		case params.Get("method") == "track.scrobble":
+			fmt.Fprint(w, `{"scrobbles": {"@attr": {"accepted": 1, "ignored": 0}}}`)
+		default:
+			apiError(http.StatusBadRequest, 3, "Invalid Method - No method with that name in this package")
+		}
+	}))
+	t.Cleanup(as.Close)
+	return as
+}
+
+func (as *audioscrobblerServer) setErrorCode(code int) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.errorCode = code
+}
+
+func (as *audioscrobblerServer) received() []url.Values {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return append([]url.Values(nil), as.calls...)
+}
+
+func TestAudioscrobbler(t *testing.T) {
+	credentials := AudioscrobblerCredentials{
+		APIKey:     "api-key",
+		Secret:     "api-secret",
+		SessionKey: "session-key",
+		Username:   "fred",
+		Password:   "yabba-dabba-doo",
+	}
+	server := newAudioscrobblerServer(t, credentials)
+	ctx := context.Background()
+	listens := testListens(2)
+
+	t.Run("Signature", func(t *testing.T) {
+		// The example from https://www.last.fm/api/authspec#_8-signing-calls: the MD5 of
+		// "api_keyxxxxxxxxmethodauth.getSessiontokenxxxxxxxmysecret". format isn't signed.
+		as := NewAudioscrobbler("", AudioscrobblerCredentials{APIKey: "xxxxxxxx", Secret: "mysecret"}, nil)
+		params := url.Values{"api_key": {"xxxxxxxx"}, "method": {"auth.getSession"}, "token": {"xxxxxxx"}, "format": {"json"}}
+		assert.Equal(t, "68afb32bee072407a63b6c41f3e1e2b4", as.signature(params))
+	})
+
+	t.Run("NowPlaying", func(t *testing.T) {
+		as := NewAudioscrobbler(server.URL, credentials, server.Client())
+		assert.Equal(t, server.URL, as.Name())
+		require.NoError(t, as.NowPlaying(ctx, listens[0]))
+		calls := server.received()
+		require.NotEmpty(t, calls)
+		call := calls[len(calls)-1]
+		assert.Equal(t, "track.updateNowPlaying", call.Get("method"))
+		assert.Equal(t, "Miles Davis", call.Get("artist"))
+		assert.Equal(t, "So What", call.Get("track"))
+		assert.Equal(t, "Kind of Blue", call.Get("album"))
+		assert.Equal(t, "562", call.Get("duration"))
+	})
+
+	t.Run("Submit", func(t *testing.T) {
+		as := NewAudioscrobbler(server.URL, credentials, server.Client())
+		require.NoError(t, as.Submit(ctx, listens))
+		calls := server.received()
+		call := calls[len(calls)-1]
+		assert.Equal(t, "track.scrobble", call.Get("method"))
+		assert.Equal(t, "So What", call.Get("track[0]"))
+		assert.Equal(t, "Freddie Freeloader", call.Get("track[1]"))
+		assert.Equal(t, fmt.Sprint(listens[1].Time.Unix()), call.Get("timestamp[1]"))
+		assert.Equal(t, "session-key", call.Get("sk"))
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		// Without a session key, one is fetched using the username and password, once.
+		withPassword := credentials
+		withPassword.SessionKey = ""
+		as := NewAudioscrobbler(server.URL, withPassword, server.Client())
+		before := len(server.received())
+		require.NoError(t, as.Submit(ctx, listens[:1]))
+		require.NoError(t, as.Submit(ctx, listens[1:]))
+		calls := server.received()[before:]
+		require.Len(t, calls, 3)
+		assert.Equal(t, "auth.getMobileSession", calls[0].Get("method"))
+		assert.Equal(t, "track.scrobble", calls[1].Get("method"))
+		assert.Equal(t, "session-key", calls[2].Get("sk"))
+
+		wrongPassword := withPassword
+		wrongPassword.Password = "wrong"
+		err := NewAudioscrobbler(server.URL, wrongPassword, server.Client()).Submit(ctx, listens)
+		assert.ErrorIs(t, err, ErrRejected)
+		assert.EqualError(t, err, "rejected: error 4: Authentication Failed")
+
+		err = NewAudioscrobbler(server.URL, AudioscrobblerCredentials{APIKey: "api-key", Secret: "api-secret"}, server.Client()).Submit(ctx, listens)
+		assert.ErrorIs(t, err, ErrRejected)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		wrongSecret := credentials
+		wrongSecret.Secret = "wrong"
+		err := NewAudioscrobbler(server.URL, wrongSecret, server.Client()).Submit(ctx, listens)
+		assert.ErrorIs(t, err, ErrRejected)
+		assert.EqualError(t, err, "rejected: error 13: Invalid method signature supplied")
+
+		wrongSession := credentials
+		wrongSession.SessionKey = "wrong"
+		err = NewAudioscrobbler(server.URL, wrongSession, server.Client()).Submit(ctx, listens)
+		assert.ErrorIs(t, err, ErrRejected)
+
+		server.setErrorCode(16)
+		defer server.setErrorCode(0)
+		err = NewAudioscrobbler(server.URL, credentials, server.Client()).Submit(ctx, listens)
+		assert.NotErrorIs(t, err, ErrRejected)
+		assert.EqualError(t, err, "error 16: Something went wrong")
+	})
+}
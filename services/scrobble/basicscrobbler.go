@@ -0,0 +1,141 @@
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How long each request to a service can take.
+const requestTimeout = 30 * time.Second
+
+// BasicScrobbler submits each user's listens to their services. Listens are
+// queued, and submitted in the background, so that playing a track never
+// waits for a service. If a service can't be reached, its listens stay in
+// the queue until they can be submitted.
+type BasicScrobbler struct {
+	queue   *Queue
+	clients map[string][]Client // By user
+
+	flushMu sync.Mutex    // So that listens are only submitted once
+	wake    chan struct{} // Tells Run there are new listens
+}
+
+// NewBasicScrobbler returns a scrobbler for the users' services. Any listens
+// in the queue for services that users no longer have are dropped.
+func NewBasicScrobbler(queue *Queue, clients map[string][]Client) (*BasicScrobbler, error) {
+	bs := &BasicScrobbler{
+		queue:   queue,
+		clients: clients,
+		wake:    make(chan struct{}, 1),
+	}
+	dropped, err := queue.RemoveFunc(func(p Pending) bool {
+		return bs.client(p.User, p.Client) == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dropped > 0 {
+		slog.Warn("Dropped listens for services which are no longer configured", "listens", dropped)
+	}
+	return bs, nil
+}
+
+func (bs *BasicScrobbler) client(user string, name string) Client {
+	for _, client := range bs.clients[user] {
+		if client.Name() == name {
+			return client
+		}
+	}
+	return nil
+}
+
+func (bs *BasicScrobbler) NowPlaying(ctx context.Context, user string, listen Listen) error {
+	var errs []error
+	for _, client := range bs.clients[user] {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		if err := client.NowPlaying(ctx, listen); err != nil {
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+func (bs *BasicScrobbler) Scrobble(user string, listen Listen) error {
+	clients := bs.clients[user]
+	if len(clients) == 0 {
+		return nil
+	}
+	pending := make([]Pending, 0, len(clients))
+	for _, client := range clients {
+		pending = append(pending, Pending{User: user, Client: client.Name(), Listen: listen})
+	}
+	if err := bs.queue.Add(pending...); err != nil {
+		return err
+	}
+
+	select {
+	case bs.wake <- struct{}{}:
+	default:
+		// Run has already been told.
+	}
+	return nil
+}
+
+func (bs *BasicScrobbler) Flush(ctx context.Context) error {
+	bs.flushMu.Lock()
+	defer bs.flushMu.Unlock()
+
+	var errs []error
+	for user, clients := range bs.clients {
+		for _, client := range clients {
+			if err := bs.flushClient(ctx, user, client); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Submit the queued listens for a user's service. Must be called with bs.flushMu held.
+func (bs *BasicScrobbler) flushClient(ctx context.Context, user string, client Client) error {
+	for {
+		listens := bs.queue.Peek(user, client.Name(), client.MaxListens())
+		if len(listens) == 0 {
+			return nil
+		}
+
+		requestCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		err := client.Submit(requestCtx, listens)
+		cancel()
+		if errors.Is(err, ErrRejected) {
+			// Trying again won't help, and would hold up the later listens.
+			slog.Error("Dropping listens rejected by scrobbling service", "user", user, "service", client.Name(),
+				"listens", len(listens), "error", err)
+		} else if err != nil {
+			return err
+		}
+		if err := bs.queue.Remove(user, client.Name(), len(listens)); err != nil {
+			return err
+		}
+	}
+}
+
+func (bs *BasicScrobbler) Run(ctx context.Context, retryInterval time.Duration) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		if err := bs.Flush(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Unable to submit listens; will try again later", "pending", bs.queue.Len(), "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-bs.wake:
+		case <-ticker.C:
+		}
+	}
+}
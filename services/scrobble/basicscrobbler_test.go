@@ -0,0 +1,112 @@
+package scrobble
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasicScrobbler(t *testing.T) {
+	lbServer := newListenBrainzServer(t, "fred-token")
+	asServer := newAudioscrobblerServer(t, AudioscrobblerCredentials{APIKey: "api-key", Secret: "api-secret", SessionKey: "fred-session"})
+	lb := NewListenBrainz(lbServer.URL, "fred-token", lbServer.Client())
+	as := NewAudioscrobbler(asServer.URL, AudioscrobblerCredentials{APIKey: "api-key", Secret: "api-secret", SessionKey: "fred-session"}, asServer.Client())
+	rejected := NewListenBrainz(lbServer.URL, "wrong-token", lbServer.Client())
+	clients := map[string][]Client{
+		"fred":  {lb, as},
+		"wilma": {rejected},
+	}
+
+	path := filepath.Join(t.TempDir(), "scrobbles.json")
+	queue, err := NewQueue(path)
+	require.NoError(t, err)
+	bs, err := NewBasicScrobbler(queue, clients)
+	require.NoError(t, err)
+	ctx := context.Background()
+	listens := testListens(60)
+
+	t.Run("NowPlaying", func(t *testing.T) {
+		require.NoError(t, bs.NowPlaying(ctx, "fred", listens[0]))
+		assert.Len(t, lbServer.received(), 1)
+		assert.Equal(t, "track.updateNowPlaying", asServer.received()[0].Get("method"))
+
+		// Users without services are ignored.
+		assert.NoError(t, bs.NowPlaying(ctx, "barney", listens[0]))
+	})
+
+	t.Run("Scrobble", func(t *testing.T) {
+		require.NoError(t, bs.Scrobble("fred", listens[0]))
+		require.NoError(t, bs.Scrobble("barney", listens[0]))
+		assert.Equal(t, 2, queue.Len())
+		require.NoError(t, bs.Flush(ctx))
+		assert.Zero(t, queue.Len())
+		submissions := lbServer.received()
+		assert.Equal(t, "single", submissions[len(submissions)-1].ListenType)
+		calls := asServer.received()
+		assert.Equal(t, "So What", calls[len(calls)-1].Get("track[0]"))
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		lbServer.setDown(true)
+		asServer.setErrorCode(11)
+		for _, listen := range listens {
+			require.NoError(t, bs.Scrobble("fred", listen))
+		}
+		assert.Error(t, bs.Flush(ctx))
+		assert.Equal(t, 120, queue.Len())
+
+		// The listens are kept if the server is restarted.
+		restarted, err := NewQueue(path)
+		require.NoError(t, err)
+		assert.Equal(t, 120, restarted.Len())
+
+		// Once the services are back, the listens are submitted in batches.
+		lbServer.setDown(false)
+		asServer.setErrorCode(0)
+		before := len(asServer.received())
+		require.NoError(t, bs.Flush(ctx))
+		assert.Zero(t, queue.Len())
+		submissions := lbServer.received()
+		last := submissions[len(submissions)-1]
+		assert.Equal(t, "import", last.ListenType)
+		assert.Len(t, last.Payload, 60)
+		calls := asServer.received()[before:]
+		require.Len(t, calls, 2)
+		assert.Equal(t, listens[50].Title, calls[1].Get("track[0]"))
+		assert.Equal(t, listens[59].Title, calls[1].Get("track[9]"))
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		// Retrying won't help, so the listens are dropped.
+		require.NoError(t, bs.Scrobble("wilma", listens[0]))
+		assert.NoError(t, bs.Flush(ctx))
+		assert.Zero(t, queue.Len())
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			bs.Run(ctx, time.Hour)
+			close(done)
+		}()
+		before := len(lbServer.received())
+		require.NoError(t, bs.Scrobble("fred", listens[1]))
+		assert.Eventually(t, func() bool { return queue.Len() == 0 && len(lbServer.received()) == before+1 }, 5*time.Second, 10*time.Millisecond)
+		cancel()
+		<-done
+	})
+
+	t.Run("Reconfigured", func(t *testing.T) {
+		require.NoError(t, queue.Add(Pending{User: "fred", Client: "https://old.example.com", Listen: listens[0]}))
+		require.NoError(t, queue.Add(Pending{User: "fred", Client: lb.Name(), Listen: listens[0]}))
+		_, err := NewBasicScrobbler(queue, clients)
+		require.NoError(t, err)
+		assert.Equal(t, []Listen{listens[0]}, queue.Peek("fred", lb.Name(), 10))
+		assert.Equal(t, 1, queue.Len())
+	})
+}
@@ -0,0 +1,35 @@
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRejected is returned when a service won't accept a submission, e.g.:
+// because the credentials are wrong. Trying again won't help, unlike when
+// the network or the service is down.
+var ErrRejected = errors.New("rejected")
+
+// Listen is a track that a user has listened to, or is listening to.
+type Listen struct {
+	Time     time.Time     `json:"time"` // When the track was played
+	Artist   string        `json:"artist"`
+	Title    string        `json:"title"`
+	Album    string        `json:"album,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"` // In nanoseconds; 0 means unknown
+	Client   string        `json:"client,omitempty"`   // What it was played with
+}
+
+// Client submits a user's listens to a scrobbling service.
+type Client interface {
+	// Name identifies the service and the user's account on it,
+	// e.g.: for logging, and for the listens in the retry queue.
+	Name() string
+	// NowPlaying tells the service what the user has just started playing.
+	NowPlaying(ctx context.Context, listen Listen) error
+	// Submit sends listens that the user has finished, oldest first.
+	Submit(ctx context.Context, listens []Listen) error
+	// MaxListens is the most listens that can be submitted at once.
+	MaxListens() int
+}
@@ -0,0 +1,152 @@
+package scrobble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultListenBrainzURL is the base URL of the ListenBrainz API.
+const DefaultListenBrainzURL = "https://api.listenbrainz.org"
+
+// How many listens ListenBrainz is sent at once. It accepts up to 1000,
+// but the requests are also limited in size.
+const listenBrainzMaxListens = 100
+
+// What the server calls itself to the scrobbling services.
+const submissionClient = "minimediaserver"
+
+// ListenBrainz submits listens using the ListenBrainz JSON API;
+// see https://listenbrainz.readthedocs.io/en/latest/users/api/core.html.
+type ListenBrainz struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewListenBrainz returns a client for a user, using their user token. If
+// baseURL is empty, DefaultListenBrainzURL is used. If httpClient is nil,
+// http.DefaultClient is used.
+func NewListenBrainz(baseURL string, token string, httpClient *http.Client) *ListenBrainz {
+	if baseURL == "" {
+		baseURL = DefaultListenBrainzURL
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &ListenBrainz{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+type listenBrainzSubmission struct {
+	ListenType string                `json:"listen_type"` // single, import or playing_now
+	Payload    []listenBrainzPayload `json:"payload"`
+}
+
+type listenBrainzPayload struct {
+	ListenedAt    int64                     `json:"listened_at,omitempty"` // Unix time; not set for playing_now
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                     `json:"artist_name"`
+	TrackName      string                     `json:"track_name"`
+	ReleaseName    string                     `json:"release_name,omitempty"`
+	AdditionalInfo listenBrainzAdditionalInfo `json:"additional_info"`
+}
+
+type listenBrainzAdditionalInfo struct {
+	DurationMs       int64  `json:"duration_ms,omitempty"`
+	MediaPlayer      string `json:"media_player,omitempty"`
+	SubmissionClient string `json:"submission_client"`
+}
+
+func (lb *ListenBrainz) Name() string {
+	return lb.baseURL
+}
+
+func (lb *ListenBrainz) MaxListens() int {
+	return listenBrainzMaxListens
+}
+
+func (lb *ListenBrainz) NowPlaying(ctx context.Context, listen Listen) error {
+	payload := lb.payload(listen)
+	payload.ListenedAt = 0
+	return lb.submit(ctx, listenBrainzSubmission{ListenType: "playing_now", Payload: []listenBrainzPayload{payload}})
+}
+
+func (lb *ListenBrainz) Submit(ctx context.Context, listens []Listen) error {
+	submission := listenBrainzSubmission{ListenType: "single"}
+	if len(listens) > 1 {
+		submission.ListenType = "import"
+	}
+	for _, listen := range listens {
+		submission.Payload = append(submission.Payload, lb.payload(listen))
+	}
+	return lb.submit(ctx, submission)
+}
+
+func (lb *ListenBrainz) payload(listen Listen) listenBrainzPayload {
+	return listenBrainzPayload{
+		ListenedAt: listen.Time.Unix(),
+		TrackMetadata: listenBrainzTrackMetadata{
+			ArtistName:  listen.Artist,
+			TrackName:   listen.Title,
+			ReleaseName: listen.Album,
+			AdditionalInfo: listenBrainzAdditionalInfo{
+				DurationMs:       listen.Duration.Milliseconds(),
+				MediaPlayer:      listen.Client,
+				SubmissionClient: submissionClient,
+			},
+		},
+	}
+}
+
+func (lb *ListenBrainz) submit(ctx context.Context, submission listenBrainzSubmission) error {
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lb.baseURL+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+lb.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", submissionClient)
+
+	resp, err := lb.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Errors are like {"code": 401, "error": "Invalid authorization token."}
+	var result struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, &result) != nil || result.Error == "" {
+		result.Error = http.StatusText(resp.StatusCode)
+	}
+	return statusError(resp.StatusCode, result.Error)
+}
+
+// statusError returns an error for an HTTP status. Client errors, apart from
+// being rate limited, mean that the submission will never be accepted.
+func statusError(status int, message string) error {
+	if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %d %s", ErrRejected, status, message)
+	}
+	return fmt.Errorf("%d %s", status, message)
+}
@@ -0,0 +1,137 @@
+package scrobble
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenBrainzServer is a stand-in for the ListenBrainz API.
+type listenBrainzServer struct {
+	*httptest.Server
+	token string
+
+	mu          sync.Mutex
+	down        bool
+	submissions []listenBrainzSubmission
+}
+
+func newListenBrainzServer(t *testing.T, token string) *listenBrainzServer {
+	lbs := &listenBrainzServer{token: token}
+	lbs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lbs.mu.Lock()
+		defer lbs.mu.Unlock()
+		switch {
+		case lbs.down:
+			http.Error(w, `{"code": 503, "error": "Down for maintenance"}`, http.StatusServiceUnavailable)
+		case r.Method != http.MethodPost || r.URL.Path != "/1/submit-listens":
+			http.Error(w, `{"code": 404, "error": "Not found"}`, http.StatusNotFound)
+		case r.Header.Get("Authorization") != "Token "+lbs.token:
+			http.Error(w, `{"code": 401, "error": "Invalid authorization token."}`, http.StatusUnauthorized)
+		default:
+			var submission listenBrainzSubmission
+			if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+				http.Error(w, `{"code": 400, "error": "Invalid JSON document submitted."}`, http.StatusBadRequest)
+				return
+			}
+			lbs.submissions = append(lbs.submissions, submission)
+			w.Write([]byte(`{"status": "ok"}`))
+		}
+	}))
+	t.Cleanup(lbs.Close)
+	return lbs
+}
+
+func (lbs *listenBrainzServer) setDown(down bool) {
+	lbs.mu.Lock()
+	defer lbs.mu.Unlock()
+	lbs.down = down
+}
+
+func (lbs *listenBrainzServer) received() []listenBrainzSubmission {
+	lbs.mu.Lock()
+	defer lbs.mu.Unlock()
+	return append([]listenBrainzSubmission(nil), lbs.submissions...)
+}
+
+func testListens(n int) []Listen {
+	start := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	titles := []string{"So What", "Freddie Freeloader", "Blue in Green", "All Blues", "Flamenco Sketches"}
+	listens := make([]Listen, 0, n)
+	for i := 0; i < n; i++ {
+		listens = append(listens, Listen{
+			Time:     start.Add(time.Duration(i) * 10 * time.Minute),
+			Artist:   "Miles Davis",
+			Title:    titles[i%len(titles)],
+			Album:    "Kind of Blue",
+			Duration: 562 * time.Second,
+			Client:   "Firefox",
+		})
+	}
+	return listens
+}
+
+func TestListenBrainz(t *testing.T) {
+	server := newListenBrainzServer(t, "secret-token")
+	lb := NewListenBrainz(server.URL+"/", "secret-token", server.Client())
+	assert.Equal(t, server.URL, lb.Name())
+	ctx := context.Background()
+	listens := testListens(2)
+
+	t.Run("NowPlaying", func(t *testing.T) {
+		require.NoError(t, lb.NowPlaying(ctx, listens[0]))
+		submissions := server.received()
+		require.Len(t, submissions, 1)
+		assert.Equal(t, listenBrainzSubmission{
+			ListenType: "playing_now",
+			Payload: []listenBrainzPayload{{
+				TrackMetadata: listenBrainzTrackMetadata{
+					ArtistName:  "Miles Davis",
+					TrackName:   "So What",
+					ReleaseName: "Kind of Blue",
+					AdditionalInfo: listenBrainzAdditionalInfo{
+						DurationMs:       562000,
+						MediaPlayer:      "Firefox",
+						SubmissionClient: "minimediaserver",
+					},
+				},
+			}},
+		}, submissions[0])
+	})
+
+	t.Run("Submit", func(t *testing.T) {
+		require.NoError(t, lb.Submit(ctx, listens[:1]))
+		require.NoError(t, lb.Submit(ctx, listens))
+		submissions := server.received()[1:]
+		require.Len(t, submissions, 2)
+		assert.Equal(t, "single", submissions[0].ListenType)
+		assert.Equal(t, listens[0].Time.Unix(), submissions[0].Payload[0].ListenedAt)
+		assert.Equal(t, "import", submissions[1].ListenType)
+		require.Len(t, submissions[1].Payload, 2)
+		assert.Equal(t, "Freddie Freeloader", submissions[1].Payload[1].TrackMetadata.TrackName)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		err := NewListenBrainz(server.URL, "wrong-token", server.Client()).Submit(ctx, listens)
+		assert.ErrorIs(t, err, ErrRejected)
+		assert.EqualError(t, err, "rejected: 401 Invalid authorization token.")
+
+		server.setDown(true)
+		defer server.setDown(false)
+		err = lb.Submit(ctx, listens)
+		assert.NotErrorIs(t, err, ErrRejected)
+		assert.EqualError(t, err, "503 Down for maintenance")
+
+		// The network is down.
+		err = NewListenBrainz("http://127.0.0.1:1", "secret-token", nil).Submit(ctx, listens)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrRejected)
+	})
+}
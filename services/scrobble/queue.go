@@ -0,0 +1,150 @@
+package scrobble
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/richdawe/minimediaserver/internal/atomicfile"
+)
+
+// Pending is a listen waiting to be submitted to one of a user's services.
+type Pending struct {
+	User   string `json:"user"`
+	Client string `json:"client"` // The Name of the Client to submit it with
+	Listen Listen `json:"listen"`
+}
+
+// Queue is the listens waiting to be submitted, oldest first. If it has
+// a path, it is persisted to disk whenever it changes, so that listens
+// aren't lost if the server is restarted while a service is down.
+type Queue struct {
+	path string
+
+	mu      sync.Mutex
+	pending []Pending
+}
+
+type queueFile struct {
+	Pending []Pending `json:"pending"`
+}
+
+// NewQueue loads the queue from path, if it exists.
+// If path is empty, listens are only queued until the server is restarted.
+func NewQueue(path string) (*Queue, error) {
+	q := &Queue{
+		path:    path,
+		pending: make([]Pending, 0),
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f queueFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	q.pending = append(q.pending, f.Pending...)
+	return q, nil
+}
+
+// Add adds listens to the end of the queue.
+func (q *Queue) Add(pending ...Pending) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Only keep the listens if they can be saved, so that they aren't lost on a restart.
+	n := len(q.pending)
+	q.pending = append(q.pending, pending...)
+	if err := q.save(); err != nil {
+		q.pending = q.pending[:n]
+		return err
+	}
+	return nil
+}
+
+// Peek returns up to n of the oldest listens for a user's service.
+func (q *Queue) Peek(user string, client string, n int) []Listen {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	listens := make([]Listen, 0)
+	for _, p := range q.pending {
+		if len(listens) == n {
+			break
+		}
+		if p.User == user && p.Client == client {
+			listens = append(listens, p.Listen)
+		}
+	}
+	return listens
+}
+
+// Remove removes the n oldest listens for a user's service,
+// e.g.: once they have been submitted.
+func (q *Queue) Remove(user string, client string, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := make([]Pending, 0, len(q.pending))
+	for _, p := range q.pending {
+		if n > 0 && p.User == user && p.Client == client {
+			n--
+			continue
+		}
+		kept = append(kept, p)
+	}
+	q.pending = kept
+	return q.save()
+}
+
+// RemoveFunc removes the listens for which remove returns true,
+// and returns how many were removed.
+func (q *Queue) RemoveFunc(remove func(p Pending) bool) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := make([]Pending, 0, len(q.pending))
+	for _, p := range q.pending {
+		if !remove(p) {
+			kept = append(kept, p)
+		}
+	}
+	removed := len(q.pending) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	q.pending = kept
+	return removed, q.save()
+}
+
+// Len returns how many listens are waiting to be submitted.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Write the queue to disk. Must be called with q.mu held.
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(queueFile{Pending: q.pending}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(q.path, data)
+}
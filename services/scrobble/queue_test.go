@@ -0,0 +1,79 @@
+package scrobble
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scrobbles.json")
+	q, err := NewQueue(path)
+	require.NoError(t, err)
+	listens := testListens(4)
+
+	require.NoError(t, q.Add(
+		Pending{User: "fred", Client: "lb", Listen: listens[0]},
+		Pending{User: "fred", Client: "lastfm", Listen: listens[0]},
+		Pending{User: "wilma", Client: "lb", Listen: listens[1]},
+	))
+	require.NoError(t, q.Add(Pending{User: "fred", Client: "lb", Listen: listens[2]}))
+	require.NoError(t, q.Add(Pending{User: "fred", Client: "lb", Listen: listens[3]}))
+	assert.Equal(t, 5, q.Len())
+
+	t.Run("Peek", func(t *testing.T) {
+		assert.Equal(t, []Listen{listens[0], listens[2]}, q.Peek("fred", "lb", 2))
+		assert.Equal(t, []Listen{listens[0], listens[2], listens[3]}, q.Peek("fred", "lb", 10))
+		assert.Equal(t, []Listen{listens[1]}, q.Peek("wilma", "lb", 10))
+		assert.Empty(t, q.Peek("barney", "lb", 10))
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		require.NoError(t, q.Remove("fred", "lb", 2))
+		assert.Equal(t, []Listen{listens[3]}, q.Peek("fred", "lb", 10))
+		assert.Equal(t, []Listen{listens[0]}, q.Peek("fred", "lastfm", 10))
+
+		removed, err := q.RemoveFunc(func(p Pending) bool { return p.User == "wilma" })
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Equal(t, 2, q.Len())
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		reloaded, err := NewQueue(path)
+		require.NoError(t, err)
+		assert.Equal(t, 2, reloaded.Len())
+		assert.Equal(t, q.Peek("fred", "lb", 10), reloaded.Peek("fred", "lb", 10))
+		assert.Equal(t, q.Peek("fred", "lastfm", 10), reloaded.Peek("fred", "lastfm", 10))
+	})
+
+	t.Run("BadFile", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "scrobbles.json")
+		require.NoError(t, os.WriteFile(bad, []byte("not JSON"), 0o600))
+		_, err := NewQueue(bad)
+		assert.Error(t, err)
+	})
+
+	t.Run("SaveFails", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "scrobbles")
+		require.NoError(t, os.Mkdir(dir, 0o700))
+		q, err := NewQueue(filepath.Join(dir, "scrobbles.json"))
+		require.NoError(t, err)
+		require.NoError(t, q.Add(Pending{User: "fred", Client: "lb", Listen: listens[0]}))
+
+		// The directory has gone, so the listen can't be saved, and isn't queued.
+		require.NoError(t, os.RemoveAll(dir))
+		assert.Error(t, q.Add(Pending{User: "fred", Client: "lb", Listen: listens[1]}))
+		assert.Equal(t, []Listen{listens[0]}, q.Peek("fred", "lb", 10))
+	})
+
+	t.Run("InMemory", func(t *testing.T) {
+		q, err := NewQueue("")
+		require.NoError(t, err)
+		require.NoError(t, q.Add(Pending{User: "fred", Client: "lb", Listen: listens[0]}))
+		assert.Equal(t, 1, q.Len())
+	})
+}
@@ -0,0 +1,13 @@
+package scrobble
+
+import (
+	"context"
+	"time"
+)
+
+type ScrobbleService interface {
+	NowPlaying(ctx context.Context, user string, listen Listen) error // Tell the user's services; not retried, since it's soon out of date
+	Scrobble(user string, listen Listen) error                        // Queue a listen for the user's services
+	Flush(ctx context.Context) error                                  // Submit the queued listens, keeping those that can't be submitted yet
+	Run(ctx context.Context, retryInterval time.Duration)             // Submit queued listens in the background, until ctx is done
+}
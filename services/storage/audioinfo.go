@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	flac "github.com/go-flac/go-flac/v2"
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// AudioInfo describes the audio in a media file, rather than what's in it.
+// Zero means unknown.
+type AudioInfo struct {
+	Duration time.Duration
+	Bitrate  int // Average bits per second; may be estimated from the file size
+}
+
+// Work out whichever of the duration and bitrate is missing from the other one.
+func completeAudioInfo(info AudioInfo, size int64) AudioInfo {
+	switch {
+	case info.Bitrate == 0 && info.Duration > 0:
+		info.Bitrate = int(float64(size*8) / info.Duration.Seconds())
+	case info.Duration == 0 && info.Bitrate > 0:
+		info.Duration = time.Duration(float64(size*8) / float64(info.Bitrate) * float64(time.Second))
+	}
+	return info
+}
+
+func samplesDuration(samples int64, sampleRate int) time.Duration {
+	if samples <= 0 || sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(samples) / float64(sampleRate) * float64(time.Second))
+}
+
+// Read the audio info from an OGG file. The length is only known
+// if the whole stream can be seeked.
+func readOggAudioInfo(r io.Reader) (AudioInfo, error) {
+	oggfile, err := oggvorbis.NewReader(r)
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	return AudioInfo{
+		Duration: samplesDuration(oggfile.Length(), oggfile.SampleRate()),
+		Bitrate:  oggfile.Bitrate().Nominal,
+	}, nil
+}
+
+// Read the audio info from the STREAMINFO block of a FLAC file.
+func readFlacAudioInfo(r io.Reader) (AudioInfo, error) {
+	flacfile, err := flac.ParseMetadata(r)
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	streamInfo, err := flacfile.GetStreamInfo()
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	return AudioInfo{Duration: samplesDuration(streamInfo.SampleCount, streamInfo.SampleRate)}, nil
+}
+
+// MPEG audio layer III bitrates in kbit/s, by bitrate index.
+var (
+	mpeg1Bitrates = [15]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mpeg2Bitrates = [15]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+)
+
+// How far into an MP3 file to look for the first frame, after any ID3v2 tag.
+const maxMP3FrameSearch = 64 * 1024
+
+// Read the audio info from the first frame of an MP3 file. The duration
+// of VBR files comes from the Xing or Info header, if there is one;
+// otherwise the file is assumed to have a constant bitrate.
+func readMP3AudioInfo(r io.Reader) (AudioInfo, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return AudioInfo{}, err
+	}
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		// The tag size is a "syncsafe" integer, with 7 bits in each byte.
+		tagSize := int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 | int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f)
+		if _, err := io.CopyN(io.Discard, r, tagSize); err != nil {
+			return AudioInfo{}, err
+		}
+		header = header[:0]
+	}
+
+	buf := make([]byte, maxMP3FrameSearch)
+	n, err := io.ReadFull(r, buf[copy(buf, header):])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return AudioInfo{}, err
+	}
+	buf = buf[:n+len(header)]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := (buf[i+1] >> 3) & 0x3 // 0: MPEG 2.5, 2: MPEG 2, 3: MPEG 1
+		layer := (buf[i+1] >> 1) & 0x3   // 1: layer III
+		bitrateIndex := buf[i+2] >> 4
+		sampleRateIndex := (buf[i+2] >> 2) & 0x3
+		if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			continue
+		}
+
+		sampleRate := []int{44100, 48000, 32000}[sampleRateIndex]
+		bitrate := mpeg1Bitrates[bitrateIndex]
+		samplesPerFrame := int64(1152)
+		sideInfoLen := 32
+		mono := buf[i+3]>>6 == 3
+		if mono {
+			sideInfoLen = 17
+		}
+		if version != 3 {
+			sampleRate /= 2
+			if version == 0 {
+				sampleRate /= 2
+			}
+			bitrate = mpeg2Bitrates[bitrateIndex]
+			samplesPerFrame = 576
+			sideInfoLen = 17
+			if mono {
+				sideInfoLen = 9
+			}
+		}
+
+		// A Xing or Info header in the first frame has the number of frames.
+		xing := buf[min(i+4+sideInfoLen, len(buf)):]
+		if len(xing) >= 12 && (bytes.HasPrefix(xing, []byte("Xing")) || bytes.HasPrefix(xing, []byte("Info"))) {
+			flags := binary.BigEndian.Uint32(xing[4:8])
+			if flags&0x1 != 0 {
+				frames := int64(binary.BigEndian.Uint32(xing[8:12]))
+				return AudioInfo{Duration: samplesDuration(frames*samplesPerFrame, sampleRate)}, nil
+			}
+		}
+		return AudioInfo{Bitrate: bitrate * 1000}, nil
+	}
+	return AudioInfo{}, errors.New("unable to find an MP3 frame")
+}
+
+// Read the audio info from a media file. It's best effort: anything
+// that can't be worked out from the headers is left as zero.
+func readAudioInfo(r io.Reader, mimeType string, size int64) (AudioInfo, error) {
+	var info AudioInfo
+	var err error
+	switch mimeType {
+	case OggMimeType:
+		info, err = readOggAudioInfo(r)
+	case FlacMimeType:
+		info, err = readFlacAudioInfo(r)
+	case MP3MimeType:
+		info, err = readMP3AudioInfo(r)
+	case MP4MimeType:
+		return AudioInfo{}, nil // TODO: implement MP4 audio info
+	default:
+		return AudioInfo{}, fmt.Errorf("unable to read audio info for MIME type %s", mimeType)
+	}
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	return completeAudioInfo(info, size), nil
+}
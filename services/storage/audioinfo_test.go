@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAudioInfo(t *testing.T) {
+	tests := []struct {
+		location string
+		mimeType string
+		info     AudioInfo
+	}{
+		// Nominal bitrate from the Vorbis header, and the length of the stream.
+		{"Album1/track1-example.ogg", OggMimeType, AudioInfo{Duration: 6104036281, Bitrate: 160003}},
+		// Duration from STREAMINFO, bitrate from the file size.
+		{"Album1/track2-example.flac", FlacMimeType, AudioInfo{Duration: 6119909297, Bitrate: 1281100}},
+		// Duration from the Xing header, bitrate from the file size.
+		{"Album2/track2-example.mp3", MP3MimeType, AudioInfo{Duration: 6164897959, Bitrate: 209744}},
+	}
+	for _, test := range tests {
+		t.Run(test.location, func(t *testing.T) {
+			data, err := os.ReadFile("../../testdata/services/storage/diskstorage/Music/cds/Artist/" + test.location)
+			require.NoError(t, err)
+			info, err := readAudioInfo(bytes.NewReader(data), test.mimeType, int64(len(data)))
+			require.NoError(t, err)
+			assert.Equal(t, test.info, info)
+		})
+	}
+
+	t.Run("ConstantBitrateMP3", func(t *testing.T) {
+		// No ID3 tag, and a frame header for MPEG 1 layer III, 128 kbit/s, 44.1 kHz, stereo.
+		data := append([]byte{0x00, 0x00, 0xff, 0xfb, 0x90, 0x00}, make([]byte, 16000-6)...)
+		info, err := readAudioInfo(bytes.NewReader(data), MP3MimeType, int64(len(data)))
+		require.NoError(t, err)
+		assert.Equal(t, AudioInfo{Duration: time.Second, Bitrate: 128000}, info)
+	})
+
+	t.Run("NotAnMP3", func(t *testing.T) {
+		data := []byte("not an mp3 file")
+		_, err := readAudioInfo(bytes.NewReader(data), MP3MimeType, int64(len(data)))
+		assert.Error(t, err)
+	})
+
+	t.Run("MP4", func(t *testing.T) {
+		info, err := readAudioInfo(bytes.NewReader(nil), MP4MimeType, 0)
+		require.NoError(t, err)
+		assert.Zero(t, info)
+	})
+}
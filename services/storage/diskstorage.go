@@ -6,18 +6,21 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/google/uuid"
+	"sync"
+	"time"
 )
 
 type DiskStorage struct {
 	ID       string
+	Options  Options
 	BasePath string
 	Regexps  []string
 
@@ -28,12 +31,36 @@ type DiskStorage struct {
 
 	sortedTracks    []Track
 	sortedPlaylists []Playlist
+
+	scanReportMu sync.Mutex
+	scanReport   []ScanProblem // Problems found during the last scan
+	scanStats    ScanStats
 }
 
 func (ds *DiskStorage) GetID() string {
 	return ds.ID
 }
 
+func (ds *DiskStorage) GetName() string {
+	return ds.Options.Name
+}
+
+func (ds *DiskStorage) GetOptions() Options {
+	return ds.Options
+}
+
+func (ds *DiskStorage) GetScanReport() []ScanProblem {
+	ds.scanReportMu.Lock()
+	defer ds.scanReportMu.Unlock()
+	return ds.scanReport
+}
+
+func (ds *DiskStorage) GetScanStats() ScanStats {
+	ds.scanReportMu.Lock()
+	defer ds.scanReportMu.Unlock()
+	return ds.scanStats
+}
+
 // Find the tracks in this storage, and return the tracks
 // in a stable order.
 func (ds *DiskStorage) FindTracks() ([]Track, []Playlist, error) {
@@ -43,6 +70,8 @@ func (ds *DiskStorage) FindTracks() ([]Track, []Playlist, error) {
 		ds.tracksByID, ds.playlistsByID, err = ds.buildTracks()
 	}
 	if err != nil {
+		// Scan again next time, rather than returning a partial scan.
+		ds.tracksByID, ds.playlistsByID = nil, nil
 		return nil, nil, err
 	}
 	if ds.sortedTracks == nil {
@@ -169,10 +198,19 @@ func (ds *DiskStorage) matchLocation(location string) *Track {
 	return t
 }
 
+// How a track's artist, album and title were determined.
+const (
+	AnnotatedByTags     = "tags"
+	AnnotatedByRegex    = "regex"
+	AnnotatedByLocation = "location"
+)
+
 // TODO: Probably would be cleaner to have this build the track completely
 // given some input data?
-func (ds *DiskStorage) annotateTrack(track *Track) {
+func (ds *DiskStorage) annotateTrack(track *Track) string {
+	strategy := AnnotatedByLocation
 	var artist, album, albumArtist, albumId, title string
+	var trackNumber, discNumber int
 
 	// Default playlist location is the directory containing the file.
 	// This may be overridden below.
@@ -186,10 +224,11 @@ func (ds *DiskStorage) annotateTrack(track *Track) {
 		album = track.Tags.Album
 		albumArtist = track.Tags.AlbumArtist
 		albumId = track.Tags.AlbumId
-		// TODO: track number
+		trackNumber = track.Tags.TrackNumber
+		discNumber = track.Tags.DiscNumber
 		title = track.Tags.Title
 
-		// TODO: track number, and use that to position in playlists.
+		// TODO: use the track number to position in playlists.
 
 		// Heuristic: If the album artist wasn't determined by tags or regex,
 		// use the directory name. But only when the filename is like
@@ -213,6 +252,7 @@ func (ds *DiskStorage) annotateTrack(track *Track) {
 		}
 
 		playlistLocation = "tags:" + filepath.Join(ds.BasePath, artistPath, album)
+		strategy = AnnotatedByTags
 	}
 
 	// Strategy 2: Regular expression matching (if enabled for this storage instance).
@@ -221,7 +261,7 @@ func (ds *DiskStorage) annotateTrack(track *Track) {
 			album = t.Album
 			artist = t.Artist
 			title = t.Title
-			// TODO: track number
+			trackNumber = t.TrackNumber
 			if t.AlbumArtist != "" {
 				albumArtist = t.AlbumArtist
 			}
@@ -233,6 +273,7 @@ func (ds *DiskStorage) annotateTrack(track *Track) {
 			}
 
 			playlistLocation = "regex:" + filepath.Join(ds.BasePath, artistPath, album)
+			strategy = AnnotatedByRegex
 		}
 	}
 
@@ -256,6 +297,11 @@ func (ds *DiskStorage) annotateTrack(track *Track) {
 	track.AlbumArtist = albumArtist
 	track.AlbumId = albumId
 	track.Title = title
+	track.TrackNumber = trackNumber
+	track.DiscNumber = discNumber
+	track.Genre = track.Tags.Genre
+	track.Year = track.Tags.Year
+	track.Rating = track.Tags.Rating
 
 	// Determine if the track name should include the track's artist,
 	// for multi-artist albums.
@@ -266,57 +312,290 @@ func (ds *DiskStorage) annotateTrack(track *Track) {
 	}
 
 	track.PlaylistLocation = playlistLocation
+	return strategy
 }
 
-func (ds *DiskStorage) buildTracks() (map[string]Track, map[string]Playlist, error) {
-	tracksByID := make(map[string]Track, 0)
+// openFile opens a file for reading; tests replace it to simulate read errors.
+var openFile = func(name string) (io.ReadSeekCloser, error) {
+	return os.Open(name)
+}
+
+// Read the tags and audio info from a file on disk. The audio info is
+// best effort, so problems reading it aren't errors. Network shares can
+// fail part way through reading a file, so the whole file is read again
+// if the error policy is to retry.
+func readFileTags(location string, mimeType string, size int64, options Options) (Tags, AudioInfo, error) {
+	var tags Tags
+	var info AudioInfo
+	err := options.retry(func() error {
+		r, err := openFile(location)
+		if err != nil {
+			return &scanError{stage: ScanStageOpen, err: err}
+		}
+		defer r.Close()
+
+		// TODO: move tags handling into common code for storage engines
+		tags, err = readTags(r, mimeType)
+		if err != nil {
+			return &scanError{stage: ScanStageTags, err: err}
+		}
+
+		info = AudioInfo{}
+		if _, err := r.Seek(0, io.SeekStart); err == nil {
+			info, err = readAudioInfo(r, mimeType, size)
+			if err != nil {
+				slog.Debug("Unable to read audio info", "location", location, "error", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Tags{}, AudioInfo{}, err
+	}
+	return tags, info, nil
+}
+
+// Record a problem with a file in the scan report.
+func (ds *DiskStorage) reportProblem(location string, err error, action string) {
+	stage := ScanStageWalk
+	var sErr *scanError
+	if errors.As(err, &sErr) {
+		stage = sErr.stage
+		err = sErr.err
+	}
+
+	slog.Warn("Problem scanning file", "storage", ds.Options.Name, "location", location,
+		"stage", stage, "action", action, "error", err)
+	ds.scanReportMu.Lock()
+	defer ds.scanReportMu.Unlock()
+	ds.scanReport = append(ds.scanReport, ScanProblem{
+		Location: location,
+		Stage:    stage,
+		Action:   action,
+		Error:    err.Error(),
+		Time:     time.Now(),
+	})
+}
+
+// Build the track for a file. Files with tags that can't be read
+// are still included, unless the error policy is ErrorPolicyFail;
+// they are annotated using their location instead.
+func (ds *DiskStorage) scanFile(location string, mimeType string) (Track, error) {
+	var fileinfo fs.FileInfo
+	err := ds.Options.retry(func() error {
+		var err error
+		fileinfo, err = os.Stat(location)
+		return err
+	})
+	if err != nil {
+		return Track{}, &scanError{stage: ScanStageStat, err: err}
+	}
+
+	tags, info, err := readFileTags(location, mimeType, fileinfo.Size(), ds.Options)
+	if err != nil {
+		var sErr *scanError
+		if ds.Options.errorPolicy() == ErrorPolicyFail || !errors.As(err, &sErr) || sErr.stage != ScanStageTags {
+			return Track{}, err
+		}
+		ds.reportProblem(location, err, ScanActionUntagged)
+		tags = Tags{}
+	}
+
+	track := Track{
+		ID:       locationToUUIDString(location),
+		Location: location,
+		MIMEType: mimeType,
+		DataLen:  fileinfo.Size(),
+		ModTime:  fileinfo.ModTime(),
+		Version:  fileVersion(fileinfo.ModTime(), fileinfo.Size()),
+		Duration: info.Duration,
+		Bitrate:  info.Bitrate,
+		Tags:     tags,
+	}
+	ds.annotateTrack(&track)
+	return track, nil
+}
+
+// InspectFile reads the tags from a single file, and annotates it
+// in the same way as a scan would, without adding it to the storage.
+// It returns the track, and how the track was annotated. This is for
+// debugging why a track shows up in the wrong playlist.
+func (ds *DiskStorage) InspectFile(location string) (Track, string, error) {
+	fileinfo, err := os.Stat(location)
+	if err != nil {
+		return Track{}, "", err
+	}
+	if fileinfo.IsDir() {
+		return Track{}, "", fmt.Errorf("%s is a directory", location)
+	}
+
+	mimeType := getMIMEType(location)
+	if ignoreMIMEType(mimeType) {
+		return Track{}, "", fmt.Errorf("%s is not a supported type of file", location)
+	}
+	tags, info, err := readFileTags(location, mimeType, fileinfo.Size(), ds.Options)
+	if err != nil {
+		var sErr *scanError
+		if errors.As(err, &sErr) {
+			err = sErr.err
+		}
+		return Track{}, "", err
+	}
+
+	track := Track{
+		ID:       locationToUUIDString(location),
+		Location: location,
+		MIMEType: mimeType,
+		DataLen:  fileinfo.Size(),
+		ModTime:  fileinfo.ModTime(),
+		Version:  fileVersion(fileinfo.ModTime(), fileinfo.Size()),
+		Duration: info.Duration,
+		Bitrate:  info.Bitrate,
+		Tags:     tags,
+	}
+	strategy := ds.annotateTrack(&track)
+	return track, strategy, nil
+}
 
+// A file found while walking the storage, to be scanned by a worker.
+type scanJob struct {
+	location string
+	mimeType string
+}
+
+type scanResult struct {
+	location string
+	track    Track
+	err      error
+}
+
+// Returned by the walk when scanning is stopped early.
+var errScanStopped = errors.New("scan stopped")
+
+// Walk the storage, sending each file to be scanned to jobs,
+// until the walk is done or stop is closed.
+// The number of files ignored is stored in ignored.
+func (ds *DiskStorage) walk(jobs chan<- scanJob, stop <-chan struct{}, ignored *int) error {
+	failOnError := ds.Options.errorPolicy() == ErrorPolicyFail
 	fileSystem := os.DirFS(ds.BasePath)
 
-	walkErr := fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
+	return fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
+		location := filepath.Join(ds.BasePath, path)
 		if err != nil {
-			return err
+			// If the top-level directory can't be read, there's no point carrying on.
+			if path == "." || failOnError {
+				return err
+			}
+			ds.reportProblem(location, err, ScanActionSkipped)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if path != "." && ds.Options.isIgnored(path) {
+			slog.Debug("Ignoring file due to ignore patterns", "storage", ds.Options.Name, "location", location)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			*ignored++
+			return nil
 		}
 		if d.IsDir() {
 			return nil
 		}
-		location := filepath.Join(ds.BasePath, path)
-		trackUUID := locationToUUIDString(location)
 
 		// Ignore some unknown MIME types
 		mimeType := getMIMEType(d.Name())
 		if ignoreMIMEType(mimeType) {
-			fmt.Printf("Ignoring file due to MIME type: %s\n", location)
+			slog.Debug("Ignoring file due to MIME type", "storage", ds.Options.Name, "location", location)
+			*ignored++
 			return nil
 		}
 
-		fileinfo, err := os.Stat(location)
-		if err != nil {
-			return err
+		select {
+		case jobs <- scanJob{location: location, mimeType: mimeType}:
+			return nil
+		case <-stop:
+			return errScanStopped
 		}
+	})
+}
 
-		// TODO: move tags handling into common code for storage engines
-		r, err := os.Open(location)
-		if err != nil {
-			return err
-		}
-		tags, err := readTags(r, mimeType)
-		if err != nil {
-			return err
-		}
+// Walk the storage and scan the files found using a pool of workers.
+// The directory walk itself is serial, but the stat and tag reads
+// for the files are done in parallel.
+func (ds *DiskStorage) buildTracks() (map[string]Track, map[string]Playlist, error) {
+	start := time.Now()
+	tracksByID := make(map[string]Track, 0)
+	ds.scanReportMu.Lock()
+	ds.scanReport = make([]ScanProblem, 0)
+	ds.scanReportMu.Unlock()
+	failOnError := ds.Options.errorPolicy() == ErrorPolicyFail
+
+	slog.Debug("Scanning storage", "storage", ds.Options.Name, "path", ds.BasePath,
+		"concurrency", ds.Options.concurrency())
+
+	jobs := make(chan scanJob)
+	results := make(chan scanResult)
+	stop := make(chan struct{})
+
+	var workers sync.WaitGroup
+	for i := 0; i < ds.Options.concurrency(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				track, err := ds.scanFile(job.location, job.mimeType)
+				if err == nil {
+					slog.Debug("Scanned file", "storage", ds.Options.Name, "location", job.location, "trackID", track.ID)
+				}
+				results <- scanResult{location: job.location, track: track, err: err}
+			}
+		}()
+	}
 
-		track := Track{
-			ID:       trackUUID,
-			Location: location,
-			MIMEType: mimeType,
-			DataLen:  fileinfo.Size(),
-			Tags:     tags,
+	ignored := 0
+	walkErrCh := make(chan error, 1)
+	go func() {
+		walkErrCh <- ds.walk(jobs, stop, &ignored)
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	var scanErr error
+	for result := range results {
+		if result.err != nil {
+			if failOnError {
+				// Stop at the first problem, but keep draining the results
+				// so that the workers can finish.
+				if scanErr == nil {
+					scanErr = fmt.Errorf("%s: %w", result.location, result.err)
+					close(stop)
+				}
+				continue
+			}
+			ds.reportProblem(result.location, result.err, ScanActionSkipped)
+			continue
 		}
-		ds.annotateTrack(&track)
-		tracksByID[track.ID] = track
+		tracksByID[result.track.ID] = result.track
+	}
 
-		return nil
+	walkErr := <-walkErrCh
+	if scanErr != nil {
+		walkErr = scanErr
+	}
+
+	// Problems are found in whatever order the workers get to them.
+	ds.scanReportMu.Lock()
+	sort.SliceStable(ds.scanReport, func(i int, j int) bool {
+		return ds.scanReport[i].Location < ds.scanReport[j].Location
 	})
+	ds.scanStats = ScanStats{
+		Duration: time.Since(start),
+		Ignored:  ignored,
+	}
+	ds.scanReportMu.Unlock()
 
 	playlistsByID, err := buildPlaylists(tracksByID)
 	if err != nil {
@@ -379,24 +658,63 @@ func (ds *DiskStorage) buildSortedTracks() ([]Track, []Playlist) {
 func (ds *DiskStorage) ReadTrack(id string) (io.Reader, error) {
 	track, ok := ds.tracksByID[id]
 	if !ok {
-		// TODO: look at standardizing errors
-		return nil, errors.New("track not found")
+		return nil, fmt.Errorf("%w: track %s", ErrNotFound, id)
 	}
 
 	// TODO: figure out some way to return a reader that reads in the file in chunks
-	data, err := os.ReadFile(track.Location)
+	var data []byte
+	err := ds.Options.retry(func() error {
+		r, err := openFile(track.Location)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err = io.ReadAll(r)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, readError(track.Location, err)
 	}
 	return bytes.NewReader(data), nil
 }
 
+// The named groups that can be used in regular expressions for matching filenames.
+var RegexpGroups = []string{"albumartist", "album", "trackno", "artist", "title"}
+
+// CompileRegexp compiles a regular expression for matching filenames,
+// and checks that it uses at least one of the named groups in RegexpGroups.
+// Other named groups are allowed, but aren't used.
+func CompileRegexp(r string) (*regexp.Regexp, error) {
+	c, err := regexp.Compile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	named, recognised := 0, 0
+	for _, name := range c.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		named++
+		if slices.Contains(RegexpGroups, name) {
+			recognised++
+		}
+	}
+	if named == 0 {
+		return nil, fmt.Errorf("regexp %s: no named groups, expected one or more of %s", r, strings.Join(RegexpGroups, ", "))
+	}
+	if recognised == 0 {
+		return nil, fmt.Errorf("regexp %s: no recognised named groups, expected one or more of %s", r, strings.Join(RegexpGroups, ", "))
+	}
+	return c, nil
+}
+
 func (ds *DiskStorage) setRegexps(regexps []string) error {
 	ds.Regexps = make([]string, 0)
 	ds.compiledRegexps = make([]*regexp.Regexp, 0)
 
 	for _, r := range regexps {
-		c, err := regexp.Compile(r)
+		c, err := CompileRegexp(r)
 		if err != nil {
 			// TODO: perhaps this should be a non-fatal error during start-up -
 			// log a warning but carry on?
@@ -409,7 +727,12 @@ func (ds *DiskStorage) setRegexps(regexps []string) error {
 	return nil
 }
 
-func NewDiskStorage(path string, regexps []string) (*DiskStorage, error) {
+func NewDiskStorage(path string, regexps []string, options Options) (*DiskStorage, error) {
+	options = options.withDefaultName(path)
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
 	fileinfo, err := os.Stat(path)
 	if err != nil {
 		return nil, err
@@ -419,7 +742,8 @@ func NewDiskStorage(path string, regexps []string) (*DiskStorage, error) {
 	}
 
 	ds := &DiskStorage{
-		ID:       uuid.NewString(),
+		ID:       NameToID(options.Name),
+		Options:  options,
 		BasePath: path,
 	}
 	err = ds.setRegexps(regexps)
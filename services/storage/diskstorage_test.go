@@ -1,12 +1,15 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"regexp/syntax"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -25,8 +28,15 @@ var mp3Regexps = []string{
 	"(?P<artist>.+) - (?P<album>.+) \\((?P<trackno>\\d+)\\) - (?P<title>.+)",
 }
 
+// modTime returns the modification time of a test file, which depends on when it was checked out.
+func modTime(t *testing.T, location string) time.Time {
+	fileinfo, err := os.Stat(location)
+	require.NoError(t, err)
+	return fileinfo.ModTime()
+}
+
 func TestDiskStorage(t *testing.T) {
-	s, err := NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{})
+	s, err := NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, Options{})
 	require.NoError(t, err)
 
 	t.Run("GetID", func(t *testing.T) {
@@ -55,6 +65,8 @@ func TestDiskStorage(t *testing.T) {
 				Artist:      "the-artist",
 				Album:       "album1",
 				AlbumArtist: "Artist",
+				Genre:       "Example",
+				TrackNumber: 1,
 
 				PlaylistLocation: "tags:../../testdata/services/storage/diskstorage/Music/cds/Artist/album1",
 
@@ -64,6 +76,10 @@ func TestDiskStorage(t *testing.T) {
 				Location: "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track1-example.ogg",
 				MIMEType: "audio/ogg",
 				DataLen:  105354,
+				ModTime:  modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track1-example.ogg"),
+				Version:  fileVersion(modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track1-example.ogg"), 105354),
+				Duration: 6104036281,
+				Bitrate:  160003,
 			},
 			{
 				Name:        "the-artist :: ALBUM1_TRACK2_EXAMPLE",
@@ -71,6 +87,8 @@ func TestDiskStorage(t *testing.T) {
 				Artist:      "the-artist",
 				Album:       "album1",
 				AlbumArtist: "Artist",
+				Genre:       "ExampleMulti-value",
+				TrackNumber: 2,
 
 				PlaylistLocation: "tags:../../testdata/services/storage/diskstorage/Music/cds/Artist/album1",
 
@@ -80,6 +98,10 @@ func TestDiskStorage(t *testing.T) {
 				Location: "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track2-example.flac",
 				MIMEType: "audio/flac",
 				DataLen:  980027,
+				ModTime:  modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track2-example.flac"),
+				Version:  fileVersion(modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track2-example.flac"), 980027),
+				Duration: 6119909297,
+				Bitrate:  1281100,
 			},
 			{
 				Name:        "another-artist :: ALBUM2_TRACK1_EXAMPLE",
@@ -96,6 +118,10 @@ func TestDiskStorage(t *testing.T) {
 				Location: "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track1-example.ogg",
 				MIMEType: "audio/ogg",
 				DataLen:  105324,
+				ModTime:  modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track1-example.ogg"),
+				Version:  fileVersion(modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track1-example.ogg"), 105324),
+				Duration: 6104036281,
+				Bitrate:  160003,
 			},
 			// TODO: fix tags to not contain nuls - may need a changeset from a PR on id3-go
 			{
@@ -104,15 +130,21 @@ func TestDiskStorage(t *testing.T) {
 				Artist:      "the-artist\x00",
 				Album:       "album1\x00",
 				AlbumArtist: "the-artist\x00",
+				Genre:       "Example;Multi-value\x00",
+				TrackNumber: 2,
 
 				PlaylistLocation: "tags:../../testdata/services/storage/diskstorage/Music/cds/the-artist\x00/album1\x00",
 
-				Tags: Tags{Title: "ALBUM1_TRACK2_EXAMPLE\x00", Album: "album1\x00", AlbumArtist: "the-artist\x00", Artist: "the-artist\x00", Genre: "Example;Multi-value\x00"},
+				Tags: Tags{Title: "ALBUM1_TRACK2_EXAMPLE\x00", Album: "album1\x00", AlbumArtist: "the-artist\x00", Artist: "the-artist\x00", Genre: "Example;Multi-value\x00", TrackNumber: 2},
 
 				ID:       trackIDs[3],
 				Location: "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track2-example.mp3",
 				MIMEType: "audio/mp3",
 				DataLen:  161632,
+				ModTime:  modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track2-example.mp3"),
+				Version:  fileVersion(modTime(t, "../../testdata/services/storage/diskstorage/Music/cds/Artist/Album2/track2-example.mp3"), 161632),
+				Duration: 6164897959,
+				Bitrate:  209744,
 			},
 		}, tracks)
 
@@ -200,13 +232,13 @@ func TestDiskStorage(t *testing.T) {
 
 	t.Run("ReadTrackNotFound", func(t *testing.T) {
 		_, err := s.ReadTrack("nope")
-		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
 	})
 }
 
 func TestDiskStorageFailures(t *testing.T) {
 	t.Run("BadPath", func(t *testing.T) {
-		s, err := NewDiskStorage("./__DOES_NOT_EXIST__", []string{})
+		s, err := NewDiskStorage("./__DOES_NOT_EXIST__", []string{}, Options{})
 		require.Error(t, err)
 		var pErr *fs.PathError
 		require.ErrorAs(t, err, &pErr)
@@ -217,12 +249,87 @@ func TestDiskStorageFailures(t *testing.T) {
 	t.Run("BadRegexps", func(t *testing.T) {
 		s, err := NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{
 			"(?P<incomplete", "(?Pperllooking[^-]+)",
-		})
+		}, Options{})
 		require.Error(t, err)
 		var pErr *syntax.Error
 		require.ErrorAs(t, err, &pErr)
 		require.Nil(t, s)
 	})
+
+	t.Run("BadRegexpGroups", func(t *testing.T) {
+		// Groups which aren't recognised are allowed, as long as there is one that is.
+		_, err := NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{
+			"(?P<artist>.+) - (?P<year>[0-9]+) - (?P<title>.+)",
+		}, Options{})
+		assert.NoError(t, err)
+
+		_, err = NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{
+			"(?P<year>[0-9]+) - (?P<tilte>.+)",
+		}, Options{})
+		assert.ErrorContains(t, err, "no recognised named groups")
+
+		_, err = NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{
+			"(.+) - (.+)",
+		}, Options{})
+		assert.ErrorContains(t, err, "no named groups")
+	})
+
+	t.Run("BadIgnorePatterns", func(t *testing.T) {
+		s, err := NewDiskStorage("../../testdata/services/storage/diskstorage/Music/cds", []string{}, Options{
+			IgnorePatterns: []string{"[unterminated"},
+		})
+		require.Error(t, err)
+		require.Nil(t, s)
+	})
+}
+
+func TestDiskStorageOptions(t *testing.T) {
+	path := "../../testdata/services/storage/diskstorage/Music/cds"
+
+	t.Run("DefaultName", func(t *testing.T) {
+		s, err := NewDiskStorage(path, []string{}, Options{})
+		require.NoError(t, err)
+		assert.Equal(t, path, s.GetName())
+	})
+
+	t.Run("NamedStableID", func(t *testing.T) {
+		s1, err := NewDiskStorage(path, []string{}, Options{Name: "cds"})
+		require.NoError(t, err)
+		s2, err := NewDiskStorage(path, []string{}, Options{Name: "cds"})
+		require.NoError(t, err)
+		s3, err := NewDiskStorage(path, []string{}, Options{Name: "other"})
+		require.NoError(t, err)
+
+		assert.Equal(t, "cds", s1.GetName())
+		assert.Equal(t, NameToID("cds"), s1.GetID())
+		assert.Equal(t, s1.GetID(), s2.GetID())
+		assert.NotEqual(t, s1.GetID(), s3.GetID())
+	})
+
+	t.Run("IgnorePatterns", func(t *testing.T) {
+		s, err := NewDiskStorage(path, []string{}, Options{
+			IgnorePatterns: []string{"*.mp3", "Artist/Album1/track1-*"},
+		})
+		require.NoError(t, err)
+
+		tracks, _, err := s.FindTracks()
+		require.NoError(t, err)
+		require.Len(t, tracks, 2)
+		assert.Equal(t, path+"/Artist/Album1/track2-example.flac", tracks[0].Location)
+		assert.Equal(t, path+"/Artist/Album2/track1-example.ogg", tracks[1].Location)
+		assert.Equal(t, 4, s.GetScanStats().Ignored) // Including the .txt files
+	})
+
+	t.Run("IgnoreDirectory", func(t *testing.T) {
+		s, err := NewDiskStorage(path, []string{}, Options{
+			IgnorePatterns: []string{"Album2"},
+		})
+		require.NoError(t, err)
+
+		tracks, _, err := s.FindTracks()
+		require.NoError(t, err)
+		assert.Len(t, tracks, 2)
+	})
 }
 
 func TestIsTrackByAlbumArtist(t *testing.T) {
@@ -501,14 +608,14 @@ func TestAnnotateTrack(t *testing.T) {
 		expectedTrack := track
 		expectedTrack.Title = "circles"
 		expectedTrack.Name = expectedTrack.Title
-		//expectedTrack.TrackNumber = 8 // TODO: track number
+		expectedTrack.TrackNumber = 8
 		expectedTrack.Artist = "adam f"
 		expectedTrack.Album = "colours"
 		expectedTrack.AlbumArtist = expectedTrack.Artist
 		expectedTrack.PlaylistLocation = "regex:" + filepath.Join(ds.BasePath, expectedTrack.Artist, expectedTrack.Album)
 
 		resultTrack := track
-		ds.annotateTrack(&resultTrack)
+		assert.Equal(t, AnnotatedByRegex, ds.annotateTrack(&resultTrack))
 		assert.Equal(t, expectedTrack, resultTrack)
 	})
 
@@ -523,6 +630,7 @@ func TestAnnotateTrack(t *testing.T) {
 		expectedTrack.Artist = "full moon scientist"
 		expectedTrack.Name = expectedTrack.Artist + " :: " + expectedTrack.Title // artist different from album artist
 		expectedTrack.Album = "botchit breaks (disc 01)"
+		expectedTrack.TrackNumber = 7
 		expectedTrack.AlbumArtist = "botchit & scarper"
 		expectedTrack.PlaylistLocation = "regex:" + filepath.Join(ds.BasePath, expectedTrack.AlbumArtist, expectedTrack.Album)
 
@@ -546,6 +654,7 @@ func TestAnnotateTrack(t *testing.T) {
 		expectedTrack.Name = expectedTrack.Title // because album artist and artist are actually the same
 		expectedTrack.Artist = "arcade fire"
 		expectedTrack.Album = "funeral"
+		expectedTrack.TrackNumber = 7
 		expectedTrack.AlbumArtist = "arcade fire"
 		expectedTrack.PlaylistLocation = "regex:" + filepath.Join(ds.BasePath, expectedTrack.AlbumArtist, expectedTrack.Album)
 
@@ -569,7 +678,245 @@ func TestAnnotateTrack(t *testing.T) {
 		expectedTrack.PlaylistLocation = filepath.Join(ds.BasePath, expectedTrack.AlbumArtist, expectedTrack.Album)
 
 		resultTrack := track
-		ds.annotateTrack(&resultTrack)
+		assert.Equal(t, AnnotatedByLocation, ds.annotateTrack(&resultTrack))
 		assert.Equal(t, expectedTrack, resultTrack)
 	})
 }
+
+// Create a storage directory with some problem files in it.
+func makeProblemStorage(t *testing.T) string {
+	dir := t.TempDir()
+	albumDir := filepath.Join(dir, "Artist", "Album")
+	require.NoError(t, os.MkdirAll(albumDir, 0o755))
+
+	data, err := os.ReadFile("../../testdata/services/storage/diskstorage/Music/cds/Artist/Album1/track1-example.ogg")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(albumDir, "01.good.ogg"), data, 0o644))
+
+	// Not a FLAC file, so tags can't be read.
+	require.NoError(t, os.WriteFile(filepath.Join(albumDir, "02.corrupt.flac"), []byte("not a flac file"), 0o644))
+
+	// Can't be stat'ed.
+	require.NoError(t, os.Symlink(filepath.Join(dir, "__DOES_NOT_EXIST__"), filepath.Join(albumDir, "03.missing.mp3")))
+
+	return dir
+}
+
+func TestDiskStorageErrorPolicies(t *testing.T) {
+	retryDelay = time.Millisecond
+	dir := makeProblemStorage(t)
+
+	t.Run("Skip", func(t *testing.T) {
+		s, err := NewDiskStorage(dir, []string{}, Options{ErrorPolicy: ErrorPolicySkip})
+		require.NoError(t, err)
+
+		tracks, playlists, err := s.FindTracks()
+		require.NoError(t, err)
+		require.Len(t, tracks, 2)
+		assert.Len(t, playlists, 2)
+
+		// The corrupt file is annotated from its location.
+		assert.Equal(t, filepath.Join(dir, "Artist/Album/02.corrupt.flac"), tracks[1].Location)
+		assert.Equal(t, "Artist", tracks[1].Artist)
+		assert.Equal(t, "Album", tracks[1].Album)
+		assert.Equal(t, "02.corrupt", tracks[1].Title)
+
+		report := s.GetScanReport()
+		require.Len(t, report, 2)
+		assert.Equal(t, filepath.Join(dir, "Artist/Album/02.corrupt.flac"), report[0].Location)
+		assert.Equal(t, ScanStageTags, report[0].Stage)
+		assert.Equal(t, ScanActionUntagged, report[0].Action)
+		assert.NotEmpty(t, report[0].Error)
+		assert.Equal(t, filepath.Join(dir, "Artist/Album/03.missing.mp3"), report[1].Location)
+		assert.Equal(t, ScanStageStat, report[1].Stage)
+		assert.Equal(t, ScanActionSkipped, report[1].Action)
+	})
+
+	t.Run("DefaultIsSkip", func(t *testing.T) {
+		s, err := NewDiskStorage(dir, []string{}, Options{})
+		require.NoError(t, err)
+		tracks, _, err := s.FindTracks()
+		require.NoError(t, err)
+		assert.Len(t, tracks, 2)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		s, err := NewDiskStorage(dir, []string{}, Options{ErrorPolicy: ErrorPolicyRetry, Retries: 2})
+		require.NoError(t, err)
+		tracks, _, err := s.FindTracks()
+		require.NoError(t, err)
+		assert.Len(t, tracks, 2)
+		assert.Len(t, s.GetScanReport(), 2)
+	})
+
+	t.Run("Fail", func(t *testing.T) {
+		s, err := NewDiskStorage(dir, []string{}, Options{ErrorPolicy: ErrorPolicyFail})
+		require.NoError(t, err)
+		_, _, err = s.FindTracks()
+		require.Error(t, err)
+	})
+
+	t.Run("BadPolicy", func(t *testing.T) {
+		_, err := NewDiskStorage(dir, []string{}, Options{ErrorPolicy: "ignore"})
+		require.Error(t, err)
+		_, err = NewDiskStorage(dir, []string{}, Options{Retries: -1})
+		require.Error(t, err)
+	})
+}
+
+// flakyFile is a file whose reads fail, like a file on a network share
+// that drops out part way through being read.
+type flakyFile struct {
+	io.ReadSeekCloser
+}
+
+func (f flakyFile) Read(p []byte) (int, error) {
+	return 0, errors.New("input/output error")
+}
+
+func TestDiskStorageRetryReads(t *testing.T) {
+	retryDelay = time.Millisecond
+	dir := makeProblemStorage(t)
+	goodLocation := filepath.Join(dir, "Artist/Album/01.good.ogg")
+
+	// The first reads of the good file fail, after it has been opened.
+	failures := 0
+	defaultOpenFile := openFile
+	t.Cleanup(func() { openFile = defaultOpenFile })
+	openFile = func(name string) (io.ReadSeekCloser, error) {
+		f, err := defaultOpenFile(name)
+		if err != nil || name != goodLocation {
+			return f, err
+		}
+		if failures == 0 {
+			return f, err
+		}
+		failures--
+		return flakyFile{f}, nil
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		failures = 2
+		s, err := NewDiskStorage(dir, []string{}, Options{ErrorPolicy: ErrorPolicyRetry})
+		require.NoError(t, err)
+		tracks, _, err := s.FindTracks()
+		require.NoError(t, err)
+		require.Len(t, tracks, 2)
+		assert.Equal(t, goodLocation, tracks[0].Location)
+		assert.NotEqual(t, "01.good", tracks[0].Title)
+		assert.Len(t, s.GetScanReport(), 2)
+
+		failures = 2
+		r, err := s.ReadTrack(tracks[0].ID)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, tracks[0].DataLen, int64(len(data)))
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		failures = 1
+		s, err := NewDiskStorage(dir, []string{}, Options{ErrorPolicy: ErrorPolicySkip})
+		require.NoError(t, err)
+		tracks, _, err := s.FindTracks()
+		require.NoError(t, err)
+		require.Len(t, tracks, 2)
+		assert.Equal(t, "01.good", tracks[0].Title)
+		report := s.GetScanReport()
+		require.Len(t, report, 3)
+		assert.Equal(t, goodLocation, report[0].Location)
+		assert.Equal(t, ScanStageTags, report[0].Stage)
+
+		failures = 1
+		_, err = s.ReadTrack(tracks[0].ID)
+		assert.ErrorIs(t, err, ErrUnavailable)
+	})
+}
+
+func TestDiskStorageConcurrency(t *testing.T) {
+	retryDelay = time.Millisecond
+	scan := func(path string, concurrency int) ([]Track, []Playlist, []ScanProblem) {
+		s, err := NewDiskStorage(path, []string{}, Options{Concurrency: concurrency})
+		require.NoError(t, err)
+		tracks, playlists, err := s.FindTracks()
+		require.NoError(t, err)
+		return tracks, playlists, s.GetScanReport()
+	}
+
+	// The output should be the same however many files are scanned at once.
+	for _, path := range []string{"../../testdata/services/storage/diskstorage/Music", makeProblemStorage(t)} {
+		serialTracks, serialPlaylists, serialReport := scan(path, 1)
+		require.NotEmpty(t, serialTracks)
+		for _, concurrency := range []int{2, 8} {
+			tracks, playlists, report := scan(path, concurrency)
+			assert.Equal(t, serialTracks, tracks, concurrency)
+			assert.Equal(t, serialPlaylists, playlists, concurrency)
+			require.Len(t, report, len(serialReport))
+			for i := range report {
+				assert.Equal(t, serialReport[i].Location, report[i].Location)
+				assert.Equal(t, serialReport[i].Stage, report[i].Stage)
+			}
+		}
+	}
+
+	t.Run("Fail", func(t *testing.T) {
+		s, err := NewDiskStorage(makeProblemStorage(t), []string{}, Options{ErrorPolicy: ErrorPolicyFail, Concurrency: 4})
+		require.NoError(t, err)
+		_, _, err = s.FindTracks()
+		require.Error(t, err)
+	})
+
+	_, err := NewDiskStorage("../../testdata/services/storage/diskstorage/Music", []string{}, Options{Concurrency: -1})
+	require.Error(t, err)
+}
+
+func TestInspectFile(t *testing.T) {
+	basePath := "../../testdata/services/storage/diskstorage/Music/cds"
+	ds, err := NewDiskStorage(basePath, []string{}, Options{})
+	require.NoError(t, err)
+
+	track, strategy, err := ds.InspectFile(filepath.Join(basePath, "Artist/Album1/track1-example.ogg"))
+	require.NoError(t, err)
+	assert.Equal(t, AnnotatedByTags, strategy)
+	assert.Equal(t, "ALBUM1_TRACK1_EXAMPLE", track.Title)
+	assert.Equal(t, "tags:"+filepath.Join(basePath, "Artist/album1"), track.PlaylistLocation)
+
+	// Inspecting a file doesn't add it to the storage.
+	tracks, _, err := ds.FindTracks()
+	require.NoError(t, err)
+	assert.Len(t, tracks, 4)
+
+	_, _, err = ds.InspectFile(filepath.Join(basePath, "Artist/Album1"))
+	assert.Error(t, err)
+	_, _, err = ds.InspectFile(filepath.Join(basePath, "Artist/Album1/example.txt"))
+	assert.Error(t, err)
+	_, _, err = ds.InspectFile(filepath.Join(basePath, "__DOES_NOT_EXIST__.ogg"))
+	assert.Error(t, err)
+}
+
+func TestRetry(t *testing.T) {
+	retryDelay = time.Millisecond
+	attempts := 0
+	failTwice := func() error {
+		attempts++
+		if attempts <= 2 {
+			return errors.New("transient error")
+		}
+		return nil
+	}
+
+	attempts = 0
+	err := Options{ErrorPolicy: ErrorPolicyRetry}.retry(failTwice)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = Options{ErrorPolicy: ErrorPolicyRetry, Retries: 1}.retry(failTwice)
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	err = Options{ErrorPolicy: ErrorPolicySkip}.retry(failTwice)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
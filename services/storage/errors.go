@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Errors returned by storage services, so that callers can tell what went wrong,
+// e.g.: to send the right HTTP status. Use errors.Is to check for them,
+// since they are usually wrapped with more details.
+var (
+	ErrNotFound    = errors.New("not found")                       // The track doesn't exist, or has been removed
+	ErrForbidden   = errors.New("permission denied")               // The track can't be read, e.g.: because of file permissions
+	ErrUnavailable = errors.New("storage unavailable")             // The storage can't be reached right now, e.g.: a network mount that's down
+	ErrBadRange    = errors.New("requested range not satisfiable") // The requested part of the track doesn't exist
+)
+
+// readError classifies an error from reading a file.
+func readError(location string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: %s: %w", ErrNotFound, location, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%w: %s: %w", ErrForbidden, location, err)
+	}
+	return fmt.Errorf("%w: %s: %w", ErrUnavailable, location, err)
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadError(t *testing.T) {
+	_, err := os.Open(filepath.Join(t.TempDir(), "missing.mp3"))
+	err = readError("missing.mp3", err)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Contains(t, err.Error(), "missing.mp3")
+
+	err = readError("secret.mp3", &fs.PathError{Op: "open", Path: "secret.mp3", Err: fs.ErrPermission})
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.NotErrorIs(t, err, ErrNotFound)
+
+	err = readError("remote.mp3", errors.New("stale NFS file handle"))
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
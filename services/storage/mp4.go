@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MP4 files are a tree of atoms (or "boxes"), each starting with its size
+// and type. iTunes-style tags are in moov/udta/meta/ilst, with an atom for
+// each tag containing a data atom with its value; see
+// https://developer.apple.com/documentation/quicktime-file-format/metadata_atoms_and_types
+//
+// $ AtomicParsley track.m4a -T
+
+// The most of the moov atom that is read, since it's read into memory.
+// It's usually much smaller, since it doesn't contain the audio.
+const maxMP4MoovSize = 64 * 1024 * 1024
+
+// Types of value in data atoms.
+const (
+	mp4DataUTF8     = 1
+	mp4DataSignedBE = 21
+)
+
+var errMP4NoMoov = errors.New("unable to find an MP4 moov atom")
+
+// Read an atom's header, returning its type and the size of its contents.
+// A size of -1 means that the atom continues to the end of the file.
+func readMP4AtomHeader(r io.Reader) (string, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	atomType := string(header[4:8])
+	switch size {
+	case 0:
+		return atomType, -1, nil
+	case 1:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(extended[:])) - 16
+	default:
+		size -= 8
+	}
+	if size < 0 {
+		return "", 0, fmt.Errorf("MP4 atom %q has an invalid size", atomType)
+	}
+	return atomType, size, nil
+}
+
+// Skip over the contents of an atom, seeking past them if possible.
+func skipMP4Atom(r io.Reader, size int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(size, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, size)
+	return err
+}
+
+// Read the contents of the top-level moov atom. The audio (in the mdat atom)
+// may come before or after it, so other atoms are skipped.
+func readMP4Moov(r io.Reader) ([]byte, error) {
+	for {
+		atomType, size, err := readMP4AtomHeader(r)
+		if errors.Is(err, io.EOF) {
+			return nil, errMP4NoMoov
+		}
+		if err != nil {
+			return nil, err
+		}
+		if atomType == "moov" {
+			if size < 0 || size > maxMP4MoovSize {
+				return nil, fmt.Errorf("MP4 moov atom is too big")
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		if size < 0 {
+			return nil, errMP4NoMoov
+		}
+		if err := skipMP4Atom(r, size); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Find the contents of a child atom in the contents of an atom in memory.
+// Returns false if there isn't one.
+func findMP4Atom(data []byte, atomType string) ([]byte, bool) {
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data[0:4]))
+		headerSize := int64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				return nil, false
+			}
+			size = int64(binary.BigEndian.Uint64(data[8:16]))
+			headerSize = 16
+		} else if size == 0 {
+			size = int64(len(data))
+		}
+		if size < headerSize || size > int64(len(data)) {
+			return nil, false
+		}
+		if string(data[4:8]) == atomType {
+			return data[headerSize:size], true
+		}
+		data = data[size:]
+	}
+	return nil, false
+}
+
+// Find an atom using its path from the contents of the moov atom.
+// The meta atom has a version and flags before its children.
+func findMP4Path(data []byte, path ...string) ([]byte, bool) {
+	for _, atomType := range path {
+		var ok bool
+		data, ok = findMP4Atom(data, atomType)
+		if !ok {
+			return nil, false
+		}
+		if atomType == "meta" {
+			if len(data) < 4 {
+				return nil, false
+			}
+			data = data[4:]
+		}
+	}
+	return data, true
+}
+
+// Parse the rating from the contents of the rate tag's data atom: its type and
+// locale, then the value. Taggers write a percentage, as text or as a number.
+func parseMP4Rating(data []byte) int {
+	if len(data) < 8 {
+		return 0
+	}
+	value := data[8:]
+	switch binary.BigEndian.Uint32(data[0:4]) {
+	case mp4DataUTF8:
+		percent, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+		if err != nil {
+			return 0
+		}
+		return percentToRating(percent)
+	case mp4DataSignedBE:
+		if len(value) == 0 || len(value) > 8 {
+			return 0
+		}
+		percent := int64(0)
+		for _, b := range value {
+			percent = percent<<8 | int64(b)
+		}
+		return percentToRating(float64(percent))
+	}
+	return 0
+}
+
+// Parse a text tag, e.g.: the title, from the contents of its data atom.
+func parseMP4Text(data []byte) string {
+	if len(data) < 8 || binary.BigEndian.Uint32(data[0:4]) != mp4DataUTF8 {
+		return ""
+	}
+	return strings.TrimRight(string(data[8:]), "\x00")
+}
+
+// Parse the number from the contents of a trkn or disk tag's data atom.
+// The value is 2 bytes of padding, the number, then the total.
+func parseMP4Number(data []byte) int {
+	if len(data) < 12 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(data[10:12]))
+}
+
+// Read tags from an MP4 file.
+func readMP4Tags(r io.Reader) (Tags, error) {
+	moov, err := readMP4Moov(r)
+	if err != nil {
+		return Tags{}, err
+	}
+
+	ilst, ok := findMP4Path(moov, "udta", "meta", "ilst")
+	if !ok {
+		return Tags{}, nil
+	}
+	// Tags which are missing have no data.
+	tag := func(atomType string) []byte {
+		data, _ := findMP4Path(ilst, atomType, "data")
+		return data
+	}
+	return Tags{
+		Title:       parseMP4Text(tag("\xa9nam")),
+		Artist:      parseMP4Text(tag("\xa9ART")),
+		Album:       parseMP4Text(tag("\xa9alb")),
+		AlbumArtist: parseMP4Text(tag("aART")),
+		Genre:       parseMP4Text(tag("\xa9gen")),
+		Year:        parseYear(parseMP4Text(tag("\xa9day"))),
+		TrackNumber: parseMP4Number(tag("trkn")),
+		DiscNumber:  parseMP4Number(tag("disk")),
+		Rating:      parseMP4Rating(tag("rate")),
+	}, nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mp4Atom builds an atom with the contents.
+func mp4Atom(atomType string, contents ...[]byte) []byte {
+	data := bytes.Join(contents, nil)
+	header := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(header, atomType...), data...)
+}
+
+// mp4Tag builds a tag atom, with a data atom containing the value.
+func mp4Tag(atomType string, dataType uint32, value []byte) []byte {
+	return mp4Atom(atomType, mp4Atom("data", binary.BigEndian.AppendUint32(nil, dataType), make([]byte, 4), value))
+}
+
+// mp4File builds an MP4 file with tags, including a rate tag, with the audio before the tags.
+func mp4File(dataType uint32, value []byte) []byte {
+	text := func(atomType string, value string) []byte {
+		return mp4Tag(atomType, mp4DataUTF8, []byte(value))
+	}
+	meta := mp4Atom("meta", make([]byte, 4), mp4Atom("hdlr", make([]byte, 25)), mp4Atom("ilst",
+		text("\xa9nam", "So What"),
+		text("\xa9ART", "Miles Davis"),
+		text("\xa9alb", "Kind of Blue"),
+		text("aART", "Miles Davis Sextet"),
+		text("\xa9gen", "Jazz"),
+		text("\xa9day", "1959-08-17T07:00:00Z"),
+		mp4Tag("trkn", 0, []byte{0, 0, 0, 1, 0, 5, 0, 0}),
+		mp4Tag("disk", 0, []byte{0, 0, 0, 1, 0, 1}),
+		mp4Tag("rate", dataType, value),
+	))
+	return bytes.Join([][]byte{
+		mp4Atom("ftyp", []byte("M4A "), make([]byte, 4)),
+		mp4Atom("mdat", make([]byte, 1000)),
+		mp4Atom("moov", mp4Atom("mvhd", make([]byte, 100)), mp4Atom("udta", meta)),
+	}, nil)
+}
+
+func TestReadMP4Tags(t *testing.T) {
+	t.Run("Text", func(t *testing.T) {
+		tags, err := readTags(bytes.NewReader(mp4File(mp4DataUTF8, []byte("80"))), MP4MimeType)
+		require.NoError(t, err)
+		assert.Equal(t, Tags{
+			Title:       "So What",
+			Artist:      "Miles Davis",
+			Album:       "Kind of Blue",
+			AlbumArtist: "Miles Davis Sextet",
+			Genre:       "Jazz",
+			Year:        1959,
+			TrackNumber: 1,
+			DiscNumber:  1,
+			Rating:      4,
+		}, tags)
+	})
+
+	t.Run("Number", func(t *testing.T) {
+		tags, err := readMP4Tags(bytes.NewReader(mp4File(mp4DataSignedBE, []byte{100})))
+		require.NoError(t, err)
+		assert.Equal(t, 5, tags.Rating)
+
+		tags, err = readMP4Tags(bytes.NewReader(mp4File(mp4DataSignedBE, []byte{0, 0})))
+		require.NoError(t, err)
+		assert.Equal(t, 0, tags.Rating)
+	})
+
+	t.Run("BadValues", func(t *testing.T) {
+		file := mp4Atom("moov", mp4Atom("udta", mp4Atom("meta", make([]byte, 4), mp4Atom("ilst",
+			mp4Tag("\xa9nam", mp4DataSignedBE, []byte("So What")), // Not text
+			mp4Tag("trkn", 0, []byte{0, 0, 0}),                    // Too short
+		))))
+		tags, err := readMP4Tags(bytes.NewReader(file))
+		require.NoError(t, err)
+		assert.Equal(t, Tags{}, tags)
+	})
+
+	t.Run("NoTags", func(t *testing.T) {
+		file := bytes.Join([][]byte{
+			mp4Atom("ftyp", []byte("M4A "), make([]byte, 4)),
+			mp4Atom("moov", mp4Atom("mvhd", make([]byte, 100))),
+			mp4Atom("mdat", make([]byte, 1000)),
+		}, nil)
+		tags, err := readMP4Tags(bytes.NewReader(file))
+		require.NoError(t, err)
+		assert.Equal(t, Tags{}, tags)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := readMP4Tags(bytes.NewReader(mp4Atom("ftyp", []byte("M4A "))))
+		assert.ErrorIs(t, err, errMP4NoMoov)
+
+		// Truncated in the middle of the moov atom.
+		file := mp4File(mp4DataUTF8, []byte("80"))
+		_, err = readMP4Tags(bytes.NewReader(file[:len(file)-10]))
+		assert.Error(t, err)
+
+		// The ilst atom is bigger than the meta atom it's in.
+		file = mp4File(mp4DataUTF8, []byte("80"))
+		i := bytes.Index(file, []byte("ilst")) - 4
+		binary.BigEndian.PutUint32(file[i:], 100000)
+		tags, err := readMP4Tags(bytes.NewReader(file))
+		require.NoError(t, err)
+		assert.Equal(t, Tags{}, tags)
+	})
+}
@@ -3,9 +3,8 @@ package storage
 import (
 	"bytes"
 	"embed"
-	"errors"
+	"fmt"
 	"io"
-	"io/fs"
 
 	"github.com/google/uuid"
 )
@@ -15,7 +14,8 @@ var exampleFS embed.FS
 var exampleFilename = "example.ogg"
 
 type NullStorage struct {
-	ID string
+	ID      string
+	Options Options
 
 	tracksByID map[string]Track
 
@@ -27,23 +27,40 @@ func (ns *NullStorage) GetID() string {
 	return ns.ID
 }
 
+func (ns *NullStorage) GetName() string {
+	return ns.Options.Name
+}
+
+func (ns *NullStorage) GetOptions() Options {
+	return ns.Options
+}
+
+// The embedded example file is always readable, so there are never any problems.
+func (ns *NullStorage) GetScanReport() []ScanProblem {
+	return make([]ScanProblem, 0)
+}
+
+func (ns *NullStorage) GetScanStats() ScanStats {
+	return ScanStats{}
+}
+
 func (ns *NullStorage) FindTracks() ([]Track, []Playlist, error) {
 	if ns.Tracks != nil && ns.Playlists != nil {
 		return ns.Tracks, ns.Playlists, nil
 	}
 
 	mimeType := OggMimeType
-	fileinfo, err := fs.Stat(exampleFS, exampleFilename)
+	data, err := exampleFS.ReadFile(exampleFilename)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// TODO: move tags handling into common code for storage engines
-	r, err := exampleFS.Open(exampleFilename)
+	tags, err := readTags(bytes.NewReader(data), mimeType)
 	if err != nil {
 		return nil, nil, err
 	}
-	tags, err := readTags(r, mimeType)
+	info, err := readAudioInfo(bytes.NewReader(data), mimeType, int64(len(data)))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -60,7 +77,10 @@ func (ns *NullStorage) FindTracks() ([]Track, []Playlist, error) {
 		ID:       trackUUID,
 		Location: trackLocation,
 		MIMEType: mimeType,
-		DataLen:  fileinfo.Size(),
+		DataLen:  int64(len(data)),
+		Version:  contentVersion(data), // Embedded files have no modification time
+		Duration: info.Duration,
+		Bitrate:  info.Bitrate,
 	}
 	tracks := []Track{track}
 	ns.tracksByID[track.ID] = track
@@ -81,8 +101,7 @@ func (ns *NullStorage) FindTracks() ([]Track, []Playlist, error) {
 func (ns *NullStorage) ReadTrack(id string) (io.Reader, error) {
 	_, ok := ns.tracksByID[id]
 	if !ok {
-		// TODO: look at standardizing errors
-		return nil, errors.New("track not found")
+		return nil, fmt.Errorf("%w: track %s", ErrNotFound, id)
 	}
 
 	data, err := exampleFS.ReadFile(exampleFilename)
@@ -92,9 +111,14 @@ func (ns *NullStorage) ReadTrack(id string) (io.Reader, error) {
 	return bytes.NewReader(data), nil
 }
 
-func NewNullStorage() (*NullStorage, error) {
+func NewNullStorage(options Options) (*NullStorage, error) {
+	options = options.withDefaultName("null")
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
 	return &NullStorage{
-		ID:         uuid.NewString(),
+		ID:         NameToID(options.Name),
+		Options:    options,
 		tracksByID: make(map[string]Track),
 	}, nil
 }
@@ -9,12 +9,14 @@ import (
 )
 
 func TestNullStorage(t *testing.T) {
-	s, err := NewNullStorage()
+	s, err := NewNullStorage(Options{})
 	require.NoError(t, err)
 
 	t.Run("GetID", func(t *testing.T) {
 		id := s.GetID()
 		assert.NotEmpty(t, id)
+		assert.Equal(t, NameToID("null"), id)
+		assert.Equal(t, "null", s.GetName())
 	})
 
 	t.Run("FindTracks", func(t *testing.T) {
@@ -35,6 +37,9 @@ func TestNullStorage(t *testing.T) {
 			Location: "/null/example.ogg",
 			MIMEType: "audio/ogg",
 			DataLen:  105269,
+			Version:  "f580c9d43da097d9",
+			Duration: 6104036281,
+			Bitrate:  160003,
 		})
 
 		playlistID := playlists[0].ID
@@ -84,6 +89,6 @@ func TestNullStorage(t *testing.T) {
 
 	t.Run("ReadTrackNotFound", func(t *testing.T) {
 		_, err := s.ReadTrack("nope")
-		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
 	})
 }
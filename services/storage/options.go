@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Options are the settings common to all storage services.
+type Options struct {
+	Name           string   // Unique name, used in logs and errors. The storage ID is derived from it.
+	IgnorePatterns []string // Glob patterns for locations to ignore, see path/filepath.Match
+	Priority       int      // Whose copy of a track is used if storages have tracks with the same ID; higher wins
+
+	ErrorPolicy ErrorPolicy // What to do about files that can't be read; defaults to ErrorPolicySkip
+	Retries     int         // How many times to retry, for ErrorPolicyRetry; defaults to 3
+
+	Concurrency int // How many files to scan at once; defaults to the number of CPUs
+}
+
+const defaultRetries = 3
+
+// Delay between retries, multiplied by the attempt number.
+var retryDelay = 100 * time.Millisecond
+
+func (o Options) errorPolicy() ErrorPolicy {
+	if o.ErrorPolicy == "" {
+		return ErrorPolicySkip
+	}
+	return o.ErrorPolicy
+}
+
+func (o Options) concurrency() int {
+	if o.Concurrency == 0 {
+		return runtime.NumCPU()
+	}
+	return o.Concurrency
+}
+
+// retry calls f until it succeeds, or the storage's retry limit is reached.
+// It only retries if the error policy is ErrorPolicyRetry.
+func (o Options) retry(f func() error) error {
+	attempts := 1
+	if o.errorPolicy() == ErrorPolicyRetry {
+		attempts += o.Retries
+		if o.Retries == 0 {
+			attempts += defaultRetries
+		}
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt < attempts {
+			time.Sleep(time.Duration(attempt) * retryDelay)
+		}
+	}
+	return err
+}
+
+// NameToID derives a stable storage ID from the storage's name,
+// so that storage IDs are the same across restarts.
+func NameToID(name string) string {
+	return locationToUUIDString("storage:" + name)
+}
+
+func (o Options) withDefaultName(name string) Options {
+	if o.Name == "" {
+		o.Name = name
+	}
+	return o
+}
+
+// Check the ignore patterns and error policy are valid.
+func (o Options) validate() error {
+	if !o.ErrorPolicy.valid() {
+		return fmt.Errorf("unknown error policy %s", o.ErrorPolicy)
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if o.Concurrency < 0 {
+		return fmt.Errorf("concurrency must not be negative")
+	}
+	for _, pattern := range o.IgnorePatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isIgnored returns true if the location matches any of the ignore patterns.
+// Patterns are matched against the location relative to the base of the storage,
+// and against the last element of the location. E.g.: "*.m3u" ignores all .m3u
+// files, whereas "podcasts/*" only ignores files in the top-level podcasts directory.
+func (o Options) isIgnored(relativeLocation string) bool {
+	base := filepath.Base(relativeLocation)
+	for _, pattern := range o.IgnorePatterns {
+		if ok, _ := filepath.Match(pattern, relativeLocation); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"time"
+)
+
+// What to do when a file can't be read while scanning a storage.
+type ErrorPolicy string
+
+const (
+	ErrorPolicyFail  ErrorPolicy = "fail"  // Abort the scan
+	ErrorPolicySkip  ErrorPolicy = "skip"  // Skip the file, and add it to the scan report
+	ErrorPolicyRetry ErrorPolicy = "retry" // Retry a few times, then skip the file
+)
+
+// Which part of scanning the problem happened in.
+const (
+	ScanStageWalk = "walk" // Listing a directory
+	ScanStageStat = "stat" // Getting a file's size
+	ScanStageOpen = "open" // Opening a file
+	ScanStageTags = "tags" // Reading a file's tags
+)
+
+// What was done about the problem.
+const (
+	ScanActionSkipped  = "skipped"  // The file (or directory) is not in the catalog
+	ScanActionUntagged = "untagged" // The file is in the catalog, but its tags were ignored
+)
+
+// ScanProblem describes a file that could not be scanned properly.
+type ScanProblem struct {
+	Location string    `json:"location"`
+	Stage    string    `json:"stage"`
+	Action   string    `json:"action"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// ScanStats summarises the last scan of a storage.
+type ScanStats struct {
+	Duration time.Duration // How long the scan took
+	Ignored  int           // Files skipped due to ignore patterns or MIME type
+}
+
+func (p ErrorPolicy) valid() bool {
+	switch p {
+	case "", ErrorPolicyFail, ErrorPolicySkip, ErrorPolicyRetry:
+		return true
+	}
+	return false
+}
+
+// scanError is returned when a file can't be scanned, recording the stage it failed in.
+type scanError struct {
+	stage string
+	err   error
+}
+
+func (e *scanError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *scanError) Unwrap() error {
+	return e.err
+}
@@ -4,7 +4,11 @@ import "io"
 
 type StorageService interface {
 	GetID() string
+	GetName() string
+	GetOptions() Options
 
 	FindTracks() ([]Track, []Playlist, error)
+	GetScanReport() []ScanProblem           // Problems found when finding tracks
+	GetScanStats() ScanStats                // Statistics from finding tracks
 	ReadTrack(id string) (io.Reader, error) // may need better name - GetTrack?
 }
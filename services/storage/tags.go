@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -42,7 +44,87 @@ type Tags struct {
 	AlbumArtist string // E.g.: for compilations, or orchestral performances
 	AlbumId     string // E.g.: ID from CDDB, or similar services
 	Genre       string
+	Year        int // 0 means unset.
 	TrackNumber int // 0 means unset.
+	DiscNumber  int // 0 means unset.
+	Rating      int // 1 to MaxRating stars; 0 means unset.
+}
+
+// The most stars a track can be rated.
+const MaxRating = 5
+
+// Parse a track or disc number, which may be followed by the total, e.g.: "3/12".
+func parseNumber(s string) int {
+	s, _, _ = strings.Cut(s, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimRight(s, "\x00")))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Parse the year from a date, e.g.: "1969" or "1969-05-01".
+func parseYear(s string) int {
+	s = strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	if len(s) < 4 {
+		return 0
+	}
+	return parseNumber(s[:4])
+}
+
+// Parse a rating from a vorbis RATING comment. Some taggers write a number
+// of stars, e.g.: "4", and others a percentage, e.g.: "80".
+func parseRating(s string) int {
+	n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimRight(s, "\x00")), 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if n > MaxRating {
+		return percentToRating(n)
+	}
+	return max(int(math.Round(n)), 1)
+}
+
+// Convert a rating from 0 to 100 into stars. 0 means unrated.
+func percentToRating(percent float64) int {
+	if percent <= 0 {
+		return 0
+	}
+	return min(max(int(math.Round(percent/100*MaxRating)), 1), MaxRating)
+}
+
+// Parse a rating from a vorbis FMPS_RATING comment, which is from 0.0 to 1.0;
+// see https://www.freedesktop.org/wiki/Specifications/free-media-player-specs/.
+func parseFMPSRating(s string) int {
+	n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimRight(s, "\x00")), 64)
+	if err != nil || n > 1 {
+		return 0
+	}
+	return percentToRating(n * 100)
+}
+
+// Parse a rating from the data of an ID3v2 POPM (popularimeter) frame: an
+// e-mail address ending with a NUL, a rating from 1 to 255 (0 is unknown),
+// and an optional play counter. Players map stars to ratings differently,
+// e.g.: Windows Media Player uses 1, 64, 128, 196 and 255, so ranges are used.
+func parsePOPMRating(data []byte) int {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 || end+1 >= len(data) {
+		return 0
+	}
+	switch rating := data[end+1]; {
+	case rating == 0:
+		return 0
+	case rating < 32:
+		return 1
+	case rating < 96:
+		return 2
+	case rating < 160:
+		return 3
+	case rating < 224:
+		return 4
+	}
+	return 5
 }
 
 // Convert a vorbis comment list into a map for lookups.
@@ -79,16 +161,25 @@ func getTags(commentsMap map[string]string) (tags Tags) {
 		tags.Genre = genre
 	}
 	if trackNumber, ok := commentsMap[flacvorbis.FIELD_TRACKNUMBER]; ok {
-		n, err := strconv.Atoi(trackNumber)
-		if err == nil {
-			tags.TrackNumber = n
-		}
+		tags.TrackNumber = parseNumber(trackNumber)
 	}
 
 	// Extension or non-standard tags
+	if date, ok := commentsMap[flacvorbis.FIELD_DATE]; ok {
+		tags.Year = parseYear(date)
+	}
+	if discNumber, ok := commentsMap["DISCNUMBER"]; ok {
+		tags.DiscNumber = parseNumber(discNumber)
+	}
 	if albumId, ok := commentsMap["CDDB"]; ok {
 		tags.AlbumId = albumId
 	}
+	if rating, ok := commentsMap["RATING"]; ok {
+		tags.Rating = parseRating(rating)
+	}
+	if rating, ok := commentsMap["FMPS_RATING"]; ok && tags.Rating == 0 {
+		tags.Rating = parseFMPSRating(rating)
+	}
 
 	return
 }
@@ -150,6 +241,7 @@ func readMP3Tags(r io.Reader) (Tags, error) {
 		Artist: file.Artist(),
 		Album:  file.Album(),
 		Genre:  file.Genre(),
+		Year:   parseYear(file.Year()),
 	}
 
 	// Determine album artist from ID3v2 tags. Prefer TPE2 over TPE3,
@@ -171,6 +263,27 @@ func readMP3Tags(r io.Reader) (Tags, error) {
 		}
 	}
 
+	// Track and disc numbers, e.g.: "3/12".
+	if resultFrame, ok := file.Frame("TRCK").(*v2.TextFrame); ok {
+		tags.TrackNumber = parseNumber(resultFrame.String())
+	}
+	if resultFrame, ok := file.Frame("TPOS").(*v2.TextFrame); ok {
+		tags.DiscNumber = parseNumber(resultFrame.String())
+	}
+	// ID3v2.4 replaced the year (TYER) with the recording time.
+	if resultFrame, ok := file.Frame("TDRC").(*v2.TextFrame); ok && tags.Year == 0 {
+		tags.Year = parseYear(resultFrame.String())
+	}
+	// There may be a rating from each player that has rated the track,
+	// identified by e-mail address. ID3v2.2 calls the frame POP.
+	for _, tagName := range []string{"POPM", "POP"} {
+		for _, frame := range file.Frames(tagName) {
+			if resultFrame, ok := frame.(*v2.DataFrame); ok && tags.Rating == 0 {
+				tags.Rating = parsePOPMRating(resultFrame.Data())
+			}
+		}
+	}
+
 	return tags, nil
 }
 
@@ -184,7 +297,7 @@ func readTags(r io.Reader, mimeType string) (Tags, error) {
 	case MP3MimeType:
 		return readMP3Tags(r)
 	case MP4MimeType:
-		return Tags{}, nil // TODO: implement MP4 tags
+		return readMP4Tags(r)
 	}
 	return Tags{}, fmt.Errorf("unable to read tags for MIME type %s", mimeType)
 }
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNumber(t *testing.T) {
+	assert.Equal(t, 3, parseNumber("3"))
+	assert.Equal(t, 3, parseNumber("3/12"))
+	assert.Equal(t, 1, parseNumber(" 01 / 02"))
+	assert.Equal(t, 2, parseNumber("2\x00"))
+	assert.Equal(t, 0, parseNumber(""))
+	assert.Equal(t, 0, parseNumber("A1"))
+	assert.Equal(t, 0, parseNumber("-1"))
+}
+
+func TestParseYear(t *testing.T) {
+	assert.Equal(t, 1969, parseYear("1969"))
+	assert.Equal(t, 1969, parseYear("1969-05-01"))
+	assert.Equal(t, 2001, parseYear("2001\x00"))
+	assert.Equal(t, 0, parseYear("69"))
+	assert.Equal(t, 0, parseYear(""))
+}
+
+func TestGetTags(t *testing.T) {
+	tags := getTags(commentsToMap([]string{"TITLE=Intro", "tracknumber=3/12", "DISCNUMBER=2/2", "GENRE=Jazz", "DATE=1959-08-17"}))
+	assert.Equal(t, Tags{Title: "Intro", Genre: "Jazz", Year: 1959, TrackNumber: 3, DiscNumber: 2}, tags)
+}
+
+func TestParseRating(t *testing.T) {
+	assert.Equal(t, 4, parseRating("4"))
+	assert.Equal(t, 4, parseRating("80"))
+	assert.Equal(t, 5, parseRating("100\x00"))
+	assert.Equal(t, 1, parseRating("10"))
+	assert.Equal(t, 0, parseRating("0"))
+	assert.Equal(t, 0, parseRating("great"))
+
+	assert.Equal(t, 4, parseFMPSRating("0.8"))
+	assert.Equal(t, 5, parseFMPSRating("1.0"))
+	assert.Equal(t, 1, parseFMPSRating("0.05"))
+	assert.Equal(t, 0, parseFMPSRating("0.0"))
+	assert.Equal(t, 0, parseFMPSRating("2"))
+}
+
+func TestParsePOPMRating(t *testing.T) {
+	popm := func(rating byte) []byte {
+		return append([]byte("Windows Media Player 9 Series\x00"), rating, 0, 0, 0, 3)
+	}
+	assert.Equal(t, 1, parsePOPMRating(popm(1)))
+	assert.Equal(t, 2, parsePOPMRating(popm(64)))
+	assert.Equal(t, 3, parsePOPMRating(popm(128)))
+	assert.Equal(t, 4, parsePOPMRating(popm(196)))
+	assert.Equal(t, 5, parsePOPMRating(popm(255)))
+	assert.Equal(t, 0, parsePOPMRating(popm(0)))
+	assert.Equal(t, 4, parsePOPMRating([]byte{0, 186}))
+	assert.Equal(t, 0, parsePOPMRating([]byte("no-rating@example.com\x00")))
+	assert.Equal(t, 0, parsePOPMRating(nil))
+}
+
+func TestGetTagsRating(t *testing.T) {
+	assert.Equal(t, 3, getTags(commentsToMap([]string{"rating=3"})).Rating)
+	assert.Equal(t, 4, getTags(commentsToMap([]string{"FMPS_RATING=0.8"})).Rating)
+	// RATING is preferred.
+	assert.Equal(t, 2, getTags(commentsToMap([]string{"FMPS_RATING=0.8", "RATING=40"})).Rating)
+	assert.Equal(t, 0, getTags(commentsToMap([]string{"TITLE=Intro"})).Rating)
+}
@@ -1,11 +1,19 @@
 package storage
 
+import "time"
+
 type Track struct {
 	ID       string // ID unique within this storage service
 	Location string // Location within storage service (e.g.: filename, URL)
 	MIMEType string // MIME type for data, see https://www.iana.org/assignments/media-types/media-types.xhtml#audio
 	DataLen  int64  // Size of track data
 
+	ModTime time.Time // When the track data was last modified; zero if unknown
+	Version string    // Changes whenever the track data changes, e.g.: for HTTP ETags
+
+	Duration time.Duration // Length of the audio; 0 means unknown
+	Bitrate  int           // Average bits per second; 0 means unknown
+
 	Tags Tags // Tags (if any), from track data or elsewhere (e.g.: DB)
 
 	// The following fields are computed.
@@ -16,7 +24,10 @@ type Track struct {
 	AlbumArtist string // Will be different to Artist for e.g.: for compilations, or orchestral performances
 	AlbumId     string // May be empty
 	Genre       string // May be empty
+	Year        int    // 0 means unknown.
 	TrackNumber int    // 0 means unknown.
+	DiscNumber  int    // 0 means unknown.
+	Rating      int    // 1 to MaxRating stars; 0 means unrated.
 
 	PlaylistLocation string // Location for the playlist; may be a virtual URL, like tags:/path or regex:/path
 }
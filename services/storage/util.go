@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-var secret string = "you'll never guess this, oops"
+// idSalt is mixed into locations when generating IDs. It is not a secret:
+// it only needs to stay the same, so that IDs are stable across releases.
+// Share links and API tokens are signed using the configured server secret instead.
+var idSalt string = "you'll never guess this, oops"
 
 var (
 	MP3MimeType  = "audio/mp3"
@@ -18,11 +25,24 @@ var (
 // locationToUUIDString converts a location into a stable UUID value,
 // for use in HTTP paths.
 func locationToUUIDString(location string) string {
-	data := location + ":" + secret
+	data := location + ":" + idSalt
 	u := uuid.NewSHA1(uuid.NameSpaceURL, []byte(data))
 	return u.String()
 }
 
+// fileVersion returns a version token for a file, which changes whenever the file
+// is modified, assuming that its modification time or size changes.
+func fileVersion(modTime time.Time, size int64) string {
+	return strconv.FormatInt(modTime.UnixNano(), 36) + "-" + strconv.FormatInt(size, 36)
+}
+
+// contentVersion returns a version token for data that has no modification time,
+// e.g.: embedded files.
+func contentVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
 func getMIMEType(filename string) string {
 	var mimeType string
 
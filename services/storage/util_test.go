@@ -2,6 +2,7 @@ package storage
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,6 +17,20 @@ func TestUtil(t *testing.T) {
 		require.NotEqual(t, uuid1, uuid2)
 	})
 
+	t.Run("fileVersion", func(t *testing.T) {
+		modTime := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+		version := fileVersion(modTime, 1234)
+		assert.Equal(t, version, fileVersion(modTime, 1234))
+		assert.NotEqual(t, version, fileVersion(modTime.Add(time.Second), 1234))
+		assert.NotEqual(t, version, fileVersion(modTime, 1235))
+	})
+
+	t.Run("contentVersion", func(t *testing.T) {
+		assert.Len(t, contentVersion([]byte("data")), 16)
+		assert.Equal(t, contentVersion([]byte("data")), contentVersion([]byte("data")))
+		assert.NotEqual(t, contentVersion([]byte("data")), contentVersion([]byte("date")))
+	})
+
 	t.Run("getMIMEType", func(t *testing.T) {
 		testCases := []struct {
 			Filename string